@@ -0,0 +1,185 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/status"
+)
+
+// instProgress is downsampling progress of instance in tier
+type instProgress struct {
+	Collection  string     `json:"collection"`
+	Tier        string     `json:"tier"`
+	Instance    string     `json:"instance"`
+	LastSuccess time.Time  `json:"last_success"`
+	LastWindow  *time.Time `json:"last_window,omitempty"`
+}
+
+// adminProgress is response of admin progress endpoint
+type adminProgress struct {
+	Paused    bool           `json:"paused"`
+	Live      status.Live    `json:"live"`
+	Instances []instProgress `json:"instances"`
+}
+
+// serveAdmin starts admin API in background. Endpoints:
+// POST /admin/pause, POST /admin/resume, POST /admin/pass?collection=NAME,
+// POST /admin/reload and GET /admin/progress.
+//
+// Parameters:
+//
+//	addr: listen address
+//
+// No return types.
+func (a *App) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/pause", a.adminPost(func(w http.ResponseWriter, r *http.Request) {
+		a.paused.Store(true)
+		helpers.PrintWarn("work paused by admin api")
+		adminReply(w, http.StatusOK, "paused")
+	}))
+	mux.HandleFunc("/admin/resume", a.adminPost(func(w http.ResponseWriter, r *http.Request) {
+		a.paused.Store(false)
+		helpers.PrintInfo("work resumed by admin api")
+		adminReply(w, http.StatusOK, "resumed")
+	}))
+	mux.HandleFunc("/admin/pass", a.adminPost(func(w http.ResponseWriter, r *http.Request) {
+		c := r.URL.Query().Get("collection")
+		if !a.hasCollection(c) {
+			adminReply(w, http.StatusNotFound, fmt.Sprintf("unknown collection %q", c))
+			return
+		}
+		select {
+		case a.wakeCh(c) <- struct{}{}:
+		default:
+		}
+		helpers.PrintInfo(fmt.Sprintf("pass of collection %s triggered by admin api", c))
+		adminReply(w, http.StatusAccepted, "pass triggered")
+	}))
+	mux.HandleFunc("/admin/reload", a.adminPost(func(w http.ResponseWriter, r *http.Request) {
+		if err := a.reload(); err != nil {
+			helpers.PrintErr(fmt.Sprintf("admin api reload: %v", err))
+			adminReply(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		adminReply(w, http.StatusAccepted, "configuration reloaded")
+	}))
+	mux.HandleFunc("/admin/progress", a.adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(a.progress()); err != nil {
+			helpers.PrintErr(fmt.Sprintf("admin api: %v", err))
+		}
+	}))
+
+	go func() {
+		helpers.PrintInfo(fmt.Sprintf("admin api listening on %s", addr))
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			helpers.PrintFatal(fmt.Sprintf("admin api: %v", err))
+		}
+	}()
+}
+
+// adminAuth wraps handler with bearer token check when admin token is configured.
+//
+// Parameters:
+//
+//	h: the handler
+//
+// Return type: http.HandlerFunc
+func (a *App) adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + a.conf.AdminToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.conf.AdminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			adminReply(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminPost wraps handler of state changing endpoint, only authorized POST requests are allowed.
+//
+// Parameters:
+//
+//	h: the handler
+//
+// Return type: http.HandlerFunc
+func (a *App) adminPost(h http.HandlerFunc) http.HandlerFunc {
+	return a.adminAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			adminReply(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h(w, r)
+	})
+}
+
+// adminReply writes json message response.
+//
+// Parameters:
+//
+//	w: response writer
+//	code: HTTP status code
+//	msg: the message
+//
+// No return types.
+func adminReply(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+// progress returns current work and downsampling progress of every instance in tier.
+//
+// No parameters.
+//
+// Return type: adminProgress
+func (a *App) progress() adminProgress {
+	p := adminProgress{
+		Paused: a.paused.Load(),
+		Live:   a.tracker.Live(),
+	}
+	for _, s := range a.tracker.Successes() {
+		ip := instProgress{
+			Collection:  s.Collection,
+			Tier:        s.Tier,
+			Instance:    s.Instance,
+			LastSuccess: s.Time,
+		}
+		if st, ok := a.db.Checkpoints.Get(s.Collection, s.Tier, s.Instance); ok {
+			ip.LastWindow = &st.Last
+		}
+		p.Instances = append(p.Instances, ip)
+	}
+
+	return p
+}
+
+// sleepPass pauses collection between passes for given duration, until pass is triggered
+// by admin api or until shutdown.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	d: duration of pause
+//
+// Return type: bool, false when interrupted by shutdown
+func (a *App) sleepPass(c string, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-a.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	case <-a.wakeCh(c):
+		return true
+	}
+}
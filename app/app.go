@@ -1,56 +1,184 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/aretaja/idbdownsampler/checkpoint"
 	"github.com/aretaja/idbdownsampler/config"
 	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/events"
+	"github.com/aretaja/idbdownsampler/graphite"
 	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/ledger"
+	"github.com/aretaja/idbdownsampler/secrets"
+	"github.com/aretaja/idbdownsampler/status"
 	"github.com/kr/pretty"
 )
 
+// default minimum interval of collection passes
+const defPassInterval = 3 * time.Hour
+
 // main application parameters
 type App struct {
 	conf          *config.Configuration
 	Version       string
+	ConfFile      string // config file overriding default and IDBDS_CONF
+	Connection    string // only downsample this connection of multi-connection config
+	Collections   string // collections overriding config
+	DryRun        bool   // log downsample queries without executing them
+	Once          bool   // perform single pass and exit
 	startTS       time.Time
 	dsCollections []string
 	db            db.Influx
+	engine        db.Downsampler // storage engine used by work loop
+	tracker       *status.Tracker
+	passes        *checkpoint.Passes
+	watchdog      *watchdog
+	thrash        thrashMon
+	queue         *workQueue
+	events        *events.Publisher
+	notifier      *notifier
+	lagMu         sync.Mutex
+	lagged        map[string]bool
+	regexCols     map[string]regexCol
+	chains        map[string][]db.Bucket
+	ctx           context.Context
+	workers       sync.WaitGroup
+	failures      atomic.Int64
+	name          string                    // connection name in multi-connection config
+	preset        *config.Configuration     // configuration of connection
+	conns         []*App                    // apps of connections
+	passMu        sync.Mutex                // serializes passes of embedded app
+	paused        atomic.Bool               // work paused by admin api
+	wake          map[string]chan struct{}  // pass triggers of collections
+	pending       atomic.Pointer[reloadSet] // reloaded settings applied at next instance boundary
+	set           atomic.Pointer[settings]  // reloadable settings, replaced by reload
+	colMu         sync.Mutex                // guards collections, pass triggers and chains changed by reload
+	sups          *supervisors              // collection supervisors of daemon
+	restart       restartPolicy             // restart policy of failed collections
+	lease         *leases                   // coordination leases of collections, nil when disabled
+	chainGen      atomic.Int64              // generation of bucket chains, incremented by reload
+	global        *db.Limiter               // query limiter shared by all connections
+}
+
+// collection applied to measurements matching regex
+type regexCol struct {
+	re   *regexp.Regexp
+	kind string
+	tag  string
 }
 
 // Initialize initializes the App struct by setting up configuration, database connection, memory limits, aggregation counts, and cardinality levels.
+// Exits on invalid configuration.
 //
 // This function does not take any parameters and does not return any values.
 func (a *App) Initialize() {
+	if err := a.setup(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setup initializes the App struct from configuration.
+//
+// No parameters.
+//
+// Return type: error, invalid configuration
+func (a *App) setup() error {
 	a.startTS = time.Now()
 
 	// Check if config can be obtained
-	c, err := config.GetConfig()
-	if err != nil {
-		log.Fatalf("failed to get config: %v", err)
+	c := a.preset
+	var err error
+	if c == nil {
+		c, err = a.readConfig()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %v", err)
+		}
+	}
+
+	// Several connections are downsampled by own apps unless one is selected
+	switch {
+	case len(c.Connections) > 0 && a.Connection == "":
+		a.conf = c
+		a.set.Store(newSettings(c))
+		return a.initConnections(c)
+	case len(c.Connections) > 0:
+		if _, ok := c.Connections[a.Connection]; !ok {
+			return fmt.Errorf("unknown connection %s", a.Connection)
+		}
+		a.name = a.Connection
+		a.global = db.NewLimiter(c.QueryRate, c.QueryConc)
+		c = c.ForConnection(a.Connection)
+	case a.Connection != "":
+		return fmt.Errorf("connection %s selected but no connections configured", a.Connection)
+	}
+	c = overrides(c, a.Collections, a.DryRun)
+	if err := validate(c); err != nil {
+		return err
 	}
 	a.conf = c
+	a.set.Store(newSettings(c))
 
-	// Check if config parameters are valid
-	if c.DbURL == "" || c.Token == "" || c.Org == "" || c.StatsBucket == "" {
-		log.Fatal("invalid config: missing required parameters")
+	// Read token from file or secret store if provided
+	if ref := a.tokenRef(); ref != "" {
+		c.Token, err = secrets.Resolve(ref)
+		if err != nil {
+			return fmt.Errorf("failed to get token: %v", err)
+		}
 	}
 
-	// Check if collections are provided
-	if c.DsCollections == "" {
-		log.Fatal("no collections for downsampling provided, interrupting")
+	// Apply defaults of valid config.
+	// InfluxDB 1.x authenticates by user and password passed as token, organization is ignored
+	if c.DbFlavor == "" {
+		c.DbFlavor = db.FlavorV2
+	}
+	if c.DbUser != "" {
+		c.Token = c.DbUser + ":" + c.DbPassword
+	}
+	if c.DbFlavor == db.FlavorV1 && c.Org == "" {
+		c.Org = "-"
+	}
+	if c.ResMonSource == "" {
+		c.ResMonSource = "stats"
+	}
+	// Token resolved from file or secret store may be empty
+	if c.Token == "" {
+		return errors.New("invalid config: missing required parameters")
 	}
 
 	// Create Influx instance
-	a.db = db.NewInflux(c.DbURL, c.Token, c.Org, c.StatsBucket, 600)
+	httpTimeout := uint(600)
+	if c.HTTPTimeout > 0 {
+		httpTimeout = uint(c.HTTPTimeout)
+	}
+	tlsConf, err := tlsConfig(c)
+	if err != nil {
+		return fmt.Errorf("invalid TLS config: %v", err)
+	}
+	a.db = db.NewInflux(c.DbURL, c.Token, c.Org, c.StatsBucket, httpTimeout, tlsConf)
+	a.engine = &a.db
+	a.db.ScrapeMetrics = c.ResMonSource == "metrics"
+	a.db.Limiters = []*db.Limiter{a.global, db.NewLimiter(c.QueryRate, c.QueryConc)}
 
 	// Set memory limit if provided
+	tun := a.db.Tunables()
 	if c.MemLimit > 0 {
-		a.db.DsMemLimit = c.MemLimit
+		tun.MemLimit = c.MemLimit
 	}
 
 	// Set aggregation count if provided
@@ -58,16 +186,309 @@ func (a *App) Initialize() {
 		a.db.AggrCnt = c.AggrCnt
 	}
 
+	// Set adaptive batch sizing if enabled
+	if c.AdaptBatch {
+		bMin, bMax, bFast, bSlow := 1, 40*a.db.AggrCnt, 30, 300
+		if c.BatchMin > 0 {
+			bMin = c.BatchMin
+		}
+		if c.BatchMax > 0 {
+			bMax = c.BatchMax
+		}
+		if c.BatchFast > 0 {
+			bFast = c.BatchFast
+		}
+		if c.BatchSlow > 0 {
+			bSlow = c.BatchSlow
+		}
+		a.db.Adapt = db.NewAdaptiveBatch(bMin, bMax, time.Duration(bFast)*time.Second, time.Duration(bSlow)*time.Second)
+	}
+
 	// Set cardinality levels if provided
 	if c.CardMedium > 0 {
-		a.db.CardMedium = c.CardMedium
+		tun.CardMedium = c.CardMedium
 	}
 	if c.CardHevy > 0 {
-		a.db.CardHevy = c.CardHevy
+		tun.CardHevy = c.CardHevy
+	}
+
+	// Set rate limit retries and backoff (seconds) if provided
+	switch {
+	case c.RLRetries < 0:
+		a.db.RLRetries = 0
+	case c.RLRetries > 0:
+		a.db.RLRetries = c.RLRetries
+	}
+	if c.RLBackoff > 0 {
+		a.db.RLBackoff = time.Duration(c.RLBackoff) * time.Second
+	}
+
+	// Set downsample batch retries on server error if provided
+	switch {
+	case c.WrRetries < 0:
+		a.db.WrRetries = 0
+	case c.WrRetries > 0:
+		a.db.WrRetries = c.WrRetries
+	}
+
+	// Set retry policy of instance downsampling on transient errors if provided
+	switch {
+	case c.Retries < 0:
+		a.db.Retry.Attempts = 0
+	case c.Retries > 0:
+		a.db.Retry.Attempts = c.Retries
+	}
+	if c.RetryBackoff > 0 {
+		a.db.Retry.Backoff = time.Duration(c.RetryBackoff) * time.Second
+	}
+	if c.RetryMaxWait > 0 {
+		a.db.Retry.MaxBackoff = time.Duration(c.RetryMaxWait) * time.Second
+	}
+	if c.RetryJitter > 0 {
+		a.db.Retry.Jitter = c.RetryJitter
+	}
+
+	// Set count of instance discovery time slices if provided
+	if c.DiscSlices > 0 {
+		a.db.DiscSlices = c.DiscSlices
+	}
+
+	// Set client-side aggregation and exporters.
+	// Flux of InfluxDB 1.x can't write, results are always written by client
+	a.db.Flavor = c.DbFlavor
+	a.db.ClientWrite = c.ClientWrite || c.DbFlavor == db.FlavorV1
+	a.db.DeleteBefore = c.DeleteBefore
+	a.db.DryRun = a.DryRun
+	a.db.WriteAsync = c.ClientAsync
+	if c.GraphiteAddr != "" {
+		g, err := graphite.New(c.GraphiteAddr, c.GraphiteProto, c.GraphiteTmpl)
+		if err != nil {
+			return fmt.Errorf("invalid graphite config: %v", err)
+		}
+		a.db.Exporters = append(a.db.Exporters, g)
+		a.db.ClientWrite = true
+	}
+
+	// Set aggregation policy of icinga check timing fields if provided
+	if c.IcingaTiming != "" {
+		a.db.IcingaTiming = c.IcingaTiming
+	}
+
+	// Set up separate server of destination tiers
+	if c.DestURL != "" {
+		a.db.SetDestination(c.DestURL, c.DestToken, c.DestOrg, httpTimeout, tlsConf)
+	}
+
+	// Set up second destination for migration
+	if c.MirrorURL != "" {
+		if err := a.db.SetMirror(c.MirrorURL, c.MirrorToken, c.MirrorOrg, c.MirrorBuckets, httpTimeout, tlsConf); err != nil {
+			return fmt.Errorf("invalid mirror config: %v", err)
+		}
+	}
+
+	// Set field aggregate overrides
+	a.db.FieldAggr = c.FieldAggr
+	if c.PctReaggr != "" {
+		a.db.PctReaggr = c.PctReaggr
+	}
+	if c.CounterReset != "" {
+		a.db.CounterReset = c.CounterReset
+	}
+	a.db.FieldRules = make(map[string][]db.FieldRule)
+	for n, rules := range c.FieldRules {
+		fr, err := fieldRules(rules)
+		if err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		if err := db.ValidateFieldRules(fr); err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		a.db.FieldRules[n] = fr
+	}
+
+	if c.StringAggr != "" {
+		a.db.StringAggr = c.StringAggr
+	}
+	a.db.GaugeExtras = make(map[string][]db.FieldRule)
+	for n, rules := range c.GaugeExtras {
+		fr, err := fieldRules(rules)
+		if err != nil {
+			return fmt.Errorf("invalid gauge extras of collection %s: %v", n, err)
+		}
+		if err := db.ValidateGaugeExtras(fr); err != nil {
+			return fmt.Errorf("invalid gauge extras of collection %s: %v", n, err)
+		}
+		a.db.GaugeExtras[n] = fr
+	}
+
+	// Open processed ranges ledger if provided
+	if c.LedgerFile != "" {
+		a.db.Ledger, err = ledger.Open(c.LedgerFile)
+		if err != nil {
+			return fmt.Errorf("failed to open ledger: %v", err)
+		}
+	}
+	if c.CheckpointFile != "" {
+		a.db.Checkpoints, err = checkpoint.Open(c.CheckpointFile)
+		if err != nil {
+			return fmt.Errorf("failed to open checkpoints: %v", err)
+		}
+	}
+	if c.PassFile != "" {
+		a.passes, err = checkpoint.OpenPasses(c.PassFile)
+		if err != nil {
+			return fmt.Errorf("failed to open pass progress: %v", err)
+		}
+	}
+	if c.Revalidate > 0 {
+		a.db.Revalidate = time.Duration(c.Revalidate) * time.Second
+	}
+
+	// Set instance tag keys of collections
+	a.db.TagKeys = c.TagKeys
+
+	// Instance sharding between processes
+	a.db.Shards = c.Shards
+	a.db.Shard = c.Shard
+
+	// Compile instance filters
+	tun.Include, err = instFilters("include", c.Include)
+	if err != nil {
+		return err
+	}
+	tun.Exclude, err = instFilters("exclude", c.Exclude)
+	if err != nil {
+		return err
+	}
+	a.db.SetTunables(tun)
+
+	// Compile field classifications
+	for _, fk := range c.FieldKinds {
+		re, err := regexp.Compile(fk.Match)
+		if err != nil {
+			return fmt.Errorf("invalid field kind regex %s: %v", fk.Match, err)
+		}
+		a.db.FieldKinds = append(a.db.FieldKinds, db.FieldKind{Re: re, Kind: fk.Kind})
+	}
+
+	// Compile regex collections
+	a.regexCols = make(map[string]regexCol)
+	for n, rc := range c.RegexCols {
+		re, err := regexp.Compile(rc.Match)
+		if err != nil {
+			return fmt.Errorf("invalid regex of collection %s: %v", n, err)
+		}
+		a.regexCols[n] = regexCol{re: re, kind: rc.Kind, tag: rc.TagKey}
+
+		// Field rules of regex collection apply to all matched measurements
+		fr, err := fieldRules(rc.Fields)
+		if err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		if err := db.ValidateFieldRules(fr); err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		a.db.FieldRules[n] = append(a.db.FieldRules[n], fr...)
 	}
 
-	// Split collections
+	// Split collections, pass of every collection can be triggered before its interval elapses
 	a.dsCollections = strings.Split(c.DsCollections, ",")
+	a.wake = make(map[string]chan struct{}, len(a.dsCollections))
+	for _, n := range a.dsCollections {
+		a.wake[n] = make(chan struct{}, 1)
+	}
+
+	// Link bucket chains from config
+	a.chains, err = buildChains(c)
+	if err != nil {
+		return err
+	}
+
+	// Set declarative collections
+	a.db.Specs = make(map[string]*db.CollectionSpec)
+	for n, cs := range c.Specs {
+		fr, err := fieldRules(cs.Fields)
+		if err != nil {
+			return fmt.Errorf("invalid spec of collection %s: %v", n, err)
+		}
+		s := &db.CollectionSpec{TagKey: cs.TagKey, Measurements: cs.Measurements, Fields: fr}
+		if err := db.ValidateSpec(s); err != nil {
+			return fmt.Errorf("invalid spec of collection %s: %v", n, err)
+		}
+		a.db.Specs[n] = s
+	}
+
+	// Load downsample query templates if provided
+	if len(c.Templates) > 0 {
+		a.db.Templates = make(map[string]*template.Template, len(c.Templates))
+		for n, f := range c.Templates {
+			t, err := db.ParseTemplate(f)
+			if err != nil {
+				return fmt.Errorf("invalid query template of %s: %v", n, err)
+			}
+			a.db.Templates[n] = t
+		}
+	}
+
+	a.tracker = status.NewTracker()
+
+	// Watchdog of instances stuck on query timeouts
+	limit, skip := 3, 24*time.Hour
+	if c.StuckLimit != 0 {
+		limit = c.StuckLimit
+	}
+	if c.StuckSkip > 0 {
+		skip = time.Duration(c.StuckSkip) * time.Second
+	}
+	quarantine := 6 * time.Hour
+	if c.QuarantineFor > 0 {
+		quarantine = time.Duration(c.QuarantineFor) * time.Second
+	}
+	a.watchdog = newWatchdog(limit, skip, c.Quarantine, quarantine)
+
+	// Restart policy of failed collections
+	a.restart.restart = c.OnFailure == "restart"
+	a.restart.limit = c.Restarts
+
+	// Coordination leases, nothing is written in dry-run mode so duplicates are harmless
+	if c.LeaseBucket != "" && !a.DryRun {
+		ttl := 2 * time.Minute
+		if c.LeaseTTL > 0 {
+			ttl = time.Duration(c.LeaseTTL) * time.Second
+		}
+		a.lease = newLeases(c.LeaseBucket, ttl)
+	}
+	a.restart.delay = time.Minute
+	if c.RestartDelay > 0 {
+		a.restart.delay = time.Duration(c.RestartDelay) * time.Second
+	}
+	a.tracker.SetProblems(a.watchdog.problems)
+	a.db.OnWrite = a.tracker.AddWrite
+	if c.ResetStats {
+		a.db.OnReset = a.tracker.AddResets
+	}
+	if c.WriteVerify {
+		a.db.OnVerify = a.tracker.AddVerify
+	}
+
+	// Set up lifecycle events publisher if broker provided
+	if c.EventsURL != "" {
+		a.events, err = events.New(c.EventsURL, c.EventsTopic)
+		if err != nil {
+			return fmt.Errorf("invalid events config: %v", err)
+		}
+	}
+	a.lagged = make(map[string]bool)
+
+	// Set up failure notifications if target provided
+	if c.NotifyWebhook != "" || c.NotifySMTP != "" {
+		a.notifier, err = newNotifier(c, a.name)
+		if err != nil {
+			return fmt.Errorf("invalid notification config: %v", err)
+		}
+	}
+
+	return nil
 }
 
 // collectionBuckets returns the collection of buckets for the given collection name.
@@ -124,6 +545,15 @@ func (a *App) collectionBuckets(s string) ([]db.Bucket, error) {
 		RPeriod: 17520 * time.Hour,
 	}
 
+	// Set cardinality query lookback and query timeouts of buckets if provided
+	set := a.live()
+	for _, b := range []*db.Bucket{&b2d, &b7d, &b28d, &b730d, &b1w, &b4w, &ball} {
+		b.CardLookback = bucketSecs(set.cardLookbacks, set.cardLookback, b.Name)
+		b.Timeout = bucketSecs(set.queryTimeouts, set.queryTimeout, b.Name)
+		b.DiscTimeout = bucketSecs(set.discTimeouts, set.discTimeout, b.Name)
+		b.CardTimeout = bucketSecs(set.cardTimeouts, set.cardTimeout, b.Name)
+	}
+
 	collections := make(map[string][]db.Bucket)
 	collections["iftraffic"] = []db.Bucket{b2d, b7d, b28d, b730d}
 	collections["ifstats"] = []db.Bucket{b2d, b7d, b28d, b730d}
@@ -131,145 +561,1064 @@ func (a *App) collectionBuckets(s string) ([]db.Bucket, error) {
 	collections["gencounter"] = []db.Bucket{b2d, b7d, b28d, b730d}
 	collections["icingachk"] = []db.Bucket{b1w, b4w, ball}
 
+	// Chains from config replace built-in ones
+	a.colMu.Lock()
+	for n, c := range a.chains {
+		collections[n] = append([]db.Bucket(nil), c...)
+	}
+	a.colMu.Unlock()
+
 	if c, ok := collections[s]; ok {
 		return c, nil
 	}
+
+	// Regex collections and measurements expanded from them use buckets of their kind
+	if rc, ok := a.regexCols[s]; ok {
+		return collections[rc.kind], nil
+	}
+	if k := a.db.Kind(s); k != s {
+		return collections[k], nil
+	}
+
 	return nil, fmt.Errorf("unknown collection %s", s)
 }
 
-// startResMon starts a resource monitor goroutine that continuously checks for running tasks and used memory.
-// Toggles the boolean flag a.db.DbHasResources.
+// bucketSecs returns configured duration of bucket, e.g. query timeout or cardinality lookback,
+// 0 if not configured.
+//
+// Parameters:
+//
+//	per: durations in seconds per bucket name
+//	all: duration in seconds of all buckets
+//	name: bucket name
+//
+// Return type: time.Duration
+func bucketSecs(per map[string]int, all int, name string) time.Duration {
+	if s, ok := per[name]; ok && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if all > 0 {
+		return time.Duration(all) * time.Second
+	}
+
+	return 0
+}
+
+// fieldRules compiles field aggregation rules from config.
+//
+// Parameters:
+//
+//	rules []config.FieldRule - the rules
+//
+// Returns:
+//
+//	[]db.FieldRule - compiled rules
+//	error - an error, if any
+func fieldRules(rules []config.FieldRule) ([]db.FieldRule, error) {
+	fr := make([]db.FieldRule, 0, len(rules))
+	for _, f := range rules {
+		re, err := regexp.Compile(f.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field regex %s: %w", f.Match, err)
+		}
+		fr = append(fr, db.FieldRule{Re: re, Aggregates: f.Aggregates, Rate: f.Rate})
+	}
+
+	return fr, nil
+}
+
+// instFilters compiles instance filter regexes.
+//
+// Parameters:
+//
+//	kind: filter kind (include, exclude)
+//	list: regexes
+//
+// Return type: []*regexp.Regexp, error
+func instFilters(kind string, list []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, s := range list {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance %s regex %s: %v", kind, s, err)
+		}
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// readConfig reads configuration from config file and environment.
+//
+// No parameters.
+//
+// Return type: *config.Configuration, error
+func (a *App) readConfig() (*config.Configuration, error) {
+	if a.ConfFile != "" {
+		return config.GetConfigFile(a.ConfFile)
+	}
+
+	return config.GetConfig()
+}
+
+// buildChains links bucket chains defined in config.
+//
+// Parameters:
+//
+//	conf: configuration
+//
+// Return type: map[string][]db.Bucket, error
+func buildChains(conf *config.Configuration) (map[string][]db.Bucket, error) {
+	chains := make(map[string][]db.Bucket)
+	defs := func(ts []config.Tier) []db.TierDef {
+		res := make([]db.TierDef, 0, len(ts))
+		for _, t := range ts {
+			res = append(res, db.TierDef{
+				Name:         t.Name,
+				AInterv:      time.Duration(t.AInterv) * time.Second,
+				RPeriod:      time.Duration(t.RPeriod) * time.Second,
+				CardLookback: bucketSecs(conf.CardLookbacks, conf.CardLookback, t.Name),
+				Timeout:      bucketSecs(conf.QueryTimeouts, conf.QueryTimeout, t.Name),
+				DiscTimeout:  bucketSecs(conf.DiscTimeouts, conf.DiscTimeout, t.Name),
+				CardTimeout:  bucketSecs(conf.CardTimeouts, conf.CardTimeout, t.Name),
+				Parent:       t.Parent,
+				Window: db.WindowOpts{
+					CreateEmpty: t.Empty,
+					Offset:      time.Duration(t.Offset) * time.Second,
+					TimeSrc:     t.TimeSrc,
+				},
+			})
+		}
+		return res
+	}
+
+	for n, c := range conf.Chains {
+		var buckets []db.Bucket
+		var err error
+		switch {
+		case len(c.Buckets) > 0 && len(c.Sources)+len(c.Tiers)+len(c.Direct) > 0:
+			err = fmt.Errorf("buckets can't be combined with sources, tiers and direct tiers")
+		case len(c.Buckets) > 0:
+			buckets, err = db.BuildTree(defs(c.Buckets))
+		default:
+			buckets, err = db.BuildChain(defs(c.Sources), defs(c.Tiers), defs(c.Direct))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chain of collection %s: %v", n, err)
+		}
+		for _, b := range buckets {
+			if b.Window != (db.WindowOpts{}) && conf.DbFlavor == db.FlavorV3 {
+				return nil, fmt.Errorf("invalid chain of collection %s: window options of bucket %s not supported by db flavor v3", n, b.Name)
+			}
+		}
+		chains[n] = buckets
+	}
+
+	return chains, nil
+}
+
+// startResMon starts a resource monitor goroutine that continuously checks for running tasks and used memory
+// until app context is done. Results of checks are recorded in resource gate a.db.Resources, which
+// pauses workers while resources are not available.
 //
 // No parameters.
 // No return types.
 func (a *App) startResMon() {
+	// InfluxDB 1.x and 3.x have no internal stats bucket to monitor
+	if a.db.Flavor != db.FlavorV2 {
+		return
+	}
+
 	interv := 10
 	ticker := time.NewTicker(time.Duration(interv) * time.Second)
+
+	// pause closes resource gate for given reason
+	pause := func(st db.ResState, reason string) {
+		helpers.PrintWarn(fmt.Sprintf("pause working, %s, retry after %ds", reason, interv))
+		st.Open = false
+		st.Reason = reason
+		a.db.Resources.Update(st)
+	}
+
+	// Monitor stops with app context
+	ctx := a.ctx
 	go func() {
-		for range ticker.C {
-			// Check for running tasks
-			tasks, err := a.db.GetRunningTasks()
-			if err != nil {
-				helpers.PrintWarn(fmt.Sprintf("pause working, failed to get running tasks: %+v, retry after %ds", err, interv))
-				a.db.DbHasResources = false
-				continue
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
+			var st db.ResState
 
-			switch {
-			case tasks == nil:
-				helpers.PrintWarn(fmt.Sprintf("pause working, no running tasks info, retry after %ds", interv))
-				a.db.DbHasResources = false
-				continue
-			case *tasks > 0:
-				helpers.PrintWarn(fmt.Sprintf("pause working, %0.f running tasks, retry after %ds", *tasks, interv))
-				a.db.DbHasResources = false
-				continue
-			default:
-				helpers.PrintDbg(fmt.Sprintf("%0.f running tasks", *tasks))
+			// Check for running tasks, only labeled ones when labels are configured
+			set := a.live()
+			if set.maxTasks >= 0 {
+				var tasks *float64
+				var err error
+				if len(set.taskLabels) > 0 {
+					var n float64
+					n, err = a.db.RunningTasks(set.taskLabels)
+					tasks = &n
+				} else {
+					tasks, err = a.db.GetRunningTasks()
+				}
+				if err != nil {
+					pause(st, fmt.Sprintf("failed to get running tasks: %+v", err))
+					continue
+				}
+
+				st.Tasks = tasks
+				switch {
+				case tasks == nil:
+					pause(st, "no running tasks info")
+					continue
+				case *tasks > float64(set.maxTasks):
+					pause(st, fmt.Sprintf("%0.f running tasks", *tasks))
+					continue
+				default:
+					helpers.PrintDbg(fmt.Sprintf("%0.f running tasks", *tasks))
+				}
 			}
 
 			// Check for used memory
 			mem, err := a.db.GetMemUsage()
 			if err != nil {
-				helpers.PrintWarn(fmt.Sprintf("pause working, failed to get mem usage: %+v, retry after %ds", err, interv))
-				a.db.DbHasResources = false
+				pause(st, fmt.Sprintf("failed to get mem usage: %+v", err))
 				continue
 			}
 
+			st.MemPct = mem
 			switch {
 			case mem == nil:
-				helpers.PrintWarn(fmt.Sprintf("pause working, no allocated memory info, retry after %ds", interv))
-				a.db.DbHasResources = false
+				pause(st, "no allocated memory info")
 				continue
-			case *mem > a.db.DsMemLimit:
-				helpers.PrintWarn(fmt.Sprintf("pause working, memory usage %0.f%%, retry after %ds", *mem, interv))
-				a.db.DbHasResources = false
+			case *mem > a.db.Tunables().MemLimit:
+				if a.db.Resources.Open() {
+					a.memPaused()
+				}
+				pause(st, fmt.Sprintf("memory usage %0.f%%", *mem))
+				// Abort running queries, they are retried in smaller parts
+				a.db.CancelQueries()
 				continue
 			default:
 				helpers.PrintDbg(fmt.Sprintf("memory usage %0.f%%", *mem))
 			}
-			a.db.DbHasResources = true
+			st.Open = true
+			a.db.Resources.Update(st)
 		}
 	}()
 }
 
-// workOn performs downsampling on buckets of given collection group.
+// gateState returns resource state of database for status API.
+//
+// No parameters.
+//
+// Returns:
+//
+//	status.Gate - resource gate state
+func (a *App) gateState() status.Gate {
+	s := a.db.Resources.Snapshot()
+
+	return status.Gate{
+		Open:    s.Open,
+		Reason:  s.Reason,
+		Since:   s.Since,
+		MemPct:  s.MemPct,
+		Tasks:   s.Tasks,
+		Checked: s.Checked,
+		Paused:  s.Paused.Seconds(),
+		Pauses:  s.Pauses,
+	}
+}
+
+// score looks up last downsampled time of instance of work item and ranks the item by it.
 //
 // Parameters:
 //
-//	c: string representing collection
-//	cg: string representing collection group
-//	buckets: slice of Bucket structs
-//	instances: slice of downsample target instances
+//	it: work item
 //
-// Return type: error
-func (a *App) workOn(c, cg string, buckets []db.Bucket, instances []string) error {
-	ts := time.Now()
-	firstRun := true
-	for {
-		il := len(instances)
-		helpers.PrintInfo(fmt.Sprintf("collection %s %s instances: %d %s", c, cg, il, time.Since(ts).String()))
+// No return types.
+func (a *App) score(it *workItem) {
+	t, err := a.engine.LastDownsampled(it.b, it.inst.Name, it.col)
+	if err != nil {
+		helpers.PrintWarn(fmt.Sprintf("%s, %s: error getting last measurement time - %v; assuming no data", it.b.Name, it.inst.Name, err))
+	}
+	a.rank(it, t)
+}
 
-		for i := range buckets {
-			helpers.PrintDbg(fmt.Sprintf("collection %s, bucket %s, elapsed %s work on instances:\n%# v", c, buckets[i].Name, time.Since(ts).String(), pretty.Formatter(instances)))
-			bucket := buckets[i]
-			if bucket.First {
-				if firstRun {
-					continue
-				}
-				inst, err := a.db.GetDsInstances(&bucket, c)
-				if err != nil {
-					return err
-				}
-				instances = inst[cg]
-				continue
-			} else {
-				count := len(instances)
-				for i, inst := range instances {
-					helpers.PrintDbg(fmt.Sprintf("collection %s, %s instances:\n%# v, bucket:\n%# v", c, cg, pretty.Formatter(inst), pretty.Formatter(bucket)))
-					helpers.PrintInfo(fmt.Sprintf("%d/%d %s %s %s %s %s", i+1, count, inst, c, cg, bucket.Name, time.Since(ts).String()))
-					count--
-
-					// Check for resources
-					for {
-						if !a.db.DbHasResources {
-							helpers.PrintDbg("pause working for 30s, no resources available")
-							time.Sleep(30 * time.Second)
-							continue
-						}
-						break
-					}
+// scoreAll scores work items like score, but last downsampled times of instances are looked up
+// with one query per collection and tier. Items are scored one by one when batch lookup fails.
+//
+// Parameters:
+//
+//	items: work items
+//
+// No return types.
+func (a *App) scoreAll(items []*workItem) {
+	type key struct {
+		col string
+		b   *db.Bucket
+	}
+	var keys []key
+	byKey := make(map[key][]*workItem)
+	for _, it := range items {
+		k := key{it.col, it.b}
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], it)
+	}
 
-					err := a.db.Downsample(&bucket, inst, c)
-					if err != nil {
-						helpers.PrintErr(fmt.Sprintf("error on downsample: %v", err))
-						time.Sleep(10 * time.Second)
-						continue
-					}
-				}
+	for _, k := range keys {
+		its := byKey[k]
+		names := make([]string, len(its))
+		for n, it := range its {
+			names[n] = it.inst.Name
+		}
+		last, err := a.engine.LastDownsampledAll(k.b, names, k.col)
+		if err != nil {
+			helpers.PrintWarn(fmt.Sprintf("%s, collection %s: error getting last measurement times - %v; looking up one by one", k.b.Name, k.col, err))
+			for _, it := range its {
+				a.score(it)
 			}
+			continue
 		}
-
-		elapsed := time.Since(ts)
-		helpers.PrintInfo(fmt.Sprintf("collection %s %s done, elapsed: %s", c, cg, elapsed.String()))
-		sd := 3*time.Hour - (elapsed + elapsed/2)
-		if sd > 0 {
-			helpers.PrintInfo(fmt.Sprintf("too soon for the next iteration, collection %s %s sleeping %s", c, cg, sd.String()))
-			time.Sleep(sd)
+		for _, it := range its {
+			a.rank(it, last[it.inst.Name])
 		}
-		firstRun = false
-		ts = time.Now()
 	}
 }
 
-// Run starts the application and performs downsampling tasks concurrently.
+// rank sets priority, lag and last downsampled time of work item. Priority reflects lag of instance
+// in tier as count of aggregation windows, weighted by cardinality so lagging light instances are not
+// stuck behind heavy ones. Last downsampled time is passed to downsampling, so it is not queried twice.
+//
+// Parameters:
+//
+//	it: work item
+//	t: last downsampled time
+//
+// No return types.
+func (a *App) rank(it *workItem, t time.Time) {
+	b, inst, c := it.b, it.inst, it.col
+	a.checkLag(c, b.Name, inst.Name, time.Since(t))
+	lag := time.Since(t).Seconds() / b.AInterv.Seconds()
+
+	it.last = t
+	it.lag = 0
+	if !t.IsZero() {
+		it.lag = time.Since(t)
+	}
+
+	it.prio = lag * float64(a.db.BatchWindows(inst.Card)) / float64(a.db.AggrCnt)
+	if m, ok := a.live().groupPrio[inst.Group]; ok {
+		it.prio *= m
+	}
+}
+
+// validGroups checks that cardinality group settings refer to known groups and have valid values.
+//
+// Parameters:
+//
+//	c: *config.Configuration to check
+//
+// Return type: error
+func validGroups(c *config.Configuration) error {
+	groups := []string{"light", "medium", "hevy"}
+	for g, n := range c.GroupWorkers {
+		if !slices.Contains(groups, g) {
+			return fmt.Errorf("worker limit of unknown cardinality group %s", g)
+		}
+		if n < 1 {
+			return fmt.Errorf("invalid worker limit %d of cardinality group %s", n, g)
+		}
+	}
+	for g, m := range c.GroupPriority {
+		if !slices.Contains(groups, g) {
+			return fmt.Errorf("priority of unknown cardinality group %s", g)
+		}
+		if m <= 0 {
+			return fmt.Errorf("invalid priority %g of cardinality group %s", m, g)
+		}
+	}
+	for g := range c.GroupIntervals {
+		if !slices.Contains(groups, g) {
+			return fmt.Errorf("interval of unknown cardinality group %s", g)
+		}
+	}
+
+	return nil
+}
+
+// checkLag publishes event when lag of instance in tier crosses configured threshold.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	tier: destination bucket name
+//	inst: instance name
+//	lag: time since last aggregation
+//
+// No return types.
+func (a *App) checkLag(c, tier, inst string, lag time.Duration) {
+	th := a.live().lagThreshold
+	if th <= 0 {
+		return
+	}
+
+	k := c + "|" + tier + "|" + inst
+	over := lag > time.Duration(th)*time.Second
+
+	a.lagMu.Lock()
+	crossed := over && !a.lagged[k]
+	a.lagged[k] = over
+	a.lagMu.Unlock()
+
+	if crossed {
+		a.events.Publish(events.Event{
+			Type:       events.LagThreshold,
+			Collection: c,
+			Tier:       tier,
+			Instance:   inst,
+			Lag:        lag.String(),
+		})
+	}
+}
+
+// expand returns measurements matching regex collection or collection itself.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	b: first bucket of collection
+//
+// Return type: []string, error
+func (a *App) expand(c string, b *db.Bucket) ([]string, error) {
+	rc, ok := a.regexCols[c]
+	if !ok {
+		return []string{c}, nil
+	}
+
+	m, err := a.db.DiscoverMeasurements(b, c, rc.re, rc.kind, rc.tag)
+	if err != nil {
+		return nil, err
+	}
+	helpers.PrintInfo(fmt.Sprintf("collection %s measurements: %d", c, len(m)))
+
+	return m, nil
+}
+
+// workOn performs downsampling passes on buckets of given collection.
+// Work items of every instance are put into shared work queue tier by tier.
+// Regex collections are expanded to matching measurements on every pass.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	buckets: slice of Bucket structs
+//
+// Return type: error
+func (a *App) workOn(c string, buckets []db.Bucket) error {
+	// Last downsampling of tiers and cardinality groups in tiers with own interval
+	tierRun := make(map[string]time.Time)
+	groupRun := make(map[string]time.Time)
+	// Instances of previous passes with their cardinality
+	known := make(map[string]knownInst)
+	gen := a.chainGen.Load()
+
+	// Pass interrupted by restart is resumed, otherwise interval of last finished pass is kept
+	resume, _ := a.passes.Get(c)
+	if !resume.Running() && !resume.Finish.IsZero() && !a.Once {
+		elapsed := resume.Finish.Sub(resume.Start)
+		if sd := a.passInterval(c) - (elapsed + elapsed/2) - time.Since(resume.Finish) + a.passJitter(); sd > 0 {
+			helpers.PrintInfo(fmt.Sprintf("last pass of collection %s finished at %s, sleeping %s", c, resume.Finish.Format(time.RFC3339), sd.String()))
+			if !a.sleepPass(c, sd) {
+				return a.ctx.Err()
+			}
+		}
+	}
+
+	for {
+		ts := time.Now()
+
+		// Reloaded configuration applies from next pass
+		a.applyReload()
+		if !a.hasCollection(c) {
+			return errRemoved
+		}
+		if g := a.chainGen.Load(); g != gen {
+			gen = g
+			nb, err := a.collectionBuckets(c)
+			if err != nil {
+				return err
+			}
+			buckets = nb
+		}
+
+		// Expand regex collection
+		cols, err := a.expand(c, &buckets[0])
+		if err != nil {
+			return err
+		}
+
+		// Get instances of all source buckets
+		srcs := sources(buckets)
+		instances, count, err := a.passInstances(cols, srcs, known)
+		if err != nil {
+			return err
+		}
+		helpers.PrintInfo(fmt.Sprintf("collection %s instances: %d", c, count))
+		if resume.Running() {
+			helpers.PrintInfo(fmt.Sprintf("collection %s: resuming pass started at %s, %d tiers done", c, resume.Start.Format(time.RFC3339), len(resume.Tiers)))
+		} else {
+			a.passes.Start(c, ts)
+		}
+		a.events.Publish(events.Event{
+			Type:       events.PassStart,
+			Collection: c,
+			Message:    fmt.Sprintf("%d instances", count),
+		})
+
+		for i := range buckets {
+			bucket := &buckets[i]
+			if bucket.First || resume.TierDone(bucket.Name) {
+				continue
+			}
+			if iv := time.Duration(a.live().tierIntervals[bucket.Name]) * time.Second; iv > 0 && !a.Once {
+				if last, ok := tierRun[bucket.Name]; ok && ts.Sub(last) < iv {
+					helpers.PrintDbg(fmt.Sprintf("collection %s, bucket %s skipped, interval %s not elapsed", c, bucket.Name, iv))
+					continue
+				}
+				tierRun[bucket.Name] = ts
+			}
+			helpers.PrintDbg(fmt.Sprintf("collection %s, bucket %s, elapsed %s work on instances:\n%# v", c, bucket.Name, time.Since(ts).String(), pretty.Formatter(instances)))
+
+			// Wait until all instances are done before next tier
+			tw := newTierWork(c, bucket.Name)
+			tierStart := time.Now()
+			for g, s := range a.live().groupIntervals {
+				iv := time.Duration(s) * time.Second
+				if iv <= 0 || a.Once {
+					continue
+				}
+				k := bucket.Name + "|" + g
+				if last, ok := groupRun[k]; ok && ts.Sub(last) < iv {
+					helpers.PrintDbg(fmt.Sprintf("collection %s, bucket %s, group %s skipped, interval %s not elapsed", c, bucket.Name, g, iv))
+					tw.skip[g] = true
+					continue
+				}
+				groupRun[k] = ts
+			}
+			a.passes.StartTier(c, bucket.Name)
+			// Ranges out of retention are dropped also for instances not downsampled any more
+			if bucket.RPeriod > 0 {
+				a.db.Ledger.ForgetBefore(bucket.Name, time.Now().Add(-1*bucket.RPeriod))
+			}
+			// Items are scored before any is queued, so workers take them in order of priority
+			var items []*workItem
+			for _, col := range cols {
+				for _, inst := range instances[col] {
+					if tw.skip[inst.Group] || resume.InstDone(bucket.Name, col+"|"+inst.Name) {
+						continue
+					}
+					tw.add()
+					items = append(items, &workItem{col: col, inst: inst, b: bucket, tw: tw})
+				}
+			}
+			a.scoreAll(items)
+			for _, it := range items {
+				if known[it.col+"|"+it.inst.Name].fresh {
+					it.prio = newInstPrio
+				}
+			}
+			a.queue.pushAll(items)
+			tw.seal()
+			done, total := tw.progress()
+			a.tracker.SetProgress(c, bucket.Name, done, total)
+			if err := a.waitTier(c, cols, instances, srcs, bucket, tw); err != nil {
+				return err
+			}
+			a.reportTier(c, tw, time.Since(tierStart))
+			a.passes.FinishTier(c, bucket.Name)
+			helpers.PrintInfo(fmt.Sprintf("collection %s, bucket %s done, elapsed: %s", c, bucket.Name, time.Since(ts).String()))
+		}
+
+		elapsed := time.Since(ts)
+		helpers.PrintInfo(fmt.Sprintf("collection %s done, elapsed: %s", c, elapsed.String()))
+		a.reportQuarantine(c)
+		a.tracker.SetPass(c, time.Now())
+		a.passes.Finish(c, time.Now())
+		resume = checkpoint.Pass{}
+		a.events.Publish(events.Event{
+			Type:       events.PassFinish,
+			Collection: c,
+			Elapsed:    elapsed.String(),
+		})
+		if a.Once {
+			return nil
+		}
+		sd := a.passInterval(c) - (elapsed + elapsed/2) + a.passJitter()
+		if sd > 0 {
+			helpers.PrintInfo(fmt.Sprintf("too soon for the next iteration, collection %s sleeping %s", c, sd.String()))
+			if !a.sleepWatch(c, sd, buckets, cols, known) {
+				return a.ctx.Err()
+			}
+		}
+	}
+}
+
+// passInterval returns minimum interval of passes of collection.
+//
+// Parameters:
+//
+//	c: string representing collection
+//
+// Return type: time.Duration
+func (a *App) passInterval(c string) time.Duration {
+	set := a.live()
+	if iv, ok := set.intervals[c]; ok && iv > 0 {
+		return time.Duration(iv) * time.Second
+	}
+	if set.passInterval > 0 {
+		return time.Duration(set.passInterval) * time.Second
+	}
+
+	return defPassInterval
+}
+
+// passJitter returns random delay added to sleep between passes, so passes of several
+// downsamplers started at the same time drift apart.
+//
+// No parameters.
+//
+// Return type: time.Duration
+func (a *App) passJitter() time.Duration {
+	j := a.live().passJitter
+	if j <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(j) * int64(time.Second)))
+}
+
+// waitTier waits until all work items of tier are done. When re-discovery is
+// enabled, instances which appeared after the start of the pass are added to
+// the tier and to the instances of the remaining tiers meanwhile.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	cols: collections (measurements) of the pass
+//	instances: instances of the pass by collection
+//	srcs: source buckets used for discovery
+//	b: bucket of the tier
+//	tw: outstanding work items of the tier
+//
+// Return type: error
+func (a *App) waitTier(c string, cols []string, instances map[string][]db.Instance, srcs []*db.Bucket, b *db.Bucket, tw *tierWork) error {
+	rd := a.live().rediscover
+	if rd <= 0 {
+		select {
+		case <-tw.done:
+			return nil
+		case <-a.ctx.Done():
+			return a.ctx.Err()
+		}
+	}
+
+	tick := time.NewTicker(time.Duration(rd) * time.Second)
+	defer tick.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-tw.done:
+			return nil
+		case <-a.ctx.Done():
+			return a.ctx.Err()
+		case <-tick.C:
+			now := time.Now()
+			for _, col := range cols {
+				known := make(map[string]bool, len(instances[col]))
+				for _, inst := range instances[col] {
+					known[inst.Name] = true
+				}
+
+				for _, src := range srcs {
+					names, err := a.engine.DiscoverInstances(src, col, last.Add(-1*src.AInterv), now)
+					if err != nil {
+						helpers.PrintErr(fmt.Sprintf("collection %s: re-discovery failed - %v", col, err))
+						continue
+					}
+
+					for _, name := range names {
+						if known[name] {
+							continue
+						}
+						known[name] = true
+						inst := a.engine.NewInstance(src, name, col)
+						instances[col] = append(instances[col], inst)
+						if tw.skip[inst.Group] || !tw.add() {
+							continue
+						}
+						helpers.PrintInfo(fmt.Sprintf("collection %s, bucket %s: picked up new instance %s", col, b.Name, name))
+						it := &workItem{col: col, inst: inst, b: b, tw: tw}
+						a.score(it)
+						it.prio = newInstPrio
+						a.queue.push(it)
+					}
+				}
+			}
+			last = now
+		}
+	}
+}
+
+// sources returns source (first tier) buckets of chain.
+//
+// Parameters:
+//
+//	buckets: slice of Bucket structs
+//
+// Return type: []*db.Bucket
+func sources(buckets []db.Bucket) []*db.Bucket {
+	var res []*db.Bucket
+	for i := range buckets {
+		if buckets[i].First {
+			res = append(res, &buckets[i])
+		}
+	}
+
+	return res
+}
+
+// worker takes work items from shared queue and downsamples them.
+//
+// Parameters:
+//
+//	n: worker number
+//
+// No return types.
+func (a *App) worker(n int) {
+	defer a.workers.Done()
+	for {
+		it := a.queue.pop()
+		if it == nil {
+			return
+		}
+		a.applyReload()
+		items := []*workItem{it}
+		if lb := a.live().lightBatch; lb > 1 && it.inst.Group == "light" {
+			items = append(items, a.queue.take(it, lb-1)...)
+		}
+		a.tracker.SetActive(n, it.col, it.b.Name, it.inst.Name)
+		st := time.Now()
+		if len(items) > 1 {
+			a.processGroup(n, items)
+		} else {
+			a.process(n, it)
+		}
+		d := time.Since(st) / time.Duration(len(items))
+		for _, o := range items {
+			o.tw.record(o.inst.Group, d, o.lag, o.failed)
+		}
+		a.tracker.ClearActive(n)
+		a.queue.done(it)
+		for _, o := range items {
+			o.tw.finish()
+		}
+		done, total := it.tw.progress()
+		a.tracker.SetProgress(it.tw.col, it.tw.tier, done, total)
+	}
+}
+
+// process performs downsampling of work item.
+//
+// Parameters:
+//
+//	n: worker number
+//	it: work item
+//
+// No return types.
+func (a *App) process(n int, it *workItem) {
+	helpers.PrintDbg(fmt.Sprintf("worker %d, collection %s, instance:\n%# v, bucket:\n%# v", n, it.col, pretty.Formatter(it.inst), pretty.Formatter(it.b)))
+	helpers.PrintInfo(fmt.Sprintf("worker %d: %s %s %s %s priority %.1f, queued %d", n, it.inst.Name, it.col, it.inst.Group, it.b.Name, it.prio, a.queue.len()))
+
+	// Skip instance stuck on query timeouts or quarantined after repeated failures
+	if a.watchdog.skipped(it.col, it.b.Name, it.inst.Name) {
+		helpers.PrintWarn(fmt.Sprintf("worker %d: %s %s %s skipped after repeated query timeouts or failures", n, it.inst.Name, it.col, it.b.Name))
+		return
+	}
+
+	if !a.ready() {
+		return
+	}
+
+	// Retry on transient errors, downsampling continues from last written window
+	var err error
+	last := it.last
+	for attempt := 0; ; attempt++ {
+		st := time.Now()
+		err = a.engine.Downsample(it.b, it.inst.Name, it.col, last)
+		// Failed attempt may have advanced, retry looks it up again
+		last = time.Time{}
+		a.tracker.ObserveDuration(it.b.Name, time.Since(st))
+		if err == nil || a.ctx.Err() != nil || !db.IsTransient(err) || attempt >= a.db.Retry.Attempts {
+			break
+		}
+
+		// Back off at least as requested by server when rate limited or unavailable
+		d := a.db.Retry.Delay(attempt)
+		if ra, ok := db.RateLimitDelay(err); ok && ra > d {
+			d = ra
+		}
+		helpers.PrintWarn(fmt.Sprintf("worker %d: %s %s %s transient error - %v; retry %d/%d after %s",
+			n, it.inst.Name, it.col, it.b.Name, err, attempt+1, a.db.Retry.Attempts, d.Round(time.Second)))
+		if !a.sleep(d) {
+			break
+		}
+	}
+	if err != nil && a.ctx.Err() != nil {
+		helpers.PrintInfo(fmt.Sprintf("worker %d: %s %s %s interrupted by shutdown", n, it.inst.Name, it.col, it.b.Name))
+		return
+	}
+	if err != nil {
+		a.failures.Add(1)
+		it.failed = true
+		helpers.PrintErr(fmt.Sprintf("error on downsample: %v", err))
+		if db.IsTimeout(err) {
+			a.watchdog.timeout(it.col, it.b.Name, it.inst.Name, err)
+		}
+		a.watchdog.failure(it.col, it.b.Name, it.inst.Name, err)
+		a.notifier.failure(it.col, it.b.Name, it.inst.Name, err)
+		a.events.Publish(events.Event{
+			Type:       events.InstFailure,
+			Collection: it.col,
+			Tier:       it.b.Name,
+			Instance:   it.inst.Name,
+			Message:    err.Error(),
+		})
+		// Give server time to recover before next work item
+		if db.IsTransient(err) {
+			a.sleep(a.db.Retry.Delay(a.db.Retry.Attempts))
+		}
+		return
+	}
+	a.succeeded(it)
+}
+
+// processGroup performs downsampling of work items of light instances of the same tier with
+// shared queries. Instances left over by grouped downsampling are processed one by one.
+//
+// Parameters:
+//
+//	n: worker number
+//	items: work items
+//
+// No return types.
+func (a *App) processGroup(n int, items []*workItem) {
+	it := items[0]
+	byName := make(map[string]*workItem, len(items))
+	var names []string
+	var single []*workItem
+	for _, o := range items {
+		// Skipped instances are reported by process
+		if a.watchdog.skipped(o.col, o.b.Name, o.inst.Name) {
+			single = append(single, o)
+			continue
+		}
+		byName[o.inst.Name] = o
+		names = append(names, o.inst.Name)
+	}
+	helpers.PrintInfo(fmt.Sprintf("worker %d: %d light instances %s %s together, queued %d", n, len(names), it.col, it.b.Name, a.queue.len()))
+
+	if !a.ready() {
+		return
+	}
+
+	st := time.Now()
+	rest, err := a.engine.DownsampleGroup(it.b, names, it.col)
+	a.tracker.ObserveDuration(it.b.Name, time.Since(st))
+	if err != nil && a.ctx.Err() != nil {
+		helpers.PrintInfo(fmt.Sprintf("worker %d: light instances %s %s interrupted by shutdown", n, it.col, it.b.Name))
+		return
+	}
+	if err != nil {
+		helpers.PrintWarn(fmt.Sprintf("worker %d: %v; downsampling instances one by one", n, err))
+		// Failed group may have advanced
+		for _, o := range items {
+			o.last = time.Time{}
+		}
+	}
+
+	left := make(map[string]bool, len(rest))
+	for _, r := range rest {
+		left[r] = true
+	}
+	for _, name := range names {
+		if left[name] {
+			single = append(single, byName[name])
+			continue
+		}
+		a.succeeded(byName[name])
+	}
+	for _, o := range single {
+		a.process(n, o)
+	}
+}
+
+// ready waits while work is paused by admin api or database resources are not available.
+//
+// No parameters.
+//
+// Return type: bool, false when interrupted by shutdown
+func (a *App) ready() bool {
+	// Wait while paused by admin api
+	for a.paused.Load() {
+		if !a.sleep(5 * time.Second) {
+			return false
+		}
+	}
+
+	// Wait for resources
+	if !a.db.Resources.Open() {
+		helpers.PrintDbg("pause working, no resources available")
+	}
+
+	return a.db.Resources.Wait(a.ctx) == nil
+}
+
+// succeeded records successful downsampling of work item.
+//
+// Parameters:
+//
+//	it: work item
+//
+// No return types.
+func (a *App) succeeded(it *workItem) {
+	a.watchdog.success(it.col, it.b.Name, it.inst.Name)
+	a.passes.InstDone(it.tw.col, it.b.Name, it.col+"|"+it.inst.Name)
+	a.notifier.success(it.col, it.b.Name, it.inst.Name)
+	a.tracker.SetSuccess(it.col, it.b.Name, it.inst.Name, time.Now())
+}
+
+// sleep pauses for given duration or until shutdown.
+//
+// Parameters:
+//
+//	d: duration of pause
+//
+// Return type: bool, false when interrupted by shutdown
+func (a *App) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-a.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Run starts the application and performs downsampling tasks concurrently.
+// Apps of several configured InfluxDB connections run concurrently with own resource monitors.
+// Stops gracefully on SIGINT or SIGTERM.
 //
 // This function does not take any parameters and does not have a return type.
 func (a *App) Run() {
+	var n int64
+	if len(a.conns) > 0 {
+		n = a.runConnections()
+	} else {
+		a.run()
+		n = a.failures.Load()
+	}
+
+	if a.Once && n > 0 {
+		helpers.PrintFatal(fmt.Sprintf("single pass finished with %d failures", n))
+	}
+}
+
+// run downsamples configured collections until shutdown or end of single pass.
+//
+// No parameters.
+// No return types.
+func (a *App) run() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	a.ctx = ctx
+	a.db.SetContext(ctx)
+	a.sups = newSupervisors()
+
 	a.startResMon()
 
-	var wg sync.WaitGroup
-	wg.Add(1) // add here because we want to stop when even one collection fails
+	// Refuse to work on collections leased by another copy of downsampler
+	if a.lease != nil {
+		if err := a.acquireLeases(a.collections()); err != nil {
+			helpers.PrintFatal(fmt.Sprintf("%v, interrupting", err))
+		}
+		a.startLeaseRenewal()
+	}
+
+	// Re-read rotated token if it is kept in file or secret store
+	if a.tokenRef() != "" && a.conf.TokenRefresh >= 0 {
+		a.startTokenRefresh()
+	}
+
+	// Create missing destination buckets and reconcile retention periods if enabled
+	if a.conf.ManageBuckets {
+		a.manageBuckets()
+	}
+
+	// Start status api if listen address provided
+	if a.conf.HTTPListen != "" {
+		a.tracker.SetCollections(a.dsCollections, time.Duration(a.conf.HealthStale)*time.Second)
+		a.tracker.SetPing(a.db.Ping)
+		a.tracker.SetGate(a.gateState)
+		a.tracker.Serve(a.conf.HTTPListen)
+	}
+
+	// Start admin api if listen address provided
+	if a.conf.AdminListen != "" {
+		a.serveAdmin(a.conf.AdminListen)
+	}
+
+	// Start aggregation spot checks if interval provided
+	if a.conf.SpotInterval > 0 && !a.Once {
+		a.startSpotCheck()
+	}
+
+	// Start destination retention enforcement if enabled
+	if (a.conf.RetEnforce || a.conf.RetDryRun) && !a.Once {
+		a.startRetention()
+	}
+
+	// Start decommissioned instance cleanup if enabled
+	if a.conf.ReapAfter > 0 && !a.Once {
+		a.startReaper()
+	}
+
+	// Start workers, by default as many as there are cardinality groups of all collections.
+	// Collections with quota get at most their share of workers
+	a.queue = newWorkQueue()
+	a.tracker.SetQueueLen(a.queue.len)
+	workers := a.conf.Workers
+	if workers < 1 {
+		workers = 3 * len(a.dsCollections)
+	}
+	helpers.PrintInfo(fmt.Sprintf("starting %d workers", workers))
+	for c, s := range a.conf.Quotas {
+		a.queue.setLimit(c, int(math.Ceil(s*float64(workers))))
+	}
+	for g, l := range a.conf.GroupWorkers {
+		a.queue.setGroupLimit(g, l)
+	}
+	for n := 1; n <= workers; n++ {
+		a.workers.Add(1)
+		go a.worker(n)
+	}
+
 	for _, c := range a.dsCollections {
 		// Get buckets
 		buckets, err := a.collectionBuckets(c)
@@ -277,28 +1626,68 @@ func (a *App) Run() {
 			helpers.PrintFatal(fmt.Sprintf("can't get buckets for collection %s, interrupting", c))
 		}
 
-		// Get instances
-		i, err := a.db.GetDsInstances(&buckets[0], c)
-		if err != nil {
-			helpers.PrintFatal(fmt.Sprintf("can't get buckets for collection %s, interrupting", c))
-		}
+		// Work on collections concurrently
+		a.startCollection(c, buckets)
+	}
 
-		// Work on collection instance groups concurrently
-		for cgroup, inst := range i {
-			go func(wg *sync.WaitGroup, c, cg string, b []db.Bucket, i []string) {
-				defer wg.Done()
-				err := a.workOn(c, cg, b, i)
-				if err != nil {
-					helpers.PrintErr(fmt.Sprintf("downsample collection %s, %s: %+v", c, cg, err))
+	// Re-read configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				helpers.PrintInfo("SIGHUP received, re-reading configuration")
+				if err := a.reload(); err != nil {
+					helpers.PrintErr(fmt.Sprintf("configuration reload: %v", err))
 				}
+			}
+		}
+	}()
 
-				// Set interrupt flag when too little time has elapsed from start
-				if time.Since(a.startTS) < 10*time.Second {
-					helpers.PrintFatal(fmt.Sprintf("downsampling of %s, %s ended too fast, interrupting", c, cg))
-				}
-			}(&wg, c, cgroup, buckets, inst)
+	// Single pass is done when all collections are done, daemon runs until any collection
+	// fails unless failed collections are restarted
+	select {
+	case err := <-a.sups.fatal:
+		helpers.PrintFatal(fmt.Sprintf("%v, interrupting", err))
+	case <-a.sups.done():
+		if ctx.Err() == nil && !a.Once {
+			helpers.PrintFatal("no collections left running, interrupting")
+		}
+	case <-ctx.Done():
+		helpers.PrintInfo("shutdown requested, stopping running work")
+	}
+
+	// Retention is enforced once after the pass in single pass mode
+	if a.Once && ctx.Err() == nil && (a.conf.RetEnforce || a.conf.RetDryRun) {
+		a.enforceRetention()
+	}
+
+	a.shutdown()
+}
+
+// shutdown stops workers after their current work, saves state and logs summary.
+//
+// No parameters.
+// No return types.
+func (a *App) shutdown() {
+	a.queue.close()
+	a.workers.Wait()
+	a.saveState()
+
+	var latest time.Time
+	succ := a.tracker.Successes()
+	for _, s := range succ {
+		if s.Time.After(latest) {
+			latest = s.Time
 		}
 	}
-	wg.Wait()
-	helpers.PrintFatal("fatal error, interrupting")
+	msg := fmt.Sprintf("stopped after %s, %d instance tiers downsampled", time.Since(a.startTS).Round(time.Second), len(succ))
+	if !latest.IsZero() {
+		msg += ", last success at " + latest.Format(time.RFC3339)
+	}
+	helpers.PrintInfo(msg)
 }
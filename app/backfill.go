@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Backfill re-downsamples collection over past time range into destination tiers, ignoring
+// already aggregated data. Conflicting points are deleted first. Tiers are processed in chain order,
+// so coarser tiers are built from freshly backfilled finer ones. Stops on SIGINT or SIGTERM.
+//
+// Parameters:
+//
+//	c string - the collection
+//	tier string - only backfill destination bucket of this name, all tiers when empty
+//	from time.Time - range start
+//	to time.Time - range stop
+//
+// Returns:
+//
+//	error - an error, if any
+func (a *App) Backfill(c, tier string, from, to time.Time) error {
+	if len(a.conns) > 0 {
+		return errConnections
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("from must be before to")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	a.ctx = ctx
+	a.db.SetContext(ctx)
+	a.startResMon()
+
+	buckets, err := a.collectionBuckets(c)
+	if err != nil {
+		return err
+	}
+	cols, err := a.expand(c, &buckets[0])
+	if err != nil {
+		return fmt.Errorf("can't get measurements for collection %s: %w", c, err)
+	}
+
+	found := false
+	failures := 0
+	for bi := range buckets {
+		b := &buckets[bi]
+		if b.First || (tier != "" && b.Name != tier) {
+			continue
+		}
+		found = true
+
+		for _, col := range cols {
+			insts, err := a.engine.DiscoverInstances(b.From, col, from, to)
+			if err != nil {
+				return fmt.Errorf("can't get instances of %s in %s: %w", col, b.From.Name, err)
+			}
+			helpers.PrintInfo(fmt.Sprintf("backfill %s, %s: %d instances", b.Name, col, len(insts)))
+
+			for _, inst := range insts {
+				st := time.Now()
+				err := a.db.Backfill(b, inst, col, from, to)
+				if ctx.Err() != nil {
+					a.saveState()
+					return ctx.Err()
+				}
+				if err != nil {
+					failures++
+					helpers.PrintErr(fmt.Sprintf("backfill %s, %s, %s: %v", b.Name, col, inst, err))
+					continue
+				}
+				helpers.PrintDbg(fmt.Sprintf("backfill %s, %s, %s: done in %s", b.Name, col, inst, time.Since(st).Round(time.Millisecond)))
+			}
+		}
+	}
+	a.saveState()
+
+	switch {
+	case !found:
+		return fmt.Errorf("no destination tier %s of collection %s", tier, c)
+	case failures > 0:
+		return fmt.Errorf("%d instances failed", failures)
+	}
+
+	return nil
+}
+
+// saveState saves persisted state of downsampler.
+//
+// No parameters.
+// No return types.
+func (a *App) saveState() {
+	if err := a.db.Ledger.Save(); err != nil {
+		helpers.PrintErr(fmt.Sprintf("can't save ledger: %v", err))
+	}
+	if err := a.db.Checkpoints.Save(); err != nil {
+		helpers.PrintErr(fmt.Sprintf("can't save checkpoints: %v", err))
+	}
+	if err := a.passes.Save(); err != nil {
+		helpers.PrintErr(fmt.Sprintf("can't save pass progress: %v", err))
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// measurement of synthetic benchmark series
+const benchMeas = "gengauge"
+
+// BenchOpts are parameters of downsample throughput benchmark
+type BenchOpts struct {
+	Bucket    string        // prefix of scratch bucket names
+	Instances int           // count of synthetic instances
+	Fields    int           // count of fields per instance
+	Period    time.Duration // time span of synthetic data
+	Interval  time.Duration // aggregation interval of destination
+	AggrCnts  []int         // base counts of aggregation windows in one query to measure
+	Workers   []int         // counts of concurrent workers to measure
+	Keep      bool          // keep scratch buckets after benchmark
+}
+
+// Bench generates synthetic series into scratch bucket and measures downsampling throughput
+// for every combination of batch size and concurrency.
+//
+// Parameters:
+//
+//	o BenchOpts - benchmark parameters
+//
+// Returns:
+//
+//	error - an error, if any
+func (a *App) Bench(o BenchOpts) error {
+	if len(a.conns) > 0 {
+		return errConnections
+	}
+	if a.conf.DestURL != "" {
+		return fmt.Errorf("not supported with separate destination server")
+	}
+	if o.Instances < 1 || o.Fields < 1 {
+		return fmt.Errorf("at least one instance and field required")
+	}
+	if o.Interval <= time.Minute || o.Period < o.Interval {
+		return fmt.Errorf("interval must be longer than 1m and period at least one interval")
+	}
+
+	src := db.Bucket{Name: o.Bucket + "_src", First: true, AInterv: time.Minute, RPeriod: o.Period}
+	dst := db.Bucket{Name: o.Bucket + "_dst", From: &src, AInterv: o.Interval, RPeriod: o.Period}
+
+	// Benchmark must not be affected by processed ranges of real chains
+	a.db.Ledger = nil
+
+	for _, n := range []string{src.Name, dst.Name} {
+		if err := a.db.ScratchBucket(n); err != nil {
+			return fmt.Errorf("can't create scratch bucket %s: %w", n, err)
+		}
+	}
+	if !o.Keep {
+		defer func() {
+			for _, n := range []string{src.Name, dst.Name} {
+				if err := a.db.DropBucket(n); err != nil {
+					helpers.PrintWarn(fmt.Sprintf("can't delete scratch bucket %s: %v", n, err))
+				}
+			}
+		}()
+	}
+
+	// Generate synthetic data
+	insts := make([]string, o.Instances)
+	for n := range insts {
+		insts[n] = fmt.Sprintf("bench-%d", n+1)
+	}
+	now := time.Now().Truncate(time.Minute)
+	if err := a.db.ClearBucket(src.Name); err != nil {
+		return err
+	}
+	st := time.Now()
+	pts, err := a.db.WriteSynthetic(&src, benchMeas, insts, o.Fields, now.Add(-1*o.Period), now)
+	if err != nil {
+		return fmt.Errorf("can't write synthetic data: %w", err)
+	}
+	helpers.PrintInfo(fmt.Sprintf("written %d synthetic values to %s in %s", pts, src.Name, time.Since(st).Round(time.Millisecond)))
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "AGGRCNT\tWORKERS\tWINDOWS\tQUERIES\tELAPSED\tWINDOWS/S\tQUERIES/S\tERRORS")
+
+	for _, ac := range o.AggrCnts {
+		for _, w := range o.Workers {
+			if err := a.db.ClearBucket(dst.Name); err != nil {
+				return err
+			}
+			a.db.AggrCnt = ac
+
+			// Windows and queries of whole period per instance
+			windows := int64(o.Period / o.Interval)
+			var queries int64
+			for _, inst := range insts {
+				card, _ := a.db.Cardinality(&src, inst, benchMeas)
+				bw := int64(a.db.BatchWindows(card))
+				queries += (windows + bw - 1) / bw
+			}
+			windows *= int64(len(insts))
+
+			elapsed, errs := a.benchRun(&dst, insts, w)
+			sec := elapsed.Seconds()
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t%.1f\t%.1f\t%d\n", ac, w, windows, queries,
+				elapsed.Round(time.Millisecond), float64(windows)/sec, float64(queries)/sec, errs)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// benchRun downsamples all instances to destination bucket with given count of concurrent workers.
+//
+// Parameters:
+//
+//	b *db.Bucket - the destination bucket
+//	insts []string - instance names
+//	workers int - count of concurrent workers
+//
+// Returns:
+//
+//	time.Duration - elapsed time
+//	int - count of failed instances
+func (a *App) benchRun(b *db.Bucket, insts []string, workers int) (time.Duration, int) {
+	ch := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := 0
+
+	st := time.Now()
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for inst := range ch {
+				if err := a.db.Downsample(b, inst, benchMeas, time.Time{}); err != nil {
+					helpers.PrintErr(fmt.Sprintf("bench %s: %v", inst, err))
+					mu.Lock()
+					errs++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, inst := range insts {
+		ch <- inst
+	}
+	close(ch)
+	wg.Wait()
+
+	return time.Since(st), errs
+}
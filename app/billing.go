@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Billing computes 95th percentile ingress and egress bitrates of interfaces of collection for
+// calendar month and writes them to billing bucket. Counters are read from the finest bucket
+// of collection which still holds the whole month. Stops on SIGINT or SIGTERM.
+//
+// Parameters:
+//
+//	c string - the collection
+//	month time.Time - start of the month
+//
+// Returns:
+//
+//	error - an error, if any
+func (a *App) Billing(c string, month time.Time) error {
+	if len(a.conns) > 0 {
+		return errConnections
+	}
+	if a.conf.BillingBucket == "" {
+		return fmt.Errorf("billing bucket not configured")
+	}
+	meas := a.conf.BillingMeas
+	if meas == "" {
+		meas = "billing"
+	}
+	stop := month.AddDate(0, 1, 0)
+	if stop.After(time.Now()) {
+		helpers.PrintWarn(fmt.Sprintf("billing: month %s not finished yet, result is partial", month.Format("2006-01")))
+		stop = time.Now()
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	a.ctx = ctx
+	a.db.SetContext(ctx)
+	a.startResMon()
+
+	buckets, err := a.collectionBuckets(c)
+	if err != nil {
+		return err
+	}
+
+	// Finest bucket covering the whole month
+	var src *db.Bucket
+	for bi := range buckets {
+		b := &buckets[bi]
+		if time.Now().Add(-b.RPeriod).After(month) {
+			continue
+		}
+		if src == nil || b.AInterv < src.AInterv {
+			src = b
+		}
+	}
+	if src == nil {
+		return fmt.Errorf("no bucket of collection %s holds data of %s", c, month.Format("2006-01"))
+	}
+	if src.AInterv > db.BillingSample {
+		helpers.PrintWarn(fmt.Sprintf("billing: source bucket %s interval %s is longer than %s sample", src.Name, src.AInterv.String(), db.BillingSample.String()))
+	}
+
+	cols, err := a.expand(c, &buckets[0])
+	if err != nil {
+		return fmt.Errorf("can't get measurements for collection %s: %w", c, err)
+	}
+
+	failures := 0
+	for _, col := range cols {
+		insts, err := a.engine.DiscoverInstances(src, col, month, stop)
+		if err != nil {
+			return fmt.Errorf("can't get instances of %s in %s: %w", col, src.Name, err)
+		}
+		helpers.PrintInfo(fmt.Sprintf("billing %s from %s, %s: %d instances", month.Format("2006-01"), src.Name, col, len(insts)))
+
+		for _, inst := range insts {
+			err := a.db.Billing(src, a.conf.BillingBucket, meas, inst, col, month, stop)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				failures++
+				helpers.PrintErr(fmt.Sprintf("billing %s, %s: %v", col, inst, err))
+			}
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d instances failed", failures)
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// manageBuckets creates missing destination buckets of configured collections and
+// reconciles their retention periods with config.
+//
+// No parameters.
+// No return types.
+func (a *App) manageBuckets() {
+	done := make(map[string]bool)
+	for _, c := range a.dsCollections {
+		buckets, err := a.collectionBuckets(c)
+		if err != nil {
+			continue
+		}
+
+		for i := range buckets {
+			b := &buckets[i]
+			if b.First || done[b.Name] {
+				continue
+			}
+			done[b.Name] = true
+
+			if err := a.db.EnsureBucket(b); err != nil {
+				helpers.PrintErr(fmt.Sprintf("%s: failed to manage bucket - %v", b.Name, err))
+			}
+		}
+	}
+}
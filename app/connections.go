@@ -0,0 +1,76 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aretaja/idbdownsampler/config"
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// errConnections is returned by commands working on single connection when several are configured
+var errConnections = errors.New("several InfluxDB connections configured, select one with -connection")
+
+// initConnections initializes app of every configured InfluxDB connection.
+//
+// Parameters:
+//
+//	c: top level configuration
+//
+// Return type: error, invalid configuration of connection
+func (a *App) initConnections(c *config.Configuration) error {
+	names := make([]string, 0, len(c.Connections))
+	for n := range c.Connections {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	global := db.NewLimiter(c.QueryRate, c.QueryConc)
+
+	for _, n := range names {
+		helpers.PrintInfo(fmt.Sprintf("initializing connection %s", n))
+		ca := &App{
+			Version:     a.Version,
+			ConfFile:    a.ConfFile,
+			Collections: a.Collections,
+			DryRun:      a.DryRun,
+			Once:        a.Once,
+			name:        n,
+			preset:      c.ForConnection(n),
+			global:      global,
+		}
+		if err := ca.setup(); err != nil {
+			return fmt.Errorf("connection %s: %w", n, err)
+		}
+		a.conns = append(a.conns, ca)
+	}
+
+	return nil
+}
+
+// runConnections runs apps of all connections concurrently until they stop.
+//
+// No parameters.
+//
+// Return type: int64, count of failures of all connections
+func (a *App) runConnections() int64 {
+	var wg sync.WaitGroup
+	for _, ca := range a.conns {
+		wg.Add(1)
+		go func(ca *App) {
+			defer wg.Done()
+			ca.run()
+			helpers.PrintInfo(fmt.Sprintf("connection %s stopped", ca.name))
+		}(ca)
+	}
+	wg.Wait()
+
+	var n int64
+	for _, ca := range a.conns {
+		n += ca.failures.Load()
+	}
+
+	return n
+}
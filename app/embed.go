@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/aretaja/idbdownsampler/config"
+	"github.com/aretaja/idbdownsampler/status"
+)
+
+// InitializeWith initializes the App struct from given configuration instead of config file
+// and environment. Used when downsampler is embedded into other program.
+//
+// Parameters:
+//
+//	c: configuration
+//
+// Return type: error, invalid configuration
+func (a *App) InitializeWith(c *config.Configuration) error {
+	a.preset = c
+
+	return a.setup()
+}
+
+// Pass performs single downsampling pass of collection through all its tiers with own workers
+// and waits until it is done. Concurrent passes are serialized.
+//
+// Parameters:
+//
+//	ctx: context cancelling the pass
+//	c: string representing collection
+//
+// Return type: error, also when some instances failed
+func (a *App) Pass(ctx context.Context, c string) error {
+	if len(a.conns) > 0 {
+		return errConnections
+	}
+	if !a.hasCollection(c) {
+		return fmt.Errorf("unknown collection %s", c)
+	}
+	a.passMu.Lock()
+	defer a.passMu.Unlock()
+
+	buckets, err := a.collectionBuckets(c)
+	if err != nil {
+		return err
+	}
+
+	// Resource monitor lives as long as the pass
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a.ctx = ctx
+	a.db.SetContext(ctx)
+	a.startResMon()
+
+	once := a.Once
+	a.Once = true
+	defer func() { a.Once = once }()
+
+	a.queue = newWorkQueue()
+	a.tracker.SetQueueLen(a.queue.len)
+	a.tracker.SetGate(a.gateState)
+	workers := a.conf.Workers
+	if workers < 1 {
+		workers = 3
+	}
+	for col, s := range a.conf.Quotas {
+		a.queue.setLimit(col, int(math.Ceil(s*float64(workers))))
+	}
+	for g, l := range a.conf.GroupWorkers {
+		a.queue.setGroupLimit(g, l)
+	}
+	for n := 1; n <= workers; n++ {
+		a.workers.Add(1)
+		go a.worker(n)
+	}
+
+	before := a.failures.Load()
+	err = a.workOn(c, buckets)
+	a.queue.close()
+	a.workers.Wait()
+	a.saveState()
+
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		a.failures.Add(1)
+		return err
+	}
+	if n := a.failures.Load() - before; n > 0 {
+		return fmt.Errorf("%d instances of collection %s failed", n, c)
+	}
+
+	return nil
+}
+
+// Status returns snapshot of tracked downsampling state, empty for apps of several connections.
+//
+// No parameters.
+//
+// Return type: status.Snapshot
+func (a *App) Status() status.Snapshot {
+	if a.tracker == nil {
+		return status.Snapshot{}
+	}
+
+	return a.tracker.Snapshot()
+}
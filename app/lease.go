@@ -0,0 +1,180 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// leases of collections held by this process in lease bucket
+type leases struct {
+	mu     sync.Mutex
+	bucket string
+	ttl    time.Duration
+	owner  string
+	held   map[string]string // lease keys by collection
+}
+
+// newLeases returns empty leases with owner unique to this process.
+//
+// Parameters:
+//
+//	bucket string - the lease bucket name
+//	ttl time.Duration - lease lifetime
+//
+// Returns:
+//
+//	*leases - the leases
+func newLeases(bucket string, ttl time.Duration) *leases {
+	host, _ := os.Hostname()
+
+	return &leases{
+		bucket: bucket,
+		ttl:    ttl,
+		owner:  fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano()),
+		held:   make(map[string]string),
+	}
+}
+
+// keys returns lease keys of held collections.
+func (l *leases) keys() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	res := make([]string, 0, len(l.held))
+	for _, k := range l.held {
+		res = append(res, k)
+	}
+
+	return res
+}
+
+// drop stops renewing lease of collection, so it expires. Safe to call on nil leases.
+//
+// Parameters:
+//
+//	c string - the collection
+func (l *leases) drop(c string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, c)
+}
+
+// leaseKey returns lease key of collection. Shards of collection have own leases.
+//
+// Parameters:
+//
+//	c string - the collection
+//
+// Returns:
+//
+//	string - the lease key
+func (a *App) leaseKey(c string) string {
+	if a.conf.Shards > 1 {
+		return fmt.Sprintf("%s@%d", c, a.conf.Shard)
+	}
+
+	return c
+}
+
+// acquireLeases takes leases of collections. Fails when any of them is held by another process.
+// Leases are confirmed after write, so of two processes starting at the same time only one wins.
+// Does nothing when leases are disabled.
+//
+// Parameters:
+//
+//	cols []string - the collections
+//
+// Returns:
+//
+//	error - an error, if any
+func (a *App) acquireLeases(cols []string) error {
+	l := a.lease
+	if l == nil || len(cols) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(cols))
+	for _, c := range cols {
+		keys = append(keys, a.leaseKey(c))
+	}
+	check := func() error {
+		owners, err := a.db.LeaseOwners(l.bucket, l.ttl)
+		if err != nil {
+			return fmt.Errorf("can't read leases: %w", err)
+		}
+		for i, k := range keys {
+			if o, ok := owners[k]; ok && o != l.owner {
+				return fmt.Errorf("collection %s is leased by %s", cols[i], o)
+			}
+		}
+
+		return nil
+	}
+
+	if err := check(); err != nil {
+		return err
+	}
+	if err := a.db.WriteLeases(l.bucket, l.owner, keys); err != nil {
+		return fmt.Errorf("can't write leases: %w", err)
+	}
+	if !a.sleep(2 * time.Second) {
+		return a.ctx.Err()
+	}
+	if err := check(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	for i, c := range cols {
+		l.held[c] = keys[i]
+	}
+	l.mu.Unlock()
+	helpers.PrintInfo(fmt.Sprintf("leases of %d collections acquired as %s", len(cols), l.owner))
+
+	return nil
+}
+
+// startLeaseRenewal starts goroutine renewing held leases until app context is done.
+// Daemon is interrupted when another process has taken over any held lease.
+//
+// No parameters.
+// No return types.
+func (a *App) startLeaseRenewal() {
+	l := a.lease
+	ticker := time.NewTicker(l.ttl / 3)
+	ctx := a.ctx
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			keys := l.keys()
+			if len(keys) == 0 {
+				continue
+			}
+			owners, err := a.db.LeaseOwners(l.bucket, l.ttl)
+			if err != nil {
+				helpers.PrintWarn(fmt.Sprintf("can't read leases: %v", err))
+			}
+			for _, k := range keys {
+				if o, ok := owners[k]; ok && o != l.owner {
+					helpers.PrintFatal(fmt.Sprintf("lease %s taken over by %s, interrupting", k, o))
+				}
+			}
+			if err := a.db.WriteLeases(l.bucket, l.owner, keys); err != nil && ctx.Err() == nil {
+				helpers.PrintWarn(fmt.Sprintf("can't renew leases: %v", err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// newInstPrio is queue priority of instances which appeared since previous pass, ahead of all others
+var newInstPrio = math.Inf(1)
+
+// sleepWatch pauses collection between passes like sleepPass. When NewInstCheck is set, source
+// buckets are checked for new instances meanwhile and new ones are downsampled immediately.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	d: duration of pause
+//	buckets: bucket chain of collection
+//	cols: collections (measurements) of previous pass
+//	known: known instances of previous passes, new instances are added
+//
+// Return type: bool, false when interrupted by shutdown
+func (a *App) sleepWatch(c string, d time.Duration, buckets []db.Bucket, cols []string, known map[string]knownInst) bool {
+	check := time.Duration(a.conf.NewInstCheck) * time.Second
+	if check <= 0 {
+		return a.sleepPass(c, d)
+	}
+
+	end := time.Now().Add(d)
+	last := time.Now()
+	for {
+		rem := time.Until(end)
+		if rem <= 0 {
+			return true
+		}
+		t := time.NewTimer(min(rem, check))
+		select {
+		case <-a.ctx.Done():
+			t.Stop()
+			return false
+		case <-a.wakeCh(c):
+			t.Stop()
+			return true
+		case <-t.C:
+		}
+		if time.Until(end) <= 0 {
+			return true
+		}
+
+		now := time.Now()
+		fresh := a.newInstances(sources(buckets), cols, known, last, now)
+		last = now
+		if len(fresh) == 0 {
+			continue
+		}
+		if err := a.fastPass(c, buckets, fresh); err != nil {
+			if a.ctx.Err() != nil {
+				return false
+			}
+			helpers.PrintErr(fmt.Sprintf("collection %s: downsampling of new instances failed - %v", c, err))
+		}
+	}
+}
+
+// newInstances discovers instances which have appeared in source buckets in given time range
+// and are not known yet. New instances are added to known instances.
+//
+// Parameters:
+//
+//	srcs: source buckets
+//	cols: collections (measurements)
+//	known: known instances by collection and instance name
+//	st: start of the range
+//	stop: end of the range
+//
+// Return type: map[string][]db.Instance new instances by collection
+func (a *App) newInstances(srcs []*db.Bucket, cols []string, known map[string]knownInst, st, stop time.Time) map[string][]db.Instance {
+	res := make(map[string][]db.Instance)
+	for _, col := range cols {
+		for _, src := range srcs {
+			names, err := a.engine.DiscoverInstances(src, col, st.Add(-1*src.AInterv), stop)
+			if err != nil {
+				helpers.PrintErr(fmt.Sprintf("collection %s: discovery of new instances failed - %v", col, err))
+				continue
+			}
+			for _, name := range names {
+				k := col + "|" + name
+				if _, ok := known[k]; ok {
+					continue
+				}
+				inst := a.engine.NewInstance(src, name, col)
+				known[k] = knownInst{inst: inst, ts: stop}
+				res[col] = append(res[col], inst)
+				helpers.PrintInfo(fmt.Sprintf("collection %s: new instance %s of group %s", col, name, inst.Group))
+			}
+		}
+	}
+
+	return res
+}
+
+// fastPass downsamples given instances in all tiers of collection ahead of other work.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	buckets: bucket chain of collection
+//	instances: instances to downsample by collection
+//
+// Return type: error
+func (a *App) fastPass(c string, buckets []db.Bucket, instances map[string][]db.Instance) error {
+	ts := time.Now()
+	for i := range buckets {
+		b := &buckets[i]
+		if b.First {
+			continue
+		}
+
+		tw := newTierWork(c, b.Name)
+		var items []*workItem
+		for col, insts := range instances {
+			for _, inst := range insts {
+				tw.add()
+				items = append(items, &workItem{col: col, inst: inst, b: b, tw: tw})
+			}
+		}
+		a.scoreAll(items)
+		for _, it := range items {
+			it.prio = newInstPrio
+		}
+		a.queue.pushAll(items)
+		tw.seal()
+		select {
+		case <-tw.done:
+		case <-a.ctx.Done():
+			return a.ctx.Err()
+		}
+	}
+	helpers.PrintInfo(fmt.Sprintf("collection %s: new instances done, elapsed: %s", c, time.Since(ts).String()))
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/aretaja/idbdownsampler/config"
+	"github.com/aretaja/idbdownsampler/notify"
+)
+
+// notifier sends notification when instance fails repeatedly or collection pass aborts.
+// Methods are safe to call on nil notifier.
+type notifier struct {
+	mu     sync.Mutex
+	n      *notify.Notifier
+	conn   string         // connection name in multi-connection config
+	limit  int            // consecutive failures of instance in tier before notification
+	streak map[string]int // consecutive failures of instances in tiers
+}
+
+// newNotifier returns notifier sending to targets of configuration.
+//
+// Parameters:
+//
+//	c: *config.Configuration holding notification targets
+//	conn: connection name, empty in single connection config
+//
+// Return type: *notifier, error
+func newNotifier(c *config.Configuration, conn string) (*notifier, error) {
+	n, err := notify.New(notifyOptions(c))
+	if err != nil {
+		return nil, err
+	}
+
+	limit := 3
+	if c.NotifyFailures > 0 {
+		limit = c.NotifyFailures
+	}
+
+	return &notifier{n: n, conn: conn, limit: limit, streak: make(map[string]int)}, nil
+}
+
+// notifyOptions returns notification targets of configuration.
+//
+// Parameters:
+//
+//	c: *config.Configuration holding notification targets
+//
+// Return type: notify.Options
+func notifyOptions(c *config.Configuration) notify.Options {
+	o := notify.Options{
+		Webhook:      c.NotifyWebhook,
+		Format:       c.NotifyFormat,
+		SMTP:         c.NotifySMTP,
+		SMTPUser:     c.NotifySMTPUser,
+		SMTPPassword: c.NotifySMTPPass,
+		From:         c.NotifyFrom,
+	}
+	for _, t := range strings.Split(c.NotifyTo, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			o.To = append(o.To, t)
+		}
+	}
+
+	return o
+}
+
+// failure records failed downsampling of instance in tier. Notification is sent
+// when limit of consecutive failures is reached and again after every further limit.
+//
+// Parameters:
+//
+//	col: collection
+//	tier: destination bucket name
+//	inst: instance name
+//	err: downsample error
+//
+// No return types.
+func (n *notifier) failure(col, tier, inst string, err error) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	k := col + "/" + tier + "/" + inst
+	n.streak[k]++
+	cnt := n.streak[k]
+	n.mu.Unlock()
+
+	if cnt%n.limit != 0 {
+		return
+	}
+	n.n.Notify(notify.Notification{
+		Type:       notify.InstFailures,
+		Connection: n.conn,
+		Collection: col,
+		Tier:       tier,
+		Instance:   inst,
+		Failures:   cnt,
+		Message:    err.Error(),
+	})
+}
+
+// success clears failures of instance in tier.
+//
+// Parameters:
+//
+//	col: collection
+//	tier: destination bucket name
+//	inst: instance name
+//
+// No return types.
+func (n *notifier) success(col, tier, inst string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.streak, col+"/"+tier+"/"+inst)
+}
+
+// abort sends notification of aborted collection pass.
+//
+// Parameters:
+//
+//	col: collection
+//	err: error which aborted the pass
+//
+// No return types.
+func (n *notifier) abort(col string, err error) {
+	if n == nil {
+		return
+	}
+	n.n.Notify(notify.Notification{
+		Type:       notify.PassAbort,
+		Connection: n.conn,
+		Collection: col,
+		Message:    err.Error(),
+	})
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// memory gate thrash detector
+type thrashMon struct {
+	pauses      []time.Time
+	lastCapture time.Time
+}
+
+// memPaused registers pause by memory gate and captures profiles of itself
+// when gate was tripped more than configured times within an hour.
+//
+// No parameters.
+// No return values.
+func (a *App) memPaused() {
+	if a.conf.ProfPauses <= 0 {
+		return
+	}
+
+	now := time.Now()
+	t := &a.thrash
+	t.pauses = append(t.pauses, now)
+
+	// Forget pauses older than an hour
+	n := 0
+	for _, p := range t.pauses {
+		if now.Sub(p) < time.Hour {
+			t.pauses[n] = p
+			n++
+		}
+	}
+	t.pauses = t.pauses[:n]
+
+	if n <= a.conf.ProfPauses || now.Sub(t.lastCapture) < time.Hour {
+		return
+	}
+	t.lastCapture = now
+
+	s := a.db.InflightStats()
+	helpers.PrintWarn(fmt.Sprintf("memory gate tripped %d times within an hour, in-flight batches: %d, windows: %d, max windows: %d, max cardinality: %d, longest: %s (%s)",
+		n, s.Count, s.Windows, s.MaxWindows, s.MaxCard, s.Longest.String(), s.LongestInst))
+
+	for _, p := range []string{"heap", "goroutine"} {
+		f, err := writeProfile(a.conf.ProfDir, p, now)
+		if err != nil {
+			helpers.PrintErr(fmt.Sprintf("failed to capture %s profile: %v", p, err))
+			continue
+		}
+		helpers.PrintInfo(fmt.Sprintf("%s profile written to %s", p, f))
+	}
+}
+
+// writeProfile writes named pprof profile to file in given directory.
+//
+// Parameters:
+//
+//	dir string - target directory, system temp dir when empty
+//	name string - profile name
+//	ts time.Time - timestamp used in file name
+//
+// Returns:
+//
+//	string - file path
+//	error - an error, if any
+func writeProfile(dir, name string, ts time.Time) (string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	fn := filepath.Join(dir, fmt.Sprintf("idbdownsampler-%s-%s.pprof", name, ts.Format("20060102T150405")))
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return fn, err
+	}
+	defer f.Close()
+
+	err = pprof.Lookup(name).WriteTo(f, 0)
+	if err != nil {
+		return fn, err
+	}
+
+	return fn, nil
+}
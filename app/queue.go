@@ -0,0 +1,350 @@
+package app
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/db"
+)
+
+// downsample work item of instance in tier
+type workItem struct {
+	col    string
+	inst   db.Instance
+	b      *db.Bucket
+	prio   float64
+	lag    time.Duration // time since last downsampled window when queued
+	seq    uint64
+	tw     *tierWork
+	index  int
+	last   time.Time // last downsampled time when queued, zero when unknown
+	failed bool      // downsampling failed
+}
+
+// heap of work items, highest priority first
+type itemHeap []*workItem
+
+// before tells if work item a is handed out before b.
+func before(a, b *workItem) bool {
+	if a.prio != b.prio {
+		return a.prio > b.prio
+	}
+	return a.seq < b.seq
+}
+
+func (h itemHeap) Len() int { return len(h) }
+
+func (h itemHeap) Less(i, j int) bool { return before(h[i], h[j]) }
+
+func (h itemHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *itemHeap) Push(x interface{}) {
+	it := x.(*workItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	it.index = -1
+	*h = old[:n-1]
+	return it
+}
+
+// key of work items which share collection quota and group limit and can be taken together
+type queueKey struct {
+	col   string
+	tw    *tierWork
+	b     *db.Bucket
+	group string
+}
+
+// keyOf returns queue key of work item.
+func keyOf(it *workItem) queueKey {
+	return queueKey{col: it.col, tw: it.tw, b: it.b, group: it.inst.Group}
+}
+
+// shared priority queue of work items. Items are kept in heap per queue key, so the heads of
+// heaps whose collection and cardinality group are within limits are the only candidates when
+// handing out items. Items of collection with quota or of cardinality group with worker limit
+// are not handed out while collection or group has its share of workers busy.
+type workQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	heaps    map[queueKey]*itemHeap
+	n        int
+	seq      uint64
+	limits   map[string]int
+	running  map[string]int
+	gLimits  map[string]int
+	gRunning map[string]int
+	closed   bool
+}
+
+// newWorkQueue returns new empty work queue.
+func newWorkQueue() *workQueue {
+	q := &workQueue{
+		heaps:    make(map[queueKey]*itemHeap),
+		limits:   make(map[string]int),
+		running:  make(map[string]int),
+		gLimits:  make(map[string]int),
+		gRunning: make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// add adds work item to heap of its key. Caller must hold the lock.
+func (q *workQueue) add(it *workItem) {
+	q.seq++
+	it.seq = q.seq
+	k := keyOf(it)
+	h, ok := q.heaps[k]
+	if !ok {
+		h = &itemHeap{}
+		q.heaps[k] = h
+	}
+	heap.Push(h, it)
+	q.n++
+}
+
+// push adds work item to the queue.
+func (q *workQueue) push(it *workItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(it)
+	q.cond.Signal()
+}
+
+// pushAll adds work items to the queue at once.
+func (q *workQueue) pushAll(items []*workItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, it := range items {
+		q.add(it)
+	}
+	q.cond.Broadcast()
+}
+
+// setLimit sets max count of concurrently processed work items of collection.
+func (q *workQueue) setLimit(col string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits[col] = n
+}
+
+// setGroupLimit sets max count of concurrently processed work items of cardinality group.
+func (q *workQueue) setGroupLimit(group string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.gLimits[group] = n
+}
+
+// eligible returns key of heap whose head has highest priority among heads of heaps whose
+// collection and cardinality group are within their limits. Returns false when there is none.
+// Caller must hold the lock.
+func (q *workQueue) eligible() (queueKey, bool) {
+	var best queueKey
+	var head *workItem
+	for k, h := range q.heaps {
+		if l, ok := q.limits[k.tw.col]; ok && q.running[k.tw.col] >= l {
+			continue
+		}
+		if l, ok := q.gLimits[k.group]; ok && q.gRunning[k.group] >= l {
+			continue
+		}
+		if head == nil || before((*h)[0], head) {
+			best, head = k, (*h)[0]
+		}
+	}
+
+	return best, head != nil
+}
+
+// remove pops up to n work items with highest priority from heap of key, empty heap is dropped.
+// Caller must hold the lock.
+func (q *workQueue) remove(k queueKey, n int) []*workItem {
+	h, ok := q.heaps[k]
+	if !ok {
+		return nil
+	}
+	var res []*workItem
+	for len(res) < n && h.Len() > 0 {
+		res = append(res, heap.Pop(h).(*workItem))
+	}
+	if h.Len() == 0 {
+		delete(q.heaps, k)
+	}
+	q.n -= len(res)
+
+	return res
+}
+
+// pop removes and returns work item with highest priority within collection quotas and group limits.
+// Blocks until item is available. Returned item must be released by done.
+// Returns nil when queue is closed.
+func (q *workQueue) pop() *workItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	k, ok := q.eligible()
+	for !ok && !q.closed {
+		q.cond.Wait()
+		k, ok = q.eligible()
+	}
+	if q.closed {
+		return nil
+	}
+
+	it := q.remove(k, 1)[0]
+	q.running[it.tw.col]++
+	q.gRunning[it.inst.Group]++
+
+	return it
+}
+
+// take removes and returns up to n queued work items of the same collection, tier, destination
+// bucket and cardinality group as given item, highest priority first. Taken items are processed by
+// worker of given item, so they use its place in collection quota and group limit and are not
+// released by done.
+func (q *workQueue) take(it *workItem, n int) []*workItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.remove(keyOf(it), n)
+}
+
+// done releases quota and group limit of processed work item.
+func (q *workQueue) done(it *workItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[it.tw.col]--
+	q.gRunning[it.inst.Group]--
+	q.cond.Broadcast()
+}
+
+// close wakes up and stops all consumers, queued items are dropped.
+func (q *workQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// len returns count of queued items.
+func (q *workQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.n
+}
+
+// outstanding work items of tier. Unlike sync.WaitGroup allows adding
+// items while waiting for completion.
+type tierWork struct {
+	mu     sync.Mutex
+	col    string
+	tier   string
+	n      int
+	total  int
+	fin    int
+	done   chan struct{}
+	groups map[string]*groupStats
+	skip   map[string]bool // cardinality groups skipped in tier by group interval
+}
+
+// summary of processed items of cardinality group
+type groupStats struct {
+	insts    int
+	failures int
+	work     time.Duration
+	maxLag   time.Duration
+}
+
+// newTierWork returns tier work of collection holding one reference released by seal.
+func newTierWork(col, tier string) *tierWork {
+	return &tierWork{col: col, tier: tier, n: 1, done: make(chan struct{}), groups: make(map[string]*groupStats), skip: make(map[string]bool)}
+}
+
+// record adds processed item to summary of its cardinality group.
+func (t *tierWork) record(group string, work, lag time.Duration, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.groups[group]
+	if !ok {
+		g = &groupStats{}
+		t.groups[group] = g
+	}
+	g.insts++
+	if failed {
+		g.failures++
+	}
+	g.work += work
+	if lag > g.maxLag {
+		g.maxLag = lag
+	}
+}
+
+// stats returns copy of summaries of cardinality groups.
+func (t *tierWork) stats() map[string]groupStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make(map[string]groupStats, len(t.groups))
+	for n, g := range t.groups {
+		res[n] = *g
+	}
+
+	return res
+}
+
+// add registers new outstanding item. Returns false when tier is already done.
+func (t *tierWork) add() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n == 0 {
+		return false
+	}
+	t.n++
+	t.total++
+
+	return true
+}
+
+// finish marks item as done.
+func (t *tierWork) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fin++
+	t.release()
+}
+
+// seal releases the initial reference after initial items are added.
+func (t *tierWork) seal() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.release()
+}
+
+// release decrements outstanding count. Caller must hold the lock.
+func (t *tierWork) release() {
+	t.n--
+	if t.n == 0 {
+		close(t.done)
+	}
+}
+
+// progress returns counts of done and all items.
+func (t *tierWork) progress() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.fin, t.total
+}
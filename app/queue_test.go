@@ -0,0 +1,160 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/aretaja/idbdownsampler/db"
+)
+
+// item returns work item of instance in group of tier work with given priority.
+func item(tw *tierWork, b *db.Bucket, name, group string, prio float64) *workItem {
+	return &workItem{col: tw.col, inst: db.Instance{Name: name, Group: group}, b: b, tw: tw, prio: prio}
+}
+
+// next returns work item pop would hand out without blocking, nil when none is eligible.
+func next(q *workQueue) *workItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	k, ok := q.eligible()
+	if !ok {
+		return nil
+	}
+
+	return (*q.heaps[k])[0]
+}
+
+// mustPop pops work item and checks it is the expected one.
+func mustPop(t *testing.T, q *workQueue, want string) *workItem {
+	t.Helper()
+	if it := next(q); it == nil || it.inst.Name != want {
+		t.Fatalf("next item %v, want %s", it, want)
+	}
+
+	return q.pop()
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := newWorkQueue()
+	b := &db.Bucket{Name: "t1"}
+	ta, tb := newTierWork("a", "t1"), newTierWork("b", "t1")
+	q.pushAll([]*workItem{
+		item(ta, b, "a1", "light", 1),
+		item(tb, b, "b1", "hevy", 5),
+		item(ta, b, "a2", "medium", 3),
+		item(ta, b, "a3", "light", 3),
+	})
+
+	// Equal priority is handed out in order of queueing
+	for _, want := range []string{"b1", "a2", "a3", "a1"} {
+		mustPop(t, q, want)
+	}
+	if n := q.len(); n != 0 {
+		t.Errorf("len() = %d after all popped", n)
+	}
+}
+
+func TestQueueQuota(t *testing.T) {
+	q := newWorkQueue()
+	q.setLimit("a", 1)
+	b := &db.Bucket{Name: "t1"}
+	ta, tb := newTierWork("a", "t1"), newTierWork("b", "t1")
+	q.pushAll([]*workItem{
+		item(ta, b, "a1", "light", 10),
+		item(ta, b, "a2", "medium", 9),
+		item(tb, b, "b1", "light", 1),
+	})
+
+	a1 := mustPop(t, q, "a1")
+	// Collection a has its share busy, so lower priority item of b goes first
+	mustPop(t, q, "b1")
+	if it := next(q); it != nil {
+		t.Fatalf("next item %s while quota of collection a is busy", it.inst.Name)
+	}
+	q.done(a1)
+	mustPop(t, q, "a2")
+}
+
+func TestQueueGroupLimit(t *testing.T) {
+	q := newWorkQueue()
+	q.setGroupLimit("hevy", 1)
+	b := &db.Bucket{Name: "t1"}
+	ta, tb := newTierWork("a", "t1"), newTierWork("b", "t1")
+	q.pushAll([]*workItem{
+		item(ta, b, "a1", "hevy", 10),
+		item(tb, b, "b1", "hevy", 9),
+		item(ta, b, "a2", "light", 1),
+	})
+
+	h := mustPop(t, q, "a1")
+	// Limit of group applies across collections
+	mustPop(t, q, "a2")
+	if it := next(q); it != nil {
+		t.Fatalf("next item %s while hevy group limit is busy", it.inst.Name)
+	}
+	q.done(h)
+	mustPop(t, q, "b1")
+}
+
+func TestQueueTake(t *testing.T) {
+	q := newWorkQueue()
+	q.setLimit("a", 1)
+	b1, b2 := &db.Bucket{Name: "t1"}, &db.Bucket{Name: "t2"}
+	ta, ta2 := newTierWork("a", "t1"), newTierWork("a", "t2")
+	q.pushAll([]*workItem{
+		item(ta, b1, "l1", "light", 5),
+		item(ta, b1, "l2", "light", 2),
+		item(ta, b1, "l3", "light", 4),
+		item(ta, b1, "l4", "light", 3),
+		item(ta, b1, "m1", "medium", 9),
+		item(ta2, b2, "x1", "light", 1),
+	})
+
+	m := mustPop(t, q, "m1")
+	q.done(m)
+	it := mustPop(t, q, "l1")
+
+	// Only items of the same tier, bucket and group are taken, highest priority first
+	got := q.take(it, 2)
+	if len(got) != 2 || got[0].inst.Name != "l3" || got[1].inst.Name != "l4" {
+		t.Fatalf("take() = %v, want l3, l4", got)
+	}
+	if n := q.len(); n != 2 {
+		t.Errorf("len() = %d after take, want 2", n)
+	}
+
+	// Taken items use place of popped item
+	if r := q.running["a"]; r != 1 {
+		t.Errorf("running of collection a = %d after take, want 1", r)
+	}
+	if r := q.gRunning["light"]; r != 1 {
+		t.Errorf("running of light group = %d after take, want 1", r)
+	}
+	if it := next(q); it != nil {
+		t.Fatalf("next item %s while quota of collection a is busy", it.inst.Name)
+	}
+	q.done(it)
+	if r := q.running["a"]; r != 0 {
+		t.Errorf("running of collection a = %d after done, want 0", r)
+	}
+
+	// Rest is taken up to what is left, emptied heap is dropped
+	l2 := mustPop(t, q, "l2")
+	if got := q.take(l2, 5); len(got) != 0 {
+		t.Errorf("take() = %v from empty heap", got)
+	}
+	if _, ok := q.heaps[keyOf(l2)]; ok {
+		t.Error("empty heap of taken items kept")
+	}
+	q.done(l2)
+	mustPop(t, q, "x1")
+}
+
+func TestQueueClose(t *testing.T) {
+	q := newWorkQueue()
+	res := make(chan *workItem)
+	go func() { res <- q.pop() }()
+	q.close()
+	if it := <-res; it != nil {
+		t.Errorf("pop() = %v after close, want nil", it)
+	}
+}
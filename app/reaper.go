@@ -0,0 +1,115 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// startReaper starts goroutine which periodically deletes series of decommissioned
+// instances from destination buckets of configured collections.
+//
+// No parameters.
+// No return types.
+func (a *App) startReaper() {
+	interv := 24 * time.Hour
+	if a.conf.ReapInterval > 0 {
+		interv = time.Duration(a.conf.ReapInterval) * time.Second
+	}
+
+	go func() {
+		for {
+			a.reap()
+			if !a.sleep(interv) {
+				return
+			}
+		}
+	}()
+}
+
+// reap deletes series of instances which have no data for ReapAfter days in any bucket of chain
+// from destination buckets. Only reports what would be removed when ReapDryRun is set.
+//
+// No parameters.
+// No return types.
+func (a *App) reap() {
+	now := time.Now()
+	since := now.AddDate(0, 0, -a.conf.ReapAfter)
+	dryRun := a.conf.ReapDryRun || a.db.DryRun
+
+	for _, c := range a.collections() {
+		buckets, err := a.collectionBuckets(c)
+		if err != nil {
+			continue
+		}
+		cols, err := a.expand(c, &buckets[0])
+		if err != nil {
+			helpers.PrintErr(fmt.Sprintf("reaper: collection %s - %v", c, err))
+			continue
+		}
+
+		for _, col := range cols {
+			// Instances with data in reap period in any tier. Source buckets may keep data for
+			// shorter time than reap period, so the newest point can be in destination only
+			active := make(map[string]bool)
+			failed := false
+			tiers := sources(buckets)
+			for i := range buckets {
+				if !buckets[i].First {
+					tiers = append(tiers, &buckets[i])
+				}
+			}
+			for _, t := range tiers {
+				names, err := a.engine.DiscoverInstances(t, col, since, now)
+				if err != nil {
+					helpers.PrintErr(fmt.Sprintf("reaper: %s, %s: discovery failed - %v", t.Name, col, err))
+					failed = true
+					break
+				}
+				for _, n := range names {
+					active[n] = true
+				}
+			}
+			// Source outage must not wipe destinations
+			if failed || len(active) == 0 {
+				helpers.PrintWarn(fmt.Sprintf("reaper: no active instances of %s found, skipped", col))
+				continue
+			}
+
+			for i := range buckets {
+				b := &buckets[i]
+				if b.First {
+					continue
+				}
+
+				// Wait for resources
+				if !a.db.Resources.Open() {
+					helpers.PrintDbg("pause reaper, no resources available")
+				}
+				if a.db.Resources.Wait(a.ctx) != nil {
+					return
+				}
+
+				st := time.Unix(0, 0)
+				if b.RPeriod > 0 {
+					st = now.Add(-1 * b.RPeriod)
+				}
+				names, err := a.engine.DiscoverInstances(b, col, st, now)
+				if err != nil {
+					helpers.PrintErr(fmt.Sprintf("reaper: %s, %s: discovery failed - %v", b.Name, col, err))
+					continue
+				}
+				for _, n := range names {
+					if active[n] {
+						continue
+					}
+					helpers.PrintInfo(fmt.Sprintf("reaper: %s, %s: instance %s has no data since %s, deleting", b.Name, col, n, since.Format(time.DateOnly)))
+					if err := a.db.PurgeInstance(b, n, col, dryRun); err != nil {
+						helpers.PrintErr(fmt.Sprintf("reaper: %s, %s: %v", b.Name, n, err))
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// instance of collection with time of its last cardinality query
+type knownInst struct {
+	inst  db.Instance
+	ts    time.Time
+	fresh bool // appeared since previous pass
+}
+
+// passInstances returns recently active instances of collections in source buckets with their
+// cardinality groups. Cardinality of instance known from previous passes is re-queried when
+// CardRefresh has elapsed, on every pass by default, group is re-evaluated on every pass.
+// Instances which are not active any more are dropped from known instances, instances which
+// appeared since previous pass are marked as fresh.
+//
+// Parameters:
+//
+//	cols: collections of pass
+//	srcs: source buckets
+//	known: known instances of previous passes by collection and instance name, updated in place
+//
+// Return type: map[string][]db.Instance instances by collection, int count of instances, error
+func (a *App) passInstances(cols []string, srcs []*db.Bucket, known map[string]knownInst) (map[string][]db.Instance, int, error) {
+	iv := time.Duration(a.conf.CardRefresh) * time.Second
+	first := len(known) == 0
+	instances := make(map[string][]db.Instance)
+	seen := make(map[string]bool)
+	count := 0
+	for _, col := range cols {
+		for _, src := range srcs {
+			now := time.Now()
+			names, err := a.engine.DiscoverInstances(src, col, now.Add(-10*src.AInterv), now)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, name := range names {
+				k := col + "|" + name
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+
+				prev, ok := known[k]
+				var inst db.Instance
+				switch {
+				case ok && iv > 0 && now.Sub(prev.ts) < iv:
+					// Cardinality levels may have changed by reload
+					inst = prev.inst
+					inst.Group = a.engine.CardGroup(inst.Card)
+					prev.inst = inst
+				default:
+					inst = a.engine.NewInstance(src, name, col)
+					prev = knownInst{inst: inst, ts: now}
+				}
+				prev.fresh = !ok && !first
+				switch {
+				case !ok:
+					helpers.PrintDbg(fmt.Sprintf("collection %s: instance %s added to group %s", col, name, inst.Group))
+				case known[k].inst.Group != inst.Group:
+					helpers.PrintInfo(fmt.Sprintf("collection %s: instance %s moved from group %s to %s, cardinality %d",
+						col, name, known[k].inst.Group, inst.Group, inst.Card))
+				}
+				known[k] = prev
+				instances[col] = append(instances[col], inst)
+			}
+		}
+		count += len(instances[col])
+	}
+
+	for k, v := range known {
+		if !seen[k] {
+			helpers.PrintInfo(fmt.Sprintf("instance %s of group %s not active any more, dropped", k, v.inst.Group))
+			delete(known, k)
+		}
+	}
+
+	return instances, count, nil
+}
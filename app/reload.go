@@ -0,0 +1,253 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aretaja/idbdownsampler/config"
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// errRemoved is returned by collection work loop when collection is removed by reload
+var errRemoved = errors.New("collection removed from configuration")
+
+// settings changeable by reload. Published as immutable snapshot, so maps and slices must not be
+// modified after publishing
+type settings struct {
+	cardLookbacks  map[string]int
+	cardLookback   int
+	queryTimeouts  map[string]int
+	queryTimeout   int
+	discTimeouts   map[string]int
+	discTimeout    int
+	cardTimeouts   map[string]int
+	cardTimeout    int
+	maxTasks       int
+	taskLabels     []string
+	intervals      map[string]int
+	passInterval   int
+	passJitter     int
+	tierIntervals  map[string]int
+	groupPrio      map[string]float64
+	groupIntervals map[string]int
+	lightBatch     int
+	rediscover     int
+	lagThreshold   int
+}
+
+// newSettings returns reloadable settings of configuration.
+//
+// Parameters:
+//
+//	c: configuration
+//
+// Return type: *settings
+func newSettings(c *config.Configuration) *settings {
+	return &settings{
+		cardLookbacks:  c.CardLookbacks,
+		cardLookback:   c.CardLookback,
+		queryTimeouts:  c.QueryTimeouts,
+		queryTimeout:   c.QueryTimeout,
+		discTimeouts:   c.DiscTimeouts,
+		discTimeout:    c.DiscTimeout,
+		cardTimeouts:   c.CardTimeouts,
+		cardTimeout:    c.CardTimeout,
+		maxTasks:       c.MaxTasks,
+		taskLabels:     c.TaskLabels,
+		intervals:      c.Intervals,
+		passInterval:   c.PassInterval,
+		passJitter:     c.PassJitter,
+		tierIntervals:  c.TierIntervals,
+		groupPrio:      c.GroupPriority,
+		groupIntervals: c.GroupIntervals,
+		lightBatch:     c.LightBatch,
+		rediscover:     c.Rediscover,
+		lagThreshold:   c.LagThreshold,
+	}
+}
+
+// live returns current reloadable settings. Safe for concurrent use.
+//
+// No parameters.
+//
+// Return type: *settings
+func (a *App) live() *settings {
+	return a.set.Load()
+}
+
+// reloadable settings of re-read configuration
+type reloadSet struct {
+	collections []string // nil when collection list is not changed
+	chains      map[string][]db.Bucket
+	set         *settings
+	tun         db.Tunables
+}
+
+// reload re-reads configuration and validates its reloadable settings. Settings are applied by
+// workers at next instance boundary, bucket chains and collection list from next pass of
+// collection. Work in progress is not interrupted.
+//
+// No parameters.
+//
+// Return type: error, unreadable or invalid configuration
+func (a *App) reload() error {
+	if a.preset != nil && a.name == "" {
+		return errors.New("configuration not read from file")
+	}
+	c, err := a.readConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %v", err)
+	}
+	if a.name != "" {
+		if _, ok := c.Connections[a.name]; !ok {
+			return fmt.Errorf("unknown connection %s", a.name)
+		}
+		c = c.ForConnection(a.name)
+	}
+	// Reloaded configuration must pass the same checks as on start
+	c = overrides(c, a.Collections, a.DryRun)
+	if err := validate(c); err != nil {
+		return err
+	}
+
+	r := &reloadSet{set: newSettings(c), tun: a.db.Tunables()}
+	if c.MemLimit > 0 {
+		r.tun.MemLimit = c.MemLimit
+	}
+	if c.CardMedium > 0 {
+		r.tun.CardMedium = c.CardMedium
+	}
+	if c.CardHevy > 0 {
+		r.tun.CardHevy = c.CardHevy
+	}
+	r.tun.Include, err = instFilters("include", c.Include)
+	if err != nil {
+		return err
+	}
+	r.tun.Exclude, err = instFilters("exclude", c.Exclude)
+	if err != nil {
+		return err
+	}
+	r.chains, err = buildChains(c)
+	if err != nil {
+		return err
+	}
+
+	// Collections set by command line are kept, declarative collections are not reloaded
+	if cols := strings.Split(c.DsCollections, ","); a.Collections == "" && !slices.Equal(cols, a.collections()) {
+		if a.Once {
+			return errors.New("collection list can't be changed during single pass")
+		}
+		for _, n := range cols {
+			if _, ok := c.Specs[n]; ok && a.db.Specs[n] == nil {
+				return fmt.Errorf("new declarative collection %s requires restart", n)
+			}
+			if _, ok := r.chains[n]; ok {
+				continue
+			}
+			if _, err := a.collectionBuckets(n); err != nil {
+				return err
+			}
+		}
+		r.collections = cols
+	}
+
+	a.pending.Store(r)
+	helpers.PrintInfo("configuration re-read, applied at next instance boundary")
+
+	return nil
+}
+
+// applyReload applies pending reloaded settings if there are some.
+//
+// No parameters.
+// No return types.
+func (a *App) applyReload() {
+	r := a.pending.Swap(nil)
+	if r == nil {
+		return
+	}
+
+	a.db.SetTunables(r.tun)
+	a.set.Store(r.set)
+
+	a.colMu.Lock()
+	a.chains = r.chains
+	var added []string
+	if r.collections != nil {
+		for _, n := range r.collections {
+			if !slices.Contains(a.dsCollections, n) {
+				added = append(added, n)
+				a.wake[n] = make(chan struct{}, 1)
+			}
+		}
+		for _, n := range a.dsCollections {
+			if !slices.Contains(r.collections, n) {
+				delete(a.wake, n)
+			}
+		}
+		a.dsCollections = r.collections
+		a.tracker.UpdateCollections(r.collections)
+	}
+	a.colMu.Unlock()
+	a.chainGen.Add(1)
+
+	// Added collections start their own passes
+	for _, n := range added {
+		b, err := a.collectionBuckets(n)
+		if err != nil {
+			helpers.PrintErr(fmt.Sprintf("can't get buckets for collection %s: %v", n, err))
+			continue
+		}
+		if err := a.acquireLeases([]string{n}); err != nil {
+			helpers.PrintErr(fmt.Sprintf("can't start collection %s added by reload: %v", n, err))
+			continue
+		}
+		helpers.PrintInfo(fmt.Sprintf("collection %s added by reload", n))
+		a.startCollection(n, b)
+	}
+	helpers.PrintInfo("reloaded configuration applied")
+}
+
+// collections returns copy of downsampled collections.
+//
+// No parameters.
+//
+// Return type: []string
+func (a *App) collections() []string {
+	a.colMu.Lock()
+	defer a.colMu.Unlock()
+
+	return slices.Clone(a.dsCollections)
+}
+
+// hasCollection checks if collection is downsampled.
+//
+// Parameters:
+//
+//	c: string representing collection
+//
+// Return type: bool
+func (a *App) hasCollection(c string) bool {
+	a.colMu.Lock()
+	defer a.colMu.Unlock()
+
+	return slices.Contains(a.dsCollections, c)
+}
+
+// wakeCh returns pass trigger channel of collection, nil for unknown collection.
+//
+// Parameters:
+//
+//	c: string representing collection
+//
+// Return type: chan struct{}
+func (a *App) wakeCh(c string) chan struct{} {
+	a.colMu.Lock()
+	defer a.colMu.Unlock()
+
+	return a.wake[c]
+}
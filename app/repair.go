@@ -0,0 +1,115 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Repair scans destination tiers of collection for windows without aggregated data while
+// source data exists and re-aggregates just these gaps. Only windows already passed by
+// regular downsampling are checked. Stops on SIGINT or SIGTERM.
+//
+// Parameters:
+//
+//	c string - the collection
+//	tier string - only repair destination bucket of this name, all tiers when empty
+//	from time.Time - range start, retention period of source bucket back from now when zero
+//	to time.Time - range stop, now when zero
+//
+// Returns:
+//
+//	error - an error, if any
+func (a *App) Repair(c, tier string, from, to time.Time) error {
+	if len(a.conns) > 0 {
+		return errConnections
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	a.ctx = ctx
+	a.db.SetContext(ctx)
+	a.startResMon()
+
+	buckets, err := a.collectionBuckets(c)
+	if err != nil {
+		return err
+	}
+	cols, err := a.expand(c, &buckets[0])
+	if err != nil {
+		return fmt.Errorf("can't get measurements for collection %s: %w", c, err)
+	}
+
+	found := false
+	failures := 0
+	for bi := range buckets {
+		b := &buckets[bi]
+		if b.First || (tier != "" && b.Name != tier) {
+			continue
+		}
+		found = true
+
+		// Gaps can only be repaired while source data exists
+		st := from
+		if oldest := time.Now().Add(-b.From.RPeriod); st.Before(oldest) {
+			st = oldest
+		}
+		if !st.Before(to) {
+			continue
+		}
+
+		for _, col := range cols {
+			insts, err := a.engine.DiscoverInstances(b.From, col, st, to)
+			if err != nil {
+				return fmt.Errorf("can't get instances of %s in %s: %w", col, b.From.Name, err)
+			}
+			helpers.PrintInfo(fmt.Sprintf("repair %s, %s: %d instances", b.Name, col, len(insts)))
+
+			for _, inst := range insts {
+				// Windows after last downsampled one are left to regular downsampling
+				stop := to
+				last, err := a.engine.LastDownsampled(b, inst, col)
+				if err != nil {
+					failures++
+					helpers.PrintErr(fmt.Sprintf("repair %s, %s, %s: %v", b.Name, col, inst, err))
+					continue
+				}
+				if last.Before(stop) {
+					stop = last
+				}
+
+				n, err := a.db.RepairGaps(b, inst, col, st, stop)
+				if ctx.Err() != nil {
+					a.saveState()
+					return ctx.Err()
+				}
+				if err != nil {
+					failures++
+					helpers.PrintErr(fmt.Sprintf("repair %s, %s, %s: %v", b.Name, col, inst, err))
+					continue
+				}
+				if n > 0 {
+					helpers.PrintInfo(fmt.Sprintf("repair %s, %s, %s: %d windows re-aggregated", b.Name, col, inst, n))
+				}
+			}
+		}
+	}
+	a.saveState()
+
+	switch {
+	case !found:
+		return fmt.Errorf("no destination tier %s of collection %s", tier, c)
+	case failures > 0:
+		return fmt.Errorf("%d instances failed", failures)
+	}
+
+	return nil
+}
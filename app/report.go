@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// reportTier writes summary of finished tier pass per cardinality group to stats bucket.
+// Write errors are only logged, reporting never fails the pass.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	tw: *tierWork holding summaries of processed items
+//	d: time.Duration of the pass in tier
+//
+// No return types.
+func (a *App) reportTier(c string, tw *tierWork, d time.Duration) {
+	if a.conf.ReportBucket == "" {
+		return
+	}
+	meas := a.conf.ReportMeas
+	if meas == "" {
+		meas = "idbdownsampler_pass"
+	}
+
+	groups := tw.stats()
+	names := make([]string, 0, len(groups))
+	for n := range groups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	stats := make([]db.PassStats, 0, len(names))
+	for _, n := range names {
+		g := groups[n]
+		stats = append(stats, db.PassStats{
+			Collection: c,
+			Tier:       tw.tier,
+			Group:      n,
+			Connection: a.name,
+			Instances:  g.insts,
+			Failures:   g.failures,
+			Duration:   d,
+			Work:       g.work,
+			MaxLag:     g.maxLag,
+			Time:       now,
+		})
+	}
+	if len(stats) == 0 {
+		return
+	}
+
+	if err := a.db.WritePassStats(a.conf.ReportBucket, meas, stats); err != nil {
+		helpers.PrintErr(fmt.Sprintf("collection %s, bucket %s: can't write pass summary - %v", c, tw.tier, err))
+	}
+}
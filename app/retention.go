@@ -0,0 +1,70 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// startRetention starts goroutine which periodically deletes data older than
+// retention period from destination buckets of configured collections.
+//
+// No parameters.
+// No return types.
+func (a *App) startRetention() {
+	interv := 24 * time.Hour
+	if a.conf.RetInterval > 0 {
+		interv = time.Duration(a.conf.RetInterval) * time.Second
+	}
+
+	go func() {
+		for {
+			a.enforceRetention()
+			if !a.sleep(interv) {
+				return
+			}
+		}
+	}()
+}
+
+// enforceRetention deletes data older than retention period from destination buckets.
+// Only reports what would be removed in dry-run mode.
+//
+// No parameters.
+// No return types.
+func (a *App) enforceRetention() {
+	done := make(map[string]bool)
+	for _, c := range a.collections() {
+		buckets, err := a.collectionBuckets(c)
+		if err != nil {
+			continue
+		}
+
+		for i := range buckets {
+			b := &buckets[i]
+			if b.First || done[b.Name] {
+				continue
+			}
+			done[b.Name] = true
+
+			// Wait for resources
+			if !a.db.Resources.Open() {
+				helpers.PrintDbg("pause retention enforcement, no resources available")
+			}
+			if a.db.Resources.Wait(a.ctx) != nil {
+				return
+			}
+
+			n, cutoff, err := a.db.EnforceRetention(b, a.conf.RetDryRun)
+			switch {
+			case err != nil:
+				helpers.PrintErr(fmt.Sprintf("%s: failed to enforce retention - %v", b.Name, err))
+			case a.conf.RetDryRun:
+				helpers.PrintInfo(fmt.Sprintf("%s: dry-run, would remove %d points older than %s", b.Name, n, cutoff.Format(time.RFC3339)))
+			default:
+				helpers.PrintInfo(fmt.Sprintf("%s: removed data older than %s", b.Name, cutoff.Format(time.RFC3339)))
+			}
+		}
+	}
+}
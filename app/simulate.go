@@ -0,0 +1,125 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// simulated effort of one tier
+type simTier struct {
+	name      string
+	instances int
+	windows   int64
+	queries   int64
+	inPoints  int64
+	outPoints int64
+}
+
+// Simulate estimates downsampling effort per tier of configured collections without executing any writes.
+// Uses current lag and cardinality of instances.
+//
+// Parameters:
+//
+//	from time.Time - assume destination tiers have no data after this time (backfill), ignored when zero
+//	empty bool - assume destination tiers are empty (new chain)
+//
+// Returns:
+//
+//	error - an error, if any
+func (a *App) Simulate(from time.Time, empty bool) error {
+	if len(a.conns) > 0 {
+		return errConnections
+	}
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tTIER\tINSTANCES\tWINDOWS\tQUERIES\tIN POINTS\tOUT SERIES*WINDOWS")
+
+	for _, c := range a.dsCollections {
+		buckets, err := a.collectionBuckets(c)
+		if err != nil {
+			return err
+		}
+
+		cols, err := a.expand(c, &buckets[0])
+		if err != nil {
+			return fmt.Errorf("can't get measurements for collection %s: %w", c, err)
+		}
+
+		groups := make(map[string][]string)
+		for _, col := range cols {
+			g, err := a.db.GetDsInstances(&buckets[0], col)
+			if err != nil {
+				return fmt.Errorf("can't get instances for collection %s: %w", col, err)
+			}
+			for _, v := range g {
+				groups[col] = append(groups[col], v...)
+			}
+		}
+
+		for bi := range buckets {
+			b := buckets[bi]
+			if b.First {
+				continue
+			}
+			st := simTier{name: b.Name}
+
+			for col, instances := range groups {
+				for _, inst := range instances {
+					helpers.PrintDbg(fmt.Sprintf("simulate %s, %s, %s", col, b.Name, inst))
+					st.instances++
+
+					// Last time in source
+					sLast, err := a.engine.LastTS(b.From, inst, col)
+					if err != nil {
+						helpers.PrintWarn(fmt.Sprintf("%s, %s: error getting last measurement time - %v; skipping instance", b.From.Name, inst, err))
+						continue
+					}
+
+					// Last time in destination
+					var dLast time.Time
+					switch {
+					case !from.IsZero():
+						dLast = from
+					case empty:
+						dLast = now.Add(-1 * b.RPeriod)
+					default:
+						dLast, err = a.engine.LastTS(&b, inst, col)
+						if err != nil {
+							helpers.PrintWarn(fmt.Sprintf("%s, %s: error getting last measurement time - %v; assuming no data", b.Name, inst, err))
+						}
+					}
+
+					// Source has no data older than its retention
+					if srcStart := now.Add(-1 * b.From.RPeriod); dLast.Before(srcStart) {
+						dLast = srcStart
+					}
+					if !sLast.After(dLast) {
+						continue
+					}
+
+					card, err := a.db.Cardinality(b.From, inst, col)
+					if err != nil {
+						helpers.PrintWarn(fmt.Sprintf("error getting cardinality: %v. Using default", err))
+					}
+
+					w := int64(sLast.Sub(dLast) / b.AInterv)
+					bw := int64(a.db.BatchWindows(card))
+					st.windows += w
+					st.queries += (w + bw - 1) / bw
+					st.outPoints += w * int64(card)
+					if b.From.AInterv > 0 {
+						st.inPoints += w * int64(card) * int64(b.AInterv/b.From.AInterv)
+					}
+				}
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\n", c, st.name, st.instances, st.windows, st.queries, st.inPoints, st.outPoints)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// startSpotCheck starts goroutine which periodically recomputes random recently produced
+// aggregation window and compares it with stored values.
+//
+// No parameters.
+// No return types.
+func (a *App) startSpotCheck() {
+	interv := time.Duration(a.conf.SpotInterval) * time.Second
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(interv)
+	go func() {
+		for range ticker.C {
+			if !a.db.Resources.Open() {
+				continue
+			}
+
+			// Pick random recently aggregated instance
+			succ := a.tracker.Successes()
+			if len(succ) == 0 {
+				continue
+			}
+			s := succ[rnd.Intn(len(succ))]
+
+			buckets, err := a.collectionBuckets(s.Collection)
+			if err != nil {
+				continue
+			}
+			for i := range buckets {
+				b := &buckets[i]
+				if b.Name != s.Tier {
+					continue
+				}
+
+				res, err := a.db.SpotCheck(b, s.Instance, s.Collection, rnd)
+				if err != nil {
+					helpers.PrintWarn(fmt.Sprintf("spot check %s, %s: %v", b.Name, s.Instance, err))
+					break
+				}
+				if res == nil {
+					break
+				}
+
+				a.tracker.AddSpotCheck(res.Checked, res.Mismatched, res.Missing)
+				msg := fmt.Sprintf("spot check %s, %s, %s window %s: %d values, %d mismatched, %d missing",
+					s.Collection, b.Name, s.Instance, res.Window.Format(time.RFC3339), res.Checked, res.Mismatched, res.Missing)
+				if res.Mismatched > 0 || res.Missing > 0 {
+					helpers.PrintWarn(msg)
+				} else {
+					helpers.PrintDbg(msg)
+				}
+				break
+			}
+		}
+	}()
+}
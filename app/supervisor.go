@@ -0,0 +1,143 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// errLoopEnded is reported when work loop of daemon returns without error
+var errLoopEnded = errors.New("work loop ended unexpectedly")
+
+// restartPolicy of failed collection work loops of daemon
+type restartPolicy struct {
+	restart bool          // restart failed collection instead of stopping daemon
+	limit   int           // consecutive restarts before collection is given up, 0 for unlimited
+	delay   time.Duration // initial restart delay, doubled on every consecutive failure
+}
+
+// restarts run longer than this are not consecutive
+const restartReset = 10 * time.Minute
+
+// longest delay of restart
+const maxRestartDelay = time.Hour
+
+// supervisors keeps collection supervisors of daemon
+type supervisors struct {
+	wg    sync.WaitGroup
+	fatal chan error // first error stopping daemon
+}
+
+// newSupervisors returns empty supervisors.
+func newSupervisors() *supervisors {
+	return &supervisors{fatal: make(chan error, 1)}
+}
+
+// fail reports error stopping daemon. Only the first error is kept.
+//
+// Parameters:
+//
+//	err error - the error
+func (s *supervisors) fail(err error) {
+	select {
+	case s.fatal <- err:
+	default:
+	}
+}
+
+// done returns channel closed when all supervisors have stopped.
+func (s *supervisors) done() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(ch)
+	}()
+
+	return ch
+}
+
+// startCollection starts supervisor of downsampling passes of collection in background.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	b: buckets of collection
+//
+// No return types.
+func (a *App) startCollection(c string, b []db.Bucket) {
+	s := a.sups
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		a.supervise(c, b)
+	}()
+}
+
+// supervise runs work loop of collection until shutdown, end of single pass or removal of collection
+// by reload. Failed loop stops the daemon or is restarted with backoff by restart policy. Collection
+// failed too many times in row is given up while other collections keep going.
+//
+// Parameters:
+//
+//	c: string representing collection
+//	b: buckets of collection
+//
+// No return types.
+func (a *App) supervise(c string, b []db.Bucket) {
+	fails := 0
+	for {
+		start := time.Now()
+		err := a.workOn(c, b)
+		switch {
+		case errors.Is(err, errRemoved):
+			helpers.PrintInfo(fmt.Sprintf("collection %s removed from configuration, stopped", c))
+			a.lease.drop(c)
+			return
+		case a.ctx.Err() != nil:
+			return
+		case err == nil && a.Once:
+			return
+		case err == nil:
+			err = errLoopEnded
+		}
+
+		a.failures.Add(1)
+		helpers.PrintErr(fmt.Sprintf("downsample collection %s: %+v", c, err))
+		a.notifier.abort(c, err)
+		if a.Once {
+			return
+		}
+		if !a.restart.restart {
+			a.sups.fail(fmt.Errorf("downsampling of collection %s failed", c))
+			return
+		}
+
+		if time.Since(start) >= restartReset {
+			fails = 0
+		}
+		fails++
+		if a.restart.limit > 0 && fails > a.restart.limit {
+			helpers.PrintErr(fmt.Sprintf("collection %s failed %d times in row, giving up", c, fails))
+			a.lease.drop(c)
+			return
+		}
+
+		d := a.restart.delay << (fails - 1)
+		if d > maxRestartDelay || d <= 0 {
+			d = maxRestartDelay
+		}
+		helpers.PrintWarn(fmt.Sprintf("restarting collection %s in %s", c, d))
+		if !a.sleep(d) {
+			return
+		}
+
+		// Chain may be changed meanwhile
+		if nb, err := a.collectionBuckets(c); err == nil {
+			b = nb
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aretaja/idbdownsampler/config"
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// tlsConfig returns TLS configuration of InfluxDB connection from config, nil when system
+// defaults are used.
+//
+// Parameters:
+//
+//	c: configuration
+//
+// Return type: *tls.Config, error
+func tlsConfig(c *config.Configuration) (*tls.Config, error) {
+	if c.TLSCA == "" && c.TLSCert == "" && c.TLSKey == "" && !c.TLSInsecure {
+		return nil, nil
+	}
+
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSCA != "" {
+		pem, err := os.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.TLSCA)
+		}
+		conf.RootCAs = pool
+	}
+
+	switch {
+	case c.TLSCert != "" && c.TLSKey != "":
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	case c.TLSCert != "" || c.TLSKey != "":
+		return nil, errors.New("TLSCert and TLSKey must be set together")
+	}
+
+	if c.TLSInsecure {
+		helpers.PrintWarn("TLS certificate verification of InfluxDB server disabled")
+		conf.InsecureSkipVerify = true
+	}
+
+	return conf, nil
+}
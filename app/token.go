@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/secrets"
+)
+
+// tokenRef returns reference of InfluxDB token in file or secret store, empty if token is set directly.
+//
+// No parameters.
+//
+// Return type: string
+func (a *App) tokenRef() string {
+	switch {
+	case a.conf.TokenSecret != "":
+		return a.conf.TokenSecret
+	case a.conf.TokenFile != "":
+		return "file:" + a.conf.TokenFile
+	default:
+		return ""
+	}
+}
+
+// startTokenRefresh starts goroutine which periodically re-reads InfluxDB token
+// and replaces token of all following requests when it has changed.
+//
+// No parameters.
+// No return types.
+func (a *App) startTokenRefresh() {
+	interv := 5 * time.Minute
+	if a.conf.TokenRefresh > 0 {
+		interv = time.Duration(a.conf.TokenRefresh) * time.Second
+	}
+	ref := a.tokenRef()
+	cur := a.conf.Token
+
+	go func() {
+		ticker := time.NewTicker(interv)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			t, err := secrets.Resolve(ref)
+			if err != nil {
+				helpers.PrintErr(fmt.Sprintf("failed to refresh token, using previous one: %v", err))
+				continue
+			}
+			if t != cur {
+				a.db.SetToken(t)
+				cur = t
+				helpers.PrintInfo("influxdb token rotated")
+			}
+		}
+	}()
+}
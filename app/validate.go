@@ -0,0 +1,387 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aretaja/idbdownsampler/config"
+	"github.com/aretaja/idbdownsampler/db"
+	"github.com/aretaja/idbdownsampler/events"
+	"github.com/aretaja/idbdownsampler/graphite"
+)
+
+// ValidateConfig checks configuration without side effects: no secrets are resolved, no state
+// files opened, no connections made and nothing started. Connections of multi-connection config
+// are checked all unless one is selected.
+//
+// Parameters:
+//
+//	c: configuration
+//	conn: selected connection, empty for all
+//
+// Return type: error, invalid configuration
+func ValidateConfig(c *config.Configuration, conn string) error {
+	switch {
+	case len(c.Connections) > 0 && conn == "":
+		names := make([]string, 0, len(c.Connections))
+		for n := range c.Connections {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if err := validate(overrides(c.ForConnection(n), "", false)); err != nil {
+				return fmt.Errorf("connection %s: %w", n, err)
+			}
+		}
+		return nil
+	case len(c.Connections) > 0:
+		if _, ok := c.Connections[conn]; !ok {
+			return fmt.Errorf("unknown connection %s", conn)
+		}
+		c = c.ForConnection(conn)
+	case conn != "":
+		return fmt.Errorf("connection %s selected but no connections configured", conn)
+	}
+
+	return validate(overrides(c, "", false))
+}
+
+// overrides returns copy of configuration with command line overrides and shard restrictions applied.
+//
+// Parameters:
+//
+//	c: configuration
+//	cols: collections selected on command line, empty for configured
+//	dryRun: dry-run mode
+//
+// Return type: *config.Configuration
+func overrides(c *config.Configuration, cols string, dryRun bool) *config.Configuration {
+	r := *c
+	if cols != "" {
+		r.DsCollections = cols
+	}
+	// Nothing is deleted in dry-run mode
+	if dryRun && r.RetEnforce {
+		r.RetEnforce = false
+		r.RetDryRun = true
+	}
+	// Retention of shared destination buckets is enforced by the first shard only
+	if r.Shards > 1 && r.Shard != 0 {
+		r.RetEnforce = false
+		r.RetDryRun = false
+	}
+
+	return &r
+}
+
+// validate checks configuration of single connection. Configuration is not changed, defaults
+// are applied to local copies of values only.
+//
+// Parameters:
+//
+//	c: configuration
+//
+// Return type: error, invalid configuration
+func validate(c *config.Configuration) error {
+	if c.TokenFile != "" && c.TokenSecret != "" {
+		return errors.New("invalid config: TokenFile and TokenSecret are mutually exclusive")
+	}
+
+	flavor := c.DbFlavor
+	if flavor == "" {
+		flavor = db.FlavorV2
+	}
+	if !db.ValidFlavor(flavor) {
+		return fmt.Errorf("invalid db flavor %s, must be v1, v2 or v3", flavor)
+	}
+	// InfluxDB 1.x authenticates by user and password passed as token, organization is ignored
+	token := c.Token != "" || c.TokenFile != "" || c.TokenSecret != ""
+	if c.DbUser != "" {
+		switch {
+		case flavor != db.FlavorV1:
+			return fmt.Errorf("invalid config: DbUser not supported by db flavor %s, use token", flavor)
+		case token:
+			return errors.New("invalid config: DbUser and token are mutually exclusive")
+		}
+		token = true
+	}
+	switch c.ResMonSource {
+	case "", "stats", "metrics":
+	default:
+		return fmt.Errorf("invalid resource monitor source %s, must be stats or metrics", c.ResMonSource)
+	}
+	stats := c.ResMonSource != "metrics"
+	if c.DbURL == "" || !token || (c.Org == "" && flavor != db.FlavorV1) || (c.StatsBucket == "" && flavor == db.FlavorV2 && stats) {
+		return errors.New("invalid config: missing required parameters")
+	}
+	// InfluxDB 1.x and 3.x have no delete API, 3.x has no flux
+	if flavor != db.FlavorV2 && c.RetEnforce {
+		return fmt.Errorf("invalid config: retention enforcement not supported by db flavor %s", flavor)
+	}
+	if flavor != db.FlavorV2 && c.ReapAfter > 0 && !c.ReapDryRun {
+		return fmt.Errorf("invalid config: decommissioned instance cleanup not supported by db flavor %s", flavor)
+	}
+	if flavor != db.FlavorV2 && c.DeleteBefore {
+		return fmt.Errorf("invalid config: delete before write not supported by db flavor %s", flavor)
+	}
+	// Flux of InfluxDB 1.8 has no types package and no time range in schema functions
+	if flavor == db.FlavorV1 && c.StringAggr != "" {
+		return fmt.Errorf("invalid config: string field aggregation not supported by db flavor %s", flavor)
+	}
+	if flavor == db.FlavorV1 && len(c.RegexCols) > 0 {
+		return fmt.Errorf("invalid config: regex collections not supported by db flavor %s", flavor)
+	}
+	if flavor != db.FlavorV2 && c.BillingBucket != "" {
+		return fmt.Errorf("invalid config: billing not supported by db flavor %s", flavor)
+	}
+	if flavor != db.FlavorV2 && c.ManageBuckets {
+		return fmt.Errorf("invalid config: bucket management not supported by db flavor %s", flavor)
+	}
+	if flavor == db.FlavorV3 && (c.RetDryRun || c.SpotInterval > 0) {
+		return errors.New("invalid config: retention enforcement and spot checks not supported by db flavor v3")
+	}
+	if c.DsCollections == "" {
+		return errors.New("no collections for downsampling provided, interrupting")
+	}
+
+	if _, err := tlsConfig(c); err != nil {
+		return fmt.Errorf("invalid TLS config: %v", err)
+	}
+
+	// Adaptive batch bounds
+	if c.AdaptBatch {
+		aggrCnt := 8
+		if c.AggrCnt > 0 {
+			aggrCnt = c.AggrCnt
+		}
+		bMin, bMax, bFast, bSlow := 1, 40*aggrCnt, 30, 300
+		if c.BatchMin > 0 {
+			bMin = c.BatchMin
+		}
+		if c.BatchMax > 0 {
+			bMax = c.BatchMax
+		}
+		if c.BatchFast > 0 {
+			bFast = c.BatchFast
+		}
+		if c.BatchSlow > 0 {
+			bSlow = c.BatchSlow
+		}
+		if bMin > bMax || bFast >= bSlow {
+			return fmt.Errorf("invalid adaptive batch config: BatchMin %d must not exceed BatchMax %d and BatchFast %ds must be less than BatchSlow %ds", bMin, bMax, bFast, bSlow)
+		}
+	}
+
+	if c.RetryJitter < 0 || c.RetryJitter > 1 {
+		return fmt.Errorf("invalid retry jitter %v, must be in range 0-1", c.RetryJitter)
+	}
+	if c.GraphiteAddr != "" {
+		if _, err := graphite.New(c.GraphiteAddr, c.GraphiteProto, c.GraphiteTmpl); err != nil {
+			return fmt.Errorf("invalid graphite config: %v", err)
+		}
+	}
+	if c.IcingaTiming != "" && !db.ValidIcingaTiming(c.IcingaTiming) {
+		return fmt.Errorf("invalid icinga timing policy %s", c.IcingaTiming)
+	}
+
+	// Destination and mirror servers
+	if c.DestURL != "" {
+		if c.DestToken == "" || c.DestOrg == "" {
+			return errors.New("invalid config: destination server token and org required")
+		}
+		if flavor == db.FlavorV3 {
+			return errors.New("invalid config: destination server not supported by db flavor v3")
+		}
+	}
+	if c.MirrorURL != "" && c.MirrorOrg == "" {
+		return fmt.Errorf("invalid mirror config: organization of mirror %s missing", c.MirrorURL)
+	}
+
+	// Field aggregation
+	if err := db.ValidateFieldAggr(c.FieldAggr); err != nil {
+		return fmt.Errorf("invalid field aggregates config: %v", err)
+	}
+	if c.PctReaggr != "" && !db.ValidPctReaggr(c.PctReaggr) {
+		return fmt.Errorf("invalid percentile re-aggregation %s, must be max, mean or same", c.PctReaggr)
+	}
+	if c.CounterReset != "" && !db.ValidCounterReset(c.CounterReset) {
+		return fmt.Errorf("invalid counter reset policy %s, must be drop, zero or interpolate", c.CounterReset)
+	}
+	rules := make(map[string][]db.FieldRule)
+	for n, rs := range c.FieldRules {
+		fr, err := fieldRules(rs)
+		if err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		if err := db.ValidateFieldRules(fr); err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		rules[n] = fr
+	}
+	if c.StringAggr != "" && !db.ValidStringAggr(c.StringAggr) {
+		return fmt.Errorf("invalid string field aggregate %s, must be last or mode", c.StringAggr)
+	}
+	for n, rs := range c.GaugeExtras {
+		fr, err := fieldRules(rs)
+		if err != nil {
+			return fmt.Errorf("invalid gauge extras of collection %s: %v", n, err)
+		}
+		if err := db.ValidateGaugeExtras(fr); err != nil {
+			return fmt.Errorf("invalid gauge extras of collection %s: %v", n, err)
+		}
+	}
+
+	// Instance selection
+	if c.Shards > 1 && (c.Shard < 0 || c.Shard >= c.Shards) {
+		return fmt.Errorf("invalid shard index %d, must be 0 to %d", c.Shard, c.Shards-1)
+	}
+	if _, err := instFilters("include", c.Include); err != nil {
+		return err
+	}
+	if _, err := instFilters("exclude", c.Exclude); err != nil {
+		return err
+	}
+	for _, fk := range c.FieldKinds {
+		if _, err := regexp.Compile(fk.Match); err != nil {
+			return fmt.Errorf("invalid field kind regex %s: %v", fk.Match, err)
+		}
+		if fk.Kind != "counter" && fk.Kind != "gauge" {
+			return fmt.Errorf("invalid field kind %s, must be counter or gauge", fk.Kind)
+		}
+	}
+	for n, rc := range c.RegexCols {
+		if _, err := regexp.Compile(rc.Match); err != nil {
+			return fmt.Errorf("invalid regex of collection %s: %v", n, err)
+		}
+		if !db.ValidMeasKind(rc.Kind) {
+			return fmt.Errorf("invalid kind %s of collection %s", rc.Kind, n)
+		}
+		fr, err := fieldRules(rc.Fields)
+		if err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		if err := db.ValidateFieldRules(fr); err != nil {
+			return fmt.Errorf("invalid field rules of collection %s: %v", n, err)
+		}
+		rules[n] = append(rules[n], fr...)
+	}
+
+	// Bucket chains and declarative collections
+	cols := strings.Split(c.DsCollections, ",")
+	chains, err := buildChains(c)
+	if err != nil {
+		return err
+	}
+	specs := make(map[string]*db.CollectionSpec)
+	for n, cs := range c.Specs {
+		fr, err := fieldRules(cs.Fields)
+		if err != nil {
+			return fmt.Errorf("invalid spec of collection %s: %v", n, err)
+		}
+		s := &db.CollectionSpec{TagKey: cs.TagKey, Measurements: cs.Measurements, Fields: fr}
+		if err := db.ValidateSpec(s); err != nil {
+			return fmt.Errorf("invalid spec of collection %s: %v", n, err)
+		}
+		if _, ok := chains[n]; !ok {
+			return fmt.Errorf("no bucket chain of collection %s in chains", n)
+		}
+		specs[n] = s
+	}
+	// InfluxDB 3.x supports only declarative collections, built in kinds are declared by specs
+	// with counter fields marked as rate
+	if flavor == db.FlavorV3 {
+		for _, n := range cols {
+			s, ok := specs[n]
+			if !ok {
+				return fmt.Errorf("collection %s not supported by db flavor v3, only collections defined in specs are", n)
+			}
+			for _, f := range append(s.Fields, rules[n]...) {
+				if slices.Contains(f.Aggregates, "mode") {
+					return fmt.Errorf("mode of fields %s of collection %s not supported by db flavor v3", f.Re, n)
+				}
+			}
+		}
+	}
+
+	// Scheduling
+	if err := validSchedule(c, cols); err != nil {
+		return err
+	}
+	if len(c.Templates) > 0 {
+		if flavor == db.FlavorV3 {
+			return errors.New("invalid config: query templates not supported by db flavor v3")
+		}
+		for n, f := range c.Templates {
+			if _, err := db.ParseTemplate(f); err != nil {
+				return fmt.Errorf("invalid query template of %s: %v", n, err)
+			}
+		}
+	}
+
+	// Failure handling and coordination
+	switch c.OnFailure {
+	case "", "exit", "restart":
+	default:
+		return fmt.Errorf("invalid collection failure handling %s, must be exit or restart", c.OnFailure)
+	}
+	if c.LeaseBucket != "" && flavor == db.FlavorV3 {
+		return fmt.Errorf("leases not supported by db flavor %s", flavor)
+	}
+	if c.WriteVerify && flavor == db.FlavorV3 {
+		return fmt.Errorf("write verification not supported by db flavor %s", flavor)
+	}
+
+	// Events and notifications
+	if c.EventsURL != "" {
+		if err := events.CheckURL(c.EventsURL); err != nil {
+			return fmt.Errorf("invalid events config: %v", err)
+		}
+	}
+	if c.NotifyWebhook != "" || c.NotifySMTP != "" {
+		if err := notifyOptions(c).Check(); err != nil {
+			return fmt.Errorf("invalid notification config: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// validSchedule checks collection quotas, cardinality group settings and pass intervals
+// against collections of configuration.
+//
+// Parameters:
+//
+//	c: configuration
+//	cols: collections for downsampling
+//
+// Return type: error, invalid configuration
+func validSchedule(c *config.Configuration, cols []string) error {
+	for n, s := range c.Quotas {
+		if !slices.Contains(cols, n) {
+			return fmt.Errorf("quota of unknown collection %s", n)
+		}
+		if s <= 0 || s > 1 {
+			return fmt.Errorf("invalid quota %g of collection %s", s, n)
+		}
+	}
+	if err := validGroups(c); err != nil {
+		return err
+	}
+	if c.PassInterval < 0 || c.PassJitter < 0 {
+		return errors.New("pass interval and jitter can't be negative")
+	}
+	if c.LightBatch < 0 {
+		return errors.New("light instance batch size can't be negative")
+	}
+	for n := range c.Intervals {
+		if !slices.Contains(cols, n) {
+			return fmt.Errorf("pass interval of unknown collection %s", n)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Verify checks consistency of destination tiers of collection. For random sample of instances
+// and windows aggregates are recomputed from source bucket and compared with stored ones.
+// Missing and mismatched values, stored points not aligned to window boundaries and points
+// without aggregate tag are reported. Stops on SIGINT or SIGTERM.
+//
+// Parameters:
+//
+//	c string - the collection
+//	tier string - only verify destination bucket of this name, all tiers when empty
+//	insts int - count of sampled instances per tier
+//	windows int - count of sampled windows per instance
+//
+// Returns:
+//
+//	error - an error, if any
+func (a *App) Verify(c, tier string, insts, windows int) error {
+	if len(a.conns) > 0 {
+		return errConnections
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	a.ctx = ctx
+	a.db.SetContext(ctx)
+	a.startResMon()
+
+	buckets, err := a.collectionBuckets(c)
+	if err != nil {
+		return err
+	}
+	cols, err := a.expand(c, &buckets[0])
+	if err != nil {
+		return fmt.Errorf("can't get measurements for collection %s: %w", c, err)
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	found := false
+	failures, bad := 0, 0
+	for bi := range buckets {
+		b := &buckets[bi]
+		if b.First || (tier != "" && b.Name != tier) {
+			continue
+		}
+		found = true
+
+		// Windows can only be recomputed while source data exists
+		oldest := time.Now().Add(-b.From.RPeriod)
+		if r := time.Now().Add(-b.RPeriod); r.After(oldest) {
+			oldest = r
+		}
+
+		var checked, values, mismatched, missing, misaligned, untagged int
+		for _, col := range cols {
+			all, err := a.engine.DiscoverInstances(b, col, time.Now().Add(-10*b.AInterv), time.Now())
+			if err != nil {
+				return fmt.Errorf("can't get instances of %s in %s: %w", col, b.Name, err)
+			}
+			rnd.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+			if len(all) > insts {
+				all = all[:insts]
+			}
+
+			for _, inst := range all {
+				last, err := a.engine.LastDownsampled(b, inst, col)
+				if err != nil {
+					failures++
+					helpers.PrintErr(fmt.Sprintf("verify %s, %s, %s: %v", b.Name, col, inst, err))
+					continue
+				}
+
+				// Random complete windows between oldest recomputable and last downsampled one
+				n := int(last.Sub(oldest)/b.AInterv) - 2
+				if n < 1 {
+					continue
+				}
+				for w := 0; w < windows && w < n; w++ {
+					ws := last.Add(-time.Duration(rnd.Intn(n)+1) * b.AInterv)
+					res, err := a.db.CheckWindow(b, inst, col, ws)
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					if err != nil {
+						failures++
+						helpers.PrintErr(fmt.Sprintf("verify %s, %s, %s: %v", b.Name, col, inst, err))
+						break
+					}
+
+					checked++
+					values += res.Checked
+					mismatched += res.Mismatched
+					missing += res.Missing
+					misaligned += res.Misaligned
+					untagged += res.Untagged
+					if res.Mismatched > 0 || res.Missing > 0 || res.Misaligned > 0 || res.Untagged > 0 {
+						bad++
+						helpers.PrintWarn(fmt.Sprintf("verify %s, %s, %s window %s: %d values, %d mismatched, %d missing, %d misaligned, %d without aggregate tag",
+							b.Name, col, inst, res.Window.Format(time.RFC3339), res.Checked, res.Mismatched, res.Missing, res.Misaligned, res.Untagged))
+					}
+				}
+			}
+		}
+		helpers.PrintInfo(fmt.Sprintf("verify %s, %s: %d windows, %d values, %d mismatched, %d missing, %d misaligned, %d without aggregate tag",
+			b.Name, c, checked, values, mismatched, missing, misaligned, untagged))
+	}
+
+	switch {
+	case !found:
+		return fmt.Errorf("no destination tier %s of collection %s", tier, c)
+	case failures > 0:
+		return fmt.Errorf("%d checks failed", failures)
+	case bad > 0:
+		return fmt.Errorf("%d inconsistent windows", bad)
+	}
+
+	return nil
+}
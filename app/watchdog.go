@@ -0,0 +1,195 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/status"
+)
+
+// watchdog of instances whose downsample queries keep timing out or failing
+type watchdog struct {
+	mu         sync.Mutex
+	limit      int           // consecutive timeouts before instance is skipped, 0 disables
+	skip       time.Duration // time instance is skipped
+	failLimit  int           // consecutive failures before instance is quarantined, 0 disables
+	quarantine time.Duration // time instance is quarantined
+	insts      map[string]*status.Problem
+}
+
+// newWatchdog returns watchdog skipping instance for given time after limit of consecutive timeouts
+// and quarantining it after limit of consecutive failures of any kind.
+func newWatchdog(limit int, skip time.Duration, failLimit int, quarantine time.Duration) *watchdog {
+	return &watchdog{limit: limit, skip: skip, failLimit: failLimit, quarantine: quarantine, insts: make(map[string]*status.Problem)}
+}
+
+// problem returns tracked problem of instance in tier, new one is added when missing.
+// Caller must hold the lock.
+func (w *watchdog) problem(col, tier, inst string) *status.Problem {
+	k := col + "/" + tier + "/" + inst
+	p, ok := w.insts[k]
+	if !ok {
+		p = &status.Problem{Collection: col, Tier: tier, Instance: inst, Since: time.Now()}
+		w.insts[k] = p
+	}
+
+	return p
+}
+
+// skipped checks if instance in tier is skipped.
+//
+// Parameters:
+//
+//	col: collection
+//	tier: destination bucket name
+//	inst: instance name
+//
+// Return type: bool, true while instance is skipped
+func (w *watchdog) skipped(col, tier, inst string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.insts[col+"/"+tier+"/"+inst]
+
+	return ok && p.SkipUntil != nil && time.Now().Before(*p.SkipUntil)
+}
+
+// timeout records query timeout of instance in tier. Instance is skipped when
+// limit of consecutive timeouts is reached.
+//
+// Parameters:
+//
+//	col: collection
+//	tier: destination bucket name
+//	inst: instance name
+//	err: timeout error
+//
+// No return types.
+func (w *watchdog) timeout(col, tier, inst string, err error) {
+	if w.limit <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p := w.problem(col, tier, inst)
+	p.Timeouts++
+	p.Error = err.Error()
+	if p.Timeouts%w.limit == 0 {
+		until := time.Now().Add(w.skip)
+		p.SkipUntil = &until
+		helpers.PrintErr(fmt.Sprintf("%s %s %s: %d consecutive query timeouts, skipping instance until %s",
+			inst, col, tier, p.Timeouts, until.Format(time.RFC3339)))
+	}
+}
+
+// failure records failure of instance in tier. Instance is quarantined when limit of
+// consecutive failures is reached, so the pass continues without retrying it.
+//
+// Parameters:
+//
+//	col: collection
+//	tier: destination bucket name
+//	inst: instance name
+//	err: downsample error
+//
+// No return types.
+func (w *watchdog) failure(col, tier, inst string, err error) {
+	if w.failLimit <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p := w.problem(col, tier, inst)
+	p.Failures++
+	p.Error = err.Error()
+	if p.Failures%w.failLimit == 0 {
+		until := time.Now().Add(w.quarantine)
+		if p.SkipUntil == nil || p.SkipUntil.Before(until) {
+			p.SkipUntil = &until
+		}
+		helpers.PrintErr(fmt.Sprintf("%s %s %s: %d consecutive failures, quarantining instance until %s",
+			inst, col, tier, p.Failures, until.Format(time.RFC3339)))
+	}
+}
+
+// quarantined returns instances of collection currently skipped.
+//
+// Parameters:
+//
+//	col: collection
+//
+// Return type: []status.Problem
+func (w *watchdog) quarantined(col string) []status.Problem {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var res []status.Problem
+	for _, p := range w.insts {
+		if p.Collection == col && p.SkipUntil != nil && time.Now().Before(*p.SkipUntil) {
+			res = append(res, *p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Tier != res[j].Tier {
+			return res[i].Tier < res[j].Tier
+		}
+		return res[i].Instance < res[j].Instance
+	})
+
+	return res
+}
+
+// success clears timeouts and failures of instance in tier.
+//
+// Parameters:
+//
+//	col: collection
+//	tier: destination bucket name
+//	inst: instance name
+//
+// No return types.
+func (w *watchdog) success(col, tier, inst string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.insts, col+"/"+tier+"/"+inst)
+}
+
+// problems returns instances with consecutive query timeouts or failures.
+//
+// No parameters.
+//
+// Return type: []status.Problem
+func (w *watchdog) problems() []status.Problem {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	res := make([]status.Problem, 0, len(w.insts))
+	for _, p := range w.insts {
+		res = append(res, *p)
+	}
+
+	return res
+}
+
+// reportQuarantine logs summary of quarantined instances of collection at pass end.
+//
+// Parameters:
+//
+//	c: collection
+//
+// No return types.
+func (a *App) reportQuarantine(c string) {
+	q := a.watchdog.quarantined(c)
+	if len(q) == 0 {
+		return
+	}
+
+	insts := make([]string, len(q))
+	for n, p := range q {
+		insts[n] = fmt.Sprintf("%s %s until %s (%s)", p.Instance, p.Tier, p.SkipUntil.Format(time.RFC3339), p.Error)
+	}
+	helpers.PrintWarn(fmt.Sprintf("collection %s: %d instances quarantined: %s", c, len(q), strings.Join(insts, "; ")))
+}
@@ -0,0 +1,214 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// minimum interval between saves of state file
+const saveInterv = 10 * time.Second
+
+// State is last downsampled timestamp of instance in tier
+type State struct {
+	Last    time.Time `json:"last"`
+	Checked time.Time `json:"checked"`
+}
+
+// Store keeps last downsampled timestamps per collection, tier and instance
+type Store struct {
+	mu     sync.Mutex
+	path   string
+	states map[string]State
+	dirty  bool
+	saved  time.Time
+}
+
+// key returns store key of instance in tier.
+func key(col, tier, inst string) string {
+	return col + "|" + tier + "|" + inst
+}
+
+// Open loads store from file. Missing file results empty store.
+//
+// Parameters:
+//
+//	path string - state file path
+//
+// Returns:
+//
+//	*Store - the store
+//	error - an error, if any
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:   path,
+		states: make(map[string]State),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &s.states)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Get returns state of instance in tier. Safe to call on nil Store.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+//
+// Returns:
+//
+//	State - the state
+//	bool - true if state is known
+func (s *Store) Get(col, tier, inst string) (State, bool) {
+	if s == nil {
+		return State{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.states[key(col, tier, inst)]
+
+	return st, ok
+}
+
+// Advance records last downsampled timestamp of instance in tier if it is later than known one.
+// Safe to call on nil Store.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+//	last time.Time - last downsampled timestamp
+func (s *Store) Advance(col, tier, inst string, last time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(col, tier, inst)
+	st, ok := s.states[k]
+	if !ok || !last.After(st.Last) {
+		// Unknown state is set by validation only
+		return
+	}
+	st.Last = last
+	s.states[k] = st
+	s.changed()
+}
+
+// Validate records last timestamp of instance in tier confirmed by database.
+// Safe to call on nil Store.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+//	last time.Time - last timestamp in database
+func (s *Store) Validate(col, tier, inst string, last time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[key(col, tier, inst)] = State{Last: last, Checked: time.Now()}
+	s.changed()
+}
+
+// Drop removes state of instance in tier. Used when data of instance is deleted.
+// Safe to call on nil Store.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+func (s *Store) Drop(col, tier, inst string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(col, tier, inst)
+	if _, ok := s.states[k]; !ok {
+		return
+	}
+	delete(s.states, k)
+	s.changed()
+}
+
+// changed marks store dirty and saves it if enough time has elapsed since previous save.
+// Caller must hold the lock.
+func (s *Store) changed() {
+	s.dirty = true
+	if time.Since(s.saved) >= saveInterv {
+		if err := s.save(); err != nil {
+			helpers.PrintErr(fmt.Sprintf("failed to save checkpoints: %v", err))
+		}
+	}
+}
+
+// Save writes store to file if changed. Safe to call on nil Store.
+//
+// Returns:
+//
+//	error - an error, if any
+func (s *Store) Save() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save()
+}
+
+// save writes store to file atomically, caller must hold the lock.
+func (s *Store) save() error {
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(s.states)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	s.saved = time.Now()
+
+	return nil
+}
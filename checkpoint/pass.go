@@ -0,0 +1,268 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Pass is progress of pass of collection
+type Pass struct {
+	Start  time.Time `json:"start"`
+	Finish time.Time `json:"finish,omitempty"` // zero while pass is in progress
+	Tiers  []string  `json:"tiers,omitempty"`  // destination tiers finished in pass
+	Tier   string    `json:"tier,omitempty"`   // destination tier in progress
+	Done   []string  `json:"done,omitempty"`   // instances done in tier in progress
+}
+
+// Running reports whether pass was started but not finished.
+func (p Pass) Running() bool {
+	return !p.Start.IsZero() && p.Finish.IsZero()
+}
+
+// TierDone reports whether destination tier was finished in pass.
+func (p Pass) TierDone(tier string) bool {
+	return slices.Contains(p.Tiers, tier)
+}
+
+// InstDone reports whether instance was done in destination tier in progress.
+func (p Pass) InstDone(tier, inst string) bool {
+	return p.Tier == tier && slices.Contains(p.Done, inst)
+}
+
+// Passes keeps progress of passes per collection, so interrupted pass can be resumed
+// after restart
+type Passes struct {
+	mu     sync.Mutex
+	path   string
+	passes map[string]*Pass
+	dirty  bool
+	saved  time.Time
+}
+
+// OpenPasses loads pass progress from file. Missing file results empty store.
+//
+// Parameters:
+//
+//	path string - state file path
+//
+// Returns:
+//
+//	*Passes - the store
+//	error - an error, if any
+func OpenPasses(path string) (*Passes, error) {
+	p := &Passes{
+		path:   path,
+		passes: make(map[string]*Pass),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &p.passes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// Get returns progress of last pass of collection. Safe to call on nil Passes.
+//
+// Parameters:
+//
+//	col string - the collection
+//
+// Returns:
+//
+//	Pass - the pass
+//	bool - true if pass is known
+func (p *Passes) Get(col string) (Pass, bool) {
+	if p == nil {
+		return Pass{}, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps, ok := p.passes[col]
+	if !ok {
+		return Pass{}, false
+	}
+	res := *ps
+	res.Tiers = slices.Clone(ps.Tiers)
+	res.Done = slices.Clone(ps.Done)
+
+	return res, true
+}
+
+// Start records start of pass of collection. Safe to call on nil Passes.
+//
+// Parameters:
+//
+//	col string - the collection
+//	ts time.Time - start of pass
+func (p *Passes) Start(col string, ts time.Time) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.passes[col] = &Pass{Start: ts}
+	p.changed()
+}
+
+// StartTier records start of destination tier in pass of collection. Instances done in tier
+// recorded before are kept when the same tier is resumed. Safe to call on nil Passes.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+func (p *Passes) StartTier(col, tier string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps, ok := p.passes[col]
+	if !ok || ps.Tier == tier {
+		return
+	}
+	ps.Tier = tier
+	ps.Done = nil
+	p.changed()
+}
+
+// InstDone records instance done in destination tier in progress. Safe to call on nil Passes.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance key
+func (p *Passes) InstDone(col, tier, inst string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps, ok := p.passes[col]
+	if !ok || ps.Tier != tier || slices.Contains(ps.Done, inst) {
+		return
+	}
+	ps.Done = append(ps.Done, inst)
+	p.changed()
+}
+
+// FinishTier records destination tier finished in pass of collection. Safe to call on nil Passes.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+func (p *Passes) FinishTier(col, tier string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps, ok := p.passes[col]
+	if !ok {
+		return
+	}
+	if !slices.Contains(ps.Tiers, tier) {
+		ps.Tiers = append(ps.Tiers, tier)
+	}
+	ps.Tier = ""
+	ps.Done = nil
+	p.changed()
+}
+
+// Finish records end of pass of collection. Safe to call on nil Passes.
+//
+// Parameters:
+//
+//	col string - the collection
+//	ts time.Time - end of pass
+func (p *Passes) Finish(col string, ts time.Time) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps, ok := p.passes[col]
+	if !ok {
+		return
+	}
+	*ps = Pass{Start: ps.Start, Finish: ts}
+	p.changed()
+}
+
+// changed marks store dirty and saves it if enough time has elapsed since previous save.
+// Caller must hold the lock.
+func (p *Passes) changed() {
+	p.dirty = true
+	if time.Since(p.saved) >= saveInterv {
+		if err := p.save(); err != nil {
+			helpers.PrintErr(fmt.Sprintf("failed to save pass progress: %v", err))
+		}
+	}
+}
+
+// Save writes store to file if changed. Safe to call on nil Passes.
+//
+// Returns:
+//
+//	error - an error, if any
+func (p *Passes) Save() error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.save()
+}
+
+// save writes store to file atomically, caller must hold the lock.
+func (p *Passes) save() error {
+	if !p.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(p.passes)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, p.path)
+	if err != nil {
+		return err
+	}
+	p.dirty = false
+	p.saved = time.Now()
+
+	return nil
+}
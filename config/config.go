@@ -1,28 +1,230 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/BurntSushi/toml"
+	"github.com/ghodss/yaml"
 	"github.com/tkanos/gonfig"
 )
 
 // API configuration sruct
 type Configuration struct {
-	DbURL         string  `env:"IDBDS_DBURL"`
-	Token         string  `env:"IDBDS_TOKEN"`
-	Org           string  `env:"IDBDS_ORG"`
-	StatsBucket   string  `env:"IDBDS_STATSBUCKET"`
-	DsCollections string  `env:"IDBDS_DSCOLLECTIONS"`
-	MemLimit      float64 `env:"IDBDS_MEMLIMIT"`
-	AggrCnt       int     `env:"IDBDS_AGGRCNT"`
-	CardMedium    int     `env:"IDBDS_CARDMEDIUM"`
-	CardHevy      int     `env:"IDBDS_CARDHEVY"`
+	DbURL          string                         `env:"IDBDS_DBURL" section:"db" desc:"InfluxDB API URL"`
+	Token          string                         `env:"IDBDS_TOKEN" section:"db" desc:"InfluxDB API token"`
+	TokenFile      string                         `env:"IDBDS_TOKEN_FILE" section:"db" desc:"File holding InfluxDB API token, overrides Token"`
+	TokenSecret    string                         `env:"IDBDS_TOKEN_SECRET" section:"db" desc:"InfluxDB API token in external secret store, overrides Token: vault:PATH#KEY (VAULT_ADDR, VAULT_TOKEN) or aws:SECRET-ID[#KEY] (AWS_REGION, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY)"`
+	TokenRefresh   int                            `env:"IDBDS_TOKENREFRESH" section:"db" desc:"Interval in seconds of re-reading token from TokenFile or TokenSecret, rotated token is used without restart, default 300, -1 disables"`
+	DbFlavor       string                         `env:"IDBDS_DBFLAVOR" section:"db" desc:"InfluxDB flavor: v2 (default) or v1 (1.8+ via Flux compatibility API, token user:password, buckets database/retention-policy, results written by client, no resource monitoring) or v3 (SQL API, buckets are databases, only collections defined in Specs, no resource monitoring)"`
+	DbUser         string                         `env:"IDBDS_DBUSER" section:"db" desc:"InfluxDB 1.x user, used with DbPassword instead of token user:password with DbFlavor v1"`
+	DbPassword     string                         `env:"IDBDS_DBPASSWORD" section:"db" desc:"InfluxDB 1.x password of DbUser"`
+	Org            string                         `env:"IDBDS_ORG" section:"db" desc:"InfluxDB organization, not used with DbFlavor v1"`
+	TLSCA          string                         `env:"IDBDS_TLSCA" section:"db" desc:"File of PEM encoded CA bundle verifying InfluxDB server certificate, system roots by default"`
+	TLSCert        string                         `env:"IDBDS_TLSCERT" section:"db" desc:"File of PEM encoded client certificate presented to InfluxDB, requires TLSKey"`
+	TLSKey         string                         `env:"IDBDS_TLSKEY" section:"db" desc:"File of PEM encoded private key of client certificate"`
+	TLSInsecure    bool                           `env:"IDBDS_TLSINSECURE" section:"db" desc:"Skip verification of InfluxDB server certificate, insecure, for testing only"`
+	StatsBucket    string                         `env:"IDBDS_STATSBUCKET" section:"db" desc:"Bucket of InfluxDB internal stats"`
+	LeaseBucket    string                         `env:"IDBDS_LEASEBUCKET" section:"db" desc:"Bucket of coordination leases of collections, another copy of downsampler refuses to work on leased collections, disabled when empty"`
+	LeaseTTL       int                            `env:"IDBDS_LEASETTL" section:"db" desc:"Lifetime in seconds of lease not renewed by its owner, default 120"`
+	ResMonSource   string                         `env:"IDBDS_RESMONSOURCE" section:"db" desc:"Source of resource monitor data: stats (default, StatsBucket written by Telegraf) or metrics (InfluxDB /metrics endpoint, StatsBucket not required)"`
+	DsCollections  string                         `env:"IDBDS_DSCOLLECTIONS" section:"collections" desc:"Comma separated list of collections to downsample"`
+	MemLimit       float64                        `env:"IDBDS_MEMLIMIT" section:"db" desc:"InfluxDB memory usage limit in percent"`
+	Workers        int                            `env:"IDBDS_WORKERS" section:"schedule" desc:"Count of concurrent downsample workers shared by all collections, 3 per collection by default"`
+	MaxTasks       int                            `env:"IDBDS_MAXTASKS" section:"db" desc:"Pause work while more InfluxDB tasks than this are running, 0 by default, -1 disables task gate"`
+	TaskLabels     []string                       `section:"db" desc:"Only count running tasks having any of these labels (uses tasks API instead of stats bucket)"`
+	AggrCnt        int                            `env:"IDBDS_AGGRCNT" section:"schedule" desc:"Base count of aggregation windows in one query"`
+	AdaptBatch     bool                           `env:"IDBDS_ADAPTBATCH" section:"schedule" desc:"Adapt count of aggregation windows in one query to query duration and memory pressure"`
+	BatchMin       int                            `env:"IDBDS_BATCHMIN" section:"schedule" desc:"Floor of adaptive count of aggregation windows in one query, default 1"`
+	BatchMax       int                            `env:"IDBDS_BATCHMAX" section:"schedule" desc:"Ceiling of adaptive count of aggregation windows in one query, default 40 times AggrCnt"`
+	BatchFast      int                            `env:"IDBDS_BATCHFAST" section:"schedule" desc:"Adaptive batch is doubled when query completes faster than this in seconds, default 30"`
+	BatchSlow      int                            `env:"IDBDS_BATCHSLOW" section:"schedule" desc:"Adaptive batch is halved when query takes longer than this in seconds, default 300 (half of query timeout)"`
+	CardMedium     int                            `env:"IDBDS_CARDMEDIUM" section:"collections" desc:"Medium cardinality level of instance"`
+	CardHevy       int                            `env:"IDBDS_CARDHEVY" section:"collections" desc:"Heavy cardinality level of instance"`
+	RLRetries      int                            `env:"IDBDS_RLRETRIES" section:"db" desc:"Retries on rate limit (429) or service unavailable (503) response, default 5, -1 disables"`
+	RLBackoff      int                            `env:"IDBDS_RLBACKOFF" section:"db" desc:"Initial backoff in seconds on rate limit or service unavailable response without Retry-After"`
+	Retries        int                            `env:"IDBDS_RETRIES" section:"db" desc:"Retries of instance downsampling failed with transient error (rate limit, server or network error), default 3, -1 disables"`
+	RetryBackoff   int                            `env:"IDBDS_RETRYBACKOFF" section:"db" desc:"Initial backoff in seconds before retry of instance downsampling, doubled on every retry, default 10"`
+	RetryMaxWait   int                            `env:"IDBDS_RETRYMAXWAIT" section:"db" desc:"Maximum backoff in seconds before retry of instance downsampling, default 300"`
+	RetryJitter    float64                        `env:"IDBDS_RETRYJITTER" section:"db" desc:"Random part (0-1) of backoff before retry of instance downsampling, default 0.2"`
+	QueryRate      int                            `env:"IDBDS_QUERYRATE" section:"db" desc:"Maximum count of queries per minute shared by all connections, 0 disables"`
+	QueryConc      int                            `env:"IDBDS_QUERYCONC" section:"db" desc:"Maximum count of concurrent queries shared by all connections, 0 disables"`
+	WrRetries      int                            `env:"IDBDS_WRRETRIES" section:"db" desc:"Retries of downsample batch on server error, default 3, -1 disables"`
+	HTTPListen     string                         `env:"IDBDS_HTTPLISTEN" section:"logging" desc:"Listen address of status API"`
+	AdminListen    string                         `env:"IDBDS_ADMINLISTEN" section:"logging" desc:"Listen address of admin API (pause, resume, pass trigger, config reload, progress), disabled by default"`
+	AdminToken     string                         `env:"IDBDS_ADMINTOKEN" section:"logging" desc:"Bearer token required by admin API, no authentication when empty"`
+	ReportBucket   string                         `env:"IDBDS_REPORTBUCKET" section:"logging" desc:"Bucket where summary of every collection pass per tier and cardinality group is written, disabled by default"`
+	ReportMeas     string                         `env:"IDBDS_REPORTMEAS" section:"logging" desc:"Measurement of pass summaries, default idbdownsampler_pass"`
+	HealthStale    int                            `env:"IDBDS_HEALTHSTALE" section:"logging" desc:"Maximum time in seconds since last finished pass of any collection before /healthz reports failure, 0 disables"`
+	ProfPauses     int                            `env:"IDBDS_PROFPAUSES" section:"logging" desc:"Capture heap and goroutine profiles when memory gate pauses work more than this times within an hour, 0 disables"`
+	ProfDir        string                         `env:"IDBDS_PROFDIR" section:"logging" desc:"Directory of captured profiles"`
+	CardRefresh    int                            `env:"IDBDS_CARDREFRESH" section:"collections" desc:"Interval in seconds of re-querying cardinality of instances known from previous passes, 0 (default) re-queries on every pass"`
+	DiscSlices     int                            `env:"IDBDS_DISCSLICES" section:"collections" desc:"Count of time sliced sub-queries used in instance discovery"`
+	EventsURL      string                         `env:"IDBDS_EVENTSURL" section:"logging" desc:"Lifecycle events broker URL (mqtt://[user:pass@]host:port or nats://[user:pass@]host:port)"`
+	EventsTopic    string                         `env:"IDBDS_EVENTSTOPIC" section:"logging" desc:"Lifecycle events topic prefix"`
+	NotifyWebhook  string                         `env:"IDBDS_NOTIFYWEBHOOK" section:"logging" desc:"Webhook URL receiving failure notifications"`
+	NotifyFormat   string                         `env:"IDBDS_NOTIFYFORMAT" section:"logging" desc:"Webhook payload format, slack or mattermost (text message) or generic (JSON), default generic"`
+	NotifySMTP     string                         `env:"IDBDS_NOTIFYSMTP" section:"logging" desc:"SMTP server host:port sending failure notifications by email"`
+	NotifySMTPUser string                         `env:"IDBDS_NOTIFYSMTPUSER" section:"logging" desc:"SMTP username, no authentication when empty"`
+	NotifySMTPPass string                         `env:"IDBDS_NOTIFYSMTPPASS" section:"logging" desc:"SMTP password"`
+	NotifyFrom     string                         `env:"IDBDS_NOTIFYFROM" section:"logging" desc:"Sender address of failure notification emails"`
+	NotifyTo       string                         `env:"IDBDS_NOTIFYTO" section:"logging" desc:"Comma separated recipient addresses of failure notification emails"`
+	NotifyFailures int                            `env:"IDBDS_NOTIFYFAILURES" section:"logging" desc:"Consecutive failures of instance in tier before notification is sent, default 3"`
+	LagThreshold   int                            `env:"IDBDS_LAGTHRESHOLD" section:"schedule" desc:"Lag of instance in tier in seconds which triggers lag threshold event, 0 disables"`
+	CardLookback   int                            `env:"IDBDS_CARDLOOKBACK" section:"collections" desc:"Cardinality query lookback in seconds for all buckets, retention period of bucket by default"`
+	CardLookbacks  map[string]int                 `section:"collections" desc:"Cardinality query lookback in seconds per bucket name"`
+	HTTPTimeout    int                            `env:"IDBDS_HTTPTIMEOUT" section:"db" desc:"HTTP request timeout in seconds, limits all query timeouts, default 600"`
+	QueryTimeout   int                            `env:"IDBDS_QUERYTIMEOUT" section:"db" desc:"Timeout in seconds of downsample queries for all destination buckets, limited by HTTPTimeout, disabled by default"`
+	QueryTimeouts  map[string]int                 `section:"db" desc:"Timeout in seconds of downsample queries per destination bucket name"`
+	DiscTimeout    int                            `env:"IDBDS_DISCTIMEOUT" section:"db" desc:"Timeout in seconds of instance discovery queries for all buckets, limited by HTTPTimeout, disabled by default"`
+	DiscTimeouts   map[string]int                 `section:"db" desc:"Timeout in seconds of instance discovery queries per queried bucket name"`
+	CardTimeout    int                            `env:"IDBDS_CARDTIMEOUT" section:"db" desc:"Timeout in seconds of cardinality queries for all buckets, limited by HTTPTimeout, disabled by default (highest rank is used on timeout)"`
+	CardTimeouts   map[string]int                 `section:"db" desc:"Timeout in seconds of cardinality queries per queried bucket name"`
+	StuckLimit     int                            `env:"IDBDS_STUCKLIMIT" section:"schedule" desc:"Skip instance in tier after this many consecutive query timeouts, default 3, -1 disables"`
+	StuckSkip      int                            `env:"IDBDS_STUCKSKIP" section:"schedule" desc:"Time in seconds stuck instance is skipped before next attempt, default 86400"`
+	Quarantine     int                            `env:"IDBDS_QUARANTINE" section:"schedule" desc:"Quarantine instance in tier after this many consecutive failures of any kind, 0 disables"`
+	QuarantineFor  int                            `env:"IDBDS_QUARANTINEFOR" section:"schedule" desc:"Time in seconds quarantined instance is skipped, default 21600"`
+	ClientWrite    bool                           `env:"IDBDS_CLIENTWRITE" section:"db" desc:"Return aggregation results to downsampler and write them by client instead of flux to()"`
+	ClientAsync    bool                           `env:"IDBDS_CLIENTASYNC" section:"db" desc:"Write batches of client-side aggregation in background while next batch is read, doubles memory of buffered points"`
+	DestURL        string                         `env:"IDBDS_DESTURL" section:"db" desc:"URL of separate InfluxDB server holding destination tiers (archive), raw data is read by query and aggregated data written by client"`
+	DestToken      string                         `env:"IDBDS_DESTTOKEN" section:"db" desc:"Authentication token of destination server"`
+	DestOrg        string                         `env:"IDBDS_DESTORG" section:"db" desc:"Organization of destination server"`
+	MirrorURL      string                         `env:"IDBDS_MIRRORURL" section:"db" desc:"URL of second InfluxDB destination written in parallel (migration), enables client-side aggregation"`
+	MirrorToken    string                         `env:"IDBDS_MIRRORTOKEN" section:"db" desc:"Authentication token of second InfluxDB destination"`
+	MirrorOrg      string                         `env:"IDBDS_MIRRORORG" section:"db" desc:"Organization of second InfluxDB destination"`
+	MirrorBuckets  map[string]string              `section:"buckets" desc:"Bucket names in second InfluxDB destination by bucket name, same name used if not mapped"`
+	GraphiteAddr   string                         `env:"IDBDS_GRAPHITEADDR" section:"logging" desc:"Graphite carbon receiver address host:port, enables client-side aggregation"`
+	GraphiteProto  string                         `env:"IDBDS_GRAPHITEPROTO" section:"logging" desc:"Graphite protocol, plaintext or pickle"`
+	GraphiteTmpl   string                         `env:"IDBDS_GRAPHITETMPL" section:"logging" desc:"Graphite metric path template, {bucket}, {measurement}, {field} and {<tag name>} are replaced"`
+	SpotInterval   int                            `env:"IDBDS_SPOTINTERVAL" section:"schedule" desc:"Interval in seconds of random aggregation spot checks, 0 disables"`
+	DeleteBefore   bool                           `env:"IDBDS_DELETEBEFORE" section:"buckets" desc:"Delete points of instance in target range of destination bucket before aggregating it, prevents overlapping aggregates when interrupted pass is rerun (v2 only)"`
+	ManageBuckets  bool                           `env:"IDBDS_MANAGEBUCKETS" section:"buckets" desc:"Create missing destination buckets and reconcile their retention periods with config on start (v2 only)"`
+	BillingBucket  string                         `env:"IDBDS_BILLINGBUCKET" section:"buckets" desc:"Bucket of 95th percentile interface bitrates written by billing command (v2 only)"`
+	BillingMeas    string                         `env:"IDBDS_BILLINGMEAS" section:"buckets" desc:"Measurement of 95th percentile interface bitrates written by billing command, default billing"`
+	RetEnforce     bool                           `env:"IDBDS_RETENFORCE" section:"buckets" desc:"Delete data older than retention period from destination buckets"`
+	RetDryRun      bool                           `env:"IDBDS_RETDRYRUN" section:"buckets" desc:"Only report data which would be removed by retention enforcement"`
+	ReapAfter      int                            `env:"IDBDS_REAPAFTER" section:"buckets" desc:"Delete series of instances without source data for this many days from destination buckets, 0 disables"`
+	ReapDryRun     bool                           `env:"IDBDS_REAPDRYRUN" section:"buckets" desc:"Only report series of decommissioned instances which would be deleted"`
+	ReapInterval   int                            `env:"IDBDS_REAPINTERVAL" section:"buckets" desc:"Interval in seconds of decommissioned instance cleanup, default 86400"`
+	RetInterval    int                            `env:"IDBDS_RETINTERVAL" section:"buckets" desc:"Interval in seconds of retention enforcement, default 86400"`
+	FieldAggr      map[string]map[string][]string `section:"collections" desc:"Aggregates (mean, min, max, first, last, sum, count, mode, p1-p99) per field overriding default handling, per collection"`
+	PctReaggr      string                         `env:"IDBDS_PCTREAGGR" section:"collections" desc:"Re-aggregation of percentiles in later tiers: max, mean or same (percentile of percentiles), default max"`
+	CounterReset   string                         `env:"IDBDS_COUNTERRESET" section:"collections" desc:"Rate of counter in interval where it decreased (reset or wrap): drop (default), zero or interpolate (increase counted from zero)"`
+	ResetStats     bool                           `env:"IDBDS_RESETSTATS" section:"collections" desc:"Count counter resets in source data of instances for status API, costs extra query per first tier batch"`
+	WriteVerify    bool                           `env:"IDBDS_WRITEVERIFY" section:"schedule" desc:"Count points written by every batch and flag windows with source data but no written points, costs extra query per batch"`
+	FieldRules     map[string][]FieldRule         `section:"collections" desc:"Aggregation rules of fields matched by regex overriding default handling, per collection, first matching rule wins, fields in FieldAggr take precedence"`
+	StringAggr     string                         `env:"IDBDS_STRINGAGGR" section:"collections" desc:"Aggregate of string (status) fields of gengauge and auto collections: last or mode (most frequent value), string fields are not supported when empty"`
+	GaugeExtras    map[string][]FieldRule         `section:"collections" desc:"Extra aggregates (first, last, spread) of gengauge fields matched by regex per collection, stored in addition to mean, max and min as fields with First, Last and Spread suffix, first matching rule wins"`
+	Templates      map[string]string              `section:"collections" desc:"Files of Go text/template Flux downsample queries per collection or collection kind, replacing built-in query (placeholders .Source, .Bucket, .Org, .Start, .Stop, .Every, .Instance, .TagKey, .Measurement, .First, .To)"`
+	RegexCols      map[string]RegexCol            `section:"collections" desc:"Collections applied to all measurements matching regex, by collection name"`
+	FieldKinds     []FieldKind                    `section:"collections" desc:"Classification of fields as counter or gauge for auto collections, first matching entry wins"`
+	LedgerFile     string                         `env:"IDBDS_LEDGERFILE" section:"schedule" desc:"File of processed ranges ledger, disabled when empty"`
+	CheckpointFile string                         `env:"IDBDS_CHECKPOINTFILE" section:"schedule" desc:"File of last downsampled timestamps per instance and tier, disabled when empty"`
+	PassFile       string                         `env:"IDBDS_PASSFILE" section:"schedule" desc:"File of pass progress per collection, interrupted pass is resumed and pass interval kept across restarts, disabled when empty"`
+	OnFailure      string                         `env:"IDBDS_ONFAILURE" section:"schedule" desc:"Handling of failed collection of daemon: exit (default, daemon stops) or restart (collection is restarted with backoff, other collections keep going)"`
+	Restarts       int                            `env:"IDBDS_RESTARTS" section:"schedule" desc:"Failed collection is given up after this many consecutive restarts while other collections keep going, 0 (default) restarts without limit"`
+	RestartDelay   int                            `env:"IDBDS_RESTARTDELAY" section:"schedule" desc:"Delay in seconds of restart of failed collection, doubled on every consecutive failure up to 1 hour, default 60"`
+	Revalidate     int                            `env:"IDBDS_REVALIDATE" section:"schedule" desc:"Interval in seconds of checkpoint validation against destination bucket, default 86400"`
+	IcingaTiming   string                         `env:"IDBDS_ICINGATIMING" section:"collections" desc:"Aggregation of icinga check execution_time and latency in every tier: exclude, mean or max"`
+	Quotas         map[string]float64             `section:"schedule" desc:"Share (0-1] of workers available to collection, collections without quota are not limited"`
+	PassInterval   int                            `env:"IDBDS_PASSINTERVAL" section:"schedule" desc:"Minimum interval in seconds of passes of collections without own interval in Intervals, default 10800"`
+	PassJitter     int                            `env:"IDBDS_PASSJITTER" section:"schedule" desc:"Random delay in seconds up to this is added to sleep between passes, so passes of several downsamplers don't start simultaneously, 0 disables"`
+	Intervals      map[string]int                 `section:"schedule" desc:"Minimum interval in seconds of passes per collection, PassInterval by default"`
+	TierIntervals  map[string]int                 `section:"schedule" desc:"Minimum interval in seconds of downsampling of destination bucket by bucket name, bucket is skipped in passes until it elapses"`
+	GroupWorkers   map[string]int                 `section:"schedule" desc:"Maximum count of workers busy with instances of cardinality group (light, medium, hevy), groups without limit are not limited"`
+	LightBatch     int                            `env:"IDBDS_LIGHTBATCH" section:"schedule" desc:"Maximum count of queued light instances of the same tier downsampled together with one query, 0 or 1 disables"`
+	GroupPriority  map[string]float64             `section:"schedule" desc:"Priority multiplier of instances of cardinality group (light, medium, hevy), default 1"`
+	GroupIntervals map[string]int                 `section:"schedule" desc:"Minimum interval in seconds of downsampling of instances of cardinality group (light, medium, hevy) in tier, group is skipped in passes until it elapses"`
+	TagKeys        map[string]string              `section:"collections" desc:"Tag identifying instance per collection, agent_name (hostname for icingachk) by default"`
+	Include        []string                       `section:"collections" desc:"Regexes of instance names (values of tag identifying instance) to downsample, all instances when empty"`
+	Exclude        []string                       `section:"collections" desc:"Regexes of instance names excluded from downsampling, applied after Include"`
+	Shards         int                            `env:"IDBDS_SHARDS" section:"collections" desc:"Count of downsampler processes sharing instances of all collections by hash of instance name, sharding disabled below 2"`
+	Shard          int                            `env:"IDBDS_SHARD" section:"collections" desc:"Shard index (0 to Shards-1) of this process"`
+	NewInstCheck   int                            `env:"IDBDS_NEWINSTCHECK" section:"schedule" desc:"Interval in seconds of discovery of new instances between passes, new instances are downsampled immediately ahead of the next pass, 0 disables"`
+	Rediscover     int                            `env:"IDBDS_REDISCOVER" section:"schedule" desc:"Interval in seconds of re-discovery of new instances during pass, 0 disables"`
+	Chains         map[string]Chain               `section:"buckets" desc:"Bucket chains per collection replacing built-in ones"`
+	Specs          map[string]CollectionSpec      `section:"collections" desc:"Collections defined declaratively, downsample query generated from spec, bucket chain of collection required in Chains"`
+	Connections    map[string]Connection          `section:"db" desc:"Several InfluxDB connections downsampled concurrently in one process, each overriding connection, collections and bucket chains of top level config"`
+}
+
+// InfluxDB connection overriding top level config
+type Connection struct {
+	DbURL          string           `desc:"InfluxDB API URL"`
+	DbFlavor       string           `desc:"InfluxDB flavor (v1, v2, v3)"`
+	Token          string           `desc:"InfluxDB API token"`
+	TokenFile      string           `desc:"File holding InfluxDB API token"`
+	TokenSecret    string           `desc:"InfluxDB API token in external secret store (vault:PATH#KEY or aws:SECRET-ID[#KEY])"`
+	DbUser         string           `desc:"InfluxDB 1.x user, instead of token"`
+	DbPassword     string           `desc:"InfluxDB 1.x password of DbUser"`
+	Org            string           `desc:"InfluxDB organization"`
+	StatsBucket    string           `desc:"Bucket of InfluxDB internal stats"`
+	ResMonSource   string           `desc:"Source of resource monitor data (stats, metrics)"`
+	MemLimit       float64          `desc:"InfluxDB memory usage limit in percent"`
+	MaxTasks       int              `desc:"Pause work while more InfluxDB tasks than this are running"`
+	Workers        int              `desc:"Count of concurrent downsample workers of connection"`
+	QueryRate      int              `desc:"Maximum count of queries per minute of connection, top level limit applies to all connections together"`
+	QueryConc      int              `desc:"Maximum count of concurrent queries of connection, top level limit applies to all connections together"`
+	DsCollections  string           `desc:"Comma separated list of collections to downsample"`
+	Chains         map[string]Chain `desc:"Bucket chains per collection, replace chains of top level config"`
+	HTTPListen     string           `desc:"Listen address of status API of connection, top level address is not inherited"`
+	AdminListen    string           `desc:"Listen address of admin API of connection, top level address is not inherited"`
+	LedgerFile     string           `desc:"File of processed ranges ledger, top level file with connection name suffix by default"`
+	CheckpointFile string           `desc:"File of last downsampled timestamps, top level file with connection name suffix by default"`
+	PassFile       string           `desc:"File of pass progress, top level file with connection name suffix by default"`
+}
+
+// Declarative collection definition
+type CollectionSpec struct {
+	TagKey       string      `desc:"Tag identifying instance"`
+	Measurements []string    `desc:"Measurement names of collection"`
+	Fields       []FieldRule `desc:"Aggregation rules of fields, field matching several rules is handled by the first one, unmatched fields are dropped"`
+}
+
+// Aggregation rule of fields
+type FieldRule struct {
+	Match      string   `desc:"Field name regex"`
+	Aggregates []string `desc:"Aggregates (mean, min, max, first, last, sum, count, mode, p1-p99 percentile) stored with aggregate tag"`
+	Rate       bool     `desc:"Aggregate per second rate of counter instead of raw values in first tier"`
+}
+
+// Bucket chain of collection
+type Chain struct {
+	Sources []Tier `desc:"Raw source buckets feeding the first destination tier"`
+	Tiers   []Tier `desc:"Destination tiers ordered from finest to coarsest, each fed by the previous one"`
+	Direct  []Tier `desc:"Destination tiers aggregated directly from raw source buckets, skipping intermediate tiers"`
+	Buckets []Tier `desc:"Buckets linked by parent name, alternative to Sources, Tiers and Direct"`
+}
+
+// Bucket tier of chain
+type Tier struct {
+	Name    string `desc:"Bucket name"`
+	AInterv int    `desc:"Aggregation interval in seconds"`
+	RPeriod int    `desc:"Retention period in seconds"`
+	Parent  string `desc:"Bucket feeding this bucket, empty for raw source bucket (Buckets only)"`
+	Offset  int    `desc:"Shift of aggregation window boundaries from unix epoch in seconds, e.g. to align windows to local midnight"`
+	TimeSrc string `desc:"Timestamp of aggregated window, _stop (default) or _start"`
+	Empty   bool   `desc:"Create empty windows (createEmpty of aggregateWindow), only aggregates with value for empty window like count are written"`
+}
+
+// Collection applied to measurements matching regex
+type RegexCol struct {
+	Match  string      `desc:"Measurement name regex"`
+	Kind   string      `desc:"Collection handling applied to matched measurements (ifstats, iftraffic, gengauge, gencounter, auto)"`
+	TagKey string      `desc:"Tag identifying instance in matched measurements, agent_name by default"`
+	Fields []FieldRule `desc:"Aggregation rules of fields of matched measurements, first matching rule wins, unmatched fields get default handling of kind"`
+}
+
+// Field classification for automatic counter/gauge handling
+type FieldKind struct {
+	Match string `desc:"Field name regex"`
+	Kind  string `desc:"Field kind, counter or gauge"`
 }
 
 // Fills Configuration struct. Prefers environment variables
 func GetConfig() (*Configuration, error) {
-	conf := new(Configuration)
-
 	f := "/opt/idbdownsampler/etc/idbdownsampler.conf"
 	if os.Getenv("IDBDS_CONF") != "" {
 		f = os.Getenv("IDBDS_CONF")
@@ -31,10 +233,195 @@ func GetConfig() (*Configuration, error) {
 		f = "/opt/idbdownsampler/etc/idbdownsampler_testdb.conf"
 	}
 
-	err := gonfig.GetConf(f, conf)
+	return GetConfigFile(f)
+}
+
+// Fills Configuration struct from given file. Prefers environment variables.
+// File may be in JSON, YAML or TOML (.toml extension) format, with keys at top level or in sections.
+func GetConfigFile(f string) (*Configuration, error) {
+	conf := new(Configuration)
+
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err = toJSON(f, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid config syntax: %w", f, err)
+	}
+
+	// Validate config file against schema
+	err = ValidateConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f, err)
+	}
+
+	data, err = flatten(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f, err)
+	}
+	err = json.Unmarshal(data, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only environment variables are read when file name is empty
+	err = gonfig.GetConf("", conf)
 	if err != nil {
 		return nil, err
 	}
 
 	return conf, nil
 }
+
+// toJSON converts content of config file to JSON.
+//
+// Parameters:
+//
+//	f string - config file name, TOML is detected by .toml extension
+//	data []byte - file content
+//
+// Returns:
+//
+//	[]byte - JSON content
+//	error - an error, if any
+func toJSON(f string, data []byte) ([]byte, error) {
+	switch {
+	case strings.EqualFold(filepath.Ext(f), ".toml"):
+		var m map[string]interface{}
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return json.Marshal(m)
+	case json.Valid(data):
+		return data, nil
+	default:
+		return yaml.YAMLToJSON(data)
+	}
+}
+
+// flatten moves keys of sections to top level of JSON config.
+//
+// Parameters:
+//
+//	data []byte - JSON config
+//
+// Returns:
+//
+//	[]byte - JSON config without sections
+//	error - an error, if key is set more than once
+func flatten(data []byte) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	for n, raw := range m {
+		if _, ok := sections[strings.ToLower(n)]; !ok {
+			continue
+		}
+		delete(m, n)
+
+		var sm map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &sm); err != nil {
+			return nil, fmt.Errorf("invalid section %s: %w", n, err)
+		}
+		for k, v := range sm {
+			if _, dup := m[k]; dup {
+				return nil, fmt.Errorf("key %s set more than once", k)
+			}
+			m[k] = v
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+// ForConnection returns configuration of named connection. Connection values override
+// top level values, state files get connection name suffix unless set by connection.
+//
+// Parameters:
+//
+//	name string - connection name
+//
+// Returns:
+//
+//	*Configuration - configuration of connection
+func (c *Configuration) ForConnection(name string) *Configuration {
+	cc := c.Connections[name]
+	r := *c
+	r.Connections = nil
+	r.HTTPListen = cc.HTTPListen
+	r.AdminListen = cc.AdminListen
+	r.QueryRate = cc.QueryRate
+	r.QueryConc = cc.QueryConc
+
+	str := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	str(&r.DbURL, cc.DbURL)
+	str(&r.DbFlavor, cc.DbFlavor)
+	str(&r.Org, cc.Org)
+	str(&r.StatsBucket, cc.StatsBucket)
+	str(&r.ResMonSource, cc.ResMonSource)
+	str(&r.DsCollections, cc.DsCollections)
+	if cc.Token != "" || cc.TokenFile != "" || cc.TokenSecret != "" || cc.DbUser != "" {
+		r.Token, r.TokenFile, r.TokenSecret = cc.Token, cc.TokenFile, cc.TokenSecret
+		r.DbUser, r.DbPassword = cc.DbUser, cc.DbPassword
+	}
+	if cc.MemLimit > 0 {
+		r.MemLimit = cc.MemLimit
+	}
+	if cc.MaxTasks != 0 {
+		r.MaxTasks = cc.MaxTasks
+	}
+	if cc.Workers > 0 {
+		r.Workers = cc.Workers
+	}
+	if cc.Chains != nil {
+		r.Chains = cc.Chains
+	}
+
+	// State of connections is kept apart
+	suffix := func(f string) string {
+		if f == "" {
+			return ""
+		}
+		ext := filepath.Ext(f)
+		return strings.TrimSuffix(f, ext) + "." + name + ext
+	}
+	r.LedgerFile = suffix(r.LedgerFile)
+	r.CheckpointFile = suffix(r.CheckpointFile)
+	r.PassFile = suffix(r.PassFile)
+	str(&r.LedgerFile, cc.LedgerFile)
+	str(&r.CheckpointFile, cc.CheckpointFile)
+	str(&r.PassFile, cc.PassFile)
+
+	return &r
+}
+
+// Redacted returns copy of configuration with secrets masked.
+func (c Configuration) Redacted() Configuration {
+	for _, s := range []*string{&c.Token, &c.DbPassword, &c.DestToken, &c.MirrorToken, &c.AdminToken, &c.NotifyWebhook, &c.NotifySMTPPass} {
+		if *s != "" {
+			*s = "<redacted>"
+		}
+	}
+	if c.Connections != nil {
+		conns := make(map[string]Connection, len(c.Connections))
+		for n, cc := range c.Connections {
+			if cc.Token != "" {
+				cc.Token = "<redacted>"
+			}
+			if cc.DbPassword != "" {
+				cc.DbPassword = "<redacted>"
+			}
+			conns[n] = cc
+		}
+		c.Connections = conns
+	}
+
+	return c
+}
@@ -0,0 +1,279 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// JSON Schema of configuration
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+// Sections grouping keys of nested config file
+var sections = map[string]string{
+	"db":          "InfluxDB connection, retries and resource limits",
+	"collections": "Collections and aggregation rules of their fields",
+	"buckets":     "Bucket chains, bucket management and retention",
+	"schedule":    "Workers, batch sizing and scheduling of passes",
+	"logging":     "Status API, events, profiles and exports",
+}
+
+// GetSchema returns JSON Schema of Configuration struct.
+// Keys are accepted at top level or in their section.
+func GetSchema() *Schema {
+	t := reflect.TypeOf(Configuration{})
+	s := typeSchema(t)
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.Title = "idbdownsampler configuration"
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		n := f.Tag.Get("section")
+		if n == "" {
+			continue
+		}
+		sec, ok := s.Properties[n]
+		if !ok {
+			sec = &Schema{
+				Type:                 "object",
+				Description:          sections[n],
+				Properties:           make(map[string]*Schema),
+				AdditionalProperties: false,
+			}
+			s.Properties[n] = sec
+		}
+		sec.Properties[fieldName(f)] = s.Properties[fieldName(f)]
+	}
+
+	return s
+}
+
+// typeSchema builds JSON Schema of given type using reflection.
+// Field descriptions are taken from "desc" struct tags.
+func typeSchema(t reflect.Type) *Schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: typeSchema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: typeSchema(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{
+			Type:                 "object",
+			Properties:           make(map[string]*Schema),
+			AdditionalProperties: false,
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			fs := typeSchema(f.Type)
+			fs.Description = f.Tag.Get("desc")
+			if e := f.Tag.Get("env"); e != "" {
+				if fs.Description != "" {
+					fs.Description += ". "
+				}
+				fs.Description += "Environment variable " + e
+			}
+			s.Properties[fieldName(f)] = fs
+		}
+		return s
+	default:
+		return &Schema{}
+	}
+}
+
+// fieldName returns config key of struct field.
+func fieldName(f reflect.StructField) string {
+	if n, _, _ := strings.Cut(f.Tag.Get("json"), ","); n != "" && n != "-" {
+		return n
+	}
+
+	return f.Name
+}
+
+// property returns schema of object property. Keys are matched case-insensitively like in encoding/json.
+func (s *Schema) property(k string) *Schema {
+	if p, ok := s.Properties[k]; ok {
+		return p
+	}
+	for n, p := range s.Properties {
+		if strings.EqualFold(n, k) {
+			return p
+		}
+	}
+	if ap, ok := s.AdditionalProperties.(*Schema); ok {
+		return ap
+	}
+
+	return nil
+}
+
+// schema validator working on json token stream
+type validator struct {
+	data []byte
+	dec  *json.Decoder
+	errs []string
+}
+
+// ValidateConfig validates configuration file content against configuration schema.
+// Returned error lists all problems with their locations.
+//
+// Parameters:
+//
+//	data []byte - content of JSON or YAML config file, TOML must be converted by toJSON first
+//
+// Returns:
+//
+//	error - validation error, if any
+func ValidateConfig(data []byte) error {
+	// YAML config has no exact locations
+	if !json.Valid(data) {
+		j, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			return fmt.Errorf("invalid config syntax: %w", err)
+		}
+		data = j
+	}
+
+	v := &validator{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	v.dec.UseNumber()
+	err := v.walk(GetSchema(), "$")
+	if err != nil {
+		return fmt.Errorf("invalid config syntax: %w", err)
+	}
+	if len(v.errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(v.errs, "\n  "))
+	}
+
+	return nil
+}
+
+// location returns line and column of current decoder position.
+func (v *validator) location() string {
+	off := int(v.dec.InputOffset())
+	if off > len(v.data) {
+		off = len(v.data)
+	}
+	line := bytes.Count(v.data[:off], []byte("\n")) + 1
+	col := off - bytes.LastIndexByte(v.data[:off], '\n')
+
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
+
+// errorf records validation error with location.
+func (v *validator) errorf(path, format string, a ...interface{}) {
+	v.errs = append(v.errs, fmt.Sprintf("%s (%s): %s", path, v.location(), fmt.Sprintf(format, a...)))
+}
+
+// walk validates next value of token stream against schema. Nil schema accepts any value.
+func (v *validator) walk(s *Schema, path string) error {
+	tok, err := v.dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			return errors.New("unexpected end of input")
+		}
+		return err
+	}
+
+	typ := ""
+	if s != nil {
+		typ = s.Type
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			if typ != "" && typ != "object" {
+				v.errorf(path, "expected %s, got object", typ)
+				s = nil
+			}
+			for v.dec.More() {
+				kt, err := v.dec.Token()
+				if err != nil {
+					return err
+				}
+				k, _ := kt.(string)
+				var ps *Schema
+				if s != nil {
+					ps = s.property(k)
+					if ps == nil {
+						v.errorf(path+"."+k, "unknown key")
+					}
+				}
+				if err := v.walk(ps, path+"."+k); err != nil {
+					return err
+				}
+			}
+		case '[':
+			if typ != "" && typ != "array" {
+				v.errorf(path, "expected %s, got array", typ)
+				s = nil
+			}
+			var is *Schema
+			if s != nil {
+				is = s.Items
+			}
+			for n := 0; v.dec.More(); n++ {
+				if err := v.walk(is, path+"["+strconv.Itoa(n)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+		// closing delimiter
+		if _, err := v.dec.Token(); err != nil {
+			return err
+		}
+	case string:
+		if typ != "" && typ != "string" {
+			v.errorf(path, "expected %s, got string %q", typ, t)
+		}
+	case bool:
+		if typ != "" && typ != "boolean" {
+			v.errorf(path, "expected %s, got boolean", typ)
+		}
+	case json.Number:
+		switch typ {
+		case "", "number":
+		case "integer":
+			if _, err := strconv.ParseInt(t.String(), 10, 64); err != nil {
+				v.errorf(path, "expected integer, got %s", t)
+			}
+		default:
+			v.errorf(path, "expected %s, got number %s", typ, t)
+		}
+	case nil:
+		if typ != "" {
+			v.errorf(path, "expected %s, got null", typ)
+		}
+	}
+
+	return nil
+}
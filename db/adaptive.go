@@ -0,0 +1,96 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// AdaptiveBatch holds parameters and state of adaptive sizing of downsample batches.
+// Batch of instance is grown when queries complete fast and shrunk when they
+// approach query timeout or are aborted by memory pressure.
+type AdaptiveBatch struct {
+	Min   int           // floor of aggregation windows in one query
+	Max   int           // ceiling of aggregation windows in one query
+	Fast  time.Duration // batch is grown when query completes faster
+	Slow  time.Duration // batch is shrunk when query takes longer
+	mu    sync.Mutex
+	sizes map[string]int
+}
+
+// NewAdaptiveBatch returns adaptive batch sizing with given bounds.
+//
+// Parameters:
+//
+//	lo int - floor of aggregation windows in one query
+//	hi int - ceiling of aggregation windows in one query
+//	fast time.Duration - batch is grown when query completes faster
+//	slow time.Duration - batch is shrunk when query takes longer
+//
+// Returns:
+//
+//	*AdaptiveBatch - adaptive batch sizing
+func NewAdaptiveBatch(lo, hi int, fast, slow time.Duration) *AdaptiveBatch {
+	return &AdaptiveBatch{Min: lo, Max: hi, Fast: fast, Slow: slow, sizes: make(map[string]int)}
+}
+
+// clamp limits count of windows to configured bounds.
+func (a *AdaptiveBatch) clamp(n int) int {
+	if n < a.Min {
+		n = a.Min
+	}
+	if a.Max > 0 && n > a.Max {
+		n = a.Max
+	}
+
+	return n
+}
+
+// windows returns count of windows in one query for instance in bucket.
+// Cardinality based count is used until batch of instance is adjusted.
+//
+// Parameters:
+//
+//	key string - bucket and instance
+//	def int - cardinality based count of windows
+//
+// Returns:
+//
+//	int - count of aggregation windows
+func (a *AdaptiveBatch) windows(key string, def int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n, ok := a.sizes[key]; ok {
+		return n
+	}
+
+	return a.clamp(def)
+}
+
+// adjust resizes batch of instance in bucket according to duration of last query.
+//
+// Parameters:
+//
+//	key string - bucket and instance
+//	n int - count of windows in last query
+//	d time.Duration - duration of last query
+//	pressure bool - last query was aborted by memory pressure
+//
+// Returns:
+//
+//	int - count of windows in next query
+func (a *AdaptiveBatch) adjust(key string, n int, d time.Duration, pressure bool) int {
+	switch {
+	case pressure || d > a.Slow:
+		n /= 2
+	case d < a.Fast:
+		n *= 2
+	}
+	n = a.clamp(n)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sizes[key] = n
+
+	return n
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// how long field classification of measurement is cached
+const kindsTTL = 24 * time.Hour
+
+// field name patterns of counters
+var counterNameRe = regexp.MustCompile(`(?i)(^if(HC)?(In|Out)|octets$|pkts$|packets$|errors$|discards$|drops$|bytes$|_total$)`)
+
+// FieldKind classifies fields matching regex as counter or gauge
+type FieldKind struct {
+	Re   *regexp.Regexp
+	Kind string
+}
+
+// cached field classification of measurement
+type measFields struct {
+	counters []string
+	ts       time.Time
+}
+
+// cache of field classifications
+type kindsCache struct {
+	mu    sync.Mutex
+	meass map[string]measFields
+}
+
+// classify returns kind of field based on configured metadata map and field name patterns.
+// Returns empty string if field can't be classified by name.
+func (i *Influx) classify(field string) string {
+	for _, fk := range i.FieldKinds {
+		if fk.Re.MatchString(field) {
+			return fk.Kind
+		}
+	}
+	if counterNameRe.MatchString(field) {
+		return "counter"
+	}
+
+	return ""
+}
+
+// counterFields returns counter fields of measurement in source bucket.
+// Fields are classified by metadata map, name patterns and for the rest by
+// sampling monotonicity of recent values of instance. Result is cached.
+//
+// Parameters:
+//
+//	b *Bucket - the source bucket
+//	col string - the measurement
+//	inst string - the instance used for sampling
+//
+// Returns:
+//
+//	[]string - counter fields
+//	error - an error, if any
+func (i *Influx) counterFields(b *Bucket, col, inst string) ([]string, error) {
+	i.kinds.mu.Lock()
+	defer i.kinds.mu.Unlock()
+	if mf, ok := i.kinds.meass[col]; ok && time.Since(mf.ts) < kindsTTL {
+		return mf.counters, nil
+	}
+
+	st := time.Now().Add(-10 * b.AInterv).Unix()
+
+	// All fields of measurement
+	q := `import "influxdata/influxdb/schema"
+		schema.measurementFieldKeys(
+			bucket: ` + queries.Str(b.Name) + `,
+			measurement: ` + queries.Str(col) + `,
+			start: ` + fmt.Sprintf("%d", st) + `
+		)`
+	helpers.PrintDbg(fmt.Sprintf("field keys query for %s:\n %s", b.Name, q))
+
+	var counters, unknown []string
+	result, done, err := i.query(b, q)
+	if err != nil {
+		return nil, err
+	}
+	for result.Next() {
+		f, ok := result.Record().Value().(string)
+		if !ok {
+			continue
+		}
+		switch i.classify(f) {
+		case "counter":
+			counters = append(counters, f)
+		case "":
+			unknown = append(unknown, f)
+		}
+	}
+	// Release query slot before sampling
+	err = result.Err()
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sample monotonicity of unclassified numeric fields
+	if len(unknown) > 0 {
+		f, err := i.instFilter(col, inst)
+		if err != nil {
+			return nil, err
+		}
+		sample := func(fn string) (map[string]float64, error) {
+			q := `import "types"
+				from(bucket: ` + queries.Str(b.Name) + `)
+					|> range(start: ` + fmt.Sprintf("%d", st) + `)
+					|> filter(fn: (r) => ` + f + `)
+					|> filter(fn: (r) => types.isNumeric(v: r._value))
+					|> map(fn: (r) => ({r with _value: float(v: r._value)}))
+					|> difference()
+					|> group(columns: ["_field"])
+					|> ` + fn + `()`
+			helpers.PrintDbg(fmt.Sprintf("field monotonicity query for %s:\n %s", b.Name, q))
+
+			res := make(map[string]float64)
+			result, done, err := i.query(b, q)
+			defer done()
+			if err != nil {
+				return nil, err
+			}
+			for result.Next() {
+				if v, ok := result.Record().Value().(float64); ok {
+					res[result.Record().Field()] = v
+				}
+			}
+			return res, result.Err()
+		}
+
+		mins, err := sample("min")
+		if err != nil {
+			return nil, err
+		}
+		maxs, err := sample("max")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range unknown {
+			// Counter never decreases and does increase
+			mn, ok1 := mins[f]
+			mx, ok2 := maxs[f]
+			if ok1 && ok2 && mn >= 0 && mx > 0 {
+				counters = append(counters, f)
+			}
+		}
+	}
+
+	sort.Strings(counters)
+	helpers.PrintDbg(fmt.Sprintf("counter fields of %s in %s: %s", col, b.Name, strings.Join(counters, ", ")))
+	i.kinds.meass[col] = measFields{counters: counters, ts: time.Now()}
+
+	return counters, nil
+}
+
+// fieldsRe returns flux regex literal matching any of given fields exactly.
+// Returns regex which never matches if there are no fields.
+func fieldsRe(fields []string) string {
+	if len(fields) == 0 {
+		return `/^$/`
+	}
+	quoted := make([]string, len(fields))
+	for n, f := range fields {
+		quoted[n] = regexp.QuoteMeta(f)
+	}
+
+	return queries.Regex(`^(` + strings.Join(quoted, "|") + `)$`)
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// predStr returns delete API predicate string literal of s.
+func predStr(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// deletePredicates returns delete API predicates matching all data of instance based on collection.
+// Predicates can't contain alternatives, so collections of several measurements get one per measurement.
+//
+// Parameters:
+//
+//	col string - the collection
+//	inst string - the instance name
+//
+// Returns:
+//
+//	[]string - delete predicates
+//	error - an error, if any
+func (i *Influx) deletePredicates(col, inst string) ([]string, error) {
+	switch i.Kind(col) {
+	case "ifstats", "iftraffic", "gengauge", "gencounter", "auto":
+		return []string{`_measurement=` + predStr(col) + ` AND ` + i.TagKey(col) + `=` + predStr(inst)}, nil
+	case "icingachk":
+		return []string{i.TagKey(col) + `=` + predStr(inst)}, nil
+	case "spec":
+		s := i.Specs[col]
+		res := make([]string, len(s.Measurements))
+		for n, m := range s.Measurements {
+			res[n] = `_measurement=` + predStr(m) + ` AND ` + s.TagKey + `=` + predStr(inst)
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("unknown collection %s", col)
+	}
+}
+
+// deleteRange deletes points of instance aggregated to windows of given range from destination bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) deleteRange(b *Bucket, inst, col string, fTs, tTs time.Time) error {
+	preds, err := i.deletePredicates(col, inst)
+	if err != nil {
+		return err
+	}
+
+	// Window results are stamped with window stop, (fTs, tTs] holds windows of range, or with
+	// window start, [fTs, tTs). Delete range includes both ends
+	st, stop := fTs.Add(time.Second), tTs
+	if b.Window.TimeSrc == "_start" {
+		st, stop = fTs, tTs.Add(-time.Second)
+	}
+	for _, p := range preds {
+		if i.DryRun {
+			helpers.PrintInfo(fmt.Sprintf("dry-run, %s, %s: delete %s - %s where %s", b.Name, inst, st, stop, p))
+			continue
+		}
+		client, org := i.server(b)
+		err := i.retryRL(i.ctx, func() error {
+			return client.DeleteAPI().DeleteWithName(i.ctx, org, b.Name, st, stop, p)
+		})
+		if err != nil {
+			return fmt.Errorf("can't delete conflicting points - %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Backfill re-downsamples instance in given time range regardless of data already aggregated
+// to destination bucket. Points of instance in range are deleted from destination bucket first.
+// Range is aligned to aggregation windows of bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) Backfill(b *Bucket, inst, col string, fTs, tTs time.Time) error {
+	if i.Flavor != FlavorV2 {
+		return fmt.Errorf("backfill not supported by db flavor %s", i.Flavor)
+	}
+	fTs = windowStart(fTs, b)
+	tTs = windowStart(tTs, b)
+	if !fTs.Before(tTs) {
+		return nil
+	}
+
+	if err := i.deleteRange(b, inst, col, fTs, tTs); err != nil {
+		return err
+	}
+
+	card, err := i.Cardinality(b.From, inst, col)
+	if err != nil {
+		helpers.PrintWarn(fmt.Sprintf("error getting cardinality: %v. Using default", err))
+	}
+	c := time.Duration(i.BatchWindows(card)) * b.AInterv
+
+	for st := fTs; st.Before(tTs); st = st.Add(c) {
+		stop := st.Add(c)
+		if stop.After(tTs) {
+			stop = tTs
+		}
+		if err := i.ctx.Err(); err != nil {
+			return err
+		}
+		if err := i.waitResources(); err != nil {
+			return err
+		}
+
+		if err := i.runBatch(b, inst, col, st, stop); err != nil {
+			return err
+		}
+		if !i.DryRun {
+			i.Ledger.Add(col, b.Name, inst, st, stop, b.RPeriod)
+		}
+	}
+
+	return nil
+}
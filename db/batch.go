@@ -0,0 +1,436 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+// ErrQueryTimeout is returned when downsample query exceeds timeout of destination bucket
+var ErrQueryTimeout = errors.New("query timeout")
+
+// trange is time range of downsample batch
+type trange struct {
+	start time.Time
+	stop  time.Time
+}
+
+// isServerErr checks if error is 5xx response from InfluxDB.
+// Writes via to() may have been partially executed in that case.
+func isServerErr(err error) bool {
+	var herr *ihttp.Error
+	return errors.As(err, &herr) && herr.StatusCode >= http.StatusInternalServerError
+}
+
+// runBatch executes downsample query for given time range.
+// On 5xx response it checks destination bucket for completely written windows and
+// re-runs query only for the rest. Queries aborted by resource gate are
+// re-run split in halves when resources are available again.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) runBatch(b *Bucket, inst, col string, fTs, tTs time.Time) error {
+	ranges := []trange{{start: fTs, stop: tTs}}
+	for attempt := 0; ; attempt++ {
+		var failed []trange
+		var lastErr error
+		for n := 0; n < len(ranges); n++ {
+			r := ranges[n]
+			gctx := i.gate.context()
+			ctx, cancel := gctx, context.CancelFunc(func() {})
+			if b.Timeout > 0 {
+				ctx, cancel = context.WithTimeout(gctx, b.Timeout)
+			}
+			var err error
+			if i.Flavor == FlavorV3 {
+				err = i.sqlBatch(ctx, b, inst, col, r.start, r.stop)
+			} else {
+				err = i.fluxBatch(ctx, b, inst, col, r.start, r.stop)
+			}
+			timedOut := ctx.Err() == context.DeadlineExceeded
+			cancel()
+			if err != nil && i.ctx.Err() != nil {
+				return i.ctx.Err()
+			}
+			if err != nil && gctx.Err() != nil {
+				helpers.PrintWarn(fmt.Sprintf("%s, %s: downsample query aborted by resource gate, retry in smaller parts", b.Name, inst))
+				if err := i.waitResources(); err != nil {
+					return err
+				}
+				ranges = append(ranges, splitRange(b, r)...)
+				continue
+			}
+			if err != nil && timedOut {
+				return fmt.Errorf("%w: %s, %s: downsample query exceeded %s", ErrQueryTimeout, b.Name, inst, b.Timeout.String())
+			}
+			if err != nil {
+				if !isServerErr(err) {
+					return fmt.Errorf("influx query error - %w", err)
+				}
+				failed = append(failed, r)
+				lastErr = err
+			}
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+		if attempt >= i.WrRetries {
+			return fmt.Errorf("influx query error after %d retries - %w", attempt, lastErr)
+		}
+
+		// Find out which windows are still missing in destination
+		ranges = ranges[:0]
+		for _, r := range failed {
+			ranges = append(ranges, i.missingRanges(b, inst, col, r)...)
+		}
+		helpers.PrintWarn(fmt.Sprintf("%s, %s: server error on downsample - %v; retry %d/%d on %d missing sub-ranges", b.Name, inst, lastErr, attempt+1, i.WrRetries, len(ranges)))
+		if len(ranges) == 0 {
+			return nil
+		}
+
+		// Back off at least as requested by server
+		d := time.Duration(attempt+1) * 10 * time.Second
+		if ra, ok := RateLimitDelay(lastErr); ok && ra > d {
+			d = ra
+		}
+		if err := sleepCtx(i.ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// fluxBatch executes flux downsample query for given time range.
+// Results are written by server or by client when client-side aggregation is enabled.
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) fluxBatch(ctx context.Context, b *Bucket, inst, col string, fTs, tTs time.Time) error {
+	q, err := i.dsQuery(b, inst, col, fTs, tTs)
+	if err != nil {
+		return err
+	}
+
+	helpers.PrintDbg(fmt.Sprintf("downsample query for %s:\n %s", b.Name, q))
+
+	// Only log query which would be executed
+	if i.DryRun {
+		helpers.PrintInfo(fmt.Sprintf("dry-run, %s, %s: downsample query:\n%s", b.Name, inst, q))
+		return nil
+	}
+
+	if i.ClientWrite {
+		return i.clientWrite(ctx, b, q)
+	}
+	_, err = i.queryRaw(ctx, b.From, q)
+
+	return err
+}
+
+// windowStart returns start of aggregation window of bucket containing t.
+// Windows are aligned to unix epoch shifted by window offset like in flux aggregateWindow().
+func windowStart(t time.Time, b *Bucket) time.Time {
+	s := int64(b.AInterv / time.Second)
+	if s <= 0 {
+		return t
+	}
+	u := t.Unix() - int64(b.Window.Offset/time.Second)
+	m := u % s
+	if m < 0 {
+		m += s
+	}
+	return t.Add(-time.Duration(m) * time.Second).Truncate(time.Second)
+}
+
+// aggrWindow returns flux aggregateWindow() pipe of bucket using given aggregate function.
+func (b *Bucket) aggrWindow(fn string) string {
+	return queries.AggregateWindow{
+		Every:       b.AInterv,
+		Offset:      b.Window.Offset,
+		Fn:          fn,
+		TimeSrc:     b.Window.TimeSrc,
+		CreateEmpty: b.Window.CreateEmpty,
+	}.String()
+}
+
+// instFilter returns flux filter predicate matching all data of instance based on collection.
+//
+// Parameters:
+//
+//	col string - the collection
+//	inst string - the instance name
+//
+// Returns:
+//
+//	string - filter predicate
+//	error - an error, if any
+func (i *Influx) instFilter(col, inst string) (string, error) {
+	switch i.Kind(col) {
+	case "ifstats", "iftraffic", "gengauge", "gencounter", "auto":
+		return `r._measurement == ` + queries.Str(col) + `
+			and ` + instEq(i.TagKey(col), inst), nil
+	case "icingachk":
+		return instEq(i.TagKey(col), inst), nil
+	case "spec":
+		return i.Specs[col].instFilter(inst), nil
+	default:
+		return "", fmt.Errorf("unknown collection %s", col)
+	}
+}
+
+// writtenWindows returns timestamps of windows of given time range which have aggregated data
+// in destination bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	map[int64]bool - unix timestamps of written windows
+//	error - an error, if any
+func (i *Influx) writtenWindows(b *Bucket, inst, col string, fTs, tTs time.Time) (map[int64]bool, error) {
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return nil, err
+	}
+
+	// Written window timestamps (aggregateWindow uses window stop or start as _time)
+	q := queries.RangeQuery{Bucket: b.Name, Start: fTs, Stop: tTs.Add(b.AInterv), Filters: []string{f}}.String() + `
+			|> group()
+			|> keep(columns: ["_time"])
+			|> unique(column: "_time")`
+
+	helpers.PrintDbg(fmt.Sprintf("written windows query for %s:\n %s", b.Name, q))
+
+	written := make(map[int64]bool)
+	result, done, err := i.query(b, q)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
+	for result.Next() {
+		written[result.Record().Time().Unix()] = true
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	return written, nil
+}
+
+// windowRanges walks through windows of given time range and merges adjacent windows
+// selected by function to ranges. Windows are identified by their timestamps like in
+// aggregateWindow(): stop (or start with _start time source) capped to the range.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//	sel func(int64) bool - selects window by its timestamp
+//
+// Returns:
+//
+//	[]trange - selected sub-ranges, adjacent windows merged
+func windowRanges(b *Bucket, fTs, tTs time.Time, sel func(int64) bool) []trange {
+	var res []trange
+	for ws := windowStart(fTs, b); ws.Before(tTs); ws = ws.Add(b.AInterv) {
+		we := ws.Add(b.AInterv)
+		// Window bounds are capped to range by aggregateWindow
+		wt := we
+		if wt.After(tTs) {
+			wt = tTs
+		}
+		s := ws
+		if s.Before(fTs) {
+			s = fTs
+		}
+		stamp := wt
+		if b.Window.TimeSrc == "_start" {
+			stamp = s
+		}
+		if !sel(stamp.Unix()) {
+			continue
+		}
+
+		n := len(res)
+		if n > 0 && res[n-1].stop.Equal(s) {
+			res[n-1].stop = wt
+			continue
+		}
+		res = append(res, trange{start: s, stop: wt})
+	}
+
+	return res
+}
+
+// missingRanges returns sub-ranges of failed range which are not completely written to destination
+// bucket. Whole range is returned when it can't be checked, rewrite replaces the same points.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	r trange - the failed range
+//
+// Returns:
+//
+//	[]trange - missing sub-ranges, adjacent windows merged
+func (i *Influx) missingRanges(b *Bucket, inst, col string, r trange) []trange {
+	// Destination of InfluxDB 3 can't be checked by flux
+	if i.Flavor == FlavorV3 {
+		return []trange{r}
+	}
+
+	series, err := i.writtenSeries(b, inst, col, r.start, r.stop)
+	if err != nil {
+		helpers.PrintWarn(fmt.Sprintf("%s, %s: error checking written windows - %v; re-running whole range", b.Name, inst, err))
+		return []trange{r}
+	}
+	complete := completeWindows(b, series, r.start)
+
+	return windowRanges(b, r.start, r.stop, func(t int64) bool { return !complete[t] })
+}
+
+// writtenSeries returns keys of series written to destination bucket per window timestamp in
+// given time range, window preceding the range included. Series key consists of measurement,
+// field and all tags, aggregate tag included.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	map[int64]map[string]bool - series keys by unix timestamp of window
+//	error - an error, if any
+func (i *Influx) writtenSeries(b *Bucket, inst, col string, fTs, tTs time.Time) (map[int64]map[string]bool, error) {
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return nil, err
+	}
+
+	q := queries.RangeQuery{Bucket: b.Name, Start: fTs.Add(-1 * b.AInterv), Stop: tTs.Add(b.AInterv), Filters: []string{f}}.String() + `
+			|> drop(columns: ["_start", "_stop", "_value"])`
+
+	helpers.PrintDbg(fmt.Sprintf("written series query for %s:\n %s", b.Name, q))
+
+	series := make(map[int64]map[string]bool)
+	result, done, err := i.query(b, q)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
+	for result.Next() {
+		rec := result.Record()
+		t := rec.Time().Unix()
+		if series[t] == nil {
+			series[t] = make(map[string]bool)
+		}
+		series[t][seriesKey(rec.Values())] = true
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	return series, nil
+}
+
+// seriesKey returns key identifying series of record values.
+func seriesKey(vals map[string]interface{}) string {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		switch k {
+		case "_time", "_value", "_start", "_stop", "result", "table":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%s=%v,", k, vals[k])
+	}
+
+	return sb.String()
+}
+
+// completeWindows returns timestamps of windows which have every series expected in destination.
+// Streams of aggregates are written independently, so window interrupted by server error may
+// have some series and miss others. Expected series are all series written in window preceding
+// the range or in any window of the range. Without preceding window nothing is known to be
+// complete, as stream never written in range would not be noticed.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	series map[int64]map[string]bool - written series keys by window timestamp
+//	fTs time.Time - range start
+//
+// Returns:
+//
+//	map[int64]bool - unix timestamps of complete windows
+func completeWindows(b *Bucket, series map[int64]map[string]bool, fTs time.Time) map[int64]bool {
+	// Window preceding range is stamped with its stop (range start) or start
+	prev := fTs.Unix()
+	if b.Window.TimeSrc == "_start" {
+		prev = fTs.Add(-1 * b.AInterv).Unix()
+	}
+	if len(series[prev]) == 0 {
+		return nil
+	}
+
+	expected := make(map[string]bool)
+	for _, ks := range series {
+		for k := range ks {
+			expected[k] = true
+		}
+	}
+
+	complete := make(map[int64]bool)
+	for t, ks := range series {
+		if len(ks) == len(expected) {
+			complete[t] = true
+		}
+	}
+
+	return complete
+}
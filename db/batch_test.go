@@ -0,0 +1,104 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMissingWindowsAfterPartialFailure(t *testing.T) {
+	every := 10 * time.Minute
+	fTs := time.Unix(1700000400, 0).Truncate(every)
+	tTs := fTs.Add(6 * every)
+	w := func(n int) int64 { return fTs.Add(time.Duration(n) * every).Unix() }
+	keys := func(ks ...string) map[string]bool {
+		m := make(map[string]bool)
+		for _, k := range ks {
+			m[k] = true
+		}
+		return m
+	}
+	all := keys("mean,in", "max,in", "mean,out", "max,out")
+
+	tests := []struct {
+		name    string
+		timeSrc string
+		series  map[int64]map[string]bool
+		want    []trange
+	}{
+		{
+			name:   "nothing written",
+			series: map[int64]map[string]bool{w(0): all},
+			want:   []trange{{fTs, tTs}},
+		},
+		{
+			name: "all written",
+			series: map[int64]map[string]bool{
+				w(0): all, w(1): all, w(2): all, w(3): all, w(4): all, w(5): all, w(6): all,
+			},
+		},
+		{
+			// max stream failed after two windows, mean stream after four
+			name: "streams interrupted",
+			series: map[int64]map[string]bool{
+				w(0): all, w(1): all, w(2): all,
+				w(3): keys("mean,in", "mean,out"), w(4): keys("mean,in", "mean,out"),
+			},
+			want: []trange{{fTs.Add(2 * every), tTs}},
+		},
+		{
+			// out fields were not written at all in range, preceding window tells they exist
+			name: "stream never written in range",
+			series: map[int64]map[string]bool{
+				w(0): all,
+				w(1): keys("mean,in", "max,in"), w(2): keys("mean,in", "max,in"),
+			},
+			want: []trange{{fTs, tTs}},
+		},
+		{
+			name: "hole in the middle",
+			series: map[int64]map[string]bool{
+				w(0): all, w(1): all, w(2): keys("mean,in"), w(3): all, w(4): all, w(5): all, w(6): all,
+			},
+			want: []trange{{fTs.Add(every), fTs.Add(2 * every)}},
+		},
+		{
+			// Without preceding window incomplete streams can't be told apart
+			name: "no preceding window",
+			series: map[int64]map[string]bool{
+				w(1): keys("mean,in"), w(2): keys("mean,in"),
+			},
+			want: []trange{{fTs, tTs}},
+		},
+		{
+			name:    "start stamped windows",
+			timeSrc: "_start",
+			series: map[int64]map[string]bool{
+				w(-1): all, w(0): all, w(1): all, w(2): keys("max,in"),
+			},
+			want: []trange{{fTs.Add(2 * every), tTs}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bucket{AInterv: every, Window: WindowOpts{TimeSrc: tt.timeSrc}}
+			complete := completeWindows(b, tt.series, fTs)
+			got := windowRanges(b, fTs, tTs, func(t int64) bool { return !complete[t] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missing ranges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	a := seriesKey(map[string]interface{}{"_measurement": "ifstats", "_field": "in", "aggregate": "mean", "_value": 1.0, "_time": time.Now(), "table": 0})
+	b := seriesKey(map[string]interface{}{"aggregate": "mean", "_field": "in", "_measurement": "ifstats", "_value": 2.0, "result": "_result"})
+	if a != b {
+		t.Errorf("keys of the same series differ: %q, %q", a, b)
+	}
+	if c := seriesKey(map[string]interface{}{"_measurement": "ifstats", "_field": "in", "aggregate": "max"}); c == a {
+		t.Errorf("keys of different aggregates equal: %q", c)
+	}
+}
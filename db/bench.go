@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// ScratchBucket creates bucket without retention if it does not exist.
+//
+// Parameters:
+//
+//	name string - the bucket name
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) ScratchBucket(name string) error {
+	ctx := context.Background()
+	var err error
+	if err = i.retryRL(ctx, func() error {
+		_, err := i.Client.BucketsAPI().FindBucketByName(ctx, name)
+		return err
+	}); err == nil {
+		return nil
+	}
+
+	var org *domain.Organization
+	err = i.retryRL(ctx, func() error {
+		var err error
+		org, err = i.Client.OrganizationsAPI().FindOrganizationByName(ctx, i.Org)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't find organization %s: %w", i.Org, err)
+	}
+
+	return i.retryRL(ctx, func() error {
+		_, err := i.Client.BucketsAPI().CreateBucketWithName(ctx, org, name)
+		return err
+	})
+}
+
+// DropBucket deletes bucket.
+//
+// Parameters:
+//
+//	name string - the bucket name
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) DropBucket(name string) error {
+	ctx := context.Background()
+	var b *domain.Bucket
+	err := i.retryRL(ctx, func() error {
+		var err error
+		b, err = i.Client.BucketsAPI().FindBucketByName(ctx, name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return i.retryRL(ctx, func() error {
+		return i.Client.BucketsAPI().DeleteBucket(ctx, b)
+	})
+}
+
+// ClearBucket deletes all data of bucket.
+//
+// Parameters:
+//
+//	name string - the bucket name
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) ClearBucket(name string) error {
+	ctx := context.Background()
+
+	return i.retryRL(ctx, func() error {
+		return i.Client.DeleteAPI().DeleteWithName(ctx, i.Org, name, time.Unix(0, 0), time.Now().Add(time.Hour), "")
+	})
+}
+
+// WriteSynthetic writes synthetic gauge series of instances to bucket, one point per aggregation interval of bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket
+//	meas string - the measurement name
+//	insts []string - instance names (agent_name tag)
+//	fields int - count of fields per instance
+//	from time.Time - time of first point
+//	to time.Time - time after last point
+//
+// Returns:
+//
+//	int64 - count of written points
+//	error - an error, if any
+func (i *Influx) WriteSynthetic(b *Bucket, meas string, insts []string, fields int, from, to time.Time) (int64, error) {
+	var n int64
+	pts := make([]*write.Point, 0, writeBatch)
+	for _, inst := range insts {
+		for t := from; t.Before(to); t = t.Add(b.AInterv) {
+			fv := make(map[string]interface{}, fields)
+			for f := 0; f < fields; f++ {
+				fv[fmt.Sprintf("field%d", f)] = math.Sin(float64(t.Unix())/3600+float64(f)) * 100
+			}
+			pts = append(pts, write.NewPoint(meas, map[string]string{"agent_name": inst}, fv, t))
+			if len(pts) >= writeBatch/fields+1 {
+				if err := i.writePoints(b, pts); err != nil {
+					return n, err
+				}
+				n += int64(len(pts) * fields)
+				pts = pts[:0]
+			}
+		}
+	}
+	if len(pts) > 0 {
+		if err := i.writePoints(b, pts); err != nil {
+			return n, err
+		}
+		n += int64(len(pts) * fields)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// BillingSample is sample interval of 95th percentile billing, rates are averaged over it
+const BillingSample = 5 * time.Minute
+
+// Billing computes 95th percentile ingress and egress bitrates of interfaces of instance in
+// given period from interface octet counters of source bucket and writes them as inP95 and
+// outP95 fields to billing measurement stamped with period start. Rates are averaged over
+// BillingSample or aggregation interval of source bucket when it is longer.
+// Query is only logged in dry-run mode.
+//
+// Parameters:
+//
+//	src *Bucket - the source bucket
+//	dst string - the billing bucket name
+//	meas string - the billing measurement name
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - period start
+//	tTs time.Time - period stop
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) Billing(src *Bucket, dst, meas, inst, col string, fTs, tTs time.Time) error {
+	switch i.Kind(col) {
+	case "ifstats", "iftraffic":
+	default:
+		return fmt.Errorf("collection %s has no interface counters", col)
+	}
+
+	every := BillingSample
+	if src.AInterv > every {
+		every = src.AInterv
+	}
+
+	// Tiers keep last counter values besides rate aggregates
+	var last string
+	if !src.First {
+		last = `
+	|> filter(fn: (r) => r.aggregate == "last")
+	|> drop(columns: ["aggregate"])`
+	}
+
+	_, org := i.server(src)
+	q := queries.RangeQuery{
+		Bucket: src.Name,
+		Start:  fTs,
+		Stop:   tTs,
+		Filters: []string{
+			queries.Eq("_measurement", col),
+			queries.Eq(i.TagKey(col), inst),
+			queries.Or(queries.Eq("_field", "ifHCInOctets"), queries.Eq("_field", "ifHCOutOctets")),
+		},
+	}.String() + last + `
+	|> derivative(unit: 1s, nonNegative: true, columns: ["_value"], timeColumn: "_time")
+	` + queries.AggregateWindow{Every: every, Fn: "mean"}.String() + `
+	|> quantile(q: 0.95, method: "exact_selector")
+	|> map(fn: (r) => ({r with
+		_value: r._value * 8.0,
+		_time: ` + fTs.UTC().Format(time.RFC3339) + `,
+		_measurement: ` + queries.Str(meas) + `,
+		_field: if r._field == "ifHCInOctets" then "inP95" else "outP95"}))
+	` + queries.ToBucket{Org: org, Bucket: dst}.String()
+
+	helpers.PrintDbg(fmt.Sprintf("billing query for %s:\n %s", src.Name, q))
+
+	if i.DryRun {
+		helpers.PrintInfo(fmt.Sprintf("dry-run, %s, %s: billing query:\n%s", dst, inst, q))
+		return nil
+	}
+	_, err := i.queryRaw(i.ctx, src, q)
+
+	return err
+}
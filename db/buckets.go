@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// EnsureBucket creates missing destination bucket with retention period of tier and
+// updates retention period of existing bucket when it differs from configured one.
+// Changes are only logged in dry-run mode.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) EnsureBucket(b *Bucket) error {
+	client, org := i.server(b)
+	bapi := client.BucketsAPI()
+	every := int64(b.RPeriod.Seconds())
+
+	var found *domain.Bucket
+	err := i.retryRL(i.ctx, func() error {
+		var err error
+		found, err = bapi.FindBucketByName(i.ctx, b.Name)
+		return err
+	})
+	// Other errors than missing bucket
+	var herr *ihttp.Error
+	if _, limited := RateLimitDelay(err); limited || errors.As(err, &herr) {
+		return err
+	}
+
+	// Create missing bucket
+	if err != nil {
+		if i.DryRun {
+			helpers.PrintInfo(fmt.Sprintf("dry-run, %s: would create bucket with retention %s", b.Name, b.RPeriod.String()))
+			return nil
+		}
+		var o *domain.Organization
+		err := i.retryRL(i.ctx, func() error {
+			var err error
+			o, err = client.OrganizationsAPI().FindOrganizationByName(i.ctx, org)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("can't find organization %s: %w", org, err)
+		}
+		err = i.retryRL(i.ctx, func() error {
+			_, err := bapi.CreateBucketWithName(i.ctx, o, b.Name, domain.RetentionRule{EverySeconds: every})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("can't create bucket %s: %w", b.Name, err)
+		}
+		helpers.PrintInfo(fmt.Sprintf("%s: created bucket with retention %s", b.Name, b.RPeriod.String()))
+
+		return nil
+	}
+
+	// Reconcile retention period, shard group duration is left to server
+	var cur int64
+	for _, r := range found.RetentionRules {
+		cur = r.EverySeconds
+	}
+	if cur == every {
+		return nil
+	}
+	if i.DryRun {
+		helpers.PrintInfo(fmt.Sprintf("dry-run, %s: would change retention from %ds to %ds", b.Name, cur, every))
+		return nil
+	}
+	found.RetentionRules = domain.RetentionRules{{EverySeconds: every}}
+	err = i.retryRL(i.ctx, func() error {
+		_, err := bapi.UpdateBucket(i.ctx, found)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't update retention of bucket %s: %w", b.Name, err)
+	}
+	helpers.PrintInfo(fmt.Sprintf("%s: changed retention from %ds to %ds", b.Name, cur, every))
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// bucket tier of chain definition
+type TierDef struct {
+	Name         string
+	AInterv      time.Duration
+	RPeriod      time.Duration
+	CardLookback time.Duration
+	Timeout      time.Duration
+	DiscTimeout  time.Duration
+	CardTimeout  time.Duration
+	Window       WindowOpts
+	Parent       string
+}
+
+// BuildChain links tiers of chain. Source tiers are marked as first tiers, first destination tier
+// is fed by every source and each next destination tier by the previous one. Direct tiers are fed
+// by every source, so raw data is aggregated straight to their resolution.
+// Destination tier fed by several sources is returned once per source.
+//
+// Parameters:
+//
+//	sources []TierDef - raw source buckets
+//	tiers []TierDef - destination tiers ordered from finest to coarsest
+//	direct []TierDef - destination tiers fed directly by sources
+//
+// Returns:
+//
+//	[]Bucket - linked buckets, sources first and direct tiers last
+//	error - an error, if any
+func BuildChain(sources, tiers, direct []TierDef) ([]Bucket, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("chain has no source buckets")
+	}
+	if len(tiers) == 0 && len(direct) == 0 {
+		return nil, fmt.Errorf("chain has no destination tiers")
+	}
+
+	// Bucket appearing twice in chain would feed itself
+	seen := make(map[string]bool)
+	all := append(append([]TierDef{}, sources...), tiers...)
+	for _, t := range append(all, direct...) {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("tier without bucket name")
+		case seen[t.Name]:
+			return nil, fmt.Errorf("bucket %s appears more than once, chain would be cyclic", t.Name)
+		case t.AInterv <= 0:
+			return nil, fmt.Errorf("bucket %s: aggregation interval must be positive", t.Name)
+		case t.RPeriod <= 0:
+			return nil, fmt.Errorf("bucket %s: retention period must be positive", t.Name)
+		}
+		if err := t.Window.check(t.Name, t.AInterv); err != nil {
+			return nil, err
+		}
+		seen[t.Name] = true
+	}
+
+	// Tiers must get coarser along the chain
+	for _, t := range direct {
+		for _, s := range sources {
+			if t.AInterv <= s.AInterv {
+				return nil, fmt.Errorf("bucket %s: aggregation interval %s must be longer than %s of %s", t.Name, t.AInterv, s.AInterv, s.Name)
+			}
+		}
+	}
+	for n, t := range tiers {
+		prev := sources
+		if n > 0 {
+			prev = tiers[n-1 : n]
+		}
+		for _, p := range prev {
+			if t.AInterv <= p.AInterv {
+				return nil, fmt.Errorf("bucket %s: aggregation interval %s must be longer than %s of %s", t.Name, t.AInterv, p.AInterv, p.Name)
+			}
+		}
+	}
+
+	var res []Bucket
+	var from *Bucket
+	for _, s := range sources {
+		res = append(res, Bucket{Name: s.Name, First: true, AInterv: s.AInterv, RPeriod: s.RPeriod, CardLookback: s.CardLookback,
+			Timeout: s.Timeout, DiscTimeout: s.DiscTimeout, CardTimeout: s.CardTimeout})
+	}
+	srcs := make([]*Bucket, len(sources))
+	for n := range sources {
+		src := res[n]
+		srcs[n] = &src
+	}
+
+	for n, t := range tiers {
+		if n == 0 {
+			for _, src := range srcs {
+				b := tierBucket(t, src)
+				res = append(res, *b)
+				if from == nil {
+					from = b
+				}
+			}
+			continue
+		}
+		b := tierBucket(t, from)
+		res = append(res, *b)
+		from = b
+	}
+	for _, t := range direct {
+		for _, src := range srcs {
+			res = append(res, *tierBucket(t, src))
+		}
+	}
+
+	return res, nil
+}
+
+// BuildTree links buckets by parent name. Buckets without parent are raw sources marked as first tiers.
+// Buckets are returned ordered so that every bucket follows its parent.
+//
+// Parameters:
+//
+//	defs []TierDef - bucket definitions
+//
+// Returns:
+//
+//	[]Bucket - linked buckets, sources first
+//	error - an error, if any
+func BuildTree(defs []TierDef) ([]Bucket, error) {
+	byName := make(map[string]TierDef)
+	children := make(map[string][]string)
+	var level []*Bucket
+	for _, d := range defs {
+		switch {
+		case d.Name == "":
+			return nil, fmt.Errorf("bucket without name")
+		case d.Name == d.Parent:
+			return nil, fmt.Errorf("bucket %s is its own parent", d.Name)
+		case d.AInterv <= 0:
+			return nil, fmt.Errorf("bucket %s: aggregation interval must be positive", d.Name)
+		case d.RPeriod <= 0:
+			return nil, fmt.Errorf("bucket %s: retention period must be positive", d.Name)
+		}
+		if err := d.Window.check(d.Name, d.AInterv); err != nil {
+			return nil, err
+		}
+		if _, ok := byName[d.Name]; ok {
+			return nil, fmt.Errorf("bucket %s defined more than once", d.Name)
+		}
+		byName[d.Name] = d
+
+		if d.Parent == "" {
+			level = append(level, &Bucket{Name: d.Name, First: true, AInterv: d.AInterv, RPeriod: d.RPeriod, CardLookback: d.CardLookback,
+				Timeout: d.Timeout, DiscTimeout: d.DiscTimeout, CardTimeout: d.CardTimeout})
+			continue
+		}
+		children[d.Parent] = append(children[d.Parent], d.Name)
+	}
+
+	for _, d := range defs {
+		p, ok := byName[d.Parent]
+		switch {
+		case d.Parent == "":
+		case !ok:
+			return nil, fmt.Errorf("bucket %s: unknown parent %s", d.Name, d.Parent)
+		case d.AInterv <= p.AInterv:
+			return nil, fmt.Errorf("bucket %s: aggregation interval %s must be longer than %s of %s", d.Name, d.AInterv, p.AInterv, p.Name)
+		}
+	}
+	if len(level) == 0 {
+		return nil, fmt.Errorf("no source buckets, every bucket has parent")
+	}
+	if len(level) == len(defs) {
+		return nil, fmt.Errorf("no destination buckets")
+	}
+
+	// Walk from sources level by level
+	var res []Bucket
+	for len(level) > 0 {
+		var next []*Bucket
+		for _, b := range level {
+			res = append(res, *b)
+			for _, c := range children[b.Name] {
+				next = append(next, tierBucket(byName[c], b))
+			}
+		}
+		level = next
+	}
+
+	// Buckets not reachable from any source have parents in cycle
+	if len(res) != len(defs) {
+		return nil, fmt.Errorf("buckets linked in cycle, not fed by any source")
+	}
+
+	return res, nil
+}
+
+// tierBucket returns destination bucket of tier fed by given bucket.
+func tierBucket(t TierDef, from *Bucket) *Bucket {
+	return &Bucket{Name: t.Name, From: from, AInterv: t.AInterv, RPeriod: t.RPeriod, CardLookback: t.CardLookback,
+		Timeout: t.Timeout, DiscTimeout: t.DiscTimeout, CardTimeout: t.CardTimeout, Window: t.Window}
+}
+
+// timeSrc returns window timestamp column.
+func (w WindowOpts) timeSrc() string {
+	if w.TimeSrc == "" {
+		return "_stop"
+	}
+
+	return w.TimeSrc
+}
+
+// check validates window options of bucket with given aggregation interval.
+func (w WindowOpts) check(name string, every time.Duration) error {
+	switch {
+	case w.Offset%time.Second != 0 || w.Offset <= -every || w.Offset >= every:
+		return fmt.Errorf("bucket %s: window offset must be whole seconds shorter than aggregation interval", name)
+	case w.TimeSrc != "" && w.TimeSrc != "_start" && w.TimeSrc != "_stop":
+		return fmt.Errorf("bucket %s: window time source must be _start or _stop", name)
+	}
+
+	return nil
+}
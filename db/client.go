@@ -0,0 +1,248 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// count of points written at once by client-side aggregation
+const writeBatch = 5000
+
+// Exporter receives downsampled points produced by client-side aggregation
+type Exporter interface {
+	Name() string
+	Export(bucket string, pts []*write.Point) error
+}
+
+// name of primary destination in write reports
+const primaryDest = "influxdb"
+
+// WriteReport receives outcome of write of points to destination
+type WriteReport func(dest, bucket string, n int, err error)
+
+// yieldQuery replaces writes via to() in downsample query with yields, so results are returned to client.
+//
+// Parameters:
+//
+//	q string - downsample query
+//	to string - to() call used in query
+//
+// Returns:
+//
+//	string - query returning results
+func yieldQuery(q, to string) string {
+	for n := 1; strings.Contains(q, to); n++ {
+		q = strings.Replace(q, to, fmt.Sprintf(`|> yield(name: "r%d")`, n), 1)
+	}
+
+	return q
+}
+
+// recordPoint converts flux result record to point. Returns nil if record has no value.
+//
+// Parameters:
+//
+//	r *query.FluxRecord - the record
+//
+// Returns:
+//
+//	*write.Point - the point
+func recordPoint(r *query.FluxRecord) *write.Point {
+	if r.Value() == nil || r.Field() == "" {
+		return nil
+	}
+
+	tags := make(map[string]string)
+	for k, v := range r.Values() {
+		switch k {
+		case "_start", "_stop", "_time", "_value", "_field", "_measurement", "result", "table":
+			continue
+		}
+		if s, ok := v.(string); ok {
+			tags[k] = s
+		}
+	}
+
+	return write.NewPoint(r.Measurement(), tags, map[string]interface{}{r.Field(): r.Value()}, r.Time())
+}
+
+// clientWrite executes downsample query returning results to client and writes them to destination bucket.
+// Points are written in batches, so memory usage stays bounded regardless of window size. With
+// WriteAsync batch is written in background while next one is read. Written points are passed to
+// configured exporters.
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	b *Bucket - the destination bucket
+//	q string - downsample query returning results
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) clientWrite(ctx context.Context, b *Bucket, q string) error {
+	result, done, err := i.queryCtx(ctx, b.From, q)
+	defer done()
+	if err != nil {
+		return err
+	}
+
+	w := newBatchWriter(i, b, i.WriteAsync)
+	var pts []*write.Point
+	records := 0
+	for result.Next() {
+		records++
+		p := recordPoint(result.Record())
+		if p == nil {
+			continue
+		}
+		pts = append(pts, p)
+		if len(pts) >= writeBatch {
+			if err := w.write(pts); err != nil {
+				result.Close()
+				w.close()
+				return err
+			}
+			pts = nil
+		}
+	}
+	if result.Err() != nil {
+		w.close()
+		return result.Err()
+	}
+	if err := w.write(pts); err != nil {
+		w.close()
+		return err
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	helpers.PrintDbg(fmt.Sprintf("%s: written %d points of %d result records", b.Name, w.written, records))
+
+	return nil
+}
+
+// batch writer of client-side aggregation results
+type batchWriter struct {
+	i       *Influx
+	b       *Bucket
+	ch      chan []*write.Point // nil in synchronous mode
+	failed  chan struct{}       // closed on first write error
+	done    chan struct{}
+	err     error
+	written int
+}
+
+// newBatchWriter returns batch writer to destination bucket. In async mode batches are
+// written by background goroutine, one batch is queued while other one is written.
+func newBatchWriter(i *Influx, b *Bucket, async bool) *batchWriter {
+	w := &batchWriter{i: i, b: b}
+	if !async {
+		return w
+	}
+
+	w.ch = make(chan []*write.Point, 1)
+	w.failed = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		for pts := range w.ch {
+			// Drain remaining batches after failure
+			if w.err != nil {
+				continue
+			}
+			if err := w.i.Write(w.b, pts); err != nil {
+				w.err = err
+				close(w.failed)
+				continue
+			}
+			w.written += len(pts)
+		}
+	}()
+
+	return w
+}
+
+// write writes or queues batch of points. Returns error of previous write in async mode.
+func (w *batchWriter) write(pts []*write.Point) error {
+	if len(pts) == 0 {
+		return nil
+	}
+	if w.ch == nil {
+		if err := w.i.Write(w.b, pts); err != nil {
+			return err
+		}
+		w.written += len(pts)
+		return nil
+	}
+
+	select {
+	case <-w.failed:
+		return w.err
+	case w.ch <- pts:
+		return nil
+	}
+}
+
+// close waits until queued batches are written and returns first write error.
+// Must be called once in async mode.
+func (w *batchWriter) close() error {
+	if w.ch == nil {
+		return nil
+	}
+	close(w.ch)
+	<-w.done
+
+	return w.err
+}
+
+// Write writes points to destination bucket and mirror and passes them to configured exporters.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	pts []*write.Point - points to write
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) Write(b *Bucket, pts []*write.Point) error {
+	if len(pts) == 0 {
+		return nil
+	}
+
+	err := i.writePoints(b, pts)
+	i.report(primaryDest, b.Name, len(pts), err)
+	if err != nil {
+		return err
+	}
+	if m := i.mirror; m != nil {
+		err := i.writeTo(m.client, m.org, m.bucket(b.Name), pts)
+		i.report(m.name, b.Name, len(pts), err)
+		if err != nil {
+			return fmt.Errorf("can't write to %s: %w", m.name, err)
+		}
+	}
+	for _, e := range i.Exporters {
+		err := e.Export(b.Name, pts)
+		i.report(e.Name(), b.Name, len(pts), err)
+		if err != nil {
+			helpers.PrintWarn(fmt.Sprintf("%s: failed to export %d points to %s - %v", b.Name, len(pts), e.Name(), err))
+		}
+	}
+	helpers.PrintDbg(fmt.Sprintf("%s: written %d points", b.Name, len(pts)))
+
+	return nil
+}
+
+// report passes outcome of write to destination to configured write report.
+func (i *Influx) report(dest, bucket string, n int, err error) {
+	if i.OnWrite != nil {
+		i.OnWrite(dest, bucket, n, err)
+	}
+}
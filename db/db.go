@@ -2,61 +2,178 @@ package db
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/aretaja/idbdownsampler/checkpoint"
 	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/ledger"
+	"github.com/aretaja/idbdownsampler/queries"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/kr/pretty"
 )
 
 // influxdb parameters
 type Influx struct {
-	Client         influxdb2.Client
-	Org            string
-	Statsb         string
-	DsMemLimit     float64
-	AggrCnt        int
-	CardMedium     int
-	CardHevy       int
-	DbHasResources bool
+	Client        influxdb2.Client
+	Org           string
+	Statsb        string
+	ScrapeMetrics bool
+	AggrCnt       int
+	Adapt         *AdaptiveBatch
+	RLRetries     int
+	RLBackoff     time.Duration
+	WrRetries     int
+	DiscSlices    int
+	ClientWrite   bool
+	WriteAsync    bool
+	DryRun        bool
+	DeleteBefore  bool
+	IcingaTiming  string
+	FieldAggr     map[string]map[string][]string
+	FieldRules    map[string][]FieldRule
+	GaugeExtras   map[string][]FieldRule
+	StringAggr    string
+	CounterReset  string
+	OnReset       ResetReport
+	OnVerify      VerifyReport
+	Templates     map[string]*template.Template
+	PctReaggr     string
+	Flavor        string
+	url           string
+	token         *tokenStore
+	httpClient    *http.Client
+	dest          *destServer
+	mirror        *mirrorServer
+	TagKeys       map[string]string
+	Shards        int // count of processes sharing instances, sharding disabled below 2
+	Shard         int // shard index of this process
+	Retry         RetryPolicy
+	Exporters     []Exporter
+	OnWrite       WriteReport
+	Resources     *ResGate
+	tun           *atomic.Pointer[Tunables]
+	inflight      *inflightBatches
+	meas          *measRegistry
+	kinds         *kindsCache
+	FieldKinds    []FieldKind
+	Specs         map[string]*CollectionSpec
+	Ledger        *ledger.Ledger
+	Checkpoints   *checkpoint.Store
+	Revalidate    time.Duration
+	Limiters      []*Limiter // query limiters shared by all connections and of connection
+	gate          *queryGate
+	ctx           context.Context
 }
 
 // bucket parameters
 type Bucket struct {
-	From    *Bucket
-	Name    string
-	AInterv time.Duration
-	RPeriod time.Duration
-	First   bool
+	From         *Bucket
+	Name         string
+	AInterv      time.Duration
+	RPeriod      time.Duration
+	CardLookback time.Duration
+	Timeout      time.Duration // timeout of downsample queries
+	DiscTimeout  time.Duration // timeout of instance discovery queries
+	CardTimeout  time.Duration // timeout of cardinality queries
+	Window       WindowOpts
+	First        bool
 }
 
-// Make new Influxdb struct
-func NewInflux(url, token, org, sb string, timeout uint) Influx {
-	// Set HTTP request timeout
-	opts := influxdb2.DefaultOptions().SetHTTPRequestTimeout(timeout)
+// aggregation window options of bucket
+type WindowOpts struct {
+	CreateEmpty bool          // keep empty windows
+	Offset      time.Duration // shift of window boundaries from unix epoch
+	TimeSrc     string        // window timestamp, _stop (default) or _start
+}
+
+// downsample target instance
+type Instance struct {
+	Name  string
+	Group string
+	Card  int
+}
+
+// Make new Influxdb struct, tlsConf nil for system defaults
+func NewInflux(url, token, org, sb string, timeout uint, tlsConf *tls.Config) Influx {
+	// Set HTTP request timeout and TLS options
+	opts := influxdb2.DefaultOptions().SetHTTPRequestTimeout(timeout).SetTLSConfig(tlsConf)
+	// Token of every request is taken from replaceable store
+	tokens := &tokenStore{}
+	tokens.set(token)
+	hc := opts.HTTPClient()
+	hc.Transport = &tokenTransport{base: hc.Transport, token: tokens}
 	// Create a new client using an InfluxDB server base URL and an authentication token
 	client := influxdb2.NewClientWithOptions(url, token, opts)
 
 	db := Influx{
-		Client:         client,
-		Org:            org,
-		DsMemLimit:     40,   // default 40%
-		AggrCnt:        8,    // default 8
-		Statsb:         sb,   // stats bucket
-		CardMedium:     50,   // medium cardinality level for instance in bucket
-		CardHevy:       1000, // hevy cardinality level for instance in bucket
-		DbHasResources: true, // default
+		Client:       client,
+		Org:          org,
+		AggrCnt:      8,                // default 8
+		Statsb:       sb,               // stats bucket
+		RLRetries:    5,                // retries on rate limit response
+		RLBackoff:    10 * time.Second, // initial backoff on rate limit response without Retry-After
+		WrRetries:    3,                // retries of downsample batch on server error
+		DiscSlices:   1,                // time slices of instance discovery
+		Revalidate:   24 * time.Hour,   // revalidation period of checkpoints
+		PctReaggr:    "max",            // re-aggregation of percentiles in later tiers
+		CounterReset: "drop",           // rate of intervals with counter reset is left out
+		Flavor:       FlavorV2,         // InfluxDB flavor
+		url:          url,
+		token:        tokens,
+		httpClient:   hc,
+		Retry: RetryPolicy{ // retries of instance downsampling on transient errors
+			Attempts:   3,
+			Backoff:    10 * time.Second,
+			MaxBackoff: 5 * time.Minute,
+			Jitter:     0.2,
+		},
+		Resources:    newResGate(), // open by default
+		tun:          newTunables(),
+		IcingaTiming: "exclude", // default
+		inflight:     &inflightBatches{batches: make(map[uint64]inflight)},
+		meas:         &measRegistry{kinds: make(map[string]string), tags: make(map[string]string), parents: make(map[string]string)},
+		kinds:        &kindsCache{meass: make(map[string]measFields)},
+		gate:         newQueryGate(context.Background()),
+		ctx:          context.Background(),
 	}
 
 	return db
 }
 
+// Ping checks connectivity of InfluxDB.
+//
+// Returns:
+//
+//	error - an error, if server is not reachable
+func (i *Influx) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ok, err := i.Client.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("ping failed")
+	}
+
+	return nil
+}
+
 // GetRunningTasks retrieves the count of running tasks from InfluxDB.
 //
 // Returns a pointer to float64 and an error.
 func (i *Influx) GetRunningTasks() (*float64, error) {
-	q := `from(bucket: "` + i.Statsb + `")
+	if i.ScrapeMetrics {
+		return i.metricsRunningTasks()
+	}
+
+	q := `from(bucket: ` + queries.Str(i.Statsb) + `)
   |> range(start: -15s)
   |> filter(fn: (r) => r["_measurement"] == "task_executor_total_runs_active"
       and r._field == "gauge")
@@ -64,10 +181,9 @@ func (i *Influx) GetRunningTasks() (*float64, error) {
 
 	var count *float64
 
-	// Get query client
-	queryAPI := i.Client.QueryAPI(i.Org)
 	// Get parser flux query result
-	result, err := queryAPI.Query(context.Background(), q)
+	result, done, err := i.query(nil, q)
+	defer done()
 	if err == nil {
 		// Use Next() to iterate over query result lines
 		for result.Next() {
@@ -90,13 +206,17 @@ func (i *Influx) GetRunningTasks() (*float64, error) {
 // No parameters.
 // Returns a pointer to float64 and an error.
 func (i *Influx) GetMemUsage() (*float64, error) {
-	q := `bytes_used = from(bucket: "` + i.Statsb + `")
+	if i.ScrapeMetrics {
+		return i.metricsMemUsage()
+	}
+
+	q := `bytes_used = from(bucket: ` + queries.Str(i.Statsb) + `)
 	|> range(start: -15s)
 	|> filter(fn: (r) => r._measurement == "go_memstats_alloc_bytes"
 	    and r._field == "gauge")
 	|> last()
 
-	total_bytes = from(bucket: "` + i.Statsb + `")
+	total_bytes = from(bucket: ` + queries.Str(i.Statsb) + `)
 		|> range(start: -15s)
 		|> filter(fn: (r) => r._measurement == "go_memstats_sys_bytes"
 		    and r._field == "gauge")
@@ -109,10 +229,9 @@ func (i *Influx) GetMemUsage() (*float64, error) {
 
 	var used *float64
 
-	// Get query client
-	queryAPI := i.Client.QueryAPI(i.Org)
 	// Get parser flux query result
-	result, err := queryAPI.Query(context.Background(), q)
+	result, done, err := i.query(nil, q)
+	defer done()
 	if err == nil {
 		// Use Next() to iterate over query result lines
 		for result.Next() {
@@ -136,24 +255,42 @@ func (i *Influx) GetMemUsage() (*float64, error) {
 //
 //	b *Bucket - the bucket object
 //	inst string - the instance name
+//	col string - the collection
 //
 // Returns:
 //
 //	int - the cardinality count
 //	error - an error, if any
-func (i *Influx) Cardinality(b *Bucket, inst string) (int, error) {
+func (i *Influx) Cardinality(b *Bucket, inst, col string) (int, error) {
 	var c int
+	// Not known in InfluxDB 3, default batch size is used
+	if i.Flavor == FlavorV3 {
+		return c, nil
+	}
+	// Look back cardinality for retention period of bucket by default
+	lb := b.RPeriod
+	if b.CardLookback > 0 {
+		lb = b.CardLookback
+	}
 	q := `import "influxdata/influxdb"
-		influxdb.cardinality(bucket: "` + b.Name + `",
-			start: -28d,
-			predicate: (r) => r["agent_name"] == "` + inst + `")`
+		influxdb.cardinality(bucket: ` + queries.Str(b.Name) + `,
+			start: -` + fmt.Sprintf("%d", int64(lb.Seconds())) + `s,
+			predicate: (r) => r[` + queries.Str(i.TagKey(col)) + `] == ` + queries.Str(inst) + `)`
+	// Flux of InfluxDB 1.x has no influxdb.cardinality(), series are counted from data
+	if i.Flavor == FlavorV1 {
+		q = `from(bucket: ` + queries.Str(b.Name) + `)
+			|> range(start: -` + fmt.Sprintf("%d", int64(lb.Seconds())) + `s)
+			|> filter(fn: (r) => r[` + queries.Str(i.TagKey(col)) + `] == ` + queries.Str(inst) + `)
+			|> first()
+			|> group()
+			|> count()`
+	}
 
 	helpers.PrintDbg(fmt.Sprintf("cardinality query for %s in %s:\n %s", inst, b.Name, q))
 
-	// Get query client
-	queryAPI := i.Client.QueryAPI(i.Org)
 	// Get parser flux query result
-	result, err := queryAPI.Query(context.Background(), q)
+	result, cancel, err := i.queryWithin(b, q, b.CardTimeout)
+	defer cancel()
 	if err == nil {
 		// Use Next() to iterate over query result lines
 		for result.Next() {
@@ -162,95 +299,276 @@ func (i *Influx) Cardinality(b *Bucket, inst string) (int, error) {
 			}
 		}
 		if result.Err() != nil {
-			return c, result.Err()
+			return c, timeoutErr(result.Err(), "cardinality query", b.CardTimeout)
 		}
 	} else {
-		return c, err
+		return c, timeoutErr(err, "cardinality query", b.CardTimeout)
 	}
 
 	return c, nil
 }
 
-// GetDsInstances retrieves instances for the given bucket based on collection type, and groups them by cardinality.
+// discQuery returns instances discovery flux query for given time range based on collection.
 //
 // Parameters:
 //
-//	b: *Bucket - the bucket for which to retrieve instances
-//	c: string - the collection type
+//	b *Bucket - the bucket to query
+//	c string - the collection
+//	st time.Time - range start
+//	stop time.Time - range stop
 //
-// Return:
+// Returns:
 //
-//	map[string][]string - a map of instance groups by cardinality
+//	string - flux query
 //	error - an error, if any
-func (i *Influx) GetDsInstances(b *Bucket, c string) (map[string][]string, error) {
-	st := time.Now().Add(-10 * b.AInterv).Unix() // now - 10 * aggregation duration
-	var instances []string
+func (i *Influx) discQuery(b *Bucket, c string, st, stop time.Time) (string, error) {
 	var q string
-
-	// flux query
-	switch {
-	case c == "ifstats" || c == "iftraffic" || c == "gengauge" || c == "gencounter":
+	switch k := i.Kind(c); {
+	case (k == "ifstats" || k == "iftraffic" || k == "gengauge" || k == "gencounter") && i.Flavor == FlavorV1:
+		// Schema functions of InfluxDB 1.x take no time range
+		q = `from(bucket: ` + queries.Str(b.Name) + `)
+		|> range(start: ` + fmt.Sprintf("%d", st.Unix()) + `, stop: ` + fmt.Sprintf("%d", stop.Unix()) + `)
+		|> filter(fn: (r) => r._measurement == ` + queries.Str(c) + `)
+		|> keyValues(keyColumns: [` + queries.Str(i.TagKey(c)) + `])
+		|> keep(columns: ["_value"])
+		|> unique()`
+	case k == "ifstats" || k == "iftraffic" || k == "gengauge" || k == "gencounter" || k == "auto":
 		q = `import "influxdata/influxdb/schema"
 		schema.measurementTagValues(
-			bucket: "` + b.Name + `",
-			measurement: "` + c + `",
-			tag: "agent_name",
-			start: ` + fmt.Sprintf("%d", st) + `
+			bucket: ` + queries.Str(b.Name) + `,
+			measurement: ` + queries.Str(c) + `,
+			tag: ` + queries.Str(i.TagKey(c)) + `,
+			start: ` + fmt.Sprintf("%d", st.Unix()) + `,
+			stop: ` + fmt.Sprintf("%d", stop.Unix()) + `
 		)`
-	case c == "icingachk":
-		q = `from(bucket: "` + b.Name + `")
-		|> range(start: ` + fmt.Sprintf("%d", st) + `)
+	case k == "spec":
+		q = i.Specs[c].discQuery(b, st, stop)
+	case k == "icingachk":
+		q = `from(bucket: ` + queries.Str(b.Name) + `)
+		|> range(start: ` + fmt.Sprintf("%d", st.Unix()) + `, stop: ` + fmt.Sprintf("%d", stop.Unix()) + `)
 		|> filter(fn: (r) => (r._measurement == "my-hostalive-icmp"
 				or r._measurement == "my-hostalive-tcp"
 				or r._measurement == "my-hostalive-http")
 		    and r._field == "value")
-		|> keyValues(keyColumns: ["hostname"])
+		|> keyValues(keyColumns: [` + queries.Str(i.TagKey(c)) + `])
 		|> keep(columns: ["_value"])
 		|> unique()`
 	default:
-		return nil, fmt.Errorf("unknown collection %s", c)
+		return "", fmt.Errorf("unknown collection %s", c)
 	}
-	helpers.PrintDbg(fmt.Sprintf("instances query for %s:\n %s", b.Name, q))
 
-	// Get query client
-	queryAPI := i.Client.QueryAPI(i.Org)
-	// Get parser flux query result
-	result, err := queryAPI.Query(context.Background(), q)
-	if err == nil {
+	return q, nil
+}
+
+// GetDsInstances retrieves instances for the given bucket based on collection type, and groups them by cardinality.
+//
+// Parameters:
+//
+//	b: *Bucket - the bucket for which to retrieve instances
+//	c: string - the collection type
+//
+// Return:
+//
+//	map[string][]string - a map of instance groups by cardinality
+//	error - an error, if any
+func (i *Influx) GetDsInstances(b *Bucket, c string) (map[string][]string, error) {
+	instances, err := i.GetInstances(b, c)
+	if err != nil {
+		return nil, err
+	}
+
+	cInst := make(map[string][]string)
+	for _, v := range instances {
+		cInst[v.Group] = append(cInst[v.Group], v.Name)
+	}
+
+	return cInst, nil
+}
+
+// CardGroup returns cardinality group name of instance.
+//
+// Parameters:
+//
+//	card int - instance cardinality
+//
+// Returns:
+//
+//	string - group name (light, medium, hevy)
+func (i *Influx) CardGroup(card int) string {
+	t := i.tun.Load()
+	switch {
+	case card < t.CardMedium:
+		return "light"
+	case card < t.CardHevy:
+		return "medium"
+	default:
+		return "hevy"
+	}
+}
+
+// GetInstances retrieves instances for the given bucket based on collection type with their cardinality.
+//
+// Parameters:
+//
+//	b: *Bucket - the bucket for which to retrieve instances
+//	c: string - the collection type
+//
+// Return:
+//
+//	[]Instance - discovered instances
+//	error - an error, if any
+func (i *Influx) GetInstances(b *Bucket, c string) ([]Instance, error) {
+	now := time.Now()
+	st := now.Add(-10 * b.AInterv) // now - 10 * aggregation duration
+
+	instances, err := i.DiscoverInstances(b, c, st, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get cardinality of instances
+	res := make([]Instance, 0, len(instances))
+	for _, v := range instances {
+		res = append(res, i.NewInstance(b, v, c))
+	}
+
+	return res, nil
+}
+
+// DiscoverInstances returns names of instances of collection which have data in given time range.
+//
+// Parameters:
+//
+//	b: *Bucket - the bucket for which to retrieve instances
+//	c: string - the collection type
+//	st: time.Time - start of the range
+//	stop: time.Time - end of the range
+//
+// Return:
+//
+//	[]string - discovered instance names
+//	error - an error, if any
+func (i *Influx) DiscoverInstances(b *Bucket, c string, st, stop time.Time) ([]string, error) {
+	var instances []string
+	seen := make(map[string]bool)
+
+	// Split discovery to time slices to keep single query bounded
+	slices := i.DiscSlices
+	if slices < 1 {
+		slices = 1
+	}
+	sl := stop.Sub(st) / time.Duration(slices)
+
+	for n := 0; n < slices; n++ {
+		sst := st.Add(time.Duration(n) * sl)
+		sstop := sst.Add(sl)
+		if n == slices-1 {
+			sstop = stop
+		}
+
+		if i.Flavor == FlavorV3 {
+			if _, ok := i.Specs[c]; !ok {
+				return nil, fmt.Errorf("collection %s not supported by db flavor %s", c, i.Flavor)
+			}
+			v, err := i.sqlDiscover(b, i.Specs[c], sst, sstop)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range v {
+				if !seen[v] && i.instAllowed(v) {
+					seen[v] = true
+					instances = append(instances, v)
+				}
+			}
+			continue
+		}
+
+		q, err := i.discQuery(b, c, sst, sstop)
+		if err != nil {
+			return nil, err
+		}
+		helpers.PrintDbg(fmt.Sprintf("instances query %d/%d for %s:\n %s", n+1, slices, b.Name, q))
+
+		// Get parser flux query result
+		result, cancel, err := i.queryWithin(b, q, b.DiscTimeout)
+		if err != nil {
+			cancel()
+			return nil, timeoutErr(err, "instances query", b.DiscTimeout)
+		}
 		// Use Next() to iterate over query result lines
 		for result.Next() {
-			if v, ok := result.Record().Value().(string); ok {
+			if v, ok := result.Record().Value().(string); ok && !seen[v] && i.instAllowed(v) {
+				seen[v] = true
 				instances = append(instances, v)
 			}
 		}
-		if result.Err() != nil {
-			return nil, result.Err()
+		err = result.Err()
+		cancel()
+		if err != nil {
+			return nil, timeoutErr(err, "instances query", b.DiscTimeout)
 		}
-	} else {
-		return nil, err
 	}
 
-	// Group by cardinality
-	cInst := make(map[string][]string)
-	for _, v := range instances {
-		// Get instance cardinality
-		card, err := i.Cardinality(b, v)
-		if err != nil {
-			helpers.PrintWarn(fmt.Sprintf("%s, %s: error getting cardinality - %v. Using highest rank", v, b.Name, err))
-		}
-		helpers.PrintDbg(fmt.Sprintf("cardinality of %s in %s: %d", v, b.Name, card))
+	return instances, nil
+}
 
-		switch {
-		case card < i.CardMedium:
-			cInst["light"] = append(cInst["light"], v)
-		case card < i.CardHevy:
-			cInst["medium"] = append(cInst["medium"], v)
-		default:
-			cInst["hevy"] = append(cInst["hevy"], v)
+// instAllowed checks instance name against configured filters. Instance must belong to shard of
+// this process, match any include filter when there are some and must not match any exclude filter.
+// Names unusable in queries are skipped.
+//
+// Parameters:
+//
+//	name string - the instance name
+//
+// Returns:
+//
+//	bool - true if instance is downsampled
+func (i *Influx) instAllowed(name string) bool {
+	if err := queries.Valid(name); err != nil {
+		helpers.PrintWarn(fmt.Sprintf("skipping instance - %s", err))
+		return false
+	}
+	if !i.inShard(name) {
+		return false
+	}
+	t := i.tun.Load()
+	for _, re := range t.Exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(t.Include) == 0 {
+		return true
+	}
+	for _, re := range t.Include {
+		if re.MatchString(name) {
+			return true
 		}
 	}
 
-	return cInst, nil
+	return false
+}
+
+// NewInstance returns instance with cardinality and cardinality group resolved.
+// Highest rank is used when cardinality query fails.
+//
+// Parameters:
+//
+//	b: *Bucket - the bucket of instance
+//	name: string - instance name
+//	col: string - the collection
+//
+// Return:
+//
+//	Instance - instance
+func (i *Influx) NewInstance(b *Bucket, name, col string) Instance {
+	card, err := i.Cardinality(b, name, col)
+	if err != nil {
+		helpers.PrintWarn(fmt.Sprintf("%s, %s: error getting cardinality - %v. Using highest rank", name, b.Name, err))
+	}
+	helpers.PrintDbg(fmt.Sprintf("cardinality of %s in %s: %d", name, b.Name, card))
+
+	return Instance{Name: name, Card: card, Group: i.CardGroup(card)}
 }
 
 // LastTS returns the timestamp of the latest data point for a given instance in a bucket based on collection.
@@ -275,47 +593,34 @@ func (i *Influx) LastTS(b *Bucket, inst, col string) (time.Time, error) {
 	if b.From != nil {
 		fTS = now.Add(-1 * b.From.RPeriod)
 	}
-	var f string
-	switch col {
-	case "ifstats":
-		f = `r._measurement == "ifstats"
-		    and r["agent_name"] == "` + inst + `"
-			and r._field == "ifAdminStatus"`
-	case "iftraffic":
-		f = `r._measurement == "iftraffic"
-			and r["agent_name"] == "` + inst + `"
-			and r._field == "ifOperStatus"`
-	case "gengauge":
-		f = `r._measurement == "gengauge"
-			and r["agent_name"] == "` + inst + `"
-			and r._field == "InPower"`
-	case "gencounter":
-		f = `r._measurement == "gencounter"
-			and r["agent_name"] == "` + inst + `"
-			and r._field == "feCor"`
-	case "icingachk":
-		f = `(r._measurement == "my-hostalive-icmp"
-				or r._measurement == "my-hostalive-tcp"
-				or r._measurement == "my-hostalive-http")
-		    and r["hostname"] == "` + inst + `"
-			and r._field == "value"`
-	default:
-		return lt, fmt.Errorf("unknown collection %s", col)
+	if i.Flavor == FlavorV3 {
+		s, ok := i.Specs[col]
+		if !ok {
+			return lt, fmt.Errorf("collection %s not supported by db flavor %s", col, i.Flavor)
+		}
+		return i.sqlLastTS(b, s, inst, fTS, lt)
 	}
 
-	q := `from(bucket: "` + b.Name + `")
-			|> range(start: ` + fmt.Sprintf("%d", fTS.Unix()) + `)
-			|> filter(fn: (r) => ` + f + `)
+	f, err := i.lastFilter(col, func(tk string) string {
+		if i.Kind(col) == "spec" {
+			return instEq(tk, inst)
+		}
+		return `r[` + queries.Str(tk) + `] == ` + queries.Str(inst)
+	})
+	if err != nil {
+		return lt, err
+	}
+
+	q := queries.RangeQuery{Bucket: b.Name, Start: fTS, Filters: []string{f}}.String() + `
 			|> group()
 			|> last()
 			|> keep(columns: ["_time"])`
 
 	helpers.PrintDbg(fmt.Sprintf("lastTS query for %s:\n %s", b.Name, q))
 
-	// Get query client
-	queryAPI := i.Client.QueryAPI(i.Org)
 	// Get parser flux query result
-	result, err := queryAPI.Query(context.Background(), q)
+	result, done, err := i.query(b, q)
+	defer done()
 	if err == nil {
 		// Use Next() to iterate over query result lines
 		for result.Next() {
@@ -331,9 +636,225 @@ func (i *Influx) LastTS(b *Bucket, inst, col string) (time.Time, error) {
 	return lt, nil
 }
 
+// lastFilter returns flux filter of records used for finding last time of instances of collection.
+// Field used for checking last time is known only for built in measurements.
+//
+// Parameters:
+//
+//	col string - the collection
+//	pred func(tk string) string - returns predicate of instances by tag key
+//
+// Returns:
+//
+//	string - the filter
+//	error - an error, if collection is unknown
+func (i *Influx) lastFilter(col string, pred func(tk string) string) (string, error) {
+	kind := i.Kind(col)
+	p := pred(i.TagKey(col))
+	fld := func(name string) string {
+		if col != kind {
+			return ""
+		}
+		return `
+			and r._field == ` + queries.Str(name)
+	}
+
+	switch kind {
+	case "ifstats":
+		return `r._measurement == ` + queries.Str(col) + `
+		    and ` + p + fld("ifAdminStatus"), nil
+	case "iftraffic":
+		return `r._measurement == ` + queries.Str(col) + `
+			and ` + p + fld("ifOperStatus"), nil
+	case "gengauge":
+		return `r._measurement == ` + queries.Str(col) + `
+			and ` + p + fld("InPower"), nil
+	case "gencounter":
+		return `r._measurement == ` + queries.Str(col) + `
+			and ` + p + fld("feCor"), nil
+	case "auto":
+		return `r._measurement == ` + queries.Str(col) + `
+			and ` + p, nil
+	case "spec":
+		return i.Specs[col].measFilter() + `
+			and ` + p, nil
+	case "icingachk":
+		return `(r._measurement == "my-hostalive-icmp"
+				or r._measurement == "my-hostalive-tcp"
+				or r._measurement == "my-hostalive-http")
+		    and ` + p + `
+			and r._field == "value"`, nil
+	default:
+		return "", fmt.Errorf("unknown collection %s", col)
+	}
+}
+
+// count of instances whose last timestamps are looked up by one query
+const lastBatch = 500
+
+// LastTSAll returns the timestamps of the latest data points of instances in a bucket with one
+// query per lastBatch instances. Instances without data get the same default as by LastTS.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket to query
+//	insts []string - the instance names
+//	col string - the collection
+//
+// Return:
+//
+//	map[string]time.Time - the timestamps of the latest data points by instance
+//	error - any error that occurred during the query
+func (i *Influx) LastTSAll(b *Bucket, insts []string, col string) (map[string]time.Time, error) {
+	now := time.Now()
+	lt := now.Add(-1 * b.RPeriod)
+	fTS := lt
+	if b.From != nil {
+		fTS = now.Add(-1 * b.From.RPeriod)
+	}
+	res := make(map[string]time.Time, len(insts))
+	for _, inst := range insts {
+		res[inst] = lt
+	}
+
+	for len(insts) > 0 {
+		chunk := insts[:min(lastBatch, len(insts))]
+		insts = insts[len(chunk):]
+
+		if i.Flavor == FlavorV3 {
+			s, ok := i.Specs[col]
+			if !ok {
+				return res, fmt.Errorf("collection %s not supported by db flavor %s", col, i.Flavor)
+			}
+			if err := i.sqlLastTSAll(b, s, chunk, fTS, res); err != nil {
+				return res, err
+			}
+			continue
+		}
+
+		f, err := i.lastFilter(col, func(tk string) string { return queries.In(tk, chunk) })
+		if err != nil {
+			return res, err
+		}
+		tk := i.TagKey(col)
+		q := queries.RangeQuery{Bucket: b.Name, Start: fTS, Filters: []string{f}}.String() + `
+			|> group(columns: [` + queries.Str(tk) + `])
+			|> last()
+			|> keep(columns: ["_time", ` + queries.Str(tk) + `])`
+		helpers.PrintDbg(fmt.Sprintf("lastTS query for %d instances of %s:\n %s", len(chunk), b.Name, q))
+
+		result, done, err := i.query(b, q)
+		if err != nil {
+			done()
+			return res, err
+		}
+		for result.Next() {
+			if inst, ok := result.Record().ValueByKey(tk).(string); ok {
+				res[inst] = result.Record().Time()
+			}
+		}
+		err = result.Err()
+		done()
+		if err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// LastDownsampled returns the timestamp of the latest downsampled data of instance in tier.
+// Known checkpoint is used until revalidation period elapses, then it is validated by LastTS.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//
+// Return:
+//
+//	time.Time - the timestamp of the latest downsampled data
+//	error - any error that occurred during the query
+func (i *Influx) LastDownsampled(b *Bucket, inst, col string) (time.Time, error) {
+	if st, ok := i.Checkpoints.Get(col, b.Name, inst); ok && time.Since(st.Checked) < i.Revalidate {
+		return st.Last, nil
+	}
+
+	t, err := i.LastTS(b, inst, col)
+	if err != nil {
+		return t, err
+	}
+	i.Checkpoints.Validate(col, b.Name, inst, t)
+
+	return t, nil
+}
+
+// LastDownsampledAll returns the timestamps of the latest downsampled data of instances in tier.
+// Known checkpoints are used until revalidation period elapses, the rest are looked up by LastTSAll
+// and validated.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	insts []string - the instance names
+//	col string - the collection
+//
+// Return:
+//
+//	map[string]time.Time - the timestamps of the latest downsampled data by instance
+//	error - any error that occurred during the query
+func (i *Influx) LastDownsampledAll(b *Bucket, insts []string, col string) (map[string]time.Time, error) {
+	res := make(map[string]time.Time, len(insts))
+	var rest []string
+	for _, inst := range insts {
+		if st, ok := i.Checkpoints.Get(col, b.Name, inst); ok && time.Since(st.Checked) < i.Revalidate {
+			res[inst] = st.Last
+			continue
+		}
+		rest = append(rest, inst)
+	}
+	if len(rest) == 0 {
+		return res, nil
+	}
+
+	ts, err := i.LastTSAll(b, rest, col)
+	if err != nil {
+		return res, err
+	}
+	for inst, t := range ts {
+		res[inst] = t
+		i.Checkpoints.Validate(col, b.Name, inst, t)
+	}
+
+	return res, nil
+}
+
+// BatchWindows returns how many aggregation windows to process in one query based on instance cardinality.
+//
+// Parameters:
+//
+//	card int - instance cardinality in source bucket
+//
+// Returns:
+//
+//	int - count of aggregation windows
+func (i *Influx) BatchWindows(card int) int {
+	ac := i.AggrCnt
+	switch {
+	case card != 0 && card < 100:
+		ac *= 20
+	case card < 1000:
+		ac *= 10
+	}
+
+	return ac
+}
+
 // Downsample performs downsampling of measurements of the given instance in the bucket based on collection.
+// Downsampling starts from last downsampled time known to caller, it is looked up when last is zero.
 // It returns an error, if any.
-func (i *Influx) Downsample(b *Bucket, inst string, col string) error {
+func (i *Influx) Downsample(b *Bucket, inst string, col string, last time.Time) error {
 	// Default range start timestamp for influx query (now - retention period of source bucket)
 	now := time.Now()
 	// Set default range start time to first measurement time of source bucket
@@ -347,10 +868,13 @@ func (i *Influx) Downsample(b *Bucket, inst string, col string) error {
 	}
 	helpers.PrintDbg(fmt.Sprintf("%s, %s: last measurement time of source bucket:\n %# v", b.From.Name, inst, pretty.Formatter(ft)))
 
-	// Get last measurement time
-	t, err := i.LastTS(b, inst, col)
-	if err != nil {
-		helpers.PrintWarn(fmt.Sprintf("%s, %s: error getting last measurement time - %v; assuming no data", b.Name, inst, err))
+	// Get last measurement time unless known
+	t := last
+	if t.IsZero() {
+		t, err = i.LastDownsampled(b, inst, col)
+		if err != nil {
+			helpers.PrintWarn(fmt.Sprintf("%s, %s: error getting last measurement time - %v; assuming no data", b.Name, inst, err))
+		}
 	}
 	helpers.PrintDbg(fmt.Sprintf("%s, %s: last measurement time:\n %# v", b.Name, inst, pretty.Formatter(t)))
 
@@ -363,25 +887,21 @@ func (i *Influx) Downsample(b *Bucket, inst string, col string) error {
 	}
 
 	// Get instance cardinality in source bucket
-	card, err := i.Cardinality(b.From, inst)
+	card, err := i.Cardinality(b.From, inst, col)
 	if err != nil {
 		helpers.PrintWarn(fmt.Sprintf("error getting cardinality: %v. Using default", err))
 	}
 	helpers.PrintDbg(fmt.Sprintf("cardinality of %s in %s: %d", inst, b.From.Name, card))
 
 	// Set how many aggregations to do at once
-	ac := i.AggrCnt
-	switch {
-	case card != 0 && card < 100:
-		ac *= 20
-	case card < 1000:
-		ac *= 10
+	ac := i.BatchWindows(card)
+	key := b.Name + "/" + inst
+	if i.Adapt != nil {
+		ac = i.Adapt.windows(key, ac)
 	}
 	c := time.Duration(ac) * b.AInterv
 	helpers.PrintDbg(fmt.Sprintf("set aggregate range for %s to %s", inst, c.String()))
 
-	// Get query client
-	queryAPI := i.Client.QueryAPI(i.Org)
 	for fTs.Before(ft.Add(-1 * b.AInterv)) {
 		tTs := fTs.Add(c)
 		// End time should be before source bucket last time
@@ -392,318 +912,548 @@ func (i *Influx) Downsample(b *Bucket, inst string, col string) error {
 			tTs = tTs.Add(-1 * b.AInterv)
 			helpers.PrintDbg(fmt.Sprintf("aggregation range for %s is behind source last record, reducing it by %s", inst, b.AInterv.String()))
 		}
-		// Check for resources
-		for {
-			if !i.DbHasResources {
-				helpers.PrintDbg("pause downsampling for 30s, no resources available")
-				time.Sleep(30 * time.Second)
-				continue
+		// Stop when shutting down, check for resources
+		if err := i.ctx.Err(); err != nil {
+			return err
+		}
+		if err := i.waitResources(); err != nil {
+			return err
+		}
+
+		// Execute downsample batch
+		id := i.inflight.add(inflight{
+			inst:    inst,
+			bucket:  b.Name,
+			windows: int(tTs.Sub(fTs) / b.AInterv),
+			card:    card,
+			start:   time.Now(),
+		})
+		st, aborts := time.Now(), i.gate.abortCount()
+		// Skip ranges already known to be aggregated
+		for _, r := range i.Ledger.Remaining(col, b.Name, inst, fTs, tTs) {
+			// Remove aggregates of interrupted earlier run before re-aggregating
+			if i.DeleteBefore {
+				if err := i.deleteRange(b, inst, col, r.Start, r.Stop); err != nil {
+					i.inflight.done(id)
+					return err
+				}
+			}
+			err := i.runBatch(b, inst, col, r.Start, r.Stop)
+			if err != nil {
+				i.inflight.done(id)
+				return err
+			}
+			if !i.DryRun {
+				i.Ledger.Add(col, b.Name, inst, r.Start, r.Stop, b.RPeriod)
 			}
-			break
+			// Count counter resets of source data for diagnostics
+			if b.From.First && i.OnReset != nil && !i.DryRun {
+				n, err := i.countResets(b, inst, col, r.Start, r.Stop)
+				if err != nil {
+					helpers.PrintWarn(fmt.Sprintf("%s, %s: error counting counter resets - %v", b.Name, inst, err))
+				} else if n > 0 {
+					i.OnReset(col, inst, n)
+				}
+			}
+			// Verify written points, templates write data of their own shape
+			if i.OnVerify != nil && !i.DryRun && i.queryTemplate(col) == nil {
+				n, empty, err := i.verifyWrite(b, inst, col, r.Start, r.Stop)
+				switch {
+				case err != nil:
+					helpers.PrintWarn(fmt.Sprintf("%s, %s: error verifying written points - %v", b.Name, inst, err))
+				case len(empty) > 0:
+					helpers.PrintWarn(fmt.Sprintf("%s, %s: %d points written, %d windows with source data have no written points, first at %s",
+						b.Name, inst, n, len(empty), empty[0].Format(time.RFC3339)))
+				default:
+					helpers.PrintDbg(fmt.Sprintf("%s, %s: %d points written", b.Name, inst, n))
+				}
+				if err == nil {
+					i.OnVerify(col, b.Name, n, len(empty))
+				}
+			}
+		}
+		i.inflight.done(id)
+		if !i.DryRun {
+			i.Checkpoints.Advance(col, b.Name, inst, tTs)
+		}
+
+		fTs = fTs.Add(c)
+
+		// Resize next batch by duration of this one
+		if i.Adapt != nil && !i.DryRun {
+			ac = i.Adapt.adjust(key, ac, time.Since(st), i.gate.abortCount() != aborts)
+			if n := time.Duration(ac) * b.AInterv; n != c {
+				helpers.PrintDbg(fmt.Sprintf("%s, %s: adaptive aggregate range changed from %s to %s", b.Name, inst, c.String(), n.String()))
+				c = n
+			}
+		}
+	}
+
+	return nil
+}
+
+// dsQuery returns downsample flux query for given instance and time range based on collection and bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	string - flux query
+//	error - an error, if any
+func (i *Influx) dsQuery(b *Bucket, inst, col string, fTs, tTs time.Time) (string, error) {
+	return i.fluxQuery(b, inst, col, fTs, tTs, i.ClientWrite)
+}
+
+// fluxQuery returns downsample flux query for given instance and time range based on collection and bucket.
+// Results are written to destination bucket by server or returned to client when yield is set.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//	yield bool - return results to client
+//
+// Returns:
+//
+//	string - flux query
+//	error - an error, if any
+func (i *Influx) fluxQuery(b *Bucket, inst, col string, fTs, tTs time.Time, yield bool) (string, error) {
+	// Write results to destination bucket
+	to := queries.ToBucket{Org: i.Org, Bucket: b.Name}.String()
+
+	// User supplied template replaces built-in query
+	if t := i.queryTemplate(col); t != nil {
+		q, err := i.templateQuery(t, b, inst, col, fTs, tTs, to)
+		if err == nil && yield {
+			q = yieldQuery(q, to)
 		}
+		return q, err
+	}
+
+	// Fields with overridden aggregates are excluded from default handling
+	excl, over, err := i.overrideQuery(b, inst, col, fTs, tTs, to)
+	if err != nil {
+		return "", err
+	}
+
+	// String fields are excluded from default handling as well
+	strExcl, str, err := i.stringQuery(b, inst, col, fTs, tTs, excl, to)
+	if err != nil {
+		return "", err
+	}
+	excl += strExcl
+
+	var q string
+	kind := i.Kind(col)
+	tk := i.TagKey(col)
 
-		var q string
-		switch {
-		case b.From.First && col == "ifstats":
-			q = `allData =
-			from(bucket: "` + b.From.Name + `")
+	// Counter fields of automatically classified measurement
+	var counters string
+	if kind == "auto" && b.From.First {
+		cf, err := i.counterFields(b.From, col, inst)
+		if err != nil {
+			return "", fmt.Errorf("can't classify fields of %s: %w", col, err)
+		}
+		counters = fieldsRe(cf)
+	}
+
+	switch {
+	case b.From.First && kind == "ifstats":
+		q = `allData =
+		from(bucket: ` + queries.Str(b.From.Name) + `)
+		  |> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+		  |> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+		      and ` + instEq(tk, inst) + excl + `)
+
+		toCounterData =
+			allData
+				|> filter(fn: (r) => r._field =~ /^if(?:HC)*(?:In|Out)/)
+
+		toCountPsData =
+			toCounterData
+				` + i.rate() + `
+
+		toMaxData =
+			allData
+				|> filter(fn: (r) => r._field =~ /^(?:ifAdminStatus|ifOperStatus)$/)
+
+		toCounterData
+			` + b.aggrWindow("last") + `
+			|> set(key: "aggregate", value: "last")
+			` + to + `
+
+		toCountPsData
+			` + b.aggrWindow("max") + `
+			|> map(fn: (r) => ({r with _field: r._field + "Max"}))
+			|> set(key: "aggregate", value: "max")
+			` + to + `
+
+		toCountPsData
+			` + b.aggrWindow("min") + `
+			|> map(fn: (r) => ({r with _field: r._field + "Min"}))
+			|> set(key: "aggregate", value: "min")
+			` + to + `
+
+		toMaxData
+			` + b.aggrWindow("max") + `
+			|> set(key: "aggregate", value: "max")
+			` + to
+	case !b.From.First && kind == "ifstats":
+		q = `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
+				|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+				|> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+				    and ` + instEq(tk, inst) + excl + `)
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "max")
+				` + b.aggrWindow("max") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "min")
+				` + b.aggrWindow("min") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "last")
+				` + b.aggrWindow("last") + `
+				` + to
+	case b.From.First && kind == "iftraffic":
+		q = `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
 			  |> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-			  |> filter(fn: (r) => r._measurement == "ifstats"
-			      and r["agent_name"] == "` + inst + `")
+			  |> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+				  and ` + instEq(tk, inst) + excl + `)
 
 			toCounterData =
 				allData
-					|> filter(fn: (r) => r._field =~ /^if(?:HC)*(?:In|Out)/)
+					|> filter(fn: (r) => r._field == "ifHCInOctets" or r._field == "ifHCOutOctets")
 
 			toCountPsData =
 				toCounterData
-					|> derivative(unit: 1s, nonNegative: true, columns: ["_value"], timeColumn: "_time")
+					` + i.rate() + `
 
 			toMaxData =
 				allData
-					|> filter(fn: (r) => r._field =~ /^(?:ifAdminStatus|ifOperStatus)$/)
+					|> filter(fn: (r) => r._field == "ifOperStatus")
 
 			toCounterData
-				|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
+				` + b.aggrWindow("last") + `
 				|> set(key: "aggregate", value: "last")
-				|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+				` + to + `
 
 			toCountPsData
-				|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
+				` + b.aggrWindow("max") + `
 				|> map(fn: (r) => ({r with _field: r._field + "Max"}))
 				|> set(key: "aggregate", value: "max")
-				|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+				` + to + `
 
 			toCountPsData
-				|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
+				` + b.aggrWindow("min") + `
 				|> map(fn: (r) => ({r with _field: r._field + "Min"}))
 				|> set(key: "aggregate", value: "min")
-				|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+				` + to + `
 
 			toMaxData
-				|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
+				` + b.aggrWindow("max") + `
 				|> set(key: "aggregate", value: "max")
-				|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case !b.From.First && col == "ifstats":
-			q = `allData =
-				from(bucket: "` + b.From.Name + `")
-					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-					|> filter(fn: (r) => r._measurement == "ifstats"
-					    and r["agent_name"] == "` + inst + `")
+				` + to
+	case !b.From.First && kind == "iftraffic":
+		q = `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
+				|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+				|> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+					and ` + instEq(tk, inst) + excl + `)
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "max")
+				` + b.aggrWindow("max") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "min")
+				` + b.aggrWindow("min") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "last")
+				` + b.aggrWindow("last") + `
+				` + to
+	case b.From.First && kind == "gengauge":
+		q = `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
+			  	|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+				|> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+					and ` + instEq(tk, inst) + excl + `)
+
+			allData
+				` + b.aggrWindow("mean") + `
+				|> set(key: "aggregate", value: "mean")
+				` + to + `
+
+			allData
+				` + b.aggrWindow("max") + `
+				|> map(fn: (r) => ({r with _field: r._field + "Max"}))
+				|> set(key: "aggregate", value: "max")
+				` + to + `
 
-				allData
-					|> filter(fn: (r) => r["aggregate"] == "max")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+			allData
+				` + b.aggrWindow("min") + `
+				|> map(fn: (r) => ({r with _field: r._field + "Min"}))
+				|> set(key: "aggregate", value: "min")
+				` + to
+		_, extras := i.gaugeExtrasQuery(b, col, to)
+		q += extras
+	case !b.From.First && kind == "gengauge":
+		q = `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
+				|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+				|> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+					and ` + instEq(tk, inst) + excl + `)
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "mean")
+				` + b.aggrWindow("mean") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "max")
+				` + b.aggrWindow("max") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "min")
+				` + b.aggrWindow("min") + `
+				` + to
+		imp, extras := i.gaugeExtrasQuery(b, col, to)
+		q = imp + q + extras
+	case b.From.First && kind == "gencounter":
+		q = `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
+			  |> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+			  |> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+				  and ` + instEq(tk, inst) + excl + `)
 
-				allData
-					|> filter(fn: (r) => r["aggregate"] == "min")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+			toCountPsData =
+					allData
+					` + i.rate() + `
 
-				allData
-					|> filter(fn: (r) => r["aggregate"] == "last")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case b.From.First && col == "iftraffic":
-			q = `allData =
-				from(bucket: "` + b.From.Name + `")
-				  |> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-				  |> filter(fn: (r) => r._measurement == "iftraffic"
-					  and r["agent_name"] == "` + inst + `")
+			allData
+				` + b.aggrWindow("last") + `
+				|> set(key: "aggregate", value: "last")
+				` + to + `
+
+			toCountPsData
+				` + b.aggrWindow("max") + `
+				|> map(fn: (r) => ({r with _field: r._field + "Max"}))
+				|> set(key: "aggregate", value: "max")
+				` + to + `
+
+			toCountPsData
+				` + b.aggrWindow("min") + `
+				|> map(fn: (r) => ({r with _field: r._field + "Min"}))
+				|> set(key: "aggregate", value: "min")
+				` + to
+	case !b.From.First && kind == "gencounter":
+		q = `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
+				|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+				|> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+					and ` + instEq(tk, inst) + excl + `)
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "max")
+				` + b.aggrWindow("max") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "min")
+				` + b.aggrWindow("min") + `
+				` + to + `
+
+			allData
+				|> filter(fn: (r) => r["aggregate"] == "last")
+				` + b.aggrWindow("last") + `
+				` + to
+	case b.From.First && kind == "auto":
+		q = `allData =
+				from(bucket: ` + queries.Str(b.From.Name) + `)
+					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+					|> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+						and ` + instEq(tk, inst) + excl + `)
 
 				toCounterData =
 					allData
-						|> filter(fn: (r) => r._field == "ifHCInOctets" or r._field == "ifHCOutOctets")
+						|> filter(fn: (r) => r._field =~ ` + counters + `)
 
 				toCountPsData =
 					toCounterData
-						|> derivative(unit: 1s, nonNegative: true, columns: ["_value"], timeColumn: "_time")
+						` + i.rate() + `
 
-				toMaxData =
+				toGaugeData =
 					allData
-						|> filter(fn: (r) => r._field == "ifOperStatus")
+						|> filter(fn: (r) => r._field !~ ` + counters + `)
 
 				toCounterData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
+					` + b.aggrWindow("last") + `
 					|> set(key: "aggregate", value: "last")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					` + to + `
 
 				toCountPsData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
+					` + b.aggrWindow("max") + `
 					|> map(fn: (r) => ({r with _field: r._field + "Max"}))
 					|> set(key: "aggregate", value: "max")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					` + to + `
 
 				toCountPsData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
+					` + b.aggrWindow("min") + `
 					|> map(fn: (r) => ({r with _field: r._field + "Min"}))
 					|> set(key: "aggregate", value: "min")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					` + to + `
 
-				toMaxData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> set(key: "aggregate", value: "max")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case !b.From.First && col == "iftraffic":
-			q = `allData =
-				from(bucket: "` + b.From.Name + `")
-					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-					|> filter(fn: (r) => r._measurement == "iftraffic"
-						and r["agent_name"] == "` + inst + `")
-
-				allData
-					|> filter(fn: (r) => r["aggregate"] == "max")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
-
-				allData
-					|> filter(fn: (r) => r["aggregate"] == "min")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
-
-				allData
-					|> filter(fn: (r) => r["aggregate"] == "last")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case b.From.First && col == "gengauge":
-			q = `allData =
-				from(bucket: "` + b.From.Name + `")
-				  	|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-					|> filter(fn: (r) => r._measurement == "gengauge"
-						and r["agent_name"] == "` + inst + `")
-
-				allData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: mean, createEmpty: false)
+				toGaugeData
+					` + b.aggrWindow("mean") + `
 					|> set(key: "aggregate", value: "mean")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					` + to + `
 
-				allData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
+				toGaugeData
+					` + b.aggrWindow("max") + `
 					|> map(fn: (r) => ({r with _field: r._field + "Max"}))
 					|> set(key: "aggregate", value: "max")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					` + to + `
 
-				allData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
+				toGaugeData
+					` + b.aggrWindow("min") + `
 					|> map(fn: (r) => ({r with _field: r._field + "Min"}))
 					|> set(key: "aggregate", value: "min")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case !b.From.First && col == "gengauge":
-			q = `allData =
-				from(bucket: "` + b.From.Name + `")
+					` + to
+	case !b.From.First && kind == "auto":
+		q = `allData =
+				from(bucket: ` + queries.Str(b.From.Name) + `)
 					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-					|> filter(fn: (r) => r._measurement == "gengauge"
-						and r["agent_name"] == "` + inst + `")
+					|> filter(fn: (r) => r._measurement == ` + queries.Str(col) + `
+						and ` + instEq(tk, inst) + excl + `)
 
 				allData
 					|> filter(fn: (r) => r["aggregate"] == "mean")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: mean, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					` + b.aggrWindow("mean") + `
+					` + to + `
 
 				allData
 					|> filter(fn: (r) => r["aggregate"] == "max")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					` + b.aggrWindow("max") + `
+					` + to + `
 
 				allData
 					|> filter(fn: (r) => r["aggregate"] == "min")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case b.From.First && col == "gencounter":
-			q = `allData =
-				from(bucket: "` + b.From.Name + `")
-				  |> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-				  |> filter(fn: (r) => r._measurement == "gencounter"
-					  and r["agent_name"] == "` + inst + `")
-
-				toCountPsData =
-						allData
-						|> derivative(unit: 1s, nonNegative: true, columns: ["_value"], timeColumn: "_time")
+					` + b.aggrWindow("min") + `
+					` + to + `
 
 				allData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
-					|> set(key: "aggregate", value: "last")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
-
-				toCountPsData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> map(fn: (r) => ({r with _field: r._field + "Max"}))
-					|> set(key: "aggregate", value: "max")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
-
-				toCountPsData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
-					|> map(fn: (r) => ({r with _field: r._field + "Min"}))
-					|> set(key: "aggregate", value: "min")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case !b.From.First && col == "gencounter":
-			q = `allData =
-				from(bucket: "` + b.From.Name + `")
+					|> filter(fn: (r) => r["aggregate"] == "last")
+					` + b.aggrWindow("last") + `
+					` + to
+	case b.From.First && kind == "icingachk":
+		tExcl, tMean, tMax := i.icingaTiming(b, to)
+		q = `allData =
+				from(bucket: ` + queries.Str(b.From.Name) + `)
 					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-					|> filter(fn: (r) => r._measurement == "gencounter"
-						and r["agent_name"] == "` + inst + `")
+					|> filter(fn: (r) => ` + instEq(tk, inst) + excl + `
+					    and r._field !~ /^(current_attempt|max_check_attempts|state|state_type|reachable|acknowledgement|downtime_depth` + tExcl + `)$/)
 
+			toMeanData =
 				allData
-					|> filter(fn: (r) => r["aggregate"] == "max")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					|> filter(fn: (r) => r._field =~ /^(value` + tMean + `)$/)
 
+			toLastData =
 				allData
-					|> filter(fn: (r) => r["aggregate"] == "min")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+					|> filter(fn: (r) => r._field =~ /^(crit|min|max|warn|unit)$/)
 
-				allData
-					|> filter(fn: (r) => r["aggregate"] == "last")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case b.From.First && col == "icingachk":
-			q = `allData =
-					from(bucket: "` + b.From.Name + `")
-						|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-						|> filter(fn: (r) => r["hostname"] == "` + inst + `"
-						    and r._field !~ /^(current_attempt|max_check_attempts|state|state_type|execution_time|latency|reachable|acknowledgement|downtime_depth)$/)
-
-				toMeanData =
-					allData
-						|> filter(fn: (r) => r._field =~ /^value$/)
-
-				toLastData =
-					allData
-						|> filter(fn: (r) => r._field =~ /^(crit|min|max|warn|unit)$/)
+			toMeanData
+				` + b.aggrWindow("mean") + `
+				|> set(key: "aggregate", value: "mean")
+				` + to + `
 
-				toMeanData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: mean, createEmpty: false)
-					|> set(key: "aggregate", value: "mean")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
-
-				toMeanData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
-					|> set(key: "aggregate", value: "min")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
-
-				toMeanData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> set(key: "aggregate", value: "max")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+			toMeanData
+				` + b.aggrWindow("min") + `
+				|> set(key: "aggregate", value: "min")
+				` + to + `
 
-				toLastData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
-					|> set(key: "aggregate", value: "last")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		case !b.From.First && col == "icingachk":
-			q = `allData =
-					from(bucket: "` + b.From.Name + `")
-						|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
-						|> filter(fn: (r) => r["hostname"] == "` + inst + `"
-						    and r._field !~ /^(current_attempt|max_check_attempts|state|state_type)$/)
-
-				toMeanData =
-					allData
-						|> filter(fn: (r) => r._field =~ /^(value|execution_time|latency)$/)
+			toMeanData
+				` + b.aggrWindow("max") + `
+				|> set(key: "aggregate", value: "max")
+				` + to + `
 
-				toLastData =
-					allData
-						|> filter(fn: (r) => r._field =~ /^(reachable|acknowledgement|crit|downtime_depth|min|max|warn|unit)$/)
-						|> filter(fn: (r) => r.aggregate == "last")
+			toLastData
+				` + b.aggrWindow("last") + `
+				|> set(key: "aggregate", value: "last")
+				` + to + tMax
+	case !b.From.First && kind == "icingachk":
+		tExcl, tMean, tMax := i.icingaTiming(b, to)
+		q = `allData =
+				from(bucket: ` + queries.Str(b.From.Name) + `)
+					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+					|> filter(fn: (r) => ` + instEq(tk, inst) + excl + `
+					    and r._field !~ /^(current_attempt|max_check_attempts|state|state_type` + tExcl + `)$/)
 
-				toMeanData
-					|> filter(fn: (r) => r.aggregate == "mean")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: mean, createEmpty: false)
-					|> set(key: "aggregate", value: "mean")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+			toMeanData =
+				allData
+					|> filter(fn: (r) => r._field =~ /^(value` + tMean + `)$/)
 
-				toMeanData
-					|> filter(fn: (r) => r.aggregate == "min")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: min, createEmpty: false)
-					|> set(key: "aggregate", value: "min")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+			toLastData =
+				allData
+					|> filter(fn: (r) => r._field =~ /^(reachable|acknowledgement|crit|downtime_depth|min|max|warn|unit)$/)
+					|> filter(fn: (r) => r.aggregate == "last")
+
+			toMeanData
+				|> filter(fn: (r) => r.aggregate == "mean")
+				` + b.aggrWindow("mean") + `
+				|> set(key: "aggregate", value: "mean")
+				` + to + `
+
+			toMeanData
+				|> filter(fn: (r) => r.aggregate == "min")
+				` + b.aggrWindow("min") + `
+				|> set(key: "aggregate", value: "min")
+				` + to + `
 
-				toMeanData
-					|> filter(fn: (r) => r.aggregate == "max")
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
-					|> set(key: "aggregate", value: "max")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")
+			toMeanData
+				|> filter(fn: (r) => r.aggregate == "max")
+				` + b.aggrWindow("max") + `
+				|> set(key: "aggregate", value: "max")
+				` + to + `
 
-				toLastData
-					|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: last, createEmpty: false)
-					|> set(key: "aggregate", value: "last")
-					|> to(org: "` + i.Org + `", bucket: "` + b.Name + `")`
-		default:
-			return fmt.Errorf("no downsaple query found, bucket: %s, collection: %s", b.Name, c)
-		}
+			toLastData
+				` + b.aggrWindow("last") + `
+				|> set(key: "aggregate", value: "last")
+				` + to + tMax
+	case kind == "spec":
+		q = i.Specs[col].query(b, inst, fTs, tTs, excl) + i.ruleQuery(b, "allData", i.Specs[col].Fields, to)
+	default:
+		return "", fmt.Errorf("no downsaple query found, bucket: %s, collection: %s", b.Name, col)
+	}
 
-		fTs = fTs.Add(c)
+	q += over
+	if str != "" {
+		q = `import "types"
 
-		helpers.PrintDbg(fmt.Sprintf("downsample query for %s:\n %s", b.Name, q))
+		` + q + str
+	}
 
-		// Execute flux query
-		_, err = queryAPI.QueryRaw(context.Background(), q, influxdb2.DefaultDialect())
-		if err != nil {
-			return fmt.Errorf("influx query error - %w", err)
-		}
+	// Return results to client instead of writing them by server
+	if yield {
+		q = yieldQuery(q, to)
 	}
 
-	return nil
+	return q, nil
 }
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"crypto/tls"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// InfluxDB server holding destination tiers
+type destServer struct {
+	client influxdb2.Client
+	org    string
+}
+
+// SetDestination sets separate InfluxDB server holding destination tiers. Raw data is read from
+// primary server and aggregated data is written to destination server by client.
+//
+// Parameters:
+//
+//	url string - destination server URL
+//	token string - authentication token
+//	org string - organization
+//	timeout uint - HTTP request timeout in seconds
+//	tlsConf *tls.Config - TLS options, nil for system defaults
+func (i *Influx) SetDestination(url, token, org string, timeout uint, tlsConf *tls.Config) {
+	opts := influxdb2.DefaultOptions().SetHTTPRequestTimeout(timeout).SetTLSConfig(tlsConf)
+	i.dest = &destServer{client: influxdb2.NewClientWithOptions(url, token, opts), org: org}
+	i.ClientWrite = true
+}
+
+// server returns client and organization of InfluxDB server holding bucket.
+// Destination tiers are on destination server when it is set, raw source buckets
+// and internal stats always on primary server.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket, nil for primary server
+//
+// Returns:
+//
+//	influxdb2.Client - the client
+//	string - the organization
+func (i *Influx) server(b *Bucket) (influxdb2.Client, string) {
+	if i.dest == nil || b == nil || b.First {
+		return i.Client, i.Org
+	}
+
+	return i.dest.client, i.dest.org
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Downsampler is storage engine performing downsampling of instances along bucket chains.
+// Work loop of application uses only this interface, so other engines can be plugged in
+// and work loop can be tested against a mock.
+type Downsampler interface {
+	// DiscoverInstances returns names of instances of collection which have data in given time range
+	DiscoverInstances(b *Bucket, c string, st, stop time.Time) ([]string, error)
+	// GetInstances returns recently active instances of collection with their cardinality
+	GetInstances(b *Bucket, c string) ([]Instance, error)
+	// NewInstance returns instance with cardinality resolved
+	NewInstance(b *Bucket, name, col string) Instance
+	// CardGroup returns cardinality group of given cardinality
+	CardGroup(card int) string
+	// LastTS returns the timestamp of the latest data point of instance in bucket
+	LastTS(b *Bucket, inst, col string) (time.Time, error)
+	// LastDownsampled returns the timestamp of the latest downsampled data of instance in tier
+	LastDownsampled(b *Bucket, inst, col string) (time.Time, error)
+	// LastDownsampledAll returns the timestamps of the latest downsampled data of instances in tier
+	LastDownsampledAll(b *Bucket, insts []string, col string) (map[string]time.Time, error)
+	// Downsample downsamples new data of instance into bucket from last downsampled time, which is
+	// looked up when zero
+	Downsample(b *Bucket, inst, col string, last time.Time) error
+	// DownsampleGroup downsamples several instances into bucket together, returns instances left over
+	DownsampleGroup(b *Bucket, names []string, col string) ([]string, error)
+	// Write writes points to bucket
+	Write(b *Bucket, pts []*write.Point) error
+}
+
+// Influx implements Downsampler
+var _ Downsampler = (*Influx)(nil)
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// aggregate functions usable in field overrides
+var overrideAggrs = map[string]bool{
+	"mean":  true,
+	"min":   true,
+	"max":   true,
+	"first": true,
+	"last":  true,
+	"sum":   true,
+	"count": true,
+	"mode":  true,
+}
+
+// percentile aggregate, p1 - p99
+var percentileRe = regexp.MustCompile(`^p([1-9][0-9]?)$`)
+
+// re-aggregation strategies of percentiles in later tiers
+var pctReaggrs = map[string]bool{
+	"max":  true,
+	"mean": true,
+	"same": true,
+}
+
+// ValidPctReaggr reports whether s is known re-aggregation strategy of percentiles.
+//
+// Parameters:
+//
+//	s string - the strategy
+//
+// Returns:
+//
+//	bool - true if strategy is known
+func ValidPctReaggr(s string) bool {
+	return pctReaggrs[s]
+}
+
+// validAggr reports whether a is aggregate usable in field overrides and specs.
+func validAggr(a string) bool {
+	return overrideAggrs[a] || percentileRe.MatchString(a)
+}
+
+// aggrFn returns flux function of aggregate usable in aggregateWindow.
+// Counts of previous tier are summed in later tiers, mode selects most frequent value. Percentiles are estimated by quantile() from raw values in first tier. In later tiers
+// the same percentile of previous tier is re-aggregated by configured strategy:
+// max, mean or same (percentile of percentiles).
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	a string - the aggregate
+//
+// Returns:
+//
+//	string - flux function
+func (i *Influx) aggrFn(b *Bucket, a string) string {
+	if a == "count" && !b.From.First {
+		return "sum"
+	}
+	if a == "mode" {
+		return modeFn
+	}
+	m := percentileRe.FindStringSubmatch(a)
+	if m == nil {
+		return a
+	}
+	if !b.From.First && i.PctReaggr != "same" {
+		return i.PctReaggr
+	}
+	p, _ := strconv.Atoi(m[1])
+
+	return `(column, tables=<-) => tables |> quantile(q: ` + fmt.Sprintf("%.2f", float64(p)/100) + `, column: column, method: "estimate_tdigest")`
+}
+
+// ValidateFieldAggr checks field aggregate overrides.
+//
+// Parameters:
+//
+//	fa map[string]map[string][]string - field aggregates per collection
+//
+// Returns:
+//
+//	error - an error, if any
+func ValidateFieldAggr(fa map[string]map[string][]string) error {
+	for col, fields := range fa {
+		for f, aggrs := range fields {
+			if len(aggrs) == 0 {
+				return fmt.Errorf("%s, %s: no aggregates", col, f)
+			}
+			for _, a := range aggrs {
+				if !validAggr(a) {
+					return fmt.Errorf("%s, %s: unsupported aggregate %s", col, f, a)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateFieldRules checks field aggregation rules.
+//
+// Parameters:
+//
+//	rules []FieldRule - the rules
+//
+// Returns:
+//
+//	error - an error, if any
+func ValidateFieldRules(rules []FieldRule) error {
+	for _, f := range rules {
+		if len(f.Aggregates) == 0 {
+			return fmt.Errorf("%s: no aggregates", f.Re)
+		}
+		for _, a := range f.Aggregates {
+			if !validAggr(a) {
+				return fmt.Errorf("%s: unsupported aggregate %s", f.Re, a)
+			}
+		}
+	}
+
+	return nil
+}
+
+// overrideRules returns field rules overriding default handling of collection. Fields with
+// aggregates set by name come first, followed by regex rules in configured order. Measurements
+// expanded from regex collection get rules of that collection after their own ones.
+//
+// Parameters:
+//
+//	col string - the collection
+//
+// Returns:
+//
+//	[]FieldRule - the rules
+func (i *Influx) overrideRules(col string) []FieldRule {
+	rules := i.ownRules(col)
+	if p := i.regexParent(col); p != "" {
+		rules = append(rules, i.ownRules(p)...)
+	}
+
+	return rules
+}
+
+// ownRules returns field rules configured for collection name.
+func (i *Influx) ownRules(col string) []FieldRule {
+	fields := i.FieldAggr[col]
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	rules := make([]FieldRule, 0, len(names)+len(i.FieldRules[col]))
+	for _, name := range names {
+		re := regexp.MustCompile(`^` + regexp.QuoteMeta(name) + `$`)
+		rules = append(rules, FieldRule{Re: re, Aggregates: fields[name]})
+	}
+
+	return append(rules, i.FieldRules[col]...)
+}
+
+// ruleQuery returns flux query part aggregating fields by rules. Field matching several rules
+// is handled by the first one. First level aggregates raw values (rates of counters),
+// later levels re-aggregate the same aggregate.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	src string - name of source data stream
+//	rules []FieldRule - the rules
+//	to string - result output expression
+//
+// Returns:
+//
+//	string - flux query part
+func (i *Influx) ruleQuery(b *Bucket, src string, rules []FieldRule, to string) string {
+	var q string
+	var prev []string
+	for n, f := range rules {
+		name := fmt.Sprintf("%sRule%d", src, n+1)
+		sel := `r._field =~ ` + fluxRe(f.Re)
+		for _, p := range prev {
+			sel += ` and r._field !~ ` + p
+		}
+		prev = append(prev, fluxRe(f.Re))
+
+		q += `
+
+			` + name + ` =
+				` + src + `
+					|> filter(fn: (r) => ` + sel + `)`
+		if f.Rate && b.From.First {
+			q += `
+					` + i.rate()
+		}
+
+		for _, a := range f.Aggregates {
+			sel := ""
+			set := `
+				|> set(key: "aggregate", value: ` + queries.Str(a) + `)`
+			if !b.From.First {
+				sel = `
+				|> filter(fn: (r) => r.aggregate == ` + queries.Str(a) + `)`
+				set = ""
+			}
+
+			q += `
+
+			` + name + sel + `
+				` + b.aggrWindow(i.aggrFn(b, a)) + set + `
+				` + to
+		}
+	}
+
+	return q
+}
+
+// overrideQuery returns flux query part for fields with overridden aggregates of collection
+// and filter expression excluding them from default handling.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//	to string - result output expression
+//
+// Returns:
+//
+//	string - filter expression excluding overridden fields
+//	string - flux query part
+//	error - an error, if any
+func (i *Influx) overrideQuery(b *Bucket, inst, col string, fTs, tTs time.Time, to string) (string, string, error) {
+	rules := i.overrideRules(col)
+	if len(rules) == 0 {
+		return "", "", nil
+	}
+
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return "", "", err
+	}
+
+	var sel, excl string
+	for n, r := range rules {
+		if n > 0 {
+			sel += ` or `
+		}
+		sel += `r._field =~ ` + fluxRe(r.Re)
+		excl += `
+						and r._field !~ ` + fluxRe(r.Re)
+	}
+
+	q := `
+
+			overData =
+				from(bucket: ` + queries.Str(b.From.Name) + `)
+					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+					|> filter(fn: (r) => ` + f + `
+						and (` + sel + `))` + i.ruleQuery(b, "overData", rules, to)
+
+	return excl, q, nil
+}
@@ -0,0 +1,21 @@
+package db
+
+// InfluxDB flavors
+const (
+	FlavorV1 = "v1" // InfluxDB 1.8+ via Flux and write compatibility API
+	FlavorV2 = "v2" // InfluxDB 2.x
+	FlavorV3 = "v3" // InfluxDB 3.x via SQL API, declarative collections only
+)
+
+// ValidFlavor reports whether f is supported InfluxDB flavor.
+//
+// Parameters:
+//
+//	f string - the flavor
+//
+// Returns:
+//
+//	bool - true if flavor is supported
+func ValidFlavor(f string) bool {
+	return f == FlavorV1 || f == FlavorV2 || f == FlavorV3
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// sourceWindows returns timestamps of windows of given time range which have data of
+// instance in source bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	map[int64]bool - unix timestamps of windows with source data
+//	error - an error, if any
+func (i *Influx) sourceWindows(b *Bucket, inst, col string, fTs, tTs time.Time) (map[int64]bool, error) {
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return nil, err
+	}
+
+	q := queries.RangeQuery{Bucket: b.From.Name, Start: fTs, Stop: tTs, Filters: []string{f}}.String() + `
+	|> keep(columns: ["_time", "_value"])
+	|> group()
+	` + queries.AggregateWindow{Every: b.AInterv, Offset: b.Window.Offset, Fn: "count", TimeSrc: b.Window.TimeSrc}.String() + `
+	|> keep(columns: ["_time"])`
+
+	helpers.PrintDbg(fmt.Sprintf("source windows query for %s:\n %s", b.From.Name, q))
+
+	windows := make(map[int64]bool)
+	result, done, err := i.query(b.From, q)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
+	for result.Next() {
+		windows[result.Record().Time().Unix()] = true
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	return windows, nil
+}
+
+// RepairGaps finds windows of given time range which have data of instance in source bucket
+// but no aggregated data in destination bucket, and re-aggregates just these gaps.
+// Range is aligned to aggregation windows of bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	int - count of repaired windows
+//	error - an error, if any
+func (i *Influx) RepairGaps(b *Bucket, inst, col string, fTs, tTs time.Time) (int, error) {
+	if i.Flavor == FlavorV3 {
+		return 0, fmt.Errorf("gap repair not supported by db flavor %s", i.Flavor)
+	}
+	fTs = windowStart(fTs, b)
+	tTs = windowStart(tTs, b)
+	if !fTs.Before(tTs) {
+		return 0, nil
+	}
+
+	src, err := i.sourceWindows(b, inst, col, fTs, tTs)
+	if err != nil {
+		return 0, fmt.Errorf("can't get source windows - %w", err)
+	}
+	if len(src) == 0 {
+		return 0, nil
+	}
+	written, err := i.writtenWindows(b, inst, col, fTs, tTs)
+	if err != nil {
+		return 0, fmt.Errorf("can't get written windows - %w", err)
+	}
+
+	gaps := windowRanges(b, fTs, tTs, func(t int64) bool { return src[t] && !written[t] })
+	if len(gaps) == 0 {
+		return 0, nil
+	}
+
+	card, err := i.Cardinality(b.From, inst, col)
+	if err != nil {
+		helpers.PrintWarn(fmt.Sprintf("error getting cardinality: %v. Using default", err))
+	}
+	c := time.Duration(i.BatchWindows(card)) * b.AInterv
+
+	n := 0
+	for _, g := range gaps {
+		helpers.PrintInfo(fmt.Sprintf("%s, %s: repairing gap %s - %s", b.Name, inst, g.start.Format(time.RFC3339), g.stop.Format(time.RFC3339)))
+		for st := g.start; st.Before(g.stop); st = st.Add(c) {
+			stop := st.Add(c)
+			if stop.After(g.stop) {
+				stop = g.stop
+			}
+			if err := i.ctx.Err(); err != nil {
+				return n, err
+			}
+			if err := i.waitResources(); err != nil {
+				return n, err
+			}
+			if err := i.runBatch(b, inst, col, st, stop); err != nil {
+				return n, err
+			}
+			if !i.DryRun {
+				i.Ledger.Add(col, b.Name, inst, st, stop, b.RPeriod)
+			}
+			n += int(stop.Sub(st) / b.AInterv)
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// cancellation context shared by running downsample queries
+type queryGate struct {
+	mu     sync.Mutex
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	aborts uint64
+}
+
+// newQueryGate returns query gate with fresh context derived from parent.
+func newQueryGate(parent context.Context) *queryGate {
+	g := &queryGate{parent: parent}
+	g.ctx, g.cancel = context.WithCancel(parent)
+
+	return g
+}
+
+// SetContext sets root context of all queries. Cancelling it stops downsampling.
+// Must be called before downsampling is started.
+//
+// Parameters:
+//
+//	ctx context.Context - root context
+func (i *Influx) SetContext(ctx context.Context) {
+	i.ctx = ctx
+	i.gate = newQueryGate(ctx)
+}
+
+// sleepCtx pauses for given duration or until context is done.
+//
+// Parameters:
+//
+//	ctx context.Context - the context
+//	d time.Duration - duration of pause
+//
+// Returns:
+//
+//	error - context error if context is done before pause ends
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// context returns context of downsample queries started now.
+func (g *queryGate) context() context.Context {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.ctx
+}
+
+// CancelQueries aborts all running downsample queries. Aborted batches are
+// retried in smaller parts when resources are available again.
+//
+// No parameters.
+// No return values.
+func (i *Influx) CancelQueries() {
+	g := i.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cancel()
+	g.ctx, g.cancel = context.WithCancel(g.parent)
+	g.aborts++
+}
+
+// abortCount returns how many times running queries have been aborted.
+func (g *queryGate) abortCount() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.aborts
+}
+
+// waitResources blocks until resource monitor reports available resources.
+// Returns root context error if stopped while waiting.
+func (i *Influx) waitResources() error {
+	if !i.Resources.Open() {
+		helpers.PrintDbg("pause downsampling, no resources available")
+	}
+
+	return i.Resources.Wait(i.ctx)
+}
+
+// splitRange splits time range to two halves aligned to aggregation windows.
+// Range of single window is returned as is.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	r trange - the range
+//
+// Returns:
+//
+//	[]trange - parts of the range
+func splitRange(b *Bucket, r trange) []trange {
+	windows := int64(r.stop.Sub(r.start) / b.AInterv)
+	if windows <= 1 {
+		return []trange{r}
+	}
+	mid := r.start.Add(time.Duration(windows/2) * b.AInterv)
+
+	return []trange{{start: r.start, stop: mid}, {start: mid, stop: r.stop}}
+}
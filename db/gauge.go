@@ -0,0 +1,131 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// extra aggregates of gengauge fields and suffixes of fields holding them
+var gaugeExtras = map[string]string{
+	"first":  "First",
+	"last":   "Last",
+	"spread": "Spread",
+}
+
+// ValidateGaugeExtras checks rules of extra aggregates of gengauge fields.
+//
+// Parameters:
+//
+//	rules []FieldRule - the rules
+//
+// Returns:
+//
+//	error - an error, if any
+func ValidateGaugeExtras(rules []FieldRule) error {
+	for _, f := range rules {
+		if len(f.Aggregates) == 0 {
+			return fmt.Errorf("%s: no aggregates", f.Re)
+		}
+		if f.Rate {
+			return fmt.Errorf("%s: rate not supported", f.Re)
+		}
+		for _, a := range f.Aggregates {
+			if gaugeExtras[a] == "" {
+				return fmt.Errorf("%s: unsupported extra aggregate %s, must be first, last or spread", f.Re, a)
+			}
+		}
+	}
+
+	return nil
+}
+
+// extraRules returns rules of extra aggregates of gengauge collection. Measurements expanded
+// from regex collection get rules of that collection after their own ones.
+func (i *Influx) extraRules(col string) []FieldRule {
+	rules := i.GaugeExtras[col]
+	if p := i.regexParent(col); p != "" {
+		rules = append(rules[:len(rules):len(rules)], i.GaugeExtras[p]...)
+	}
+
+	return rules
+}
+
+// gaugeExtrasQuery returns flux query part storing extra aggregates of gengauge fields in addition
+// to default mean, max and min. Field matching several rules is handled by the first one. Values
+// are stored as fields with aggregate suffix (First, Last, Spread). Later tiers take first and
+// last of previous tier and compute spread from its max and min, which keeps it exact.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	col string - the collection
+//	to string - result output expression
+//
+// Returns:
+//
+//	string - imports needed by query part
+//	string - flux query part
+func (i *Influx) gaugeExtrasQuery(b *Bucket, col, to string) (string, string) {
+	var q string
+	var prev []string
+	sels := make(map[string][]string)
+	for _, f := range i.extraRules(col) {
+		sel := `r._field =~ ` + fluxRe(f.Re)
+		for _, p := range prev {
+			sel += ` and r._field !~ ` + p
+		}
+		prev = append(prev, fluxRe(f.Re))
+		for _, a := range f.Aggregates {
+			sels[a] = append(sels[a], `(`+sel+`)`)
+		}
+	}
+
+	for _, a := range []string{"first", "last", "spread"} {
+		if len(sels[a]) == 0 {
+			continue
+		}
+		sel := strings.Join(sels[a], ` or `)
+		sfx := gaugeExtras[a]
+
+		switch {
+		case b.From.First:
+			q += `
+
+			allData
+				|> filter(fn: (r) => ` + sel + `)
+				` + b.aggrWindow(a) + `
+				|> map(fn: (r) => ({r with _field: r._field + "` + sfx + `"}))
+				|> set(key: "aggregate", value: "` + a + `")
+				` + to
+		case a == "spread":
+			// Spread of window is max of max values minus min of min values
+			q += `
+
+			allData
+				|> filter(fn: (r) => r.aggregate == "max" or r.aggregate == "min")
+				|> map(fn: (r) => ({r with _field: if r.aggregate == "max" then strings.trimSuffix(v: r._field, suffix: "Max") else strings.trimSuffix(v: r._field, suffix: "Min")}))
+				|> filter(fn: (r) => ` + sel + `)
+				|> set(key: "aggregate", value: "spread")
+				|> group(columns: ["_time", "_value"], mode: "except")
+				` + b.aggrWindow("spread") + `
+				|> map(fn: (r) => ({r with _field: r._field + "` + sfx + `"}))
+				` + to
+		default:
+			q += `
+
+			allData
+				|> filter(fn: (r) => r.aggregate == "` + a + `")
+				` + b.aggrWindow(a) + `
+				` + to
+		}
+	}
+
+	var imp string
+	if !b.From.First && len(sels["spread"]) > 0 {
+		imp = `import "strings"
+
+		`
+	}
+
+	return imp, q
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// separator of member names in instance group name. Control characters are not valid in
+// instance names, so group name can't be mistaken for an instance.
+const groupSep = "\x1f"
+
+// groupName returns name of instance group used in place of instance name in queries.
+func groupName(names []string) string {
+	return strings.Join(names, groupSep)
+}
+
+// groupMembers returns member names of instance group or the instance itself.
+func groupMembers(inst string) []string {
+	return strings.Split(inst, groupSep)
+}
+
+// groupLabel returns readable name of instance group for logs.
+func groupLabel(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+
+	return fmt.Sprintf("%s and %d more", names[0], len(names)-1)
+}
+
+// instEq returns flux predicate matching data of instance or of any member of instance group.
+//
+// Parameters:
+//
+//	tk string - the instance tag key
+//	inst string - the instance or instance group name
+//
+// Returns:
+//
+//	string - filter predicate
+func instEq(tk, inst string) string {
+	ms := groupMembers(inst)
+	preds := make([]string, len(ms))
+	for n, m := range ms {
+		preds[n] = `r[` + queries.Str(tk) + `] == ` + queries.Str(m)
+	}
+	if len(preds) == 1 {
+		return preds[0]
+	}
+
+	return queries.Or(preds...)
+}
+
+// DownsampleGroup downsamples several light instances of collection into bucket with one query
+// per batch. Instances are grouped by time of last downsampled window and window of last source
+// measurement, so the members of a group share time ranges. Only the largest such group is
+// downsampled. Counter resets are not counted for grouped instances.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	names []string - the instance names
+//	col string - the collection
+//
+// Returns:
+//
+//	[]string - instances not downsampled, to be downsampled one by one
+//	error - an error, if any. All instances are returned then
+func (i *Influx) DownsampleGroup(b *Bucket, names []string, col string) ([]string, error) {
+	// Grouping is not possible for custom queries and for write verification of single instances
+	if len(names) < 2 || i.Flavor == FlavorV3 || i.queryTemplate(col) != nil || i.OnVerify != nil {
+		return names, nil
+	}
+
+	type span struct{ from, last time.Time }
+	now := time.Now()
+	var rest []string
+	spans := make(map[span][]string)
+	last := make(map[string]time.Time)
+	var best span
+	for _, inst := range names {
+		ft, err := i.LastTS(b.From, inst, col)
+		if err != nil {
+			rest = append(rest, inst)
+			continue
+		}
+		last[inst] = ft
+		t, err := i.LastDownsampled(b, inst, col)
+		if err != nil {
+			rest = append(rest, inst)
+			continue
+		}
+		// Nothing to downsample yet
+		if t.Add(b.AInterv).Compare(now) >= 0 {
+			continue
+		}
+
+		k := span{from: t, last: windowStart(ft, b)}
+		spans[k] = append(spans[k], inst)
+		if len(spans[k]) > len(spans[best]) {
+			best = k
+		}
+	}
+	for k, s := range spans {
+		if k != best || len(s) < 2 {
+			rest = append(rest, s...)
+		}
+	}
+	members := spans[best]
+	if len(members) < 2 {
+		return rest, nil
+	}
+
+	// Don't go past last measurement of any member
+	ft := now
+	for _, inst := range members {
+		if last[inst].Before(ft) {
+			ft = last[inst]
+		}
+	}
+
+	label := groupLabel(members)
+	helpers.PrintDbg(fmt.Sprintf("%s, %s: downsampling %d light instances together", b.Name, label, len(members)))
+	if err := i.downsampleRange(b, members, col, best.from, ft); err != nil {
+		return names, fmt.Errorf("%s, %s: grouped downsample: %w", b.Name, label, err)
+	}
+
+	return rest, nil
+}
+
+// downsampleRange downsamples instance group from given time up to last source measurement.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	members []string - the instance names
+//	col string - the collection
+//	fTs time.Time - last downsampled time of members
+//	ft time.Time - last source measurement time of members
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) downsampleRange(b *Bucket, members []string, col string, fTs, ft time.Time) error {
+	inst := groupName(members)
+	// Cardinality of group is not known
+	c := time.Duration(i.BatchWindows(0)) * b.AInterv
+	for fTs.Before(ft.Add(-1 * b.AInterv)) {
+		tTs := fTs.Add(c)
+		// End time should be before source bucket last time
+		for !tTs.Before(ft) {
+			tTs = tTs.Add(-1 * b.AInterv)
+		}
+		// Stop when shutting down, check for resources
+		if err := i.ctx.Err(); err != nil {
+			return err
+		}
+		if err := i.waitResources(); err != nil {
+			return err
+		}
+
+		id := i.inflight.add(inflight{
+			inst:    groupLabel(members),
+			bucket:  b.Name,
+			windows: int(tTs.Sub(fTs) / b.AInterv),
+			start:   time.Now(),
+		})
+		// Delete predicates can't match several instances
+		if i.DeleteBefore {
+			for _, m := range members {
+				if err := i.deleteRange(b, m, col, fTs, tTs); err != nil {
+					i.inflight.done(id)
+					return err
+				}
+			}
+		}
+		err := i.runBatch(b, inst, col, fTs, tTs)
+		i.inflight.done(id)
+		if err != nil {
+			return err
+		}
+		if !i.DryRun {
+			for _, m := range members {
+				i.Ledger.Add(col, b.Name, m, fTs, tTs, b.RPeriod)
+				i.Checkpoints.Advance(col, b.Name, m, tTs)
+			}
+		}
+
+		fTs = fTs.Add(c)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package db
+
+// aggregation policies of icinga check timing fields (execution_time, latency)
+var icingaTimings = map[string]bool{
+	"exclude": true,
+	"mean":    true,
+	"max":     true,
+}
+
+// ValidIcingaTiming reports whether p is known aggregation policy of icinga check timing fields.
+//
+// Parameters:
+//
+//	p string - the policy
+//
+// Returns:
+//
+//	bool - true if policy is known
+func ValidIcingaTiming(p string) bool {
+	return icingaTimings[p]
+}
+
+// icingaTiming returns query parts handling icinga check timing fields according to configured policy.
+// Policy is applied the same way in every tier.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	to string - to() call used in query
+//
+// Returns:
+//
+//	string - alternation of timing fields to exclude from source data
+//	string - alternation of timing fields to aggregate together with check value
+//	string - query aggregating only max of timing fields
+func (i *Influx) icingaTiming(b *Bucket, to string) (string, string, string) {
+	const fields = "execution_time|latency"
+
+	switch i.IcingaTiming {
+	case "mean":
+		return "", "|" + fields, ""
+	case "max":
+		var src string
+		if !b.From.First {
+			src = `
+				|> filter(fn: (r) => r.aggregate == "max")`
+		}
+		q := `
+
+			allData
+				|> filter(fn: (r) => r._field =~ /^(` + fields + `)$/)` + src + `
+				|> aggregateWindow(every: ` + b.AInterv.String() + `, fn: max, createEmpty: false)
+				|> set(key: "aggregate", value: "max")
+				` + to
+
+		return "", "", q
+	default:
+		return "|" + fields, "", ""
+	}
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// in-flight downsample batch
+type inflight struct {
+	inst    string
+	bucket  string
+	windows int
+	card    int
+	start   time.Time
+}
+
+// registry of in-flight downsample batches
+type inflightBatches struct {
+	mu      sync.Mutex
+	seq     uint64
+	batches map[uint64]inflight
+}
+
+// BatchStats is aggregate statistics about in-flight downsample batches
+type BatchStats struct {
+	Count       int
+	Windows     int
+	MaxWindows  int
+	MaxCard     int
+	LongestInst string
+	Longest     time.Duration
+}
+
+// add registers in-flight batch and returns its id.
+func (f *inflightBatches) add(b inflight) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	f.batches[f.seq] = b
+
+	return f.seq
+}
+
+// done removes batch from registry.
+func (f *inflightBatches) done(id uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.batches, id)
+}
+
+// InflightStats returns aggregate statistics about in-flight downsample batches.
+func (i *Influx) InflightStats() BatchStats {
+	var s BatchStats
+	f := i.inflight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, b := range f.batches {
+		s.Count++
+		s.Windows += b.windows
+		if b.windows > s.MaxWindows {
+			s.MaxWindows = b.windows
+		}
+		if b.card > s.MaxCard {
+			s.MaxCard = b.card
+		}
+		if d := time.Since(b.start); d > s.Longest {
+			s.Longest = d
+			s.LongestInst = b.bucket + ", " + b.inst
+		}
+	}
+
+	return s
+}
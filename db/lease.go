@@ -0,0 +1,74 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// LeaseMeas is measurement of coordination leases
+const LeaseMeas = "idbds_lease"
+
+// LeaseOwners returns owners of unexpired leases in lease bucket on primary server. Lease expires
+// when it isn't renewed in ttl.
+//
+// Parameters:
+//
+//	bucket string - the lease bucket name
+//	ttl time.Duration - lease lifetime
+//
+// Returns:
+//
+//	map[string]string - owners by lease key
+//	error - an error, if any
+func (i *Influx) LeaseOwners(bucket string, ttl time.Duration) (map[string]string, error) {
+	q := `from(bucket: ` + queries.Str(bucket) + `)
+  |> range(start: -` + ttl.String() + `)
+  |> filter(fn: (r) => r._measurement == ` + queries.Str(LeaseMeas) + ` and r._field == "owner")
+  |> group(columns: ["lease"])
+  |> last()`
+
+	helpers.PrintDbg(fmt.Sprintf("lease query:\n %s", q))
+
+	owners := make(map[string]string)
+	result, done, err := i.query(nil, q)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
+	for result.Next() {
+		k, _ := result.Record().ValueByKey("lease").(string)
+		if v, ok := result.Record().Value().(string); ok && k != "" {
+			owners[k] = v
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	return owners, nil
+}
+
+// WriteLeases writes (renews) leases of given keys to lease bucket on primary server.
+//
+// Parameters:
+//
+//	bucket string - the lease bucket name
+//	owner string - the lease owner
+//	keys []string - lease keys
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) WriteLeases(bucket, owner string, keys []string) error {
+	now := time.Now()
+	pts := make([]*write.Point, 0, len(keys))
+	for _, k := range keys {
+		pts = append(pts, write.NewPoint(LeaseMeas, map[string]string{"lease": k}, map[string]interface{}{"owner": owner}, now))
+	}
+
+	return i.writePoints(&Bucket{Name: bucket, First: true}, pts)
+}
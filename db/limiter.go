@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter limits rate and concurrency of queries. One limiter can be shared by several connections.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second, 0 means unlimited rate
+	burst  float64
+	tokens float64
+	last   time.Time
+	sem    chan struct{} // nil means unlimited concurrency
+}
+
+// NewLimiter returns token bucket limiter of queries.
+//
+// Parameters:
+//
+//	perMin int - queries per minute, burst of at most one second worth of queries, 0 disables
+//	conc int - concurrent queries, 0 disables
+//
+// Returns:
+//
+//	*Limiter - the limiter, nil if both limits are disabled
+func NewLimiter(perMin, conc int) *Limiter {
+	if perMin <= 0 && conc <= 0 {
+		return nil
+	}
+
+	l := &Limiter{last: time.Now()}
+	if perMin > 0 {
+		l.rate = float64(perMin) / 60
+		l.burst = max(1, l.rate)
+		l.tokens = l.burst
+	}
+	if conc > 0 {
+		l.sem = make(chan struct{}, conc)
+	}
+
+	return l
+}
+
+// acquire waits for token and free concurrency slot. Slot must be released by release.
+func (l *Limiter) acquire(ctx context.Context) error {
+	for l.rate > 0 {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			break
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		if err := sleepCtx(ctx, wait); err != nil {
+			return err
+		}
+	}
+
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// release frees concurrency slot.
+func (l *Limiter) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// limit waits until query is allowed by all limiters of connection.
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//
+// Returns:
+//
+//	func() - releases concurrency slots, must be called when query is done
+//	error - context error if context is done while waiting
+func (i *Influx) limit(ctx context.Context) (func(), error) {
+	var held []*Limiter
+	release := func() {
+		for _, l := range held {
+			l.release()
+		}
+	}
+	for _, l := range i.Limiters {
+		if l == nil {
+			continue
+		}
+		if err := l.acquire(ctx); err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+
+	return release, nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// kinds of collections which can be applied to measurements matched by regex
+var measKinds = map[string]bool{
+	"ifstats":    true,
+	"iftraffic":  true,
+	"gengauge":   true,
+	"gencounter": true,
+	"auto":       true,
+}
+
+// registry of measurements expanded from regex collections
+type measRegistry struct {
+	mu      sync.RWMutex
+	kinds   map[string]string
+	tags    map[string]string
+	parents map[string]string
+}
+
+// ValidMeasKind checks if collection kind can be applied to measurements matched by regex.
+func ValidMeasKind(kind string) bool {
+	return measKinds[kind]
+}
+
+// Kind returns kind of collection. Built in collections are their own kind,
+// measurements expanded from regex collections have kind of that collection
+// and collections defined by spec are of kind "spec".
+//
+// Parameters:
+//
+//	col string - the collection
+//
+// Returns:
+//
+//	string - collection kind
+func (i *Influx) Kind(col string) string {
+	if _, ok := i.Specs[col]; ok {
+		return "spec"
+	}
+
+	i.meas.mu.RLock()
+	defer i.meas.mu.RUnlock()
+	if k, ok := i.meas.kinds[col]; ok {
+		return k
+	}
+
+	return col
+}
+
+// TagKey returns tag identifying instance of collection. Tag of spec collections is defined
+// in spec, tag of other collections can be configured per collection (measurements expanded from
+// regex collections inherit tag of that collection). Defaults are hostname for icinga checks and
+// agent_name for the rest.
+//
+// Parameters:
+//
+//	col string - the collection
+//
+// Returns:
+//
+//	string - tag key
+func (i *Influx) TagKey(col string) string {
+	if s, ok := i.Specs[col]; ok {
+		return s.TagKey
+	}
+	if t, ok := i.TagKeys[col]; ok {
+		return t
+	}
+
+	i.meas.mu.RLock()
+	t, ok := i.meas.tags[col]
+	i.meas.mu.RUnlock()
+	switch {
+	case ok && t != "":
+		return t
+	case i.Kind(col) == "icingachk":
+		return "hostname"
+	default:
+		return "agent_name"
+	}
+}
+
+// regexParent returns regex collection measurement was expanded from, empty for other collections.
+func (i *Influx) regexParent(col string) string {
+	i.meas.mu.RLock()
+	defer i.meas.mu.RUnlock()
+
+	return i.meas.parents[col]
+}
+
+// DiscoverMeasurements retrieves measurements matching regex from bucket and registers them
+// as collections of given kind expanded from regex collection.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket to query
+//	parent string - the regex collection
+//	re *regexp.Regexp - measurement name regex
+//	kind string - collection kind applied to matched measurements
+//	tag string - tag identifying instance in matched measurements, default when empty
+//
+// Returns:
+//
+//	[]string - matched measurements
+//	error - an error, if any
+func (i *Influx) DiscoverMeasurements(b *Bucket, parent string, re *regexp.Regexp, kind, tag string) ([]string, error) {
+	st := time.Now().Add(-10 * b.AInterv) // now - 10 * aggregation duration
+	q := `import "influxdata/influxdb/schema"
+		schema.measurements(
+			bucket: ` + queries.Str(b.Name) + `,
+			start: ` + fmt.Sprintf("%d", st.Unix()) + `
+		)`
+
+	helpers.PrintDbg(fmt.Sprintf("measurements query for %s:\n %s", b.Name, q))
+
+	var res []string
+	result, done, err := i.query(b, q)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
+	for result.Next() {
+		// Built in collections keep their own handling
+		if v, ok := result.Record().Value().(string); ok && re.MatchString(v) && !measKinds[v] {
+			res = append(res, v)
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	i.meas.mu.Lock()
+	defer i.meas.mu.Unlock()
+	for _, m := range res {
+		i.meas.kinds[m] = kind
+		i.meas.tags[m] = tag
+		i.meas.parents[m] = parent
+	}
+
+	return res, nil
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+// scrapeMetrics reads InfluxDB Prometheus /metrics endpoint and returns values of requested metrics.
+// Values of series with different labels are summed.
+//
+// Parameters:
+//
+//	names ...string - metric names
+//
+// Returns:
+//
+//	map[string]float64 - values of found metrics
+//	error - an error, if any
+func (i *Influx) scrapeMetrics(names ...string) (map[string]float64, error) {
+	var res map[string]float64
+	err := i.retryRL(i.ctx, func() error {
+		var err error
+		res, err = i.scrapeOnce(names)
+		return err
+	})
+
+	return res, err
+}
+
+// scrapeOnce reads InfluxDB Prometheus /metrics endpoint once, see scrapeMetrics.
+func (i *Influx) scrapeOnce(names []string) (map[string]float64, error) {
+	ctx, cancel := context.WithTimeout(i.ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(i.url, "/")+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+i.token.get())
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return nil, &ihttp.Error{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &ihttp.Error{StatusCode: resp.StatusCode, Code: resp.Status, Message: strings.TrimSpace(string(msg)), RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	return parseMetrics(resp.Body, names)
+}
+
+// parseMetrics parses Prometheus text exposition format and returns values of requested metrics.
+//
+// Parameters:
+//
+//	r io.Reader - metrics text
+//	names []string - metric names
+//
+// Returns:
+//
+//	map[string]float64 - values of found metrics
+//	error - an error, if any
+func parseMetrics(r io.Reader, names []string) (map[string]float64, error) {
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[n] = true
+	}
+
+	res := make(map[string]float64)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		// name{labels} value [timestamp]
+		name, rest := l, ""
+		if n := strings.IndexAny(l, "{ "); n > 0 {
+			name, rest = l[:n], l[n:]
+		}
+		if !want[name] {
+			continue
+		}
+		if strings.HasPrefix(rest, "{") {
+			n := strings.LastIndex(rest, "}")
+			if n < 0 {
+				continue
+			}
+			rest = rest[n+1:]
+		}
+		f := strings.Fields(rest)
+		if len(f) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(f[0], 64)
+		if err != nil {
+			continue
+		}
+		res[name] += v
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("can't read metrics - %w", err)
+	}
+
+	return res, nil
+}
+
+// metricsRunningTasks retrieves the count of running tasks from InfluxDB /metrics endpoint.
+//
+// Returns:
+//
+//	*float64 - count of running tasks, nil if not exposed
+//	error - an error, if any
+func (i *Influx) metricsRunningTasks() (*float64, error) {
+	m, err := i.scrapeMetrics("task_executor_total_runs_active")
+	if err != nil {
+		return nil, err
+	}
+	v, ok := m["task_executor_total_runs_active"]
+	if !ok {
+		return nil, nil
+	}
+
+	return &v, nil
+}
+
+// metricsMemUsage retrieves the memory usage percentage from InfluxDB /metrics endpoint.
+//
+// Returns:
+//
+//	*float64 - allocated memory in percent of memory obtained from system, nil if not exposed
+//	error - an error, if any
+func (i *Influx) metricsMemUsage() (*float64, error) {
+	m, err := i.scrapeMetrics("go_memstats_alloc_bytes", "go_memstats_sys_bytes")
+	if err != nil {
+		return nil, err
+	}
+	used, ok1 := m["go_memstats_alloc_bytes"]
+	total, ok2 := m["go_memstats_sys_bytes"]
+	if !ok1 || !ok2 || total == 0 {
+		return nil, nil
+	}
+	v := used / total * 100.0
+
+	return &v, nil
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// second InfluxDB destination written in parallel with destination tiers
+type mirrorServer struct {
+	name    string
+	client  influxdb2.Client
+	org     string
+	buckets map[string]string // mirror bucket names by destination bucket name
+}
+
+// SetMirror sets second InfluxDB destination of downsampled points, e.g. during migration. Points
+// are written to mirror after destination bucket, batch not written to mirror fails like failed
+// write to destination, so checkpoint is not advanced and range is re-run.
+//
+// Parameters:
+//
+//	url string - mirror server URL
+//	token string - authentication token
+//	org string - organization
+//	buckets map[string]string - mirror bucket names by destination bucket name, same name used if not mapped
+//	timeout uint - HTTP request timeout in seconds
+//	tlsConf *tls.Config - TLS options, nil for system defaults
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) SetMirror(url, token, org string, buckets map[string]string, timeout uint, tlsConf *tls.Config) error {
+	if org == "" {
+		return fmt.Errorf("organization of mirror %s missing", url)
+	}
+
+	opts := influxdb2.DefaultOptions().SetHTTPRequestTimeout(timeout).SetTLSConfig(tlsConf)
+	i.mirror = &mirrorServer{
+		name:    "mirror:" + url,
+		client:  influxdb2.NewClientWithOptions(url, token, opts),
+		org:     org,
+		buckets: buckets,
+	}
+	i.ClientWrite = true
+
+	return nil
+}
+
+// bucket returns mirror bucket name of destination bucket.
+func (m *mirrorServer) bucket(name string) string {
+	if b, ok := m.buckets[name]; ok {
+		return b
+	}
+
+	return name
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// maximum backoff when server does not provide Retry-After
+const maxRLBackoff = 5 * time.Minute
+
+// RateLimitDelay checks if error is rate limit (HTTP 429) or service unavailable (HTTP 503)
+// response from InfluxDB. Both mean server asks client to back off.
+//
+// Parameters:
+//
+//	err error - error returned by influxdb client
+//
+// Returns:
+//
+//	time.Duration - delay requested by server in Retry-After header, 0 if not provided
+//	bool - true if error is rate limit or service unavailable response
+func RateLimitDelay(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+	var herr *ihttp.Error
+	if !errors.As(err, &herr) {
+		// Errors of management APIs (delete, buckets, tasks) carry only text of response
+		m := err.Error()
+		for _, p := range apiLimitPrefixes {
+			if strings.HasPrefix(m, p) {
+				return 0, true
+			}
+		}
+		return 0, false
+	}
+	if herr.StatusCode != http.StatusTooManyRequests && herr.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	return time.Duration(herr.RetryAfter) * time.Second, true
+}
+
+// prefixes of rate limit and service unavailable error texts of management APIs, by error code
+// of json response or by status of other responses
+var apiLimitPrefixes = []string{
+	string(domain.ErrorCodeTooManyRequests) + ":",
+	string(domain.ErrorCodeUnavailable) + ":",
+	"429 ",
+	"503 ",
+}
+
+// retryRL calls function and retries it when server responds with rate limit or service unavailable.
+// Waits as long as requested by Retry-After, otherwise backs off exponentially.
+//
+// Parameters:
+//
+//	ctx context.Context - context of waiting between attempts
+//	fn func() error - the call
+//
+// Returns:
+//
+//	error - an error of the last attempt, if any
+func (i *Influx) retryRL(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		ra, ok := RateLimitDelay(err)
+		if !ok || attempt >= i.RLRetries {
+			return err
+		}
+
+		w := i.rlWait(ra, attempt)
+		helpers.PrintWarn(fmt.Sprintf("influxdb asked to back off - %v; retry %d/%d after %s", err, attempt+1, i.RLRetries, w.String()))
+		if err := sleepCtx(ctx, w); err != nil {
+			return err
+		}
+	}
+}
+
+// retryAfter parses Retry-After header given either in seconds or as HTTP date.
+// Returns 0 when header is missing, invalid or in the past.
+func retryAfter(h string) uint {
+	if s, err := strconv.ParseUint(h, 10, 32); err == nil {
+		return uint(s)
+	}
+	if t, err := http.ParseTime(h); err == nil && time.Until(t) > 0 {
+		return uint(math.Ceil(time.Until(t).Seconds()))
+	}
+
+	return 0
+}
+
+// rlWait returns how long to wait before the next attempt after rate limit or service unavailable response.
+// Uses Retry-After when provided, otherwise exponential backoff starting from RLBackoff.
+func (i *Influx) rlWait(ra time.Duration, attempt int) time.Duration {
+	if ra > 0 {
+		return ra
+	}
+
+	d := i.RLBackoff << attempt
+	if d <= 0 || d > maxRLBackoff {
+		d = maxRLBackoff
+	}
+
+	return d
+}
+
+// query executes flux query and retries it when server responds with rate limit or service unavailable.
+// Returned done function must be called after the result is read.
+//
+// Parameters:
+//
+//	b *Bucket - the queried bucket, nil for primary server
+//	q string - flux query
+//
+// Returns:
+//
+//	*api.QueryTableResult - query result
+//	func() - closes result and releases query limiter slot
+//	error - an error, if any
+func (i *Influx) query(b *Bucket, q string) (*api.QueryTableResult, func(), error) {
+	return i.queryCtx(i.ctx, b, q)
+}
+
+// queryWithin executes flux query like query, limited by timeout when it is positive.
+// Returned cancel function must be called after the result is read.
+//
+// Parameters:
+//
+//	b *Bucket - the queried bucket, nil for primary server
+//	q string - flux query
+//	d time.Duration - query timeout, 0 for none
+//
+// Returns:
+//
+//	*api.QueryTableResult - query result
+//	context.CancelFunc - releases query context and query limiter slot
+//	error - an error, if any
+func (i *Influx) queryWithin(b *Bucket, q string, d time.Duration) (*api.QueryTableResult, context.CancelFunc, error) {
+	ctx, cancel := i.ctx, context.CancelFunc(func() {})
+	if d > 0 {
+		ctx, cancel = context.WithTimeout(i.ctx, d)
+	}
+	result, done, err := i.queryCtx(ctx, b, q)
+
+	return result, func() { done(); cancel() }, err
+}
+
+// timeoutErr marks error of query which exceeded its timeout as ErrQueryTimeout.
+//
+// Parameters:
+//
+//	err error - query error
+//	what string - description of query
+//	d time.Duration - query timeout
+//
+// Returns:
+//
+//	error - the error
+func timeoutErr(err error, what string, d time.Duration) error {
+	if d > 0 && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s exceeded %s", ErrQueryTimeout, what, d.String())
+	}
+
+	return err
+}
+
+// queryCtx executes flux query within context and retries it when server responds with rate limit or service unavailable.
+// Query limiter slot is held until returned done function is called after the result is read.
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	b *Bucket - the queried bucket, nil for primary server
+//	q string - flux query
+//
+// Returns:
+//
+//	*api.QueryTableResult - query result
+//	func() - closes result and releases query limiter slot
+//	error - an error, if any
+func (i *Influx) queryCtx(ctx context.Context, b *Bucket, q string) (*api.QueryTableResult, func(), error) {
+	client, org := i.server(b)
+	queryAPI := client.QueryAPI(org)
+	var result *api.QueryTableResult
+	done := func() {}
+	err := i.retryRL(ctx, func() error {
+		release, err := i.limit(ctx)
+		if err != nil {
+			return err
+		}
+		r, err := queryAPI.Query(ctx, q)
+		if err != nil {
+			release()
+			return err
+		}
+		// Server executes query while result is streamed
+		result, done = r, func() {
+			r.Close()
+			release()
+		}
+
+		return nil
+	})
+
+	return result, done, err
+}
+
+// queryRaw executes flux query without parsing the result and retries it when server responds with rate limit or service unavailable.
+// Used for queries which write data via to().
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	b *Bucket - the queried bucket, nil for primary server
+//	q string - flux query
+//
+// Returns:
+//
+//	string - raw query result
+//	error - an error, if any
+func (i *Influx) queryRaw(ctx context.Context, b *Bucket, q string) (string, error) {
+	client, org := i.server(b)
+	queryAPI := client.QueryAPI(org)
+	var result string
+	err := i.retryRL(ctx, func() error {
+		release, err := i.limit(ctx)
+		if err != nil {
+			return err
+		}
+		// Whole response is read, so query is finished on server
+		result, err = queryAPI.QueryRaw(ctx, q, api.DefaultDialect())
+		release()
+
+		return err
+	})
+
+	return result, err
+}
+
+// writePoints writes points to bucket and retries when server responds with rate limit or service unavailable.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	pts []*write.Point - points to write
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) writePoints(b *Bucket, pts []*write.Point) error {
+	client, org := i.server(b)
+
+	return i.writeTo(client, org, b.Name, pts)
+}
+
+// writeTo writes points to bucket of given server and retries when server responds with rate limit
+// or service unavailable.
+//
+// Parameters:
+//
+//	client influxdb2.Client - the server client
+//	org string - the organization
+//	bucket string - the bucket name
+//	pts []*write.Point - points to write
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) writeTo(client influxdb2.Client, org, bucket string, pts []*write.Point) error {
+	writeAPI := client.WriteAPIBlocking(org, bucket)
+
+	return i.retryRL(i.ctx, func() error {
+		return writeAPI.WritePoint(i.ctx, pts...)
+	})
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		delay time.Duration
+		ok    bool
+	}{
+		{"nil", nil, 0, false},
+		{"too many requests", &ihttp.Error{StatusCode: 429, RetryAfter: 7}, 7 * time.Second, true},
+		{"unavailable", &ihttp.Error{StatusCode: 503}, 0, true},
+		{"server error", &ihttp.Error{StatusCode: 500}, 0, false},
+		{"management api json", errors.New("too many requests: org quota exceeded"), 0, true},
+		{"management api unavailable", errors.New("unavailable: service is starting"), 0, true},
+		{"management api text", errors.New("429 Too Many Requests: slow down"), 0, true},
+		{"management api not found", errors.New("not found: bucket \"x\" not found"), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := RateLimitDelay(tt.err)
+			if d != tt.delay || ok != tt.ok {
+				t.Errorf("RateLimitDelay() = %s, %v, want %s, %v", d, ok, tt.delay, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRetryRL(t *testing.T) {
+	i := &Influx{RLRetries: 2, RLBackoff: time.Millisecond}
+	limited := &ihttp.Error{StatusCode: 429}
+
+	calls := 0
+	err := i.retryRL(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return limited
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("retryRL() = %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	err = i.retryRL(context.Background(), func() error {
+		calls++
+		return limited
+	})
+	if !errors.Is(err, limited) || calls != 3 {
+		t.Errorf("retryRL() = %v after %d calls, want rate limit error after 3", err, calls)
+	}
+
+	calls = 0
+	other := errors.New("bad request")
+	err = i.retryRL(context.Background(), func() error {
+		calls++
+		return other
+	})
+	if !errors.Is(err, other) || calls != 1 {
+		t.Errorf("retryRL() = %v after %d calls, want error without retry", err, calls)
+	}
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// PurgeInstance deletes all points of instance from bucket and forgets its ledger ranges and checkpoint
+// in bucket. In dry-run mode only logs what would be deleted.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket
+//	inst string - the instance name
+//	col string - the collection
+//	dryRun bool - only report
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) PurgeInstance(b *Bucket, inst, col string, dryRun bool) error {
+	if i.Flavor != FlavorV2 && !dryRun {
+		return fmt.Errorf("delete not supported by db flavor %s", i.Flavor)
+	}
+	preds, err := i.deletePredicates(col, inst)
+	if err != nil {
+		return err
+	}
+	for _, p := range preds {
+		if dryRun {
+			helpers.PrintInfo(fmt.Sprintf("dry-run, %s, %s: delete all points where %s", b.Name, inst, p))
+			continue
+		}
+		client, org := i.server(b)
+		err := i.retryRL(i.ctx, func() error {
+			return client.DeleteAPI().DeleteWithName(i.ctx, org, b.Name, time.Unix(0, 0), time.Now(), p)
+		})
+		if err != nil {
+			return fmt.Errorf("can't delete points of instance - %w", err)
+		}
+	}
+	if !dryRun {
+		i.Ledger.Forget(col, b.Name, inst, time.Unix(0, 0), time.Now())
+		i.Checkpoints.Drop(col, b.Name, inst)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// PassStats is summary of downsampling pass of collection in tier for one cardinality group
+type PassStats struct {
+	Collection string
+	Tier       string
+	Group      string
+	Connection string        // connection name in multi-connection config
+	Instances  int           // count of processed instances
+	Failures   int           // count of failed instances
+	Duration   time.Duration // duration of the pass in tier
+	Work       time.Duration // time spent on instances of group
+	MaxLag     time.Duration // largest lag of instances of group before the pass
+	Time       time.Time     // end of the pass
+}
+
+// WritePassStats writes pass summaries to stats bucket on primary server. Nothing is written in dry-run mode.
+//
+// Parameters:
+//
+//	bucket string - the stats bucket name
+//	meas string - the measurement name
+//	stats []PassStats - pass summaries
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) WritePassStats(bucket, meas string, stats []PassStats) error {
+	pts := make([]*write.Point, 0, len(stats))
+	for _, s := range stats {
+		tags := map[string]string{
+			"collection": s.Collection,
+			"tier":       s.Tier,
+			"group":      s.Group,
+		}
+		if s.Connection != "" {
+			tags["connection"] = s.Connection
+		}
+		pts = append(pts, write.NewPoint(meas, tags, map[string]interface{}{
+			"instances":        s.Instances,
+			"failures":         s.Failures,
+			"duration_seconds": s.Duration.Seconds(),
+			"work_seconds":     s.Work.Seconds(),
+			"lag_max_seconds":  s.MaxLag.Seconds(),
+		}, s.Time))
+	}
+
+	if i.DryRun {
+		helpers.PrintInfo(fmt.Sprintf("dry-run, %s: would write %d pass summaries", bucket, len(pts)))
+		return nil
+	}
+
+	return i.writePoints(&Bucket{Name: bucket, First: true}, pts)
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// counter reset policies of rate computation
+var resetPolicies = map[string]bool{
+	"drop":        true,
+	"zero":        true,
+	"interpolate": true,
+}
+
+// ResetReport receives count of counter resets found in source data of instance
+type ResetReport func(col, inst string, n int)
+
+// ValidCounterReset reports whether s is known counter reset policy.
+//
+// Parameters:
+//
+//	s string - the policy
+//
+// Returns:
+//
+//	bool - true if policy is known
+func ValidCounterReset(s string) bool {
+	return resetPolicies[s]
+}
+
+// rate returns flux pipe computing per second rate of counters by configured reset policy.
+func (i *Influx) rate() string {
+	return queries.CounterRate{Reset: i.CounterReset}.String()
+}
+
+// rateFilter returns flux predicate matching counter fields of collection whose rates are
+// computed in first tier, empty when collection has none.
+//
+// Parameters:
+//
+//	b *Bucket - the source bucket
+//	col string - the collection
+//	inst string - the instance name
+//
+// Returns:
+//
+//	string - filter predicate
+//	error - an error, if any
+func (i *Influx) rateFilter(b *Bucket, col, inst string) (string, error) {
+	var preds []string
+	rules := i.overrideRules(col)
+
+	// Counters of default handling not overridden by rules
+	var def string
+	switch i.Kind(col) {
+	case "ifstats":
+		def = `r._field =~ /^if(?:HC)*(?:In|Out)/`
+	case "iftraffic":
+		def = `(r._field == "ifHCInOctets" or r._field == "ifHCOutOctets")`
+	case "gencounter":
+		def = `true`
+	case "auto":
+		cf, err := i.counterFields(b, col, inst)
+		if err != nil {
+			return "", fmt.Errorf("can't classify fields of %s: %w", col, err)
+		}
+		if len(cf) > 0 {
+			def = `r._field =~ ` + fieldsRe(cf)
+		}
+	case "spec":
+		rules = append(rules, i.Specs[col].Fields...)
+	}
+	if def != "" {
+		for _, r := range rules {
+			def += ` and r._field !~ ` + fluxRe(r.Re)
+		}
+		preds = append(preds, `(`+def+`)`)
+	}
+
+	// Fields of rate rules
+	for _, r := range rules {
+		if r.Rate {
+			preds = append(preds, `r._field =~ `+fluxRe(r.Re))
+		}
+	}
+	if len(preds) == 0 {
+		return "", nil
+	}
+
+	return queries.Or(preds...), nil
+}
+
+// countResets returns count of counter resets (decreases of counter value) in source data
+// of instance in given time range.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket of first tier
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	int - count of resets
+//	error - an error, if any
+func (i *Influx) countResets(b *Bucket, inst, col string, fTs, tTs time.Time) (int, error) {
+	if i.queryTemplate(col) != nil {
+		return 0, nil
+	}
+	sel, err := i.rateFilter(b.From, col, inst)
+	if err != nil || sel == "" {
+		return 0, err
+	}
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return 0, err
+	}
+
+	q := queries.RangeQuery{Bucket: b.From.Name, Start: fTs, Stop: tTs, Filters: []string{f, sel}}.String() + `
+			|> toFloat()
+			|> difference(nonNegative: false)
+			|> filter(fn: (r) => r._value < 0.0)
+			|> count()
+			|> group()
+			|> sum()`
+
+	helpers.PrintDbg(fmt.Sprintf("counter resets query for %s:\n %s", b.From.Name, q))
+
+	result, done, err := i.query(b.From, q)
+	defer done()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for result.Next() {
+		if v, ok := result.Record().Value().(int64); ok {
+			n += int(v)
+		}
+	}
+	if result.Err() != nil {
+		return 0, result.Err()
+	}
+
+	return n, nil
+}
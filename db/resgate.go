@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ResState is snapshot of database resource state reported by resource monitor
+type ResState struct {
+	Open    bool
+	Reason  string        // reason of closed gate
+	MemPct  *float64      // memory usage percentage, nil if unknown
+	Tasks   *float64      // count of running tasks, nil if unknown or not checked
+	Checked time.Time     // time of last check, zero before first check
+	Since   time.Time     // time of last change of Open
+	Paused  time.Duration // time spent paused, current pause included
+	Pauses  int
+}
+
+// ResGate keeps resource state of database and pauses work while resources are not available.
+// Waiting workers are released as soon as resources become available again. Safe for
+// concurrent use.
+type ResGate struct {
+	mu     sync.Mutex
+	state  ResState
+	ch     chan struct{} // closed while gate is open
+	paused time.Duration // time spent paused, current pause excluded
+}
+
+// newResGate returns open resource gate.
+func newResGate() *ResGate {
+	ch := make(chan struct{})
+	close(ch)
+
+	return &ResGate{state: ResState{Open: true, Since: time.Now()}, ch: ch}
+}
+
+// Update records result of resource check and opens or closes the gate accordingly.
+// Opening releases all waiters.
+//
+// Parameters:
+//
+//	s ResState - checked state, only Open, Reason, MemPct and Tasks are used
+func (g *ResGate) Update(s ResState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	st := &g.state
+	st.Reason = s.Reason
+	st.MemPct = s.MemPct
+	st.Tasks = s.Tasks
+	st.Checked = now
+	if st.Open == s.Open {
+		return
+	}
+
+	st.Open = s.Open
+	if s.Open {
+		g.paused += now.Sub(st.Since)
+		close(g.ch)
+	} else {
+		st.Pauses++
+		g.ch = make(chan struct{})
+	}
+	st.Since = now
+}
+
+// Open reports whether resources are available.
+func (g *ResGate) Open() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.state.Open
+}
+
+// Snapshot returns current resource state.
+//
+// Returns:
+//
+//	ResState - the state
+func (g *ResGate) Snapshot() ResState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.state
+	s.Paused = g.paused
+	if !s.Open {
+		s.Paused += time.Since(s.Since)
+	}
+
+	return s
+}
+
+// Wait blocks until the gate is open or context is done.
+//
+// Parameters:
+//
+//	ctx context.Context - the context
+//
+// Returns:
+//
+//	error - context error if context is done before gate opens
+func (g *ResGate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	ch := g.ch
+	g.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
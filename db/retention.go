@@ -0,0 +1,61 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// EnforceRetention deletes data older than retention period from bucket.
+// In dry-run mode only counts points which would be removed.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket
+//	dryRun bool - only report
+//
+// Returns:
+//
+//	int64 - count of points to remove (dry-run only)
+//	time.Time - cutoff time
+//	error - an error, if any
+func (i *Influx) EnforceRetention(b *Bucket, dryRun bool) (int64, time.Time, error) {
+	cutoff := time.Now().Add(-1 * b.RPeriod)
+
+	if !dryRun {
+		client, org := i.server(b)
+		err := i.retryRL(i.ctx, func() error {
+			return client.DeleteAPI().DeleteWithName(i.ctx, org, b.Name, time.Unix(0, 0), cutoff, "")
+		})
+		if err == nil {
+			i.Ledger.ForgetBefore(b.Name, cutoff)
+		}
+		return 0, cutoff, err
+	}
+
+	q := `from(bucket: ` + queries.Str(b.Name) + `)
+			|> range(start: 0, stop: ` + fmt.Sprintf("%d", cutoff.Unix()) + `)
+			|> group()
+			|> count()`
+
+	helpers.PrintDbg(fmt.Sprintf("retention dry-run query for %s:\n %s", b.Name, q))
+
+	var c int64
+	result, done, err := i.query(b, q)
+	defer done()
+	if err != nil {
+		return 0, cutoff, err
+	}
+	for result.Next() {
+		if v, ok := result.Record().Value().(int64); ok {
+			c += v
+		}
+	}
+	if result.Err() != nil {
+		return c, cutoff, result.Err()
+	}
+
+	return c, cutoff, nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+// RetryPolicy defines retries of instance downsampling failed with transient error
+type RetryPolicy struct {
+	Attempts   int           // count of retries
+	Backoff    time.Duration // delay before first retry, doubled on every retry
+	MaxBackoff time.Duration // upper limit of delay
+	Jitter     float64       // random part of delay (0-1)
+}
+
+// Delay returns delay before retry with exponential backoff and jitter.
+//
+// Parameters:
+//
+//	attempt int - count of retries done so far
+//
+// Returns:
+//
+//	time.Duration - delay
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.Backoff << attempt
+	if d <= 0 || (p.MaxBackoff > 0 && d > p.MaxBackoff) {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 - p.Jitter*rand.Float64()))
+	}
+
+	return d
+}
+
+// IsTransient checks if error may go away on retry. Rate limit and server error responses,
+// timeouts and network errors are transient. Other responses like flux compilation
+// errors are permanent.
+//
+// Parameters:
+//
+//	err error - the error
+//
+// Returns:
+//
+//	bool - true if error is transient
+func IsTransient(err error) bool {
+	var herr *ihttp.Error
+	if errors.As(err, &herr) {
+		if herr.StatusCode == http.StatusTooManyRequests || herr.StatusCode >= http.StatusInternalServerError {
+			return true
+		}
+		// Client errors without HTTP response are network failures
+		if herr.StatusCode != 0 {
+			return false
+		}
+		err = herr.Err
+	}
+
+	var nerr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &nerr),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF):
+		return true
+	}
+
+	return false
+}
+
+// IsTimeout checks if error is timeout of query, either by timeout of destination bucket
+// or by HTTP client timeout.
+//
+// Parameters:
+//
+//	err error - the error
+//
+// Returns:
+//
+//	bool - true if error is timeout
+func IsTimeout(err error) bool {
+	var nerr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrQueryTimeout),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &nerr) && nerr.Timeout():
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,39 @@
+package db
+
+import "hash/fnv"
+
+// inShard reports whether instance belongs to shard of this process. All instances belong to it
+// when sharding is not configured.
+//
+// Parameters:
+//
+//	name string - the instance name
+//
+// Returns:
+//
+//	bool - true if instance is downsampled by this process
+func (i *Influx) inShard(name string) bool {
+	if i.Shards < 2 {
+		return true
+	}
+
+	return ShardOf(name, i.Shards) == i.Shard
+}
+
+// ShardOf returns shard of instance. The same instance name always maps to the same shard
+// regardless of process and platform.
+//
+// Parameters:
+//
+//	name string - the instance name
+//	shards int - count of shards
+//
+// Returns:
+//
+//	int - shard index, 0 to shards-1
+func ShardOf(name string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	return int(h.Sum32() % uint32(shards))
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// CollectionSpec defines collection declaratively, downsample flux is generated from it
+type CollectionSpec struct {
+	TagKey       string
+	Measurements []string
+	Fields       []FieldRule
+}
+
+// FieldRule defines aggregation of fields matching regex
+type FieldRule struct {
+	Re         *regexp.Regexp
+	Aggregates []string
+	Rate       bool
+}
+
+// ValidateSpec checks collection spec.
+//
+// Parameters:
+//
+//	s *CollectionSpec - the spec
+//
+// Returns:
+//
+//	error - an error, if any
+func ValidateSpec(s *CollectionSpec) error {
+	switch {
+	case s.TagKey == "":
+		return fmt.Errorf("instance tag key missing")
+	case len(s.Measurements) == 0:
+		return fmt.Errorf("no measurements")
+	case len(s.Fields) == 0:
+		return fmt.Errorf("no field rules")
+	}
+	return ValidateFieldRules(s.Fields)
+}
+
+// fluxRe returns regex as flux regex literal.
+func fluxRe(re *regexp.Regexp) string {
+	return queries.Regex(re.String())
+}
+
+// measFilter returns flux predicate matching measurements of spec.
+func (s *CollectionSpec) measFilter() string {
+	ms := make([]string, len(s.Measurements))
+	for n, m := range s.Measurements {
+		ms[n] = `r._measurement == ` + queries.Str(m)
+	}
+
+	return `(` + strings.Join(ms, " or ") + `)`
+}
+
+// instFilter returns flux predicate matching all data of instance.
+func (s *CollectionSpec) instFilter(inst string) string {
+	return s.measFilter() + `
+			and ` + instEq(s.TagKey, inst)
+}
+
+// discQuery returns flux query listing instances of spec collection in time range.
+func (s *CollectionSpec) discQuery(b *Bucket, st, stop time.Time) string {
+	return `from(bucket: ` + queries.Str(b.Name) + `)
+		|> range(start: ` + fmt.Sprintf("%d", st.Unix()) + `, stop: ` + fmt.Sprintf("%d", stop.Unix()) + `)
+		|> filter(fn: (r) => ` + s.measFilter() + `)
+		|> keyValues(keyColumns: [` + queries.Str(s.TagKey) + `])
+		|> keep(columns: ["_value"])
+		|> unique()`
+}
+
+// query returns source data part of downsample flux query generated from spec.
+// Fields are aggregated by rules of spec appended by ruleQuery.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//	excl string - filter expression excluding fields with overridden aggregates
+//
+// Returns:
+//
+//	string - flux query
+func (s *CollectionSpec) query(b *Bucket, inst string, fTs, tTs time.Time, excl string) string {
+	q := `allData =
+			from(bucket: ` + queries.Str(b.From.Name) + `)
+				|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+				|> filter(fn: (r) => ` + s.instFilter(inst) + excl + `)`
+
+	return q
+}
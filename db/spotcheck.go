@@ -0,0 +1,220 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// relative tolerance of spot check value comparison
+const spotTolerance = 1e-6
+
+// SpotResult is result of spot check of one aggregation window
+type SpotResult struct {
+	Window     time.Time
+	Checked    int
+	Mismatched int
+	Missing    int
+	Misaligned int // stored points not aligned to window boundaries
+	Untagged   int // stored points without aggregate tag
+}
+
+// pointKeys returns comparison keys and values of numeric point fields.
+func pointKeys(p *write.Point) map[string]float64 {
+	var tags []string
+	for _, t := range p.TagList() {
+		tags = append(tags, t.Key+"="+t.Value)
+	}
+	sort.Strings(tags)
+	base := p.Name() + "," + strings.Join(tags, ",") + "," + fmt.Sprintf("%d", p.Time().Unix())
+
+	res := make(map[string]float64)
+	for _, f := range p.FieldList() {
+		var v float64
+		switch n := f.Value.(type) {
+		case float64:
+			v = n
+		case int64:
+			v = float64(n)
+		case uint64:
+			v = float64(n)
+		default:
+			continue
+		}
+		res[base+","+f.Key] = v
+	}
+
+	return res
+}
+
+// hasTag reports whether point has tag of given key.
+func hasTag(p *write.Point, key string) bool {
+	for _, t := range p.TagList() {
+		if t.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// windowValues runs query and returns numeric values of result keyed by series, field and time.
+// Only values with time equal to ts are included.
+func (i *Influx) windowValues(b *Bucket, q string, ts time.Time) (map[string]float64, error) {
+	result, done, err := i.query(b, q)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]float64)
+	for result.Next() {
+		p := recordPoint(result.Record())
+		if p == nil || !p.Time().Equal(ts) {
+			continue
+		}
+		for k, v := range pointKeys(p) {
+			res[k] = v
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	return res, nil
+}
+
+// SpotCheck recomputes random recently produced aggregation window of instance in destination bucket
+// from source bucket and compares it with stored values.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	rnd *rand.Rand - random source
+//
+// Returns:
+//
+//	*SpotResult - result of check, nil if there is no window to check
+//	error - an error, if any
+func (i *Influx) SpotCheck(b *Bucket, inst, col string, rnd *rand.Rand) (*SpotResult, error) {
+	if b.From == nil {
+		return nil, nil
+	}
+
+	t, err := i.LastTS(b, inst, col)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick one of 10 last complete windows
+	we := windowStart(t, b).Add(-time.Duration(rnd.Intn(10)) * b.AInterv)
+	ws := we.Add(-1 * b.AInterv)
+	if ws.Add(-1 * b.AInterv).Before(time.Now().Add(-1 * b.From.RPeriod)) {
+		return nil, nil
+	}
+
+	return i.CheckWindow(b, inst, col, ws)
+}
+
+// CheckWindow recomputes aggregation window of instance in destination bucket from source bucket
+// and compares it with stored values. Stored points not aligned to window boundaries of bucket
+// and points without aggregate tag are counted too.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	ws time.Time - window start
+//
+// Returns:
+//
+//	*SpotResult - result of check
+//	error - an error, if any
+func (i *Influx) CheckWindow(b *Bucket, inst, col string, ws time.Time) (*SpotResult, error) {
+	if i.Flavor == FlavorV3 {
+		return nil, fmt.Errorf("window check not supported by db flavor %s", i.Flavor)
+	}
+	we := ws.Add(b.AInterv)
+
+	// Recompute with one window margin, derivatives need previous value
+	q, err := i.fluxQuery(b, inst, col, ws.Add(-1*b.AInterv), we, true)
+	if err != nil {
+		return nil, err
+	}
+	helpers.PrintDbg(fmt.Sprintf("spot check query for %s, %s:\n %s", b.Name, inst, q))
+
+	stamp := we
+	if b.Window.TimeSrc == "_start" {
+		stamp = ws
+	}
+	want, err := i.windowValues(b.From, q, stamp)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return nil, err
+	}
+	q = `from(bucket: ` + queries.Str(b.Name) + `)
+			|> range(start: ` + fmt.Sprintf("%d", ws.Unix()) + `, stop: ` + fmt.Sprintf("%d", we.Add(time.Second).Unix()) + `)
+			|> filter(fn: (r) => ` + f + `)`
+
+	res := &SpotResult{Window: stamp}
+	got := make(map[string]float64)
+	tagged := i.queryTemplate(col) == nil
+	result, done, err := i.query(b, q)
+	defer done()
+	if err != nil {
+		return nil, err
+	}
+	for result.Next() {
+		p := recordPoint(result.Record())
+		if p == nil {
+			continue
+		}
+		if !windowStart(p.Time(), b).Equal(p.Time()) {
+			res.Misaligned++
+			helpers.PrintDbg(fmt.Sprintf("spot check %s, %s: %s %s not aligned to window", b.Name, inst, p.Name(), p.Time().Format(time.RFC3339)))
+			continue
+		}
+		if !p.Time().Equal(stamp) {
+			continue
+		}
+		if tagged && !hasTag(p, "aggregate") {
+			res.Untagged++
+			helpers.PrintDbg(fmt.Sprintf("spot check %s, %s: %s without aggregate tag", b.Name, inst, p.Name()))
+		}
+		for k, v := range pointKeys(p) {
+			got[k] = v
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	for k, w := range want {
+		res.Checked++
+		g, ok := got[k]
+		switch {
+		case !ok:
+			res.Missing++
+			helpers.PrintDbg(fmt.Sprintf("spot check %s, %s: missing %s", b.Name, inst, k))
+		case math.Abs(g-w) > spotTolerance*math.Max(math.Abs(w), 1):
+			res.Mismatched++
+			helpers.PrintDbg(fmt.Sprintf("spot check %s, %s: %s stored %v, recomputed %v", b.Name, inst, k, g, w))
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,504 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	ihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// layout of timestamps in json results of InfluxDB 3 SQL queries
+const sqlTimeLayout = "2006-01-02T15:04:05.999999999"
+
+// sqlIdent returns quoted SQL identifier.
+func sqlIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// sqlString returns quoted SQL string literal.
+func sqlString(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// sqlRange returns SQL predicate matching time range [st, stop).
+func sqlRange(st, stop time.Time) string {
+	return fmt.Sprintf("time >= to_timestamp(%d) AND time < to_timestamp(%d)", st.Unix(), stop.Unix())
+}
+
+// sqlQuery executes SQL query on database using InfluxDB 3 HTTP API and retries it when
+// server responds with rate limit or service unavailable.
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	database string - the database (bucket) name
+//	q string - SQL query
+//
+// Returns:
+//
+//	[]map[string]interface{} - result rows
+//	error - an error, if any
+func (i *Influx) sqlQuery(ctx context.Context, database, q string) ([]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	err := i.retryRL(ctx, func() error {
+		var err error
+		rows, err = i.sqlQueryOnce(ctx, database, q)
+		return err
+	})
+
+	return rows, err
+}
+
+// sqlQueryOnce executes SQL query on database using InfluxDB 3 HTTP API.
+// Error responses are returned as influxdb client errors, so they are classified by the same rules.
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	database string - the database (bucket) name
+//	q string - SQL query
+//
+// Returns:
+//
+//	[]map[string]interface{} - result rows
+//	error - an error, if any
+func (i *Influx) sqlQueryOnce(ctx context.Context, database, q string) ([]map[string]interface{}, error) {
+	body, err := json.Marshal(map[string]string{"db": database, "q": q, "format": "json"})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(i.url, "/")+"/api/v3/query_sql", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+i.token.get())
+
+	release, err := i.limit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return nil, &ihttp.Error{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &ihttp.Error{StatusCode: resp.StatusCode, Code: resp.Status, Message: strings.TrimSpace(string(msg)), RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var rows []map[string]interface{}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&rows); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("can't decode sql result - %w", err)
+	}
+
+	return rows, nil
+}
+
+// sqlValue converts json value of SQL result to point field value. Integers stay integers.
+func sqlValue(v interface{}) (interface{}, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		if iv, err := n.Int64(); err == nil && !strings.ContainsAny(n.String(), ".eE") {
+			return iv, true
+		}
+		f, err := n.Float64()
+		return f, err == nil
+	case bool, string:
+		return n, true
+	default:
+		return nil, false
+	}
+}
+
+// sqlTime parses timestamp of SQL result.
+func sqlTime(v interface{}) (time.Time, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(sqlTimeLayout, strings.TrimSuffix(s, "Z"), time.UTC)
+
+	return t, err == nil
+}
+
+// sqlDiscover returns names of instances of spec collection which have data in given time range.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket to query
+//	s *CollectionSpec - the collection spec
+//	st time.Time - range start
+//	stop time.Time - range stop
+//
+// Returns:
+//
+//	[]string - instance names
+//	error - an error, if any
+func (i *Influx) sqlDiscover(b *Bucket, s *CollectionSpec, st, stop time.Time) ([]string, error) {
+	var res []string
+	seen := make(map[string]bool)
+	for _, m := range s.Measurements {
+		q := `SELECT DISTINCT ` + sqlIdent(s.TagKey) + ` AS inst FROM ` + sqlIdent(m) + `
+			WHERE ` + sqlRange(st, stop)
+		helpers.PrintDbg(fmt.Sprintf("instances query for %s:\n %s", b.Name, q))
+
+		ctx, cancel := i.ctx, context.CancelFunc(func() {})
+		if b.DiscTimeout > 0 {
+			ctx, cancel = context.WithTimeout(i.ctx, b.DiscTimeout)
+		}
+		rows, err := i.sqlQuery(ctx, b.Name, q)
+		cancel()
+		if err != nil {
+			return nil, timeoutErr(err, "instances query", b.DiscTimeout)
+		}
+		for _, r := range rows {
+			if v, ok := r["inst"].(string); ok && !seen[v] {
+				seen[v] = true
+				res = append(res, v)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// sqlLastTS returns the timestamp of the latest data point of instance of spec collection in bucket.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket to query
+//	s *CollectionSpec - the collection spec
+//	inst string - the instance name
+//	fTS time.Time - query start
+//	lt time.Time - timestamp returned when there is no data
+//
+// Returns:
+//
+//	time.Time - the timestamp of the latest data point
+//	error - an error, if any
+func (i *Influx) sqlLastTS(b *Bucket, s *CollectionSpec, inst string, fTS, lt time.Time) (time.Time, error) {
+	for _, m := range s.Measurements {
+		q := `SELECT max(time) AS last FROM ` + sqlIdent(m) + `
+			WHERE ` + sqlIdent(s.TagKey) + ` = ` + sqlString(inst) + ` AND ` + sqlRange(fTS, time.Now().Add(time.Hour))
+		helpers.PrintDbg(fmt.Sprintf("lastTS query for %s:\n %s", b.Name, q))
+
+		rows, err := i.sqlQuery(i.ctx, b.Name, q)
+		if err != nil {
+			return lt, err
+		}
+		for _, r := range rows {
+			if t, ok := sqlTime(r["last"]); ok && t.After(lt) {
+				lt = t
+			}
+		}
+	}
+
+	return lt, nil
+}
+
+// sqlLastTSAll looks up the timestamps of the latest data points of instances of spec collection
+// in bucket with one query per measurement and sets them in res when later than already set.
+//
+// Parameters:
+//
+//	b *Bucket - the bucket to query
+//	s *CollectionSpec - the collection spec
+//	insts []string - the instance names
+//	fTS time.Time - query start
+//	res map[string]time.Time - timestamps by instance, updated in place
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) sqlLastTSAll(b *Bucket, s *CollectionSpec, insts []string, fTS time.Time, res map[string]time.Time) error {
+	set := make([]string, len(insts))
+	for n, inst := range insts {
+		set[n] = sqlString(inst)
+	}
+	for _, m := range s.Measurements {
+		q := `SELECT ` + sqlIdent(s.TagKey) + ` AS inst, max(time) AS last FROM ` + sqlIdent(m) + `
+			WHERE ` + sqlIdent(s.TagKey) + ` IN (` + strings.Join(set, ", ") + `) AND ` + sqlRange(fTS, time.Now().Add(time.Hour)) + `
+			GROUP BY ` + sqlIdent(s.TagKey)
+		helpers.PrintDbg(fmt.Sprintf("lastTS query for %d instances of %s:\n %s", len(insts), b.Name, q))
+
+		rows, err := i.sqlQuery(i.ctx, b.Name, q)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			inst, _ := r["inst"].(string)
+			cur, known := res[inst]
+			if t, ok := sqlTime(r["last"]); ok && known && t.After(cur) {
+				res[inst] = t
+			}
+		}
+	}
+
+	return nil
+}
+
+// sqlColumns returns tag and field columns of measurement.
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	database string - the database (bucket) name
+//	m string - the measurement
+//
+// Returns:
+//
+//	[]string - tag columns
+//	[]string - field columns
+//	error - an error, if any
+func (i *Influx) sqlColumns(ctx context.Context, database, m string) ([]string, []string, error) {
+	q := `SELECT column_name, data_type FROM information_schema.columns
+			WHERE table_name = ` + sqlString(m)
+	rows, err := i.sqlQuery(ctx, database, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tags, fields []string
+	for _, r := range rows {
+		n, _ := r["column_name"].(string)
+		t, _ := r["data_type"].(string)
+		switch {
+		case n == "" || n == "time":
+		case strings.HasPrefix(t, "Dictionary"):
+			tags = append(tags, n)
+		default:
+			fields = append(fields, n)
+		}
+	}
+
+	return tags, fields, nil
+}
+
+// sqlAggr returns SQL aggregate expression of field. Counts are summed and percentiles are
+// re-aggregated by configured strategy in later tiers like in flux queries.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	a string - the aggregate
+//	f string - the field
+//
+// Returns:
+//
+//	string - SQL expression
+func (i *Influx) sqlAggr(b *Bucket, a, f string) string {
+	col := sqlIdent(f)
+	if a == "count" && !b.From.First {
+		a = "sum"
+	}
+	if m := percentileRe.FindStringSubmatch(a); m != nil {
+		if !b.From.First && i.PctReaggr != "same" {
+			a = i.PctReaggr
+		} else {
+			p, _ := strconv.Atoi(m[1])
+			return `approx_percentile_cont(` + col + `, ` + fmt.Sprintf("%.2f", float64(p)/100) + `)`
+		}
+	}
+
+	switch a {
+	case "mean":
+		return `avg(` + col + `)`
+	case "first":
+		return `selector_first(` + col + `, time)['value']`
+	case "last":
+		return `selector_last(` + col + `, time)['value']`
+	default:
+		return a + `(` + col + `)`
+	}
+}
+
+// sqlRates returns SQL subquery computing per second rates of counter fields of measurement by
+// configured reset policy like flux rate pipe. Rate of first point of series in range is not known.
+//
+// Parameters:
+//
+//	m string - the measurement
+//	where string - predicate selecting source rows
+//	group []string - quoted tag columns of series
+//	fields []string - counter fields
+//
+// Returns:
+//
+//	string - SQL subquery with time, tag and rate columns
+func (i *Influx) sqlRates(m, where string, group, fields []string) string {
+	over := `OVER (ORDER BY time)`
+	if len(group) > 0 {
+		over = `OVER (PARTITION BY ` + strings.Join(group, ", ") + ` ORDER BY time)`
+	}
+	dt := `(date_part('epoch', time) - date_part('epoch', lag(time) ` + over + `))`
+
+	sel := append([]string{"time"}, group...)
+	for _, f := range fields {
+		v := `CAST(` + sqlIdent(f) + ` AS DOUBLE)`
+		d := `(` + v + ` - lag(` + v + `) ` + over + `)`
+		// Drop leaves rate of interval with counter decrease null, aggregates skip it
+		neg := `NULL`
+		switch i.CounterReset {
+		case "zero":
+			neg = `0.0`
+		case "interpolate":
+			neg = v + ` / ` + dt
+		}
+		sel = append(sel, `CASE WHEN `+d+` < 0 THEN `+neg+` ELSE `+d+` / `+dt+` END AS `+sqlIdent(f))
+	}
+
+	return `(SELECT ` + strings.Join(sel, ", ") + `
+				FROM ` + sqlIdent(m) + `
+				WHERE ` + where + `) AS rates`
+}
+
+// sqlBatch downsamples instance of spec collection in given time range and writes results to
+// destination bucket by client. Windows are aligned to unix epoch and stamped with window stop
+// like in flux aggregateWindow().
+//
+// Parameters:
+//
+//	ctx context.Context - query context
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	error - an error, if any
+func (i *Influx) sqlBatch(ctx context.Context, b *Bucket, inst, col string, fTs, tTs time.Time) error {
+	s, ok := i.Specs[col]
+	if !ok {
+		return fmt.Errorf("collection %s not supported by db flavor %s", col, i.Flavor)
+	}
+	rules := append(i.overrideRules(col), s.Fields...)
+	every := int64(b.AInterv / time.Second)
+
+	for _, m := range s.Measurements {
+		tags, fields, err := i.sqlColumns(ctx, b.From.Name, m)
+		if err != nil {
+			return err
+		}
+		// Aggregate tag of previous tier selects re-aggregated values
+		var group []string
+		for _, t := range tags {
+			if t != "aggregate" {
+				group = append(group, sqlIdent(t))
+			}
+		}
+
+		// Fields are handled by first matching rule
+		byRule := make([][]string, len(rules))
+		for _, f := range fields {
+			for n, r := range rules {
+				if r.Re.MatchString(f) {
+					byRule[n] = append(byRule[n], f)
+					break
+				}
+			}
+		}
+
+		for n, r := range rules {
+			if len(byRule[n]) == 0 {
+				continue
+			}
+			for _, a := range r.Aggregates {
+				sel := make([]string, 0, len(byRule[n]))
+				for _, f := range byRule[n] {
+					sel = append(sel, i.sqlAggr(b, a, f)+` AS `+sqlIdent(f))
+				}
+				where := sqlIdent(s.TagKey) + ` = ` + sqlString(inst) + ` AND ` + sqlRange(fTs, tTs)
+				if !b.From.First {
+					where += ` AND "aggregate" = ` + sqlString(a)
+				}
+				from := sqlIdent(m) + `
+			WHERE ` + where
+				// Counters are aggregated as rates in first tier
+				if r.Rate && b.From.First {
+					from = i.sqlRates(m, where, group, byRule[n])
+				}
+				keys := append([]string{"_window"}, group...)
+				q := `SELECT date_bin(INTERVAL '` + fmt.Sprintf("%d", every) + ` seconds', time, TIMESTAMP '1970-01-01T00:00:00Z') AS _window, ` +
+					strings.Join(append(group, sel...), ", ") + `
+			FROM ` + from + `
+			GROUP BY ` + strings.Join(keys, ", ")
+
+				helpers.PrintDbg(fmt.Sprintf("downsample query for %s:\n %s", b.Name, q))
+				if i.DryRun {
+					helpers.PrintInfo(fmt.Sprintf("dry-run, %s, %s: downsample query:\n%s", b.Name, inst, q))
+					continue
+				}
+
+				rows, err := i.sqlQuery(ctx, b.From.Name, q)
+				if err != nil {
+					return err
+				}
+				pts := sqlPoints(rows, m, a, tags, byRule[n], b.AInterv)
+				if err := i.Write(b, pts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// sqlPoints converts rows of SQL downsample query to points with aggregate tag.
+//
+// Parameters:
+//
+//	rows []map[string]interface{} - result rows
+//	m string - the measurement
+//	a string - the aggregate
+//	tags []string - tag columns
+//	fields []string - field columns
+//	every time.Duration - aggregation interval
+//
+// Returns:
+//
+//	[]*write.Point - the points
+func sqlPoints(rows []map[string]interface{}, m, a string, tags, fields []string, every time.Duration) []*write.Point {
+	pts := make([]*write.Point, 0, len(rows))
+	for _, r := range rows {
+		t, ok := sqlTime(r["_window"])
+		if !ok {
+			continue
+		}
+		tv := map[string]string{"aggregate": a}
+		for _, k := range tags {
+			if v, ok := r[k].(string); ok && k != "aggregate" {
+				tv[k] = v
+			}
+		}
+		fv := make(map[string]interface{})
+		for _, f := range fields {
+			if v, ok := sqlValue(r[f]); ok {
+				fv[f] = v
+			}
+		}
+		if len(fv) == 0 {
+			continue
+		}
+		pts = append(pts, write.NewPoint(m, tv, fv, t.Add(every)))
+	}
+
+	return pts
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// aggregates of string fields
+var stringAggrs = map[string]bool{
+	"last": true,
+	"mode": true,
+}
+
+// flux function selecting most frequent value of window, ties are resolved by value order
+const modeFn = `(column, tables=<-) => tables |> mode(column: column) |> limit(n: 1)`
+
+// ValidStringAggr reports whether s is known aggregate of string fields.
+//
+// Parameters:
+//
+//	s string - the aggregate
+//
+// Returns:
+//
+//	bool - true if aggregate is known
+func ValidStringAggr(s string) bool {
+	return stringAggrs[s]
+}
+
+// stringKinds are collection kinds whose string fields are handled by StringAggr
+var stringKinds = map[string]bool{
+	"gengauge": true,
+	"auto":     true,
+}
+
+// stringQuery returns flux query part downsampling string (status) fields of collection by
+// configured aggregate and filter expression excluding them from default handling. Values keep
+// field name and get aggregate tag. Later tiers apply the same aggregate to values of previous tier.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//	excl string - filter expression excluding fields with overridden aggregates
+//	to string - result output expression
+//
+// Returns:
+//
+//	string - filter expression excluding string fields
+//	string - flux query part
+//	error - an error, if any
+func (i *Influx) stringQuery(b *Bucket, inst, col string, fTs, tTs time.Time, excl, to string) (string, string, error) {
+	if i.StringAggr == "" || !stringKinds[i.Kind(col)] {
+		return "", "", nil
+	}
+
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return "", "", err
+	}
+
+	var sel, set string
+	if b.From.First {
+		set = `
+				|> set(key: "aggregate", value: ` + queries.Str(i.StringAggr) + `)`
+	} else {
+		sel = `
+						and r.aggregate == ` + queries.Str(i.StringAggr)
+	}
+
+	q := `
+
+			strData =
+				from(bucket: ` + queries.Str(b.From.Name) + `)
+					|> range(start: ` + fmt.Sprintf("%d", fTs.Unix()) + `, stop: ` + fmt.Sprintf("%d", tTs.Unix()) + `)
+					|> filter(fn: (r) => ` + f + excl + sel + `
+						and types.isType(v: r._value, type: "string"))
+
+			strData
+				` + b.aggrWindow(i.aggrFn(b, i.StringAggr)) + set + `
+				` + to
+
+	return `
+					and not types.isType(v: r._value, type: "string")`, q, nil
+}
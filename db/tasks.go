@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// RunningTasks retrieves the count of running tasks having any of given labels using tasks API.
+//
+// Parameters:
+//
+//	labels []string - label names of counted tasks
+//
+// Returns:
+//
+//	float64 - count of running tasks
+//	error - an error, if any
+func (i *Influx) RunningTasks(labels []string) (float64, error) {
+	ctx, cancel := context.WithTimeout(i.ctx, 30*time.Second)
+	defer cancel()
+
+	var tasks []domain.Task
+	err := i.retryRL(ctx, func() error {
+		var err error
+		tasks, err = i.Client.TasksAPI().FindTasks(ctx, &api.TaskFilter{OrgName: i.Org, Status: domain.TaskStatusTypeActive, Limit: 500})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var n float64
+	for _, t := range tasks {
+		if !taskLabeled(t, labels) {
+			continue
+		}
+		var runs []domain.Run
+		err := i.retryRL(ctx, func() error {
+			var err error
+			runs, err = i.Client.TasksAPI().FindRuns(ctx, &t, &api.RunFilter{AfterTime: time.Now().Add(-24 * time.Hour)})
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range runs {
+			if r.Status != nil && *r.Status == domain.RunStatusStarted {
+				n++
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// taskLabeled checks if task has any of given labels.
+func taskLabeled(t domain.Task, labels []string) bool {
+	if t.Labels == nil {
+		return false
+	}
+	for _, l := range *t.Labels {
+		if l.Name != nil && slices.Contains(labels, *l.Name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// data available to downsample query templates
+type templateData struct {
+	Source      string // source bucket name
+	Bucket      string // destination bucket name
+	Org         string // organization
+	Start       int64  // range start, unix timestamp
+	Stop        int64  // range stop, unix timestamp
+	Every       string // aggregation interval as flux duration
+	Offset      string // window offset as flux duration
+	TimeSrc     string // window timestamp column, _stop or _start
+	CreateEmpty bool   // create empty windows
+	Instance    string // instance name
+	TagKey      string // tag identifying instance
+	Measurement string // collection name, measurement name of expanded regex collections
+	First       bool   // source is raw data bucket
+	To          string // pipe writing results to destination bucket
+}
+
+// ParseTemplate parses downsample query template file and checks that it can be executed.
+//
+// Parameters:
+//
+//	f string - template file name
+//
+// Returns:
+//
+//	*template.Template - parsed template
+//	error - an error, if any
+func ParseTemplate(f string) (*template.Template, error) {
+	t, err := template.New(filepath.Base(f)).Option("missingkey=error").
+		Funcs(template.FuncMap{"str": queries.Str, "regex": queries.Regex}).ParseFiles(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Execute with sample data to catch unknown placeholders
+	d := templateData{
+		Source:      "src",
+		Bucket:      "dst",
+		Org:         "org",
+		Start:       time.Now().Add(-time.Hour).Unix(),
+		Stop:        time.Now().Unix(),
+		Every:       "5m",
+		Offset:      "0s",
+		TimeSrc:     "_stop",
+		Instance:    "inst",
+		TagKey:      "agent_name",
+		Measurement: "meas",
+		First:       true,
+		To:          `|> to(org: "org", bucket: "dst")`,
+	}
+	if err := t.Execute(io.Discard, d); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// queryTemplate returns user supplied downsample query template of collection. Template of
+// collection name is preferred to template of collection kind.
+//
+// Parameters:
+//
+//	col string - the collection
+//
+// Returns:
+//
+//	*template.Template - the template, nil if not configured
+func (i *Influx) queryTemplate(col string) *template.Template {
+	if t, ok := i.Templates[col]; ok {
+		return t
+	}
+
+	return i.Templates[i.Kind(col)]
+}
+
+// templateQuery returns downsample flux query generated from template.
+//
+// Parameters:
+//
+//	t *template.Template - the template
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//	to string - pipe writing results to destination bucket
+//
+// Returns:
+//
+//	string - flux query
+//	error - an error, if any
+func (i *Influx) templateQuery(t *template.Template, b *Bucket, inst, col string, fTs, tTs time.Time, to string) (string, error) {
+	d := templateData{
+		Source:      b.From.Name,
+		Bucket:      b.Name,
+		Org:         i.Org,
+		Start:       fTs.Unix(),
+		Stop:        tTs.Unix(),
+		Every:       b.AInterv.String(),
+		Offset:      b.Window.Offset.String(),
+		TimeSrc:     b.Window.timeSrc(),
+		CreateEmpty: b.Window.CreateEmpty,
+		Instance:    inst,
+		TagKey:      i.TagKey(col),
+		Measurement: col,
+		First:       b.From.First,
+		To:          to,
+	}
+
+	var sb strings.Builder
+	if err := t.Execute(&sb, d); err != nil {
+		return "", fmt.Errorf("query template of %s: %w", col, err)
+	}
+
+	return sb.String(), nil
+}
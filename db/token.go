@@ -0,0 +1,51 @@
+package db
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// InfluxDB token shared by all requests of primary server, replaceable at runtime
+type tokenStore struct {
+	v atomic.Value
+}
+
+// get returns current token.
+func (t *tokenStore) get() string {
+	s, _ := t.v.Load().(string)
+	return s
+}
+
+// set replaces current token.
+func (t *tokenStore) set(s string) {
+	t.v.Store(s)
+}
+
+// HTTP transport setting current token to Authorization header of requests
+type tokenTransport struct {
+	base  http.RoundTripper
+	token *tokenStore
+}
+
+// RoundTrip executes request with current token. Authorization scheme of request is kept.
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scheme, _, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if scheme == "" {
+		scheme = "Token"
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", scheme+" "+t.token.get())
+
+	return t.base.RoundTrip(r)
+}
+
+// SetToken replaces InfluxDB token of primary server. Used by all following requests,
+// so token can be rotated without restart.
+//
+// Parameters:
+//
+//	token string - the new token
+func (i *Influx) SetToken(token string) {
+	i.token.set(token)
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"regexp"
+	"sync/atomic"
+)
+
+// Tunables are settings of Influx changeable by configuration reload while downsampling is
+// running. Published as immutable snapshot, slices must not be modified after SetTunables.
+type Tunables struct {
+	Include    []*regexp.Regexp // instances to downsample, all when empty
+	Exclude    []*regexp.Regexp // instances not to downsample
+	MemLimit   float64          // memory usage percentage of database pausing work
+	CardMedium int              // medium cardinality level of instance in bucket
+	CardHevy   int              // hevy cardinality level of instance in bucket
+}
+
+// newTunables returns holder of default tunables.
+func newTunables() *atomic.Pointer[Tunables] {
+	p := &atomic.Pointer[Tunables]{}
+	p.Store(&Tunables{
+		MemLimit:   40,   // default 40%
+		CardMedium: 50,   // medium cardinality level for instance in bucket
+		CardHevy:   1000, // hevy cardinality level for instance in bucket
+	})
+
+	return p
+}
+
+// Tunables returns current tunables. Safe for concurrent use.
+//
+// Returns:
+//
+//	Tunables - the tunables
+func (i *Influx) Tunables() Tunables {
+	return *i.tun.Load()
+}
+
+// SetTunables replaces tunables. Goroutines working with Influx see either old or new ones
+// as a whole. Safe for concurrent use.
+//
+// Parameters:
+//
+//	t Tunables - the tunables
+func (i *Influx) SetTunables(t Tunables) {
+	i.tun.Store(&t)
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/queries"
+)
+
+// VerifyReport receives count of points written to tier and count of suspicious windows,
+// which have source data but no written points
+type VerifyReport func(col, tier string, points, suspicious int)
+
+// verifyWrite counts points written to destination bucket in given time range and finds
+// windows which have data in source bucket but no written points. Source is only queried
+// when some windows of range have no written points.
+//
+// Parameters:
+//
+//	b *Bucket - the destination bucket
+//	inst string - the instance name
+//	col string - the collection
+//	fTs time.Time - range start
+//	tTs time.Time - range stop
+//
+// Returns:
+//
+//	int - count of written points
+//	[]time.Time - windows with source data but no written points, sorted
+//	error - an error, if any
+func (i *Influx) verifyWrite(b *Bucket, inst, col string, fTs, tTs time.Time) (int, []time.Time, error) {
+	f, err := i.instFilter(col, inst)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Points per written window timestamp (aggregateWindow uses window stop or start as _time)
+	q := queries.RangeQuery{Bucket: b.Name, Start: fTs, Stop: tTs.Add(b.AInterv), Filters: []string{f}}.String() + `
+			|> group(columns: ["_time"])
+			|> count()
+			|> group()`
+
+	helpers.PrintDbg(fmt.Sprintf("write verification query for %s:\n %s", b.Name, q))
+
+	written := make(map[int64]bool)
+	var points int
+	result, done, err := i.query(b, q)
+	if err != nil {
+		return 0, nil, err
+	}
+	for result.Next() {
+		if v, ok := result.Record().Value().(int64); ok && v > 0 {
+			points += int(v)
+			written[result.Record().Time().Unix()] = true
+		}
+	}
+	// Release query slot before querying source
+	err = result.Err()
+	done()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(written) >= int(tTs.Sub(fTs)/b.AInterv) {
+		return points, nil, nil
+	}
+
+	src, err := i.sourceWindows(b, inst, col, fTs, tTs)
+	if err != nil {
+		return points, nil, err
+	}
+	var empty []time.Time
+	for ts := range src {
+		if !written[ts] {
+			empty = append(empty, time.Unix(ts, 0))
+		}
+	}
+
+	sort.Slice(empty, func(i, j int) bool { return empty[i].Before(empty[j]) })
+
+	return points, empty, nil
+}
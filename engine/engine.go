@@ -0,0 +1,81 @@
+// Package engine exposes downsampler as library for embedding into other Go programs.
+//
+//	c, err := config.GetConfigFile("/etc/idbdownsampler.conf")
+//	...
+//	e, err := engine.New(c, engine.Options{})
+//	...
+//	err = e.DownsampleCollection(ctx, "iftraffic")
+//	st := e.Status()
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aretaja/idbdownsampler/app"
+	"github.com/aretaja/idbdownsampler/config"
+	"github.com/aretaja/idbdownsampler/status"
+)
+
+// Options of embedded downsampler
+type Options struct {
+	Connection string // connection of multi-connection config, required when several are configured
+	DryRun     bool   // log downsample queries without executing them
+}
+
+// Engine is embedded downsampler. Only passes started by caller are performed, status API,
+// retention enforcement and spot checks of daemon mode are not started.
+type Engine struct {
+	app *app.App
+}
+
+// New returns downsampler initialized from configuration.
+//
+// Parameters:
+//
+//	c *config.Configuration - the configuration, DsCollections lists collections known to engine
+//	o Options - engine options
+//
+// Returns:
+//
+//	*Engine - the engine
+//	error - an error, if any
+func New(c *config.Configuration, o Options) (*Engine, error) {
+	if len(c.Connections) > 0 && o.Connection == "" {
+		return nil, fmt.Errorf("several InfluxDB connections configured, connection option required")
+	}
+
+	a := &app.App{
+		Connection: o.Connection,
+		DryRun:     o.DryRun,
+	}
+	if err := a.InitializeWith(c); err != nil {
+		return nil, err
+	}
+
+	return &Engine{app: a}, nil
+}
+
+// DownsampleCollection performs single downsampling pass of collection through all its tiers
+// and returns when it is done. Concurrent calls are serialized.
+//
+// Parameters:
+//
+//	ctx context.Context - context cancelling the pass
+//	name string - the collection
+//
+// Returns:
+//
+//	error - an error, also when some instances failed
+func (e *Engine) DownsampleCollection(ctx context.Context, name string) error {
+	return e.app.Pass(ctx, name)
+}
+
+// Status returns snapshot of downsampling state, same data as served by /status of daemon.
+//
+// Returns:
+//
+//	status.Snapshot - the state
+func (e *Engine) Status() status.Snapshot {
+	return e.app.Status()
+}
@@ -0,0 +1,321 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Event types
+const (
+	PassStart    = "pass_start"
+	PassFinish   = "pass_finish"
+	InstFailure  = "instance_failure"
+	LagThreshold = "lag_threshold"
+)
+
+// lifecycle event
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Collection string    `json:"collection,omitempty"`
+	Tier       string    `json:"tier,omitempty"`
+	Instance   string    `json:"instance,omitempty"`
+	Lag        string    `json:"lag,omitempty"`
+	Elapsed    string    `json:"elapsed,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// Publisher publishes events to MQTT broker or NATS server
+type Publisher struct {
+	url   *url.URL
+	topic string
+	ch    chan Event
+	mu    sync.Mutex
+	conn  net.Conn
+}
+
+// New returns new Publisher and starts publishing in background.
+//
+// Parameters:
+//
+//	rawURL string - broker url, mqtt://[user:pass@]host:port or nats://[user:pass@]host:port
+//	topic string - topic prefix, event type is appended to it
+//
+// Returns:
+//
+//	*Publisher - the publisher
+//	error - an error, if any
+func New(rawURL, topic string) (*Publisher, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if topic == "" {
+		topic = "idbdownsampler"
+	}
+
+	p := &Publisher{
+		url:   u,
+		topic: topic,
+		ch:    make(chan Event, 1000),
+	}
+	go p.run()
+
+	return p, nil
+}
+
+// CheckURL checks broker url without connecting to it.
+//
+// Parameters:
+//
+//	rawURL string - broker url
+//
+// Returns:
+//
+//	error - an error, if url is invalid
+func CheckURL(rawURL string) error {
+	_, err := parseURL(rawURL)
+	return err
+}
+
+// parseURL parses broker url and checks its scheme.
+func parseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "mqtt" && u.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported events url scheme %s", u.Scheme)
+	}
+
+	return u, nil
+}
+
+// Publish queues event for publishing. Does not block, event is dropped when queue is full.
+// Safe to call on nil Publisher.
+//
+// Parameters:
+//
+//	e Event - the event
+func (p *Publisher) Publish(e Event) {
+	if p == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	select {
+	case p.ch <- e:
+	default:
+		helpers.PrintWarn(fmt.Sprintf("events queue full, dropping %s event", e.Type))
+	}
+}
+
+// run publishes queued events, reconnects on failure.
+func (p *Publisher) run() {
+	for e := range p.ch {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			helpers.PrintErr(fmt.Sprintf("events: %v", err))
+			continue
+		}
+
+		for attempt := 0; attempt < 3; attempt++ {
+			err = p.send(e.Type, payload)
+			if err == nil {
+				break
+			}
+			helpers.PrintWarn(fmt.Sprintf("events: failed to publish %s event - %v", e.Type, err))
+			p.close()
+			time.Sleep(time.Duration(attempt+1) * time.Second)
+		}
+	}
+}
+
+// close closes broker connection.
+func (p *Publisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// send publishes payload of given event type, connects to broker if needed.
+func (p *Publisher) send(typ string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		var err error
+		switch p.url.Scheme {
+		case "mqtt":
+			err = p.mqttConnect()
+		case "nats":
+			err = p.natsConnect()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_ = p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	switch p.url.Scheme {
+	case "mqtt":
+		return p.mqttPublish(p.topic+"/"+typ, payload)
+	default:
+		return p.natsPublish(p.topic+"."+typ, payload)
+	}
+}
+
+// natsConnect connects to NATS server and starts answering server pings.
+func (p *Publisher) natsConnect() error {
+	c, err := net.DialTimeout("tcp", p.url.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(c)
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO") {
+		c.Close()
+		return fmt.Errorf("unexpected nats greeting %q", strings.TrimSpace(info))
+	}
+	_ = c.SetReadDeadline(time.Time{})
+
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "idbdownsampler"}
+	if p.url.User != nil {
+		opts["user"] = p.url.User.Username()
+		opts["pass"], _ = p.url.User.Password()
+	}
+	o, _ := json.Marshal(opts)
+	_, err = fmt.Fprintf(c, "CONNECT %s\r\n", o)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	p.conn = c
+
+	// Answer server pings, otherwise server drops connection
+	go func() {
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(l, "PING"):
+				p.mu.Lock()
+				if p.conn == c {
+					_, _ = c.Write([]byte("PONG\r\n"))
+				}
+				p.mu.Unlock()
+			case strings.HasPrefix(l, "-ERR"):
+				helpers.PrintWarn(fmt.Sprintf("events: nats error %s", strings.TrimSpace(l)))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// natsPublish publishes payload to NATS subject.
+func (p *Publisher) natsPublish(subj string, payload []byte) error {
+	_, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\n", subj, len(payload), payload)
+	return err
+}
+
+// mqttString encodes MQTT length prefixed string.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttPacket encodes MQTT packet with fixed header.
+func mqttPacket(typ byte, body []byte) []byte {
+	pkt := []byte{typ}
+	l := len(body)
+	for {
+		b := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if l == 0 {
+			break
+		}
+	}
+
+	return append(pkt, body...)
+}
+
+// mqttConnect connects to MQTT broker using protocol version 3.1.1.
+func (p *Publisher) mqttConnect() error {
+	c, err := net.DialTimeout("tcp", p.url.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = append(payload, mqttString(fmt.Sprintf("idbdownsampler-%s-%d", host, os.Getpid()))...)
+	if p.url.User != nil {
+		flags |= 0x80
+		payload = append(payload, mqttString(p.url.User.Username())...)
+		if pw, ok := p.url.User.Password(); ok {
+			flags |= 0x40
+			payload = append(payload, mqttString(pw)...)
+		}
+	}
+
+	// protocol name, level 4, flags, keepalive disabled
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	body = append(body, payload...)
+
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write(mqttPacket(0x10, body))
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	ack := make([]byte, 4)
+	_, err = io.ReadFull(c, ack)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		c.Close()
+		return fmt.Errorf("mqtt connection refused, code %d", ack[3])
+	}
+	_ = c.SetDeadline(time.Time{})
+	p.conn = c
+
+	return nil
+}
+
+// mqttPublish publishes payload to MQTT topic with QoS 0.
+func (p *Publisher) mqttPublish(topic string, payload []byte) error {
+	body := append(mqttString(topic), payload...)
+	_, err := p.conn.Write(mqttPacket(0x30, body))
+	return err
+}
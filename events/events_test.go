@@ -0,0 +1,253 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// broker starts fake broker serving single connection by handler and returns its address.
+func broker(t *testing.T, handle func(c net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		handle(c)
+	}()
+
+	return l.Addr().String()
+}
+
+// publisher returns publisher of url with default topic. Unlike by New, publishing goroutine
+// is not started, so events are sent only by calling send.
+func publisher(t *testing.T, rawURL string) *Publisher {
+	t.Helper()
+	u, err := parseURL(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Publisher{url: u, topic: "idbdownsampler"}
+	t.Cleanup(p.close)
+
+	return p
+}
+
+// readMQTT reads MQTT packet and returns its type byte and body.
+func readMQTT(r io.Reader) (byte, []byte, error) {
+	h := make([]byte, 1)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return 0, nil, err
+	}
+	l, mul := 0, 1
+	for {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		l += int(b[0]&0x7f) * mul
+		if b[0]&0x80 == 0 {
+			break
+		}
+		mul *= 128
+	}
+	body := make([]byte, l)
+	_, err := io.ReadFull(r, body)
+
+	return h[0], body, err
+}
+
+// mqttField splits MQTT length prefixed string from start of buffer.
+func mqttField(b []byte) (string, []byte) {
+	l := int(b[0])<<8 | int(b[1])
+	return string(b[2 : 2+l]), b[2+l:]
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	tests := []struct {
+		len  int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.len), func(t *testing.T) {
+			pkt := mqttPacket(0x30, make([]byte, tt.len))
+			if pkt[0] != 0x30 {
+				t.Fatalf("packet type %#x, want 0x30", pkt[0])
+			}
+			if got := pkt[1 : 1+len(tt.want)]; !bytes.Equal(got, tt.want) {
+				t.Errorf("remaining length % x, want % x", got, tt.want)
+			}
+			if got := len(pkt) - 1 - len(tt.want); got != tt.len {
+				t.Errorf("body length %d, want %d", got, tt.len)
+			}
+		})
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	type packet struct {
+		typ  byte
+		body []byte
+	}
+	got := make(chan packet, 2)
+	addr := broker(t, func(c net.Conn) {
+		typ, body, err := readMQTT(c)
+		if err != nil {
+			return
+		}
+		got <- packet{typ, body}
+		_, _ = c.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		typ, body, err = readMQTT(c)
+		if err != nil {
+			return
+		}
+		got <- packet{typ, body}
+	})
+
+	p := publisher(t, "mqtt://user:secret@"+addr)
+	payload := []byte(strings.Repeat("x", 200))
+	if err := p.send(PassStart, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-got
+	if conn.typ != 0x10 {
+		t.Fatalf("connect packet type %#x, want 0x10", conn.typ)
+	}
+	name, rest := mqttField(conn.body)
+	if name != "MQTT" || rest[0] != 4 {
+		t.Errorf("protocol %s level %d, want MQTT level 4", name, rest[0])
+	}
+	if flags := rest[1]; flags != 0xc2 {
+		t.Errorf("connect flags %#x, want 0xc2 (user, password, clean session)", flags)
+	}
+	id, rest := mqttField(rest[4:])
+	if !strings.HasPrefix(id, "idbdownsampler-") {
+		t.Errorf("client id %q", id)
+	}
+	user, rest := mqttField(rest)
+	pass, _ := mqttField(rest)
+	if user != "user" || pass != "secret" {
+		t.Errorf("credentials %s:%s, want user:secret", user, pass)
+	}
+
+	pub := <-got
+	if pub.typ != 0x30 {
+		t.Fatalf("publish packet type %#x, want 0x30", pub.typ)
+	}
+	topic, body := mqttField(pub.body)
+	if topic != "idbdownsampler/"+PassStart {
+		t.Errorf("topic %s, want idbdownsampler/%s", topic, PassStart)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("payload %q, want %q", body, payload)
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	addr := broker(t, func(c net.Conn) {
+		if _, _, err := readMQTT(c); err != nil {
+			return
+		}
+		// Not authorized
+		_, _ = c.Write([]byte{0x20, 0x02, 0x00, 0x05})
+	})
+
+	p := publisher(t, "mqtt://"+addr)
+	err := p.send(PassStart, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "code 5") {
+		t.Errorf("send() error %v, want connection refused with code 5", err)
+	}
+}
+
+func TestNATSPublish(t *testing.T) {
+	type result struct {
+		connect map[string]interface{}
+		pub     string
+		payload string
+		pong    string
+	}
+	got := make(chan result, 1)
+	addr := broker(t, func(c net.Conn) {
+		var res result
+		defer func() { got <- res }()
+		r := bufio.NewReader(c)
+		_, _ = c.Write([]byte(`INFO {"server_id":"test","max_payload":1048576}` + "\r\n"))
+
+		l, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(l, "CONNECT ") {
+			return
+		}
+		_ = json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(l), "CONNECT ")), &res.connect)
+
+		l, err = r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		res.pub = strings.TrimSpace(l)
+		f := strings.Fields(res.pub)
+		n, _ := strconv.Atoi(f[len(f)-1])
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return
+		}
+		res.payload = string(b)
+
+		// Client has to answer pings
+		_, _ = c.Write([]byte("PING\r\n"))
+		res.pong, _ = r.ReadString('\n')
+	})
+
+	p := publisher(t, "nats://user:secret@"+addr)
+	if err := p.send(InstFailure, []byte(`{"type":"instance_failure"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-got
+	if res.connect["user"] != "user" || res.connect["pass"] != "secret" || res.connect["verbose"] != false {
+		t.Errorf("connect options %v", res.connect)
+	}
+	if want := "PUB idbdownsampler." + InstFailure + " 27"; res.pub != want {
+		t.Errorf("publish line %q, want %q", res.pub, want)
+	}
+	if want := `{"type":"instance_failure"}` + "\r\n"; res.payload != want {
+		t.Errorf("payload %q, want %q", res.payload, want)
+	}
+	if res.pong != "PONG\r\n" {
+		t.Errorf("ping answer %q, want PONG", res.pong)
+	}
+}
+
+func TestNATSGreeting(t *testing.T) {
+	addr := broker(t, func(c net.Conn) {
+		_, _ = c.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+	})
+
+	p := publisher(t, "nats://"+addr)
+	if err := p.send(PassStart, []byte("{}")); err == nil || !strings.Contains(err.Error(), "greeting") {
+		t.Errorf("send() error %v, want unexpected greeting", err)
+	}
+}
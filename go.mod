@@ -3,14 +3,13 @@ module github.com/aretaja/idbdownsampler
 go 1.22.0
 
 require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/ghodss/yaml v1.0.0
 	github.com/influxdata/influxdb-client-go/v2 v2.13.0
 	github.com/kr/pretty v0.3.1
 )
 
-require (
-	github.com/ghodss/yaml v1.0.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
-)
+require gopkg.in/yaml.v2 v2.4.0 // indirect
 
 require (
 	github.com/apapsch/go-jsonmerge/v2 v2.0.0 // indirect
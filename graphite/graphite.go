@@ -0,0 +1,231 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// default metric path template
+const DefaultTemplate = "{bucket}.{measurement}.{agent_name}.{field}.{aggregate}"
+
+// template placeholder
+var placeholderRe = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Exporter sends downsampled points to Graphite
+type Exporter struct {
+	addr     string
+	pickle   bool
+	template string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// metric of graphite
+type metric struct {
+	path  string
+	ts    int64
+	value float64
+}
+
+// New returns new Graphite exporter.
+//
+// Parameters:
+//
+//	addr string - carbon receiver address host:port
+//	proto string - "plaintext" (default) or "pickle"
+//	template string - metric path template, {bucket}, {measurement}, {field} and {<tag name>} are replaced
+//
+// Returns:
+//
+//	*Exporter - the exporter
+//	error - an error, if any
+func New(addr, proto, template string) (*Exporter, error) {
+	if template == "" {
+		template = DefaultTemplate
+	}
+
+	e := &Exporter{
+		addr:     addr,
+		template: template,
+	}
+
+	switch proto {
+	case "", "plaintext":
+	case "pickle":
+		e.pickle = true
+	default:
+		return nil, fmt.Errorf("unsupported graphite protocol %s", proto)
+	}
+
+	return e, nil
+}
+
+// Name returns name of destination.
+func (e *Exporter) Name() string {
+	return "graphite:" + e.addr
+}
+
+// sanitize makes string usable as graphite path node.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '/', '\t', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// path returns metric path of point field based on template. Empty path nodes are dropped.
+func (e *Exporter) path(bucket string, p *write.Point, field string) string {
+	tags := make(map[string]string)
+	for _, t := range p.TagList() {
+		tags[t.Key] = t.Value
+	}
+
+	s := placeholderRe.ReplaceAllStringFunc(e.template, func(m string) string {
+		k := m[1 : len(m)-1]
+		switch k {
+		case "bucket":
+			return sanitize(bucket)
+		case "measurement":
+			return sanitize(p.Name())
+		case "field":
+			return sanitize(field)
+		default:
+			return sanitize(tags[k])
+		}
+	})
+
+	var nodes []string
+	for _, n := range strings.Split(s, ".") {
+		if n != "" {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return strings.Join(nodes, ".")
+}
+
+// numeric converts field value to float. Returns false for non-numeric values.
+func numeric(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// Export sends numeric fields of points to Graphite.
+//
+// Parameters:
+//
+//	bucket string - destination bucket of points
+//	pts []*write.Point - the points
+//
+// Returns:
+//
+//	error - an error, if any
+func (e *Exporter) Export(bucket string, pts []*write.Point) error {
+	var ms []metric
+	for _, p := range pts {
+		for _, f := range p.FieldList() {
+			v, ok := numeric(f.Value)
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			ms = append(ms, metric{path: e.path(bucket, p, f.Key), ts: p.Time().Unix(), value: v})
+		}
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+
+	var data []byte
+	if e.pickle {
+		data = pickle(ms)
+	} else {
+		var buf bytes.Buffer
+		for _, m := range ms {
+			fmt.Fprintf(&buf, "%s %v %d\n", m.path, m.value, m.ts)
+		}
+		data = buf.Bytes()
+	}
+
+	return e.send(data)
+}
+
+// send writes data to carbon receiver, reconnects once on failure.
+func (e *Exporter) send(data []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if e.conn == nil {
+			e.conn, err = net.DialTimeout("tcp", e.addr, 10*time.Second)
+			if err != nil {
+				return err
+			}
+		}
+
+		_ = e.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		_, err = e.conn.Write(data)
+		if err == nil {
+			return nil
+		}
+		e.conn.Close()
+		e.conn = nil
+	}
+
+	return err
+}
+
+// pickle encodes metrics as pickle protocol 2 list of (path, (timestamp, value)) tuples
+// prefixed with length header as expected by carbon pickle receiver.
+func pickle(ms []metric) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x80, 0x02}) // PROTO 2
+	b.WriteByte(']')            // EMPTY_LIST
+	b.WriteByte('(')            // MARK
+	for _, m := range ms {
+		// path
+		b.WriteByte('X') // BINUNICODE
+		_ = binary.Write(&b, binary.LittleEndian, uint32(len(m.path)))
+		b.WriteString(m.path)
+		// timestamp
+		b.WriteByte('J') // BININT
+		_ = binary.Write(&b, binary.LittleEndian, int32(m.ts))
+		// value
+		b.WriteByte('G') // BINFLOAT
+		_ = binary.Write(&b, binary.BigEndian, m.value)
+		b.WriteByte(0x86) // TUPLE2 (timestamp, value)
+		b.WriteByte(0x86) // TUPLE2 (path, (timestamp, value))
+	}
+	b.WriteByte('e') // APPENDS
+	b.WriteByte('.') // STOP
+
+	out := make([]byte, 4, 4+b.Len())
+	binary.BigEndian.PutUint32(out, uint32(b.Len()))
+
+	return append(out, b.Bytes()...)
+}
@@ -5,11 +5,21 @@ import (
 	"os"
 )
 
-// PrintDbg prints the debug message if the "IDBDS_DEBUG" environment variable is set.
+// debug output enabled regardless of environment
+var debug bool
+
+// SetDebug enables debug messages.
+//
+// d enables debug output when true.
+func SetDebug(d bool) {
+	debug = d
+}
+
+// PrintDbg prints the debug message if debug is enabled or the "IDBDS_DEBUG" environment variable is set.
 //
 // s is the string to be printed.
 func PrintDbg(s string) {
-	if os.Getenv("IDBDS_DEBUG") != "" {
+	if debug || os.Getenv("IDBDS_DEBUG") != "" {
 		log.Println("[DEBUG] ", s)
 	}
 }
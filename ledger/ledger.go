@@ -0,0 +1,302 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// minimum interval between saves of ledger file
+const saveInterv = 10 * time.Second
+
+// Range is time range known to be fully aggregated
+type Range struct {
+	Start time.Time `json:"start"`
+	Stop  time.Time `json:"stop"`
+}
+
+// Ledger keeps fully aggregated time ranges per collection, tier and instance
+type Ledger struct {
+	mu     sync.Mutex
+	path   string
+	ranges map[string][]Range
+	dirty  bool
+	saved  time.Time
+}
+
+// key returns ledger key of instance in tier.
+func key(col, tier, inst string) string {
+	return col + "|" + tier + "|" + inst
+}
+
+// Open loads ledger from file. Missing file results empty ledger.
+//
+// Parameters:
+//
+//	path string - ledger file path
+//
+// Returns:
+//
+//	*Ledger - the ledger
+//	error - an error, if any
+func Open(path string) (*Ledger, error) {
+	l := &Ledger{
+		path:   path,
+		ranges: make(map[string][]Range),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &l.ranges)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return l, nil
+}
+
+// merge sorts ranges and merges overlapping and adjacent ones.
+func merge(rs []Range) []Range {
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Start.Before(rs[j].Start) })
+
+	var res []Range
+	for _, r := range rs {
+		n := len(res)
+		if n > 0 && !r.Start.After(res[n-1].Stop) {
+			if r.Stop.After(res[n-1].Stop) {
+				res[n-1].Stop = r.Stop
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+
+	return res
+}
+
+// Add records time range of instance in tier as fully aggregated.
+// Ranges older than retention are dropped. Safe to call on nil Ledger.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+//	start time.Time - range start
+//	stop time.Time - range stop
+//	ret time.Duration - retention period of tier
+func (l *Ledger) Add(col, tier, inst string, start, stop time.Time, ret time.Duration) {
+	if l == nil || !stop.After(start) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := key(col, tier, inst)
+	rs := merge(append(l.ranges[k], Range{Start: start, Stop: stop}))
+
+	// Forget ranges out of retention, zero retention is infinite
+	cutoff := time.Now().Add(-1 * ret)
+	n := 0
+	for _, r := range rs {
+		if ret > 0 && r.Stop.Before(cutoff) {
+			continue
+		}
+		rs[n] = r
+		n++
+	}
+	l.ranges[k] = rs[:n]
+	l.dirty = true
+
+	if time.Since(l.saved) >= saveInterv {
+		if err := l.save(); err != nil {
+			helpers.PrintErr(fmt.Sprintf("failed to save ledger: %v", err))
+		}
+	}
+}
+
+// Remaining returns sub-ranges of given time range which are not fully aggregated.
+// Returns whole range for nil Ledger.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+//	start time.Time - range start
+//	stop time.Time - range stop
+//
+// Returns:
+//
+//	[]Range - remaining sub-ranges
+func (l *Ledger) Remaining(col, tier, inst string, start, stop time.Time) []Range {
+	if l == nil {
+		return []Range{{Start: start, Stop: stop}}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var res []Range
+	cur := start
+	for _, r := range l.ranges[key(col, tier, inst)] {
+		if !r.Stop.After(cur) {
+			continue
+		}
+		if !r.Start.Before(stop) {
+			break
+		}
+		if r.Start.After(cur) {
+			res = append(res, Range{Start: cur, Stop: r.Start})
+		}
+		cur = r.Stop
+	}
+	if cur.Before(stop) {
+		res = append(res, Range{Start: cur, Stop: stop})
+	}
+
+	return res
+}
+
+// Forget removes time range of instance in tier from ledger. Used when data is deleted.
+// Safe to call on nil Ledger.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+//	start time.Time - range start
+//	stop time.Time - range stop
+func (l *Ledger) Forget(col, tier, inst string, start, stop time.Time) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := key(col, tier, inst)
+	var res []Range
+	for _, r := range l.ranges[k] {
+		if !r.Stop.After(start) || !r.Start.Before(stop) {
+			res = append(res, r)
+			continue
+		}
+		if r.Start.Before(start) {
+			res = append(res, Range{Start: r.Start, Stop: start})
+		}
+		if r.Stop.After(stop) {
+			res = append(res, Range{Start: stop, Stop: r.Stop})
+		}
+	}
+	if len(res) == 0 {
+		delete(l.ranges, k)
+	} else {
+		l.ranges[k] = res
+	}
+	l.dirty = true
+}
+
+// ForgetBefore removes time ranges before cutoff of all instances in tier, including instances
+// no longer downsampled. Used when data out of retention is deleted and to prune ledger on every
+// pass of tier. Safe to call on nil Ledger.
+//
+// Parameters:
+//
+//	tier string - the destination bucket name
+//	cutoff time.Time - retention cutoff
+func (l *Ledger) ForgetBefore(tier string, cutoff time.Time) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, rs := range l.ranges {
+		if p := strings.SplitN(k, "|", 3); len(p) != 3 || p[1] != tier {
+			continue
+		}
+		if len(rs) > 0 && !rs[0].Start.Before(cutoff) {
+			continue
+		}
+		n := 0
+		for _, r := range rs {
+			if !r.Stop.After(cutoff) {
+				continue
+			}
+			if r.Start.Before(cutoff) {
+				r.Start = cutoff
+			}
+			rs[n] = r
+			n++
+		}
+		if n == 0 {
+			delete(l.ranges, k)
+		} else {
+			l.ranges[k] = rs[:n]
+		}
+		l.dirty = true
+	}
+
+	if err := l.save(); err != nil {
+		helpers.PrintErr(fmt.Sprintf("failed to save ledger: %v", err))
+	}
+}
+
+// Save writes ledger to file if changed. Safe to call on nil Ledger.
+//
+// Returns:
+//
+//	error - an error, if any
+func (l *Ledger) Save() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.save()
+}
+
+// save writes ledger to file atomically, caller must hold the lock.
+func (l *Ledger) save() error {
+	if !l.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(l.ranges)
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, l.path)
+	if err != nil {
+		return err
+	}
+	l.dirty = false
+	l.saved = time.Now()
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package ledger
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// r returns range of given hour offsets from base time.
+func r(start, stop int) Range {
+	base := time.Unix(1700000000, 0)
+	return Range{Start: base.Add(time.Duration(start) * time.Hour), Stop: base.Add(time.Duration(stop) * time.Hour)}
+}
+
+func newLedger(t *testing.T, rs ...Range) *Ledger {
+	t.Helper()
+	l, err := Open(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range rs {
+		l.Add("col", "tier", "inst", x.Start, x.Stop, 0)
+	}
+
+	return l
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []Range
+		want []Range
+	}{
+		{"empty", nil, nil},
+		{"single", []Range{r(0, 1)}, []Range{r(0, 1)}},
+		{"disjoint", []Range{r(3, 4), r(0, 1)}, []Range{r(0, 1), r(3, 4)}},
+		{"adjacent", []Range{r(1, 2), r(0, 1)}, []Range{r(0, 2)}},
+		{"overlapping", []Range{r(0, 3), r(2, 5)}, []Range{r(0, 5)}},
+		{"contained", []Range{r(0, 5), r(1, 2)}, []Range{r(0, 5)}},
+		{"chain", []Range{r(4, 6), r(0, 2), r(2, 4), r(8, 9)}, []Range{r(0, 6), r(8, 9)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := merge(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	tests := []struct {
+		name  string
+		known []Range
+		q     Range
+		want  []Range
+	}{
+		{"empty ledger", nil, r(0, 10), []Range{r(0, 10)}},
+		{"covered", []Range{r(0, 10)}, r(2, 8), nil},
+		{"exactly covered", []Range{r(2, 8)}, r(2, 8), nil},
+		{"head missing", []Range{r(5, 10)}, r(0, 10), []Range{r(0, 5)}},
+		{"tail missing", []Range{r(0, 5)}, r(0, 10), []Range{r(5, 10)}},
+		{"holes", []Range{r(1, 2), r(4, 6)}, r(0, 10), []Range{r(0, 1), r(2, 4), r(6, 10)}},
+		{"outside", []Range{r(20, 30)}, r(0, 10), []Range{r(0, 10)}},
+		{"before", []Range{r(0, 5)}, r(5, 10), []Range{r(5, 10)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLedger(t, tt.known...)
+			if got := l.Remaining("col", "tier", "inst", tt.q.Start, tt.q.Stop); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Remaining() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var l *Ledger
+	if got, want := l.Remaining("col", "tier", "inst", r(0, 1).Start, r(0, 1).Stop), []Range{r(0, 1)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nil Remaining() = %v, want %v", got, want)
+	}
+}
+
+func TestForget(t *testing.T) {
+	tests := []struct {
+		name  string
+		known []Range
+		f     Range
+		want  []Range
+	}{
+		{"all", []Range{r(0, 10)}, r(0, 10), nil},
+		{"middle", []Range{r(0, 10)}, r(4, 6), []Range{r(0, 4), r(6, 10)}},
+		{"head", []Range{r(0, 10)}, r(0, 3), []Range{r(3, 10)}},
+		{"tail", []Range{r(0, 10)}, r(7, 12), []Range{r(0, 7)}},
+		{"outside", []Range{r(0, 10)}, r(10, 12), []Range{r(0, 10)}},
+		{"spanning", []Range{r(0, 2), r(4, 6), r(8, 10)}, r(1, 9), []Range{r(0, 1), r(9, 10)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLedger(t, tt.known...)
+			l.Forget("col", "tier", "inst", tt.f.Start, tt.f.Stop)
+			if got := l.ranges[key("col", "tier", "inst")]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Forget() left %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForgetBefore(t *testing.T) {
+	l := newLedger(t, r(0, 2), r(4, 6), r(8, 10))
+	l.Add("col", "other", "inst", r(0, 2).Start, r(0, 2).Stop, 0)
+	l.Add("col", "tier", "gone", r(0, 2).Start, r(0, 2).Stop, 0)
+
+	l.ForgetBefore("tier", r(5, 5).Start)
+
+	if got, want := l.ranges[key("col", "tier", "inst")], []Range{r(5, 6), r(8, 10)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForgetBefore() left %v, want %v", got, want)
+	}
+	if _, ok := l.ranges[key("col", "tier", "gone")]; ok {
+		t.Error("ForgetBefore() kept instance with all ranges out of retention")
+	}
+	if got, want := l.ranges[key("col", "other", "inst")], []Range{r(0, 2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForgetBefore() changed other tier to %v, want %v", got, want)
+	}
+}
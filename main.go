@@ -6,10 +6,19 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aretaja/idbdownsampler/app"
+	"github.com/aretaja/idbdownsampler/config"
 	"github.com/aretaja/idbdownsampler/helpers"
+	"github.com/aretaja/idbdownsampler/tui"
 )
 
 // Version of release
@@ -22,11 +31,67 @@ const version string = "v0.1.1"
 func main() {
 	log.SetFlags(log.Ldate | log.Lmicroseconds)
 
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "simulate":
+			simulate(os.Args[2:])
+			return
+		case "config-schema":
+			configSchema()
+			return
+		case "checkconfig":
+			checkConfig(os.Args[2:])
+			return
+		case "top":
+			top(os.Args[2:])
+			return
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "backfill":
+			backfill(os.Args[2:])
+			return
+		case "repair":
+			repair(os.Args[2:])
+			return
+		case "billing":
+			billing(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		default:
+			helpers.PrintFatal(fmt.Sprintf("unknown command %s", os.Args[1]))
+		}
+	}
+
+	// Flags override config file and environment
+	fs := flag.NewFlagSet("idbdownsampler", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	cols := fs.String("collections", "", "comma separated list of collections to downsample, overrides IDBDS_DSCOLLECTIONS")
+	once := fs.Bool("once", false, "perform single pass over all collections and exit, non-zero exit code if any instance failed")
+	dryRun := fs.Bool("dry-run", false, "run discovery but only log downsample queries without executing them")
+	debug := fs.Bool("debug", false, "print debug messages")
+	ver := fs.Bool("version", false, "print version and exit")
+	conn := fs.String("connection", "", "only use this connection of multi-connection config")
+	_ = fs.Parse(os.Args[1:])
+
+	if *ver {
+		fmt.Println(version)
+		return
+	}
+	helpers.SetDebug(*debug)
+
 	helpers.PrintInfo("start influxdb downsampler")
 	helpers.PrintDbg("initializing app")
 
 	a := &app.App{
-		Version: version,
+		Version:     version,
+		ConfFile:    *conf,
+		Collections: *cols,
+		DryRun:      *dryRun,
+		Once:        *once,
+		Connection:  *conn,
 	}
 
 	a.Initialize()
@@ -36,3 +101,329 @@ func main() {
 	helpers.PrintDbg("running app")
 	a.Run()
 }
+
+// simulate runs simulate command which estimates downsampling effort without executing it.
+//
+// args is the list of command arguments.
+func simulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	from := fs.String("from", "", "simulate backfill of destination tiers from date (YYYY-MM-DD)")
+	empty := fs.Bool("new", false, "simulate new chain with empty destination tiers")
+	conn := fs.String("connection", "", "only use this connection of multi-connection config")
+	_ = fs.Parse(args)
+
+	var ft time.Time
+	if *from != "" {
+		t, err := time.ParseInLocation(time.DateOnly, *from, time.Local)
+		if err != nil {
+			helpers.PrintFatal(fmt.Sprintf("invalid from date: %v", err))
+		}
+		ft = t
+	}
+
+	a := &app.App{
+		Version:    version,
+		ConfFile:   *conf,
+		Connection: *conn,
+	}
+	a.Initialize()
+
+	err := a.Simulate(ft, *empty)
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("simulate: %v", err))
+	}
+}
+
+// checkConfig runs checkconfig command which validates configuration the same way as it is
+// validated on start and prints effective configuration with secrets masked.
+//
+// args is the list of command arguments.
+func checkConfig(args []string) {
+	fs := flag.NewFlagSet("checkconfig", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	conn := fs.String("connection", "", "only check this connection of multi-connection config")
+	_ = fs.Parse(args)
+
+	var c *config.Configuration
+	var err error
+	if *conf != "" {
+		c, err = config.GetConfigFile(*conf)
+	} else {
+		c, err = config.GetConfig()
+	}
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("checkconfig: %v", err))
+	}
+
+	if err := app.ValidateConfig(c, *conn); err != nil {
+		helpers.PrintFatal(fmt.Sprintf("checkconfig: %v", err))
+	}
+	if *conn != "" {
+		c = c.ForConnection(*conn)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(c.Redacted())
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("checkconfig: %v", err))
+	}
+}
+
+// configSchema prints JSON Schema of configuration.
+//
+// No parameters.
+// No return values.
+func configSchema() {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(config.GetSchema())
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("config-schema: %v", err))
+	}
+}
+
+// top runs terminal monitor of running downsampler connecting to its status API.
+//
+// args is the list of command arguments.
+func top(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9180", "status API address of running downsampler")
+	interv := fs.Duration("interval", 2*time.Second, "refresh interval")
+	_ = fs.Parse(args)
+
+	err := tui.Run(*addr, *interv)
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("top: %v", err))
+	}
+}
+
+// bench runs benchmark command which measures downsampling throughput on synthetic data.
+//
+// args is the list of command arguments.
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	bucket := fs.String("bucket", "idbds_bench", "prefix of scratch bucket names")
+	insts := fs.Int("instances", 10, "count of synthetic instances")
+	fields := fs.Int("fields", 20, "count of fields per instance")
+	period := fs.Duration("period", 6*time.Hour, "time span of synthetic data")
+	interv := fs.Duration("interval", 10*time.Minute, "aggregation interval of destination")
+	aggr := fs.String("aggrcnt", "8", "comma separated base counts of aggregation windows in one query")
+	workers := fs.String("workers", "1,4", "comma separated counts of concurrent workers")
+	keep := fs.Bool("keep", false, "keep scratch buckets")
+	conn := fs.String("connection", "", "only use this connection of multi-connection config")
+	_ = fs.Parse(args)
+
+	o := app.BenchOpts{
+		Bucket:    *bucket,
+		Instances: *insts,
+		Fields:    *fields,
+		Period:    *period,
+		Interval:  *interv,
+		AggrCnts:  intList("aggrcnt", *aggr),
+		Workers:   intList("workers", *workers),
+		Keep:      *keep,
+	}
+
+	a := &app.App{
+		Version:    version,
+		ConfFile:   *conf,
+		Connection: *conn,
+	}
+	a.Initialize()
+
+	err := a.Bench(o)
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("bench: %v", err))
+	}
+}
+
+// backfill runs backfill command which re-downsamples collection over past time range.
+//
+// args is the list of command arguments.
+func backfill(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	col := fs.String("collection", "", "collection to backfill")
+	tier := fs.String("tier", "", "only backfill destination bucket of this name (default all tiers)")
+	from := fs.String("from", "", "range start date (YYYY-MM-DD)")
+	to := fs.String("to", "", "range stop date (YYYY-MM-DD, default now)")
+	dryRun := fs.Bool("dry-run", false, "only log delete and downsample queries without executing them")
+	debug := fs.Bool("debug", false, "print debug messages")
+	conn := fs.String("connection", "", "only use this connection of multi-connection config")
+	_ = fs.Parse(args)
+
+	helpers.SetDebug(*debug)
+	if *col == "" || *from == "" {
+		helpers.PrintFatal("backfill: collection and from required")
+	}
+	ft, err := time.ParseInLocation(time.DateOnly, *from, time.Local)
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("invalid from date: %v", err))
+	}
+	tt := time.Now()
+	if *to != "" {
+		tt, err = time.ParseInLocation(time.DateOnly, *to, time.Local)
+		if err != nil {
+			helpers.PrintFatal(fmt.Sprintf("invalid to date: %v", err))
+		}
+	}
+
+	a := &app.App{
+		Version:     version,
+		ConfFile:    *conf,
+		Collections: *col,
+		DryRun:      *dryRun,
+		Connection:  *conn,
+	}
+	a.Initialize()
+
+	err = a.Backfill(*col, *tier, ft, tt)
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("backfill: %v", err))
+	}
+}
+
+// repair runs repair command which re-aggregates gaps in destination tiers of collection.
+//
+// args is the list of command arguments.
+func repair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	col := fs.String("collection", "", "collection to repair")
+	tier := fs.String("tier", "", "only repair destination bucket of this name (default all tiers)")
+	from := fs.String("from", "", "range start date (YYYY-MM-DD, default retention period of source bucket)")
+	to := fs.String("to", "", "range stop date (YYYY-MM-DD, default now)")
+	dryRun := fs.Bool("dry-run", false, "only log downsample queries of found gaps without executing them")
+	debug := fs.Bool("debug", false, "print debug messages")
+	conn := fs.String("connection", "", "only use this connection of multi-connection config")
+	_ = fs.Parse(args)
+
+	helpers.SetDebug(*debug)
+	if *col == "" {
+		helpers.PrintFatal("repair: collection required")
+	}
+	var ft, tt time.Time
+	var err error
+	if *from != "" {
+		ft, err = time.ParseInLocation(time.DateOnly, *from, time.Local)
+		if err != nil {
+			helpers.PrintFatal(fmt.Sprintf("invalid from date: %v", err))
+		}
+	}
+	if *to != "" {
+		tt, err = time.ParseInLocation(time.DateOnly, *to, time.Local)
+		if err != nil {
+			helpers.PrintFatal(fmt.Sprintf("invalid to date: %v", err))
+		}
+	}
+
+	a := &app.App{
+		Version:     version,
+		ConfFile:    *conf,
+		Collections: *col,
+		DryRun:      *dryRun,
+		Connection:  *conn,
+	}
+	a.Initialize()
+
+	err = a.Repair(*col, *tier, ft, tt)
+	if err != nil {
+		helpers.PrintFatal(fmt.Sprintf("repair: %v", err))
+	}
+}
+
+// verify runs verify command which checks consistency of destination tiers of collection.
+//
+// args is the list of command arguments.
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	col := fs.String("collection", "", "collection to verify")
+	tier := fs.String("tier", "", "only verify destination bucket of this name (default all tiers)")
+	insts := fs.Int("instances", 10, "count of sampled instances per tier")
+	windows := fs.Int("windows", 5, "count of sampled windows per instance")
+	debug := fs.Bool("debug", false, "print debug messages")
+	conn := fs.String("connection", "", "only use this connection of multi-connection config")
+	_ = fs.Parse(args)
+
+	helpers.SetDebug(*debug)
+	if *col == "" {
+		helpers.PrintFatal("verify: collection required")
+	}
+	if *insts < 1 || *windows < 1 {
+		helpers.PrintFatal("verify: instances and windows must be positive")
+	}
+
+	a := &app.App{
+		Version:     version,
+		ConfFile:    *conf,
+		Collections: *col,
+		Connection:  *conn,
+	}
+	a.Initialize()
+
+	if err := a.Verify(*col, *tier, *insts, *windows); err != nil {
+		helpers.PrintFatal(fmt.Sprintf("verify: %v", err))
+	}
+}
+
+// billing runs billing command which computes 95th percentile interface bitrates of calendar month.
+//
+// args is the list of command arguments.
+func billing(args []string) {
+	fs := flag.NewFlagSet("billing", flag.ExitOnError)
+	conf := fs.String("config", "", "config file (default IDBDS_CONF or /opt/idbdownsampler/etc/idbdownsampler.conf)")
+	col := fs.String("collection", "", "interface collection (ifstats or iftraffic kind)")
+	month := fs.String("month", "", "calendar month (YYYY-MM, default previous month)")
+	dryRun := fs.Bool("dry-run", false, "only log billing queries without executing them")
+	debug := fs.Bool("debug", false, "print debug messages")
+	conn := fs.String("connection", "", "only use this connection of multi-connection config")
+	_ = fs.Parse(args)
+
+	helpers.SetDebug(*debug)
+	if *col == "" {
+		helpers.PrintFatal("billing: collection required")
+	}
+	now := time.Now()
+	mt := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local)
+	if *month != "" {
+		var err error
+		mt, err = time.ParseInLocation("2006-01", *month, time.Local)
+		if err != nil {
+			helpers.PrintFatal(fmt.Sprintf("invalid month: %v", err))
+		}
+	}
+
+	a := &app.App{
+		Version:     version,
+		ConfFile:    *conf,
+		Collections: *col,
+		DryRun:      *dryRun,
+		Connection:  *conn,
+	}
+	a.Initialize()
+
+	if err := a.Billing(*col, mt); err != nil {
+		helpers.PrintFatal(fmt.Sprintf("billing: %v", err))
+	}
+}
+
+// intList parses comma separated list of positive integers of flag.
+//
+// name is the flag name, s is the flag value.
+func intList(name, s string) []int {
+	var res []int
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 1 {
+			helpers.PrintFatal(fmt.Sprintf("invalid %s value %q", name, v))
+		}
+		res = append(res, n)
+	}
+
+	return res
+}
@@ -0,0 +1,226 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Notification types
+const (
+	InstFailures = "instance_failures"
+	PassAbort    = "pass_abort"
+)
+
+// failure notification
+type Notification struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Connection string    `json:"connection,omitempty"`
+	Collection string    `json:"collection,omitempty"`
+	Tier       string    `json:"tier,omitempty"`
+	Instance   string    `json:"instance,omitempty"`
+	Failures   int       `json:"failures,omitempty"`
+	Message    string    `json:"message"`
+}
+
+// Subject returns one line summary of notification.
+func (n Notification) Subject() string {
+	var s string
+	switch n.Type {
+	case InstFailures:
+		s = fmt.Sprintf("downsampling of %s %s %s failed %d times in a row", n.Instance, n.Collection, n.Tier, n.Failures)
+	case PassAbort:
+		s = fmt.Sprintf("downsampling pass of collection %s aborted", n.Collection)
+	default:
+		s = n.Type
+	}
+	if n.Connection != "" {
+		s = n.Connection + ": " + s
+	}
+
+	return "idbdownsampler: " + s
+}
+
+// Options of notification targets
+type Options struct {
+	Webhook      string   // webhook URL
+	Format       string   // webhook payload format, slack (also Mattermost) or generic
+	SMTP         string   // SMTP server host:port
+	SMTPUser     string   // SMTP username, no authentication when empty
+	SMTPPassword string   // SMTP password
+	From         string   // sender address
+	To           []string // recipient addresses
+}
+
+// Notifier sends failure notifications to webhook and/or by email
+type Notifier struct {
+	o      Options
+	client *http.Client
+	ch     chan Notification
+}
+
+// Check checks notification targets without contacting them.
+//
+// Returns:
+//
+//	error - an error, if options are invalid
+func (o Options) Check() error {
+	if o.Webhook != "" {
+		u, err := url.Parse(o.Webhook)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("unsupported webhook url scheme %s", u.Scheme)
+		}
+	}
+	switch o.Format {
+	case "", "generic", "slack", "mattermost":
+	default:
+		return fmt.Errorf("unsupported webhook format %s", o.Format)
+	}
+	if o.SMTP != "" {
+		if _, _, err := net.SplitHostPort(o.SMTP); err != nil {
+			return fmt.Errorf("invalid smtp address - %w", err)
+		}
+		if o.From == "" || len(o.To) == 0 {
+			return fmt.Errorf("smtp sender and recipients required")
+		}
+	}
+
+	return nil
+}
+
+// New returns new Notifier and starts sending in background.
+//
+// Parameters:
+//
+//	o Options - notification targets
+//
+// Returns:
+//
+//	*Notifier - the notifier
+//	error - an error, if any
+func New(o Options) (*Notifier, error) {
+	if err := o.Check(); err != nil {
+		return nil, err
+	}
+	if o.Format == "" {
+		o.Format = "generic"
+	}
+
+	n := &Notifier{
+		o:      o,
+		client: &http.Client{Timeout: 30 * time.Second},
+		ch:     make(chan Notification, 100),
+	}
+	go n.run()
+
+	return n, nil
+}
+
+// Notify queues notification for sending. Does not block, notification is dropped when queue is full.
+// Safe to call on nil Notifier.
+//
+// Parameters:
+//
+//	m Notification - the notification
+func (n *Notifier) Notify(m Notification) {
+	if n == nil {
+		return
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+
+	select {
+	case n.ch <- m:
+	default:
+		helpers.PrintWarn(fmt.Sprintf("notification queue full, dropping %s", m.Subject()))
+	}
+}
+
+// run sends queued notifications to all targets, retries failed sends.
+func (n *Notifier) run() {
+	for m := range n.ch {
+		if n.o.Webhook != "" {
+			n.retry("webhook", m, n.webhook)
+		}
+		if n.o.SMTP != "" {
+			n.retry("email", m, n.mail)
+		}
+	}
+}
+
+// retry calls send function up to 3 times until it succeeds.
+func (n *Notifier) retry(target string, m Notification, send func(Notification) error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		err := send(m)
+		if err == nil {
+			return
+		}
+		helpers.PrintWarn(fmt.Sprintf("notify: failed to send %s notification - %v", target, err))
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	helpers.PrintErr(fmt.Sprintf("notify: %s notification dropped: %s", target, m.Subject()))
+}
+
+// webhook posts notification to webhook. Slack and Mattermost get text message,
+// generic webhook gets notification as JSON.
+func (n *Notifier) webhook(m Notification) error {
+	var payload []byte
+	var err error
+	if n.o.Format == "generic" {
+		payload, err = json.Marshal(m)
+	} else {
+		payload, err = json.Marshal(map[string]string{"text": m.Subject() + "\n" + m.Message})
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.o.Webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook response %s", resp.Status)
+	}
+
+	return nil
+}
+
+// mail sends notification by email.
+func (n *Notifier) mail(m Notification) error {
+	var auth smtp.Auth
+	if n.o.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(n.o.SMTP)
+		auth = smtp.PlainAuth("", n.o.SMTPUser, n.o.SMTPPassword, host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.o.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.o.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(m.Subject()))
+	fmt.Fprintf(&b, "Date: %s\r\n", m.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Time: %s\r\n", m.Time.Format(time.RFC3339))
+	for _, f := range [][2]string{{"Connection", m.Connection}, {"Collection", m.Collection}, {"Tier", m.Tier}, {"Instance", m.Instance}} {
+		if f[1] != "" {
+			fmt.Fprintf(&b, "%s: %s\r\n", f[0], f[1])
+		}
+	}
+	fmt.Fprintf(&b, "\r\n%s\r\n", m.Message)
+
+	return smtp.SendMail(n.o.SMTP, auth, n.o.From, n.o.To, []byte(b.String()))
+}
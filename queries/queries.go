@@ -0,0 +1,231 @@
+// Package queries builds Flux query strings from typed parts.
+package queries
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Str returns Flux string literal of s. Quotes, backslashes and interpolation are escaped.
+//
+// Parameters:
+//
+//	s string - the string
+//
+// Returns:
+//
+//	string - quoted string literal
+func Str(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `${`, `\${`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// Valid checks that s is usable as interpolated identifier or value. It must be
+// non empty valid UTF-8 without control characters.
+//
+// Parameters:
+//
+//	s string - the value
+//
+// Returns:
+//
+//	error - an error, if any
+func Valid(s string) error {
+	if s == "" {
+		return fmt.Errorf("empty value")
+	}
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("invalid utf-8 in %q", s)
+	}
+	for _, c := range s {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("control character in %q", s)
+		}
+	}
+
+	return nil
+}
+
+// Regex returns Flux regex literal of expression s. Slashes are escaped.
+//
+// Parameters:
+//
+//	s string - regular expression
+//
+// Returns:
+//
+//	string - regex literal
+func Regex(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('/')
+	esc := false
+	for _, c := range s {
+		switch {
+		case esc:
+			esc = false
+		case c == '\\':
+			esc = true
+		case c == '/':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	sb.WriteByte('/')
+
+	return sb.String()
+}
+
+// Col returns Flux expression of column of record r.
+//
+// Parameters:
+//
+//	name string - column name
+//
+// Returns:
+//
+//	string - column expression
+func Col(name string) string {
+	return `r[` + Str(name) + `]`
+}
+
+// Eq returns Flux predicate matching records whose column equals value.
+//
+// Parameters:
+//
+//	col string - column name
+//	val string - value
+//
+// Returns:
+//
+//	string - predicate
+func Eq(col, val string) string {
+	return Col(col) + ` == ` + Str(val)
+}
+
+// In returns Flux predicate matching records whose column value is one of given values.
+//
+// Parameters:
+//
+//	col string - column name
+//	vals []string - values
+//
+// Returns:
+//
+//	string - predicate
+func In(col string, vals []string) string {
+	set := make([]string, len(vals))
+	for n, v := range vals {
+		set[n] = Str(v)
+	}
+
+	return `contains(value: ` + Col(col) + `, set: [` + strings.Join(set, ", ") + `])`
+}
+
+// Match returns Flux predicate matching records whose column matches regular expression.
+//
+// Parameters:
+//
+//	col string - column name
+//	re string - regular expression
+//
+// Returns:
+//
+//	string - predicate
+func Match(col, re string) string {
+	return Col(col) + ` =~ ` + Regex(re)
+}
+
+// And joins predicates with and.
+func And(preds ...string) string {
+	return strings.Join(preds, "\n\t\tand ")
+}
+
+// Or joins predicates with or, the result is parenthesized.
+func Or(preds ...string) string {
+	return `(` + strings.Join(preds, "\n\t\tor ") + `)`
+}
+
+// RangeQuery selects data of bucket in time range matching filter predicates.
+type RangeQuery struct {
+	Bucket  string    // bucket name
+	Start   time.Time // range start
+	Stop    time.Time // range stop, open range when zero
+	Filters []string  // filter predicates joined with and
+}
+
+// String returns Flux source of query.
+func (q RangeQuery) String() string {
+	var sb strings.Builder
+	sb.WriteString(`from(bucket: ` + Str(q.Bucket) + `)`)
+	sb.WriteString("\n\t|> range(start: " + fmt.Sprintf("%d", q.Start.Unix()))
+	if !q.Stop.IsZero() {
+		sb.WriteString(", stop: " + fmt.Sprintf("%d", q.Stop.Unix()))
+	}
+	sb.WriteString(")")
+	if len(q.Filters) > 0 {
+		sb.WriteString("\n\t|> filter(fn: (r) => " + And(q.Filters...) + ")")
+	}
+
+	return sb.String()
+}
+
+// AggregateWindow aggregates data in windows stamped with window stop unless TimeSrc is set.
+type AggregateWindow struct {
+	Every       time.Duration // window length
+	Offset      time.Duration // shift of window boundaries from unix epoch
+	Fn          string        // aggregate function
+	TimeSrc     string        // column used as window timestamp, _stop by default
+	CreateEmpty bool          // create empty windows
+}
+
+// String returns Flux pipe of aggregation.
+func (a AggregateWindow) String() string {
+	var off, src string
+	if a.Offset != 0 {
+		off = ", offset: " + a.Offset.String()
+	}
+	if a.TimeSrc != "" {
+		src = ", timeSrc: " + Str(a.TimeSrc)
+	}
+
+	return fmt.Sprintf("|> aggregateWindow(every: %s%s, fn: %s%s, createEmpty: %t)", a.Every.String(), off, a.Fn, src, a.CreateEmpty)
+}
+
+// ToBucket writes data to bucket.
+type ToBucket struct {
+	Org    string // organization
+	Bucket string // bucket name
+}
+
+// String returns Flux pipe of write.
+func (t ToBucket) String() string {
+	return `|> to(org: ` + Str(t.Org) + `, bucket: ` + Str(t.Bucket) + `)`
+}
+
+// CounterRate computes per second rate of counter. Reset sets handling of intervals where
+// counter decreased (reset or wrap): drop (default) leaves them out, zero sets their rate to 0
+// and interpolate counts increase from zero as if counter restarted at the start of interval.
+type CounterRate struct {
+	Reset string // counter reset policy: drop, zero or interpolate
+}
+
+// String returns Flux pipe of rate computation.
+func (c CounterRate) String() string {
+	switch c.Reset {
+	case "zero":
+		return "|> derivative(unit: 1s, nonNegative: false, columns: [\"_value\"], timeColumn: \"_time\")" +
+			"\n\t|> map(fn: (r) => ({r with _value: if r._value < 0.0 then 0.0 else r._value}))"
+	case "interpolate":
+		return "|> toFloat()" +
+			"\n\t|> duplicate(column: \"_value\", as: \"_counter\")" +
+			"\n\t|> difference(nonNegative: false, keepFirst: true)" +
+			"\n\t|> elapsed(unit: 1s)" +
+			"\n\t|> map(fn: (r) => ({r with _value: (if r._value < 0.0 then r._counter else r._value) / float(v: r.elapsed)}))" +
+			"\n\t|> drop(columns: [\"_counter\", \"elapsed\"])"
+	default:
+		return `|> derivative(unit: 1s, nonNegative: true, columns: ["_value"], timeColumn: "_time")`
+	}
+}
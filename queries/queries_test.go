@@ -0,0 +1,104 @@
+package queries
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestGolden(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	stop := time.Unix(1700003600, 0)
+
+	tests := []struct {
+		name string
+		q    string
+	}{
+		{"range_open", RangeQuery{Bucket: "telegraf/2d", Start: start}.String()},
+		{"range_filter", RangeQuery{
+			Bucket:  "telegraf/2d",
+			Start:   start,
+			Stop:    stop,
+			Filters: []string{Eq("_measurement", "ifstats"), Eq("agent_name", "sw-1")},
+		}.String()},
+		{"range_regex", RangeQuery{
+			Bucket:  "network/raw",
+			Start:   start,
+			Stop:    stop,
+			Filters: []string{Match("_field", `^(ifHC(In|Out)Octets|if/Speed)$`), Or(Eq("_measurement", "a"), Eq("_measurement", "b"))},
+		}.String()},
+		{"range_quoting", RangeQuery{
+			Bucket:  `my "bucket"`,
+			Start:   start,
+			Filters: []string{Eq("agent_name", `sw\1 ${x}`)},
+		}.String()},
+		{"range_in", RangeQuery{
+			Bucket:  "telegraf/28d",
+			Start:   start,
+			Filters: []string{Eq("_measurement", "ifstats"), In("agent_name", []string{"sw-1", `sw"2`})},
+		}.String()},
+		{"aggregate_window", AggregateWindow{Every: 30 * time.Minute, Fn: "mean"}.String()},
+		{"aggregate_window_empty", AggregateWindow{Every: 2 * time.Minute, Fn: "last", CreateEmpty: true}.String()},
+		{"aggregate_window_offset", AggregateWindow{Every: 24 * time.Hour, Offset: -3 * time.Hour, Fn: "mean", TimeSrc: "_start"}.String()},
+		{"counter_rate", CounterRate{}.String()},
+		{"counter_rate_zero", CounterRate{Reset: "zero"}.String()},
+		{"counter_rate_interpolate", CounterRate{Reset: "interpolate"}.String()},
+		{"to_bucket", ToBucket{Org: "my-org", Bucket: "telegraf/28d"}.String()},
+		{"pipeline", RangeQuery{Bucket: "telegraf/2d", Start: start, Stop: stop, Filters: []string{Eq("agent_name", "sw-1")}}.String() +
+			"\n\t" + AggregateWindow{Every: 8 * time.Minute, Fn: "max"}.String() +
+			"\n\t" + ToBucket{Org: "my-org", Bucket: "telegraf/7d"}.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(f, []byte(tt.q), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.q != string(want) {
+				t.Errorf("query mismatch\ngot:\n%s\nwant:\n%s", tt.q, want)
+			}
+		})
+	}
+}
+
+func TestRegex(t *testing.T) {
+	tests := map[string]string{
+		`^a$`:    `/^a$/`,
+		`a/b`:    `/a\/b/`,
+		`a\/b`:   `/a\/b/`,
+		`\d+/\w`: `/\d+\/\w/`,
+		`a\\/b`:  `/a\\\/b/`,
+	}
+	for in, want := range tests {
+		if got := Regex(in); got != want {
+			t.Errorf("Regex(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := map[string]bool{
+		"sw-1.example.com": true,
+		`sw"1`:             true,
+		"":                 false,
+		"sw\n1":            false,
+		"sw\x001":          false,
+		"sw\xff":           false,
+	}
+	for in, ok := range tests {
+		if err := Valid(in); (err == nil) != ok {
+			t.Errorf("Valid(%q) = %v, want ok %t", in, err, ok)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package secrets resolves secrets from files and external secret stores.
+package secrets
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTP client of secret store requests
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// Resolve returns secret referenced by ref.
+//
+// Supported references:
+//
+//	file:PATH - content of file, surrounding whitespace trimmed
+//	vault:PATH#KEY - key of HashiCorp Vault KV secret, uses VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE
+//	aws:SECRET-ID[#KEY] - AWS Secrets Manager secret string or key of JSON secret, uses AWS_REGION,
+//	AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+//
+// Parameters:
+//
+//	ref string - secret reference
+//
+// Returns:
+//
+//	string - the secret
+//	error - an error, if any
+func Resolve(ref string) (string, error) {
+	kind, loc, ok := strings.Cut(ref, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid secret reference %q, must be file:, vault: or aws:", ref)
+	}
+
+	var s string
+	var err error
+	switch kind {
+	case "file":
+		s, err = fromFile(loc)
+	case "vault":
+		s, err = fromVault(loc)
+	case "aws":
+		s, err = fromAWS(loc)
+	default:
+		return "", fmt.Errorf("unknown secret store %s", kind)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s secret %s: %w", kind, loc, err)
+	}
+	if s == "" {
+		return "", fmt.Errorf("%s secret %s is empty", kind, loc)
+	}
+
+	return s, nil
+}
+
+// fromFile returns content of file with surrounding whitespace trimmed.
+func fromFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// fromVault returns key of HashiCorp Vault secret. Both KV v1 and v2 engines are supported.
+//
+// Parameters:
+//
+//	loc string - secret path and key separated by #
+//
+// Returns:
+//
+//	string - the secret
+//	error - an error, if any
+func fromVault(loc string) (string, error) {
+	path, key, ok := strings.Cut(loc, "#")
+	if !ok || key == "" {
+		return "", fmt.Errorf("key required")
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR not set")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	var res struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := doJSON(req, &res); err != nil {
+		return "", err
+	}
+
+	// KV v2 nests secret data in data.data
+	data := res.Data
+	if d, ok := data["data"].(map[string]interface{}); ok {
+		data = d
+	}
+	v, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("no string key %s", key)
+	}
+
+	return v, nil
+}
+
+// fromAWS returns AWS Secrets Manager secret string or key of JSON secret string.
+//
+// Parameters:
+//
+//	loc string - secret id, optionally followed by # and JSON key
+//
+// Returns:
+//
+//	string - the secret
+//	error - an error, if any
+func fromAWS(loc string) (string, error) {
+	id, key, _ := strings.Cut(loc, "#")
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	akid, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if region == "" || akid == "" || secret == "" {
+		return "", fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY required")
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	host := "secretsmanager." + region + ".amazonaws.com"
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signV4(req, body, host, region, "secretsmanager", akid, secret, os.Getenv("AWS_SESSION_TOKEN"), time.Now().UTC())
+
+	var res struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := doJSON(req, &res); err != nil {
+		return "", err
+	}
+	if key == "" {
+		return res.SecretString, nil
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(res.SecretString), &m); err != nil {
+		return "", fmt.Errorf("secret string is not JSON object: %w", err)
+	}
+	v, ok := m[key].(string)
+	if !ok {
+		return "", fmt.Errorf("no string key %s", key)
+	}
+
+	return v, nil
+}
+
+// signV4 signs AWS API request with Signature Version 4.
+//
+// Parameters:
+//
+//	req *http.Request - the request, headers to sign already set
+//	body []byte - request body
+//	host string - service host
+//	region string - AWS region
+//	service string - AWS service name
+//	akid string - access key id
+//	secret string - secret access key
+//	session string - session token, empty for long-term credentials
+//	t time.Time - signing time
+func signV4(req *http.Request, body []byte, host, region, service, akid, secret, session string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if session != "" {
+		req.Header.Set("X-Amz-Security-Token", session)
+	}
+
+	// Canonical headers sorted by name
+	names := []string{"content-type", "host", "x-amz-date"}
+	if session != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	names = append(names, "x-amz-target")
+	var ch strings.Builder
+	for _, n := range names {
+		v := req.Header.Get(n)
+		if n == "host" {
+			v = host
+		}
+		ch.WriteString(n + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{req.Method, "/", "", ch.String(), signed, hexHash(body)}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	sts := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexHash([]byte(creq))}, "\n")
+
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, sts))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+akid+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+}
+
+// hexHash returns hex encoded SHA256 hash of data.
+func hexHash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// hmacSHA256 returns HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// doJSON executes request and decodes JSON response.
+func doJSON(req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
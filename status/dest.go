@@ -0,0 +1,66 @@
+package status
+
+import (
+	"sort"
+	"time"
+)
+
+// key of tracked destination writes
+type destKey struct {
+	Dest   string
+	Bucket string
+}
+
+// DestStats is cumulative result of writes to destination bucket
+type DestStats struct {
+	Destination string    `json:"destination"`
+	Bucket      string    `json:"bucket"`
+	Points      int64     `json:"points"`
+	Failed      int64     `json:"failed_points"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// AddWrite records outcome of write of points to destination bucket.
+//
+// Parameters:
+//
+//	dest string - the destination name
+//	bucket string - the primary destination bucket name
+//	n int - count of points
+//	err error - write error, nil on success
+func (t *Tracker) AddWrite(dest, bucket string, n int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := destKey{Dest: dest, Bucket: bucket}
+	s := t.dests[k]
+	s.Destination = dest
+	s.Bucket = bucket
+	if err != nil {
+		s.Failed += int64(n)
+		s.LastError = err.Error()
+	} else {
+		s.Points += int64(n)
+		s.LastSuccess = time.Now()
+	}
+	t.dests[k] = s
+}
+
+// Destinations returns write results of all destinations sorted by destination and bucket.
+func (t *Tracker) Destinations() []DestStats {
+	t.mu.RLock()
+	res := make([]DestStats, 0, len(t.dests))
+	for _, v := range t.dests {
+		res = append(res, v)
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Destination != res[j].Destination {
+			return res[i].Destination < res[j].Destination
+		}
+		return res[i].Bucket < res[j].Bucket
+	})
+
+	return res
+}
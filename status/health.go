@@ -0,0 +1,149 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// Pass is last finished pass of collection
+type Pass struct {
+	Collection string     `json:"collection"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Stale      bool       `json:"stale"`
+}
+
+// health is state of downsampler reported by health endpoints
+type health struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Passes []Pass `json:"passes"`
+	Gate   Gate   `json:"gate"`
+}
+
+// SetCollections sets collections whose passes are expected to finish.
+// Staleness of collection without finished pass is measured from this call.
+//
+// Parameters:
+//
+//	cols []string - the collections
+//	stale time.Duration - maximum time since last finished pass, 0 disables staleness check
+func (t *Tracker) SetCollections(cols []string, stale time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started = time.Now()
+	t.stale = stale
+	for _, c := range cols {
+		if _, ok := t.passes[c]; !ok {
+			t.passes[c] = time.Time{}
+		}
+	}
+}
+
+// UpdateCollections replaces list of collections checked by health endpoint. Pass times of
+// kept collections are preserved.
+//
+// Parameters:
+//
+//	cols []string - collections
+func (t *Tracker) UpdateCollections(cols []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	passes := make(map[string]time.Time, len(cols))
+	for _, c := range cols {
+		passes[c] = t.passes[c]
+	}
+	t.passes = passes
+}
+
+// SetPass records finish of collection pass.
+//
+// Parameters:
+//
+//	col string - the collection
+//	ts time.Time - time of finish
+func (t *Tracker) SetPass(col string, ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.passes[col] = ts
+}
+
+// SetPing sets function checking database connectivity.
+//
+// Parameters:
+//
+//	f func() error - connectivity check
+func (t *Tracker) SetPing(f func() error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ping = f
+}
+
+// Passes returns last finished passes of collections sorted by collection.
+func (t *Tracker) Passes() []Pass {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	res := make([]Pass, 0, len(t.passes))
+	for c, ts := range t.passes {
+		p := Pass{Collection: c}
+		last := t.started
+		if !ts.IsZero() {
+			p.Finished = &ts
+			last = ts
+		}
+		p.Stale = t.stale > 0 && time.Since(last) > t.stale
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Collection < res[j].Collection })
+
+	return res
+}
+
+// writeHealth writes health state as json with status code depending on error.
+func (t *Tracker) writeHealth(w http.ResponseWriter, err error) {
+	h := health{Status: "ok", Passes: t.Passes(), Gate: t.Live().Gate}
+	code := http.StatusOK
+	if err != nil {
+		h.Status = "fail"
+		h.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		helpers.PrintErr(fmt.Sprintf("status api: %v", err))
+	}
+}
+
+// healthzHandler reports liveness. Fails when pass of any collection has not finished in time,
+// which indicates hung downsampler.
+func (t *Tracker) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	for _, p := range t.Passes() {
+		if p.Stale {
+			err = fmt.Errorf("no finished pass of collection %s within %s", p.Collection, t.stale)
+			break
+		}
+	}
+	t.writeHealth(w, err)
+}
+
+// readyzHandler reports readiness. Fails when database is not reachable.
+func (t *Tracker) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	t.mu.RLock()
+	ping := t.ping
+	t.mu.RUnlock()
+
+	var err error
+	if ping != nil {
+		if perr := ping(); perr != nil {
+			err = fmt.Errorf("influxdb not reachable: %w", perr)
+		}
+	}
+	t.writeHealth(w, err)
+}
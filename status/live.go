@@ -0,0 +1,178 @@
+package status
+
+import (
+	"sort"
+	"time"
+)
+
+// Progress is progress of collection pass in tier
+type Progress struct {
+	Collection string    `json:"collection"`
+	Tier       string    `json:"tier"`
+	Done       int       `json:"done"`
+	Total      int       `json:"total"`
+	Started    time.Time `json:"started"`
+}
+
+// Active is instance currently processed by worker
+type Active struct {
+	Worker     int       `json:"worker"`
+	Collection string    `json:"collection"`
+	Tier       string    `json:"tier"`
+	Instance   string    `json:"instance"`
+	Started    time.Time `json:"started"`
+}
+
+// Durations is statistics of downsample query durations in tier
+type Durations struct {
+	Tier  string  `json:"tier"`
+	Count int64   `json:"count"`
+	Last  float64 `json:"last_seconds"`
+	Avg   float64 `json:"avg_seconds"`
+	Max   float64 `json:"max_seconds"`
+	total float64
+}
+
+// Gate is state of resource gate
+type Gate struct {
+	Open    bool      `json:"open"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since"`
+	MemPct  *float64  `json:"mem_percent,omitempty"`
+	Tasks   *float64  `json:"running_tasks,omitempty"`
+	Checked time.Time `json:"checked"`        // time of last resource check
+	Paused  float64   `json:"paused_seconds"` // time spent paused
+	Pauses  int       `json:"pauses"`
+}
+
+// Live is snapshot of current work
+type Live struct {
+	Progress  []Progress  `json:"progress"`
+	Active    []Active    `json:"active"`
+	Durations []Durations `json:"durations"`
+	Gate      Gate        `json:"gate"`
+	Queued    int         `json:"queued"`
+}
+
+// SetProgress records progress of collection pass in tier. New pass is started when tier changes.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	done int - count of done instances
+//	total int - count of instances in pass
+func (t *Tracker) SetProgress(col, tier string, done, total int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.progress[col]
+	if !ok || p.Tier != tier {
+		p = Progress{Collection: col, Tier: tier, Started: time.Now()}
+	}
+	p.Done = done
+	p.Total = total
+	t.progress[col] = p
+}
+
+// SetActive records instance currently processed by worker.
+//
+// Parameters:
+//
+//	n int - worker number
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+func (t *Tracker) SetActive(n int, col, tier, inst string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active[n] = Active{Worker: n, Collection: col, Tier: tier, Instance: inst, Started: time.Now()}
+}
+
+// ClearActive removes record of instance processed by worker.
+//
+// Parameters:
+//
+//	n int - worker number
+func (t *Tracker) ClearActive(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, n)
+}
+
+// ObserveDuration records duration of downsample queries of instance in tier.
+//
+// Parameters:
+//
+//	tier string - the destination bucket name
+//	d time.Duration - duration
+func (t *Tracker) ObserveDuration(tier string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.durations[tier]
+	s.Tier = tier
+	s.Count++
+	s.Last = d.Seconds()
+	s.total += s.Last
+	s.Avg = s.total / float64(s.Count)
+	if s.Last > s.Max {
+		s.Max = s.Last
+	}
+	t.durations[tier] = s
+}
+
+// SetQueueLen sets function returning count of queued work items.
+//
+// Parameters:
+//
+//	f func() int - queue length function
+func (t *Tracker) SetQueueLen(f func() int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queueLen = f
+}
+
+// SetGate sets function returning state of resource gate.
+//
+// Parameters:
+//
+//	f func() Gate - resource gate state function
+func (t *Tracker) SetGate(f func() Gate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gateFn = f
+}
+
+// Live returns snapshot of current work.
+func (t *Tracker) Live() Live {
+	t.mu.RLock()
+	l := Live{
+		Progress:  make([]Progress, 0, len(t.progress)),
+		Active:    make([]Active, 0, len(t.active)),
+		Durations: make([]Durations, 0, len(t.durations)),
+		Gate:      Gate{Open: true, Since: t.started},
+	}
+	for _, v := range t.progress {
+		l.Progress = append(l.Progress, v)
+	}
+	for _, v := range t.active {
+		l.Active = append(l.Active, v)
+	}
+	for _, v := range t.durations {
+		l.Durations = append(l.Durations, v)
+	}
+	ql := t.queueLen
+	gf := t.gateFn
+	t.mu.RUnlock()
+
+	if ql != nil {
+		l.Queued = ql()
+	}
+	if gf != nil {
+		l.Gate = gf()
+	}
+	sort.Slice(l.Progress, func(i, j int) bool { return l.Progress[i].Collection < l.Progress[j].Collection })
+	sort.Slice(l.Active, func(i, j int) bool { return l.Active[i].Worker < l.Active[j].Worker })
+	sort.Slice(l.Durations, func(i, j int) bool { return l.Durations[i].Tier < l.Durations[j].Tier })
+
+	return l
+}
@@ -0,0 +1,53 @@
+package status
+
+import (
+	"sort"
+	"time"
+)
+
+// Problem is instance whose downsample queries in tier keep timing out or failing
+type Problem struct {
+	Collection string     `json:"collection"`
+	Tier       string     `json:"tier"`
+	Instance   string     `json:"instance"`
+	Timeouts   int        `json:"timeouts"`
+	Failures   int        `json:"failures"`
+	Error      string     `json:"error"`
+	Since      time.Time  `json:"since"`
+	SkipUntil  *time.Time `json:"skip_until,omitempty"`
+}
+
+// SetProblems sets function returning problem instances.
+//
+// Parameters:
+//
+//	f func() []Problem - problem instances function
+func (t *Tracker) SetProblems(f func() []Problem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.problems = f
+}
+
+// Problems returns problem instances sorted by collection, tier and instance.
+func (t *Tracker) Problems() []Problem {
+	t.mu.RLock()
+	f := t.problems
+	t.mu.RUnlock()
+	if f == nil {
+		return []Problem{}
+	}
+
+	res := f()
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Collection != b.Collection {
+			return a.Collection < b.Collection
+		}
+		if a.Tier != b.Tier {
+			return a.Tier < b.Tier
+		}
+		return a.Instance < b.Instance
+	})
+
+	return res
+}
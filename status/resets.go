@@ -0,0 +1,58 @@
+package status
+
+import (
+	"sort"
+	"time"
+)
+
+// key of tracked counter resets
+type resetKey struct {
+	Collection string
+	Instance   string
+}
+
+// ResetStats is cumulative count of counter resets found in source data of instance
+type ResetStats struct {
+	Collection string    `json:"collection"`
+	Instance   string    `json:"instance"`
+	Resets     int64     `json:"resets"`
+	Last       time.Time `json:"last"`
+}
+
+// AddResets records counter resets found in source data of instance.
+//
+// Parameters:
+//
+//	col string - the collection
+//	inst string - the instance name
+//	n int - count of resets
+func (t *Tracker) AddResets(col, inst string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := resetKey{Collection: col, Instance: inst}
+	s := t.resets[k]
+	s.Collection = col
+	s.Instance = inst
+	s.Resets += int64(n)
+	s.Last = time.Now()
+	t.resets[k] = s
+}
+
+// Resets returns counter resets of all instances sorted by collection and instance.
+func (t *Tracker) Resets() []ResetStats {
+	t.mu.RLock()
+	res := make([]ResetStats, 0, len(t.resets))
+	for _, v := range t.resets {
+		res = append(res, v)
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Collection != res[j].Collection {
+			return res[i].Collection < res[j].Collection
+		}
+		return res[i].Instance < res[j].Instance
+	})
+
+	return res
+}
@@ -0,0 +1,292 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/helpers"
+)
+
+// key of tracked aggregation
+type key struct {
+	Collection string
+	Tier       string
+	Instance   string
+}
+
+// Success is last successful aggregation of instance in tier
+type Success struct {
+	Collection string    `json:"collection"`
+	Tier       string    `json:"tier"`
+	Instance   string    `json:"instance"`
+	Time       time.Time `json:"time"`
+}
+
+// SpotStats is cumulative result of aggregation spot checks
+type SpotStats struct {
+	Checks     int64     `json:"checks"`
+	Values     int64     `json:"values"`
+	Mismatches int64     `json:"mismatches"`
+	Missing    int64     `json:"missing"`
+	Last       time.Time `json:"last"`
+}
+
+// Correctness returns ratio of correct values of spot checked values.
+func (s SpotStats) Correctness() float64 {
+	if s.Values == 0 {
+		return 1
+	}
+
+	return float64(s.Values-s.Mismatches-s.Missing) / float64(s.Values)
+}
+
+// Tracker keeps track of last successful aggregations
+type Tracker struct {
+	mu        sync.RWMutex
+	success   map[key]time.Time
+	spot      SpotStats
+	progress  map[string]Progress
+	active    map[int]Active
+	durations map[string]Durations
+	queueLen  func() int
+	gateFn    func() Gate
+	dests     map[destKey]DestStats
+	resets    map[resetKey]ResetStats
+	verify    map[verifyKey]VerifyStats
+	passes    map[string]time.Time
+	started   time.Time
+	stale     time.Duration
+	ping      func() error
+	problems  func() []Problem
+}
+
+// NewTracker returns new empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{
+		success:   make(map[key]time.Time),
+		progress:  make(map[string]Progress),
+		active:    make(map[int]Active),
+		durations: make(map[string]Durations),
+		dests:     make(map[destKey]DestStats),
+		resets:    make(map[resetKey]ResetStats),
+		verify:    make(map[verifyKey]VerifyStats),
+		passes:    make(map[string]time.Time),
+		started:   time.Now(),
+	}
+}
+
+// SetSuccess records time of successful aggregation of instance in tier.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	inst string - the instance name
+//	ts time.Time - time of success
+func (t *Tracker) SetSuccess(col, tier, inst string, ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.success[key{Collection: col, Tier: tier, Instance: inst}] = ts
+}
+
+// AddSpotCheck records result of aggregation spot check.
+//
+// Parameters:
+//
+//	values int - count of checked values
+//	mismatches int - count of values not matching recomputed ones
+//	missing int - count of recomputed values missing in destination
+func (t *Tracker) AddSpotCheck(values, mismatches, missing int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spot.Checks++
+	t.spot.Values += int64(values)
+	t.spot.Mismatches += int64(mismatches)
+	t.spot.Missing += int64(missing)
+	t.spot.Last = time.Now()
+}
+
+// Spot returns cumulative result of spot checks.
+func (t *Tracker) Spot() SpotStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.spot
+}
+
+// Successes returns all tracked successes sorted by collection, tier and instance.
+func (t *Tracker) Successes() []Success {
+	t.mu.RLock()
+	res := make([]Success, 0, len(t.success))
+	for k, v := range t.success {
+		res = append(res, Success{Collection: k.Collection, Tier: k.Tier, Instance: k.Instance, Time: v})
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Collection != b.Collection {
+			return a.Collection < b.Collection
+		}
+		if a.Tier != b.Tier {
+			return a.Tier < b.Tier
+		}
+		return a.Instance < b.Instance
+	})
+
+	return res
+}
+
+// promLabel escapes prometheus label value.
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// metricsHandler writes tracked data in prometheus text format.
+func (t *Tracker) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP idbds_last_success_timestamp_seconds Unix time of last successful aggregation of instance in tier.")
+	fmt.Fprintln(w, "# TYPE idbds_last_success_timestamp_seconds gauge")
+	for _, s := range t.Successes() {
+		fmt.Fprintf(w, "idbds_last_success_timestamp_seconds{collection=\"%s\",tier=\"%s\",instance=\"%s\"} %d\n",
+			promLabel(s.Collection), promLabel(s.Tier), promLabel(s.Instance), s.Time.Unix())
+	}
+
+	sp := t.Spot()
+	fmt.Fprintln(w, "# HELP idbds_spotcheck_checks_total Count of aggregation window spot checks.")
+	fmt.Fprintln(w, "# TYPE idbds_spotcheck_checks_total counter")
+	fmt.Fprintf(w, "idbds_spotcheck_checks_total %d\n", sp.Checks)
+	fmt.Fprintln(w, "# HELP idbds_spotcheck_values_total Count of spot checked aggregated values.")
+	fmt.Fprintln(w, "# TYPE idbds_spotcheck_values_total counter")
+	fmt.Fprintf(w, "idbds_spotcheck_values_total %d\n", sp.Values)
+	fmt.Fprintln(w, "# HELP idbds_spotcheck_mismatches_total Count of stored values not matching recomputed ones.")
+	fmt.Fprintln(w, "# TYPE idbds_spotcheck_mismatches_total counter")
+	fmt.Fprintf(w, "idbds_spotcheck_mismatches_total %d\n", sp.Mismatches)
+	fmt.Fprintln(w, "# HELP idbds_spotcheck_missing_total Count of recomputed values missing in destination.")
+	fmt.Fprintln(w, "# TYPE idbds_spotcheck_missing_total counter")
+	fmt.Fprintf(w, "idbds_spotcheck_missing_total %d\n", sp.Missing)
+	fmt.Fprintln(w, "# HELP idbds_spotcheck_correctness_ratio Ratio of correct spot checked values.")
+	fmt.Fprintln(w, "# TYPE idbds_spotcheck_correctness_ratio gauge")
+	fmt.Fprintf(w, "idbds_spotcheck_correctness_ratio %g\n", sp.Correctness())
+
+	g := t.Live().Gate
+	fmt.Fprintln(w, "# HELP idbds_paused_seconds_total Time spent paused waiting for database resources.")
+	fmt.Fprintln(w, "# TYPE idbds_paused_seconds_total counter")
+	fmt.Fprintf(w, "idbds_paused_seconds_total %g\n", g.Paused)
+	fmt.Fprintln(w, "# HELP idbds_pauses_total Count of pauses waiting for database resources.")
+	fmt.Fprintln(w, "# TYPE idbds_pauses_total counter")
+	fmt.Fprintf(w, "idbds_pauses_total %d\n", g.Pauses)
+
+	skipped := 0
+	for _, p := range t.Problems() {
+		if p.SkipUntil != nil {
+			skipped++
+		}
+	}
+	fmt.Fprintln(w, "# HELP idbds_skipped_instances Count of instances skipped after repeated query timeouts or quarantined after repeated failures.")
+	fmt.Fprintln(w, "# TYPE idbds_skipped_instances gauge")
+	fmt.Fprintf(w, "idbds_skipped_instances %d\n", skipped)
+
+	ds := t.Destinations()
+	fmt.Fprintln(w, "# HELP idbds_destination_points_total Count of points written to destination by client-side aggregation.")
+	fmt.Fprintln(w, "# TYPE idbds_destination_points_total counter")
+	for _, d := range ds {
+		fmt.Fprintf(w, "idbds_destination_points_total{destination=\"%s\",bucket=\"%s\"} %d\n", promLabel(d.Destination), promLabel(d.Bucket), d.Points)
+	}
+	fmt.Fprintln(w, "# HELP idbds_destination_failed_points_total Count of points failed to write to destination.")
+	fmt.Fprintln(w, "# TYPE idbds_destination_failed_points_total counter")
+	for _, d := range ds {
+		fmt.Fprintf(w, "idbds_destination_failed_points_total{destination=\"%s\",bucket=\"%s\"} %d\n", promLabel(d.Destination), promLabel(d.Bucket), d.Failed)
+	}
+	fmt.Fprintln(w, "# HELP idbds_destination_last_success_timestamp_seconds Unix time of last successful write to destination.")
+	fmt.Fprintln(w, "# TYPE idbds_destination_last_success_timestamp_seconds gauge")
+	for _, d := range ds {
+		if d.LastSuccess.IsZero() {
+			continue
+		}
+		fmt.Fprintf(w, "idbds_destination_last_success_timestamp_seconds{destination=\"%s\",bucket=\"%s\"} %d\n", promLabel(d.Destination), promLabel(d.Bucket), d.LastSuccess.Unix())
+	}
+
+	fmt.Fprintln(w, "# HELP idbds_counter_resets_total Count of counter resets found in source data of instance.")
+	fmt.Fprintln(w, "# TYPE idbds_counter_resets_total counter")
+	for _, r := range t.Resets() {
+		fmt.Fprintf(w, "idbds_counter_resets_total{collection=\"%s\",instance=\"%s\"} %d\n", promLabel(r.Collection), promLabel(r.Instance), r.Resets)
+	}
+
+	vs := t.Verified()
+	fmt.Fprintln(w, "# HELP idbds_verified_points_total Count of points found in destination by write verification.")
+	fmt.Fprintln(w, "# TYPE idbds_verified_points_total counter")
+	for _, v := range vs {
+		fmt.Fprintf(w, "idbds_verified_points_total{collection=\"%s\",tier=\"%s\"} %d\n", promLabel(v.Collection), promLabel(v.Tier), v.Points)
+	}
+	fmt.Fprintln(w, "# HELP idbds_suspicious_windows_total Count of windows with source data but no points written to destination.")
+	fmt.Fprintln(w, "# TYPE idbds_suspicious_windows_total counter")
+	for _, v := range vs {
+		fmt.Fprintf(w, "idbds_suspicious_windows_total{collection=\"%s\",tier=\"%s\"} %d\n", promLabel(v.Collection), promLabel(v.Tier), v.Suspicious)
+	}
+}
+
+// Snapshot of all tracked data
+type Snapshot struct {
+	LastSuccess  []Success     `json:"last_success"`
+	SpotCheck    SpotStats     `json:"spot_check"`
+	Live         Live          `json:"live"`
+	Destinations []DestStats   `json:"destinations"`
+	Resets       []ResetStats  `json:"counter_resets"`
+	Verified     []VerifyStats `json:"write_verification"`
+	Passes       []Pass        `json:"passes"`
+	Problems     []Problem     `json:"problems"`
+}
+
+// Snapshot returns copy of all tracked data.
+//
+// Returns:
+//
+//	Snapshot - tracked data
+func (t *Tracker) Snapshot() Snapshot {
+	return Snapshot{
+		LastSuccess:  t.Successes(),
+		SpotCheck:    t.Spot(),
+		Live:         t.Live(),
+		Destinations: t.Destinations(),
+		Resets:       t.Resets(),
+		Verified:     t.Verified(),
+		Passes:       t.Passes(),
+		Problems:     t.Problems(),
+	}
+}
+
+// statusHandler writes tracked data as json.
+func (t *Tracker) statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(t.Snapshot())
+	if err != nil {
+		helpers.PrintErr(fmt.Sprintf("status api: %v", err))
+	}
+}
+
+// Serve starts http server exposing /metrics, /status, /healthz and /readyz endpoints in background.
+//
+// Parameters:
+//
+//	addr string - listen address
+func (t *Tracker) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", t.metricsHandler)
+	mux.HandleFunc("/status", t.statusHandler)
+	mux.HandleFunc("/healthz", t.healthzHandler)
+	mux.HandleFunc("/readyz", t.readyzHandler)
+
+	go func() {
+		helpers.PrintInfo(fmt.Sprintf("status api listening on %s", addr))
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			helpers.PrintFatal(fmt.Sprintf("status api: %v", err))
+		}
+	}()
+}
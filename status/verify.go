@@ -0,0 +1,61 @@
+package status
+
+import (
+	"sort"
+	"time"
+)
+
+// key of tracked write verification
+type verifyKey struct {
+	Collection string
+	Tier       string
+}
+
+// VerifyStats is cumulative result of write verification of collection in tier
+type VerifyStats struct {
+	Collection string    `json:"collection"`
+	Tier       string    `json:"tier"`
+	Points     int64     `json:"points"`
+	Suspicious int64     `json:"suspicious_windows"` // windows with source data but no written points
+	Last       time.Time `json:"last"`
+}
+
+// AddVerify records result of write verification of range of collection in tier.
+//
+// Parameters:
+//
+//	col string - the collection
+//	tier string - the destination bucket name
+//	points int - count of written points
+//	suspicious int - count of windows with source data but no written points
+func (t *Tracker) AddVerify(col, tier string, points, suspicious int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := verifyKey{Collection: col, Tier: tier}
+	s := t.verify[k]
+	s.Collection = col
+	s.Tier = tier
+	s.Points += int64(points)
+	s.Suspicious += int64(suspicious)
+	s.Last = time.Now()
+	t.verify[k] = s
+}
+
+// Verified returns write verification results sorted by collection and tier.
+func (t *Tracker) Verified() []VerifyStats {
+	t.mu.RLock()
+	res := make([]VerifyStats, 0, len(t.verify))
+	for _, v := range t.verify {
+		res = append(res, v)
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Collection != res[j].Collection {
+			return res[i].Collection < res[j].Collection
+		}
+		return res[i].Tier < res[j].Tier
+	})
+
+	return res
+}
@@ -0,0 +1,162 @@
+package tui
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aretaja/idbdownsampler/status"
+)
+
+// ANSI sequences used for redrawing terminal
+const (
+	clear = "\033[H\033[2J"
+	bold  = "\033[1m"
+	red   = "\033[31m"
+	green = "\033[32m"
+	reset = "\033[0m"
+)
+
+// snapshot of status api response used by monitor
+type snapshot struct {
+	Live      status.Live      `json:"live"`
+	SpotCheck status.SpotStats `json:"spot_check"`
+}
+
+// Run polls status api of running downsampler and redraws terminal until interrupted.
+//
+// Parameters:
+//
+//	addr string - status api address (host:port or url)
+//	interv time.Duration - refresh interval
+//
+// Returns:
+//
+//	error - any error that occurred on first poll
+func Run(addr string, interv time.Duration) error {
+	url := addr
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	url = strings.TrimSuffix(url, "/") + "/status"
+
+	client := &http.Client{Timeout: interv}
+	if _, err := poll(client, url); err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	ticker := time.NewTicker(interv)
+	defer ticker.Stop()
+
+	for {
+		s, err := poll(client, url)
+		os.Stdout.WriteString(clear + render(addr, s, err, time.Now()))
+
+		select {
+		case <-sig:
+			fmt.Println()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches status from status api.
+func poll(client *http.Client, url string) (*snapshot, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status api: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var s snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// render returns screen content of status snapshot.
+func render(addr string, s *snapshot, err error, now time.Time) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%sidbdownsampler top%s - %s - %s\n\n", bold, reset, addr, now.Format(time.TimeOnly))
+	if err != nil {
+		fmt.Fprintf(&buf, "%serror: %v%s\n", red, err, reset)
+		return buf.String()
+	}
+	l := s.Live
+
+	gate := green + "open" + reset
+	if !l.Gate.Open {
+		gate = red + "closed" + reset
+		if l.Gate.Reason != "" {
+			gate += " (" + l.Gate.Reason + ")"
+		}
+	}
+	fmt.Fprintf(&buf, "resources: %s for %s, queued: %d, spot check correctness: %.4f\n\n",
+		gate, since(now, l.Gate.Since), l.Queued, s.SpotCheck.Correctness())
+
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "COLLECTION\tTIER\tDONE\tTOTAL\tPROGRESS\tELAPSED\n")
+	for _, p := range l.Progress {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", p.Collection, p.Tier, p.Done, p.Total, bar(p.Done, p.Total, 20), since(now, p.Started))
+	}
+	w.Flush()
+	buf.WriteString("\n")
+
+	w = tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "WORKER\tCOLLECTION\tTIER\tINSTANCE\tRUNNING\n")
+	for _, a := range l.Active {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", a.Worker, a.Collection, a.Tier, a.Instance, since(now, a.Started))
+	}
+	w.Flush()
+	buf.WriteString("\n")
+
+	w = tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TIER\tQUERIES\tLAST\tAVG\tMAX\n")
+	for _, d := range l.Durations {
+		fmt.Fprintf(w, "%s\t%d\t%.1fs\t%.1fs\t%.1fs\n", d.Tier, d.Count, d.Last, d.Avg, d.Max)
+	}
+	w.Flush()
+
+	return buf.String()
+}
+
+// bar returns text progress bar of given width.
+func bar(done, total, width int) string {
+	if total <= 0 {
+		return "[" + strings.Repeat(" ", width) + "]"
+	}
+	n := done * width / total
+
+	return "[" + strings.Repeat("#", n) + strings.Repeat(" ", width-n) + "]"
+}
+
+// since returns rounded duration since t or "-" when t is not set.
+func since(now, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return now.Sub(t).Round(time.Second).String()
+}